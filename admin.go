@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// adminAPI serves the operator facing REST API. Every request must carry the
+// configured ADMIN_TOKEN as a bearer token.
+type adminAPI struct {
+	token string
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(auth), []byte(a.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	if servePprof(w, r) {
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "api/registrations" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, registrations.list())
+
+	case path == "api/bans" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, bans.list())
+
+	case path == "api/maintenance" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]bool{"maintenance": inMaintenance()})
+
+	case path == "api/maintenance" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		setMaintenance(r.Method == http.MethodPut)
+		w.WriteHeader(http.StatusNoContent)
+
+	case path == "api/notice" && r.Method == http.MethodPost:
+		a.notice(w, r)
+
+	case path == "api/pending" && r.Method == http.MethodGet:
+		a.pending(w, r.Context())
+
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "pending" && r.Method == http.MethodDelete:
+		a.revoke(w, r.Context(), parts[2])
+
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "pending" && parts[3] == "resend" && r.Method == http.MethodPost:
+		a.resend(w, r.Context(), parts[2])
+
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "registrations" && parts[3] == "disable" && r.Method == http.MethodPost:
+		a.setEnabled(w, r.Context(), parts[2], false)
+
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "registrations" && parts[3] == "restore" && r.Method == http.MethodPost:
+		a.setEnabled(w, r.Context(), parts[2], true)
+
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "data" && r.Method == http.MethodGet:
+		a.export(w, r.Context(), parts[2])
+
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "data" && r.Method == http.MethodDelete:
+		a.erase(w, r.Context(), parts[2])
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// notice broadcasts the message of a {"message": "..."} body to the
+// connected sessions.
+func (a *adminAPI) notice(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	n, err := broadcastNotice(body.Message)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": n})
+}
+
+func (a *adminAPI) pending(w http.ResponseWriter, ctx context.Context) {
+	list, err := tokens.List(ctx)
+	if err != nil {
+		logError("Could not list pending tokens: %v", err)
+		writeError(w, http.StatusInternalServerError, "could not list pending tokens")
+		return
+	}
+	// never expose the tokens themselves
+	for i := range list {
+		list[i].Token = ""
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *adminAPI) revoke(w http.ResponseWriter, ctx context.Context, user string) {
+	ok, err := tokens.Remove(ctx, user)
+	if err != nil {
+		logError("Could not revoke the pending token for %s: %v", user, err)
+		writeError(w, http.StatusInternalServerError, "could not revoke the token")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no pending token for "+user)
+		return
+	}
+	logInfo("Admin revoked the pending token for %s", user)
+	audits.publish(auditEvent{Type: auditRevoked, User: user, Detail: "revoked through the admin API"})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) resend(w http.ResponseWriter, ctx context.Context, user string) {
+	t, ok, err := tokens.Get(ctx, user)
+	if err != nil {
+		logError("Could not look up the pending token for %s: %v", user, err)
+		writeError(w, http.StatusInternalServerError, "could not look up the token")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no pending token for "+user)
+		return
+	}
+	if err := sendmail(ctx, t.User, t.Mail, t.Token); err != nil {
+		logError("Could not resend mail to %s: %v", t.Mail, err)
+		writeError(w, http.StatusBadGateway, "could not send mail")
+		return
+	}
+	logInfo("Admin resent the token mail for %s to %s", user, t.Mail)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setEnabled disables the account of a user, or restores it, see
+// softdelete.go.
+func (a *adminAPI) setEnabled(w http.ResponseWriter, ctx context.Context, user string, enabled bool) {
+	var err error
+	if enabled {
+		err = restoreRegistration(ctx, user, "the admin API")
+	} else {
+		err = disableRegistration(ctx, user, "the admin API")
+	}
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, errNotRegistered):
+		writeError(w, http.StatusNotFound, "no user "+user+" in the directory")
+	case errors.Is(err, errCannotDisable), errors.Is(err, errCannotRestore):
+		writeError(w, http.StatusNotImplemented, err.Error())
+	default:
+		logError("Could not update the account of %s: %v", user, err)
+		writeError(w, http.StatusBadGateway, "could not update the directory")
+	}
+}
+
+// export returns everything stored about a user or an address.
+func (a *adminAPI) export(w http.ResponseWriter, ctx context.Context, subject string) {
+	d, err := exportData(ctx, subject)
+	if err != nil {
+		logError("Could not export the data of %s: %v", subject, err)
+		writeError(w, http.StatusInternalServerError, "could not export the data")
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// erase drops everything stored about a user or an address.
+func (a *adminAPI) erase(w http.ResponseWriter, ctx context.Context, subject string) {
+	users, err := eraseData(ctx, subject)
+	if err != nil {
+		logError("Could not erase the data of %s: %v", subject, err)
+		writeError(w, http.StatusInternalServerError, "could not erase the data")
+		return
+	}
+	logInfo("Admin erased the data stored about %d users through the admin API", len(users))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveAdmin starts the admin API on ADMIN_LISTEN, if configured.
+func serveAdmin() {
+	if options().AdminListen == "" {
+		return
+	}
+	if options().AdminToken == "" {
+		log.Fatal("ADMIN_TOKEN must be set to enable the admin API")
+	}
+	logInfo("Admin API listening on %s", options().AdminListen)
+	go func() {
+		log.Fatal(http.ListenAndServe(options().AdminListen, &adminAPI{token: options().AdminToken}))
+	}()
+}
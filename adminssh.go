@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// adminKeys are the keys read from ADMIN_SSH_KEYS.
+var adminKeys reloadable[[]gossh.PublicKey]
+
+// loadAdminKeys reads ADMIN_SSH_KEYS, an authorized_keys file.
+func loadAdminKeys() error {
+	adminKeys.set(nil)
+	if options().AdminSSHKeys == "" {
+		return nil
+	}
+	data, err := os.ReadFile(options().AdminSSHKeys)
+	if err != nil {
+		return fmt.Errorf("Could not read ADMIN_SSH_KEYS: %v", err)
+	}
+	var keys []gossh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			return fmt.Errorf("Could not parse ADMIN_SSH_KEYS: %v", err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	adminKeys.set(keys)
+	return nil
+}
+
+// isAdminKey reports whether the user and key grant an admin session.
+func isAdminKey(user string, key ssh.PublicKey) bool {
+	if user != options().AdminSSHUser {
+		return false
+	}
+	for _, k := range adminKeys.get() {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminSession reports whether the session was authenticated with one of
+// the ADMIN_SSH_KEYS.
+func isAdminSession(s ssh.Session) bool {
+	return authExtension(s.Context(), extensionAdmin) != ""
+}
+
+const adminHelp = `Commands:
+  registrations     list the recent registrations
+  bans              list the banned addresses
+  ban <ip>          ban an address for BAN_DURATION
+  unban <ip>        lift the ban of an address
+  pending           list the pending tokens
+  revoke <user>     revoke the pending token of a user
+  resend <user>     mail the pending token of a user again
+  incomplete        list the entries left by failed registrations
+  keep <user>       keep an incomplete entry, fixed by hand
+  delete <user>     drop the pending token and the incomplete entry of a
+                    user who didn't complete the registration
+  export <user|mail>
+                    show everything stored about a user or an address
+  erase <user|mail> drop everything stored about a user or an address
+  disable <user>    disable the account of a user, in the directory
+  restore <user>    enable again the account of a user
+  maintenance [on|off]
+                    show or toggle the maintenance mode
+  notice <message>  show a line to every connected session
+  clock [<duration>]
+                    show the frozen clock or move it on
+  help              show this help
+  exit              close the session
+`
+
+// adminShell serves a small command line for the operators authenticated
+// with one of the ADMIN_SSH_KEYS, mirroring the admin API.
+func (s *session) adminShell() {
+	logInfo("Admin session opened from %s", s.ip)
+	io.WriteString(s, "sshauth admin shell, type help for the list of commands\n")
+	for {
+		io.WriteString(s, "> ")
+		line, err := readN(s, 256, nil, true)
+		if err != nil {
+			return
+		}
+		args := strings.Fields(string(line))
+		if len(args) == 0 {
+			continue
+		}
+		switch {
+		case args[0] == "help":
+			io.WriteString(s, adminHelp)
+		case args[0] == "exit" || args[0] == "quit":
+			s.bye()
+			return
+		case args[0] == "registrations":
+			s.adminRegistrations()
+		case args[0] == "bans":
+			s.adminBans()
+		case args[0] == "ban" && len(args) == 2:
+			s.adminBan(args[1])
+		case args[0] == "unban" && len(args) == 2:
+			s.adminUnban(args[1])
+		case args[0] == "pending":
+			s.adminPending()
+		case args[0] == "revoke" && len(args) == 2:
+			s.adminRevoke(args[1])
+		case args[0] == "resend" && len(args) == 2:
+			s.adminResend(args[1])
+		case args[0] == "incomplete":
+			s.adminIncomplete()
+		case args[0] == "keep" && len(args) == 2:
+			s.adminKeep(args[1])
+		case args[0] == "delete" && len(args) == 2:
+			s.adminDelete(args[1])
+		case args[0] == "export" && len(args) == 2:
+			s.adminExport(args[1])
+		case args[0] == "erase" && len(args) == 2:
+			s.adminErase(args[1])
+		case args[0] == "disable" && len(args) == 2:
+			s.adminSetEnabled(args[1], false)
+		case args[0] == "restore" && len(args) == 2:
+			s.adminSetEnabled(args[1], true)
+		case args[0] == "maintenance" && len(args) <= 2:
+			s.adminMaintenance(args[1:])
+		case args[0] == "notice" && len(args) >= 2:
+			s.adminNotice(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(line)), "notice")))
+		case args[0] == "clock" && len(args) <= 2:
+			s.adminClock(args[1:])
+		default:
+			io.WriteString(s, "Unknown command, type help for the list of commands\n")
+		}
+	}
+}
+
+// table writes rows aligned in columns.
+func (s *session) table(header string, rows []string) {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, r := range rows {
+		fmt.Fprintln(w, r)
+	}
+	w.Flush()
+	io.WriteString(s, b.String())
+}
+
+func (s *session) adminRegistrations() {
+	var rows []string
+	for _, r := range registrations.list() {
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%s", r.Time.Format(time.RFC3339), r.User, r.Mail, r.IP, r.Conn.ClientVersion))
+	}
+	s.table("TIME\tUSER\tMAIL\tIP\tCLIENT", rows)
+}
+
+func (s *session) adminBans() {
+	var rows []string
+	for ip, until := range bans.list() {
+		rows = append(rows, fmt.Sprintf("%s\t%s", ip, until.Format(time.RFC3339)))
+	}
+	sort.Strings(rows)
+	s.table("IP\tUNTIL", rows)
+}
+
+func (s *session) adminBan(ip string) {
+	if net.ParseIP(ip) == nil {
+		io.WriteString(s, "Usage: ban <ip>, such as ban 192.0.2.1\n")
+		return
+	}
+	bans.ban(ip)
+	logWarn("Admin banned %s from %s", ip, s.ip)
+	io.WriteString(s, "Banned\n")
+}
+
+func (s *session) adminUnban(ip string) {
+	if !bans.unban(ip) {
+		io.WriteString(s, "No ban for "+ip+"\n")
+		return
+	}
+	logInfo("Admin lifted the ban of %s from %s", ip, s.ip)
+	io.WriteString(s, "Unbanned\n")
+}
+
+func (s *session) adminPending() {
+	list, err := tokens.List(s.ctx)
+	if err != nil {
+		logError("Could not list pending tokens: %v", err)
+		io.WriteString(s, "Could not list pending tokens\n")
+		return
+	}
+	var rows []string
+	for _, t := range list {
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%d", t.User, t.Mail, t.IP, t.ExpiresAt.Format(time.RFC3339), t.Attempts))
+	}
+	s.table("USER\tMAIL\tIP\tEXPIRES\tATTEMPTS", rows)
+}
+
+func (s *session) adminRevoke(user string) {
+	ok, err := tokens.Remove(s.ctx, user)
+	if err != nil {
+		logError("Could not revoke the pending token for %s: %v", user, err)
+		io.WriteString(s, "Could not revoke the token\n")
+		return
+	}
+	if !ok {
+		io.WriteString(s, "No pending token for "+user+"\n")
+		return
+	}
+	logInfo("Admin revoked the pending token for %s", user)
+	audits.publish(auditEvent{Type: auditRevoked, User: user, Detail: "revoked from the admin shell", IP: s.ip})
+	io.WriteString(s, "Revoked\n")
+}
+
+func (s *session) adminIncomplete() {
+	marked, err := tokens.ListIncomplete(s.ctx)
+	if err != nil {
+		logError("Could not list the incomplete entries: %v", err)
+		io.WriteString(s, "Could not list the incomplete entries\n")
+		return
+	}
+	var rows []string
+	for user, since := range marked {
+		rows = append(rows, fmt.Sprintf("%s\t%s", user, since.Format(time.RFC3339)))
+	}
+	sort.Strings(rows)
+	s.table("USER\tSINCE", rows)
+}
+
+func (s *session) adminKeep(user string) {
+	if err := tokens.ClearIncomplete(s.ctx, user); err != nil {
+		logError("Could not clear the incomplete entry of %s: %v", user, err)
+		io.WriteString(s, "Could not clear the incomplete entry\n")
+		return
+	}
+	logInfo("Admin kept the incomplete entry of %s", user)
+	io.WriteString(s, "Kept\n")
+}
+
+func (s *session) adminDelete(user string) {
+	found, err := deleteUnverified(s.ctx, user)
+	if err != nil {
+		logError("Could not delete the unverified account of %s: %v", user, err)
+		io.WriteString(s, "Could not delete the account\n")
+		return
+	}
+	if !found {
+		io.WriteString(s, "No pending token or incomplete entry for "+user+"\n")
+		return
+	}
+	logInfo("Admin deleted the unverified account of %s from %s", user, s.ip)
+	audits.publish(auditEvent{Type: auditRevoked, User: user, Detail: "deleted from the admin shell", IP: s.ip})
+	io.WriteString(s, "Deleted\n")
+}
+
+func (s *session) adminExport(subject string) {
+	d, err := exportData(s.ctx, subject)
+	if err != nil {
+		logError("Could not export the data of %s: %v", subject, err)
+		io.WriteString(s, "Could not export the data\n")
+		return
+	}
+	data, _ := json.MarshalIndent(d, "", "  ")
+	io.WriteString(s, string(data)+"\n")
+}
+
+func (s *session) adminErase(subject string) {
+	users, err := eraseData(s.ctx, subject)
+	if err != nil {
+		logError("Could not erase the data of %s: %v", subject, err)
+		io.WriteString(s, "Could not erase the data\n")
+		return
+	}
+	logInfo("Admin erased the data stored about %d users from %s", len(users), s.ip)
+	fmt.Fprintf(s, "Erased the data of %d users\n", len(users))
+}
+
+func (s *session) adminSetEnabled(user string, enabled bool) {
+	by := "the admin shell from " + s.ip
+	var err error
+	if enabled {
+		err = restoreRegistration(s.ctx, user, by)
+	} else {
+		err = disableRegistration(s.ctx, user, by)
+	}
+	switch {
+	case err == nil && enabled:
+		io.WriteString(s, "Restored\n")
+	case err == nil:
+		io.WriteString(s, "Disabled\n")
+	case errors.Is(err, errNotRegistered):
+		io.WriteString(s, "No user "+user+" in the directory\n")
+	case errors.Is(err, errCannotDisable), errors.Is(err, errCannotRestore):
+		io.WriteString(s, "The directory backend can't disable and enable users\n")
+	default:
+		logError("Could not update the account of %s: %v", user, err)
+		io.WriteString(s, "Could not update the directory\n")
+	}
+}
+
+func (s *session) adminMaintenance(args []string) {
+	if len(args) == 1 {
+		switch args[0] {
+		case "on", "off":
+			setMaintenance(args[0] == "on")
+		default:
+			io.WriteString(s, "Usage: maintenance [on|off]\n")
+			return
+		}
+	}
+	if inMaintenance() {
+		io.WriteString(s, "Maintenance mode is on\n")
+	} else {
+		io.WriteString(s, "Maintenance mode is off\n")
+	}
+}
+
+func (s *session) adminNotice(msg string) {
+	n, err := broadcastNotice(msg)
+	if err != nil {
+		io.WriteString(s, err.Error()+"\n")
+		return
+	}
+	fmt.Fprintf(s, "Sent to %d sessions\n", n)
+}
+
+func (s *session) adminClock(args []string) {
+	c, ok := clk.get().(*frozenClock)
+	if !ok {
+		io.WriteString(s, "The clock is not frozen, set FROZEN_CLOCK\n")
+		return
+	}
+	if len(args) == 1 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d < 0 {
+			io.WriteString(s, "Usage: clock [<duration>], such as clock 10m\n")
+			return
+		}
+		logInfo("Admin moved the frozen clock on by %s", d)
+		c.advance(d)
+	}
+	io.WriteString(s, "The clock is frozen at "+c.Now().Format(time.RFC3339)+"\n")
+}
+
+func (s *session) adminResend(user string) {
+	t, ok, err := tokens.Get(s.ctx, user)
+	if err != nil {
+		logError("Could not look up the pending token for %s: %v", user, err)
+		io.WriteString(s, "Could not look up the token\n")
+		return
+	}
+	if !ok {
+		io.WriteString(s, "No pending token for "+user+"\n")
+		return
+	}
+	if err := sendmail(s.ctx, t.User, t.Mail, t.Token); err != nil {
+		logError("Could not resend mail to %s: %v", t.Mail, err)
+		io.WriteString(s, "Could not send mail\n")
+		return
+	}
+	logInfo("Admin resent the token mail for %s to %s", user, t.Mail)
+	io.WriteString(s, "Sent\n")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// alertTimeout bounds the delivery of a single alert.
+const alertTimeout = 30 * time.Second
+
+// securityAlert describes a security relevant event, along with the audit
+// details of the session which caused it.
+type securityAlert struct {
+	Event  string    `json:"event"`
+	User   string    `json:"user,omitempty"`
+	Mail   string    `json:"mail,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail"`
+	Time   time.Time `json:"time"`
+	// the transcript of the session, with ALERT_TRANSCRIPT, see transcript.go
+	Transcript string `json:"transcript,omitempty"`
+}
+
+// alertsEnabled reports whether any alert channel is configured.
+func alertsEnabled() bool {
+	return options().AlertMail != "" || options().AlertWebhookURL != ""
+}
+
+// raiseAlert sends an alert to ALERT_MAIL and ALERT_WEBHOOK_URL in the
+// background, so that the session raising it is not slowed down.
+func raiseAlert(a securityAlert) {
+	if !alertsEnabled() {
+		return
+	}
+	a.Time = clockNow()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+		defer cancel()
+		if options().AlertMail != "" {
+			if err := deliver(ctx, options().AlertMail, "[sshauth] "+a.Event, alertBody(a)); err != nil {
+				logError("Could not mail the %s alert: %v", a.Event, err)
+			}
+		}
+		if options().AlertWebhookURL != "" {
+			if _, err := doJSON(ctx, http.MethodPost, options().AlertWebhookURL, nil, a, nil); err != nil {
+				logError("Could not post the %s alert: %v", a.Event, err)
+			}
+		}
+	}()
+}
+
+func alertBody(a securityAlert) string {
+	fields := [][2]string{
+		{"Event", a.Event},
+		{"Detail", a.Detail},
+		{"Time", a.Time.Format(time.RFC3339)},
+		{"User", a.User},
+		{"Mail", a.Mail},
+		{"IP", a.IP},
+	}
+	var b strings.Builder
+	b.WriteString("<pre>\n")
+	for _, f := range fields {
+		if f[1] != "" {
+			fmt.Fprintf(&b, "%-7s %s\n", f[0]+":", html.EscapeString(f[1]))
+		}
+	}
+	b.WriteString("</pre>\n")
+	if a.Transcript != "" {
+		b.WriteString("<p>Transcript of the session:</p>\n<pre>\n")
+		b.WriteString(html.EscapeString(a.Transcript))
+		b.WriteString("\n</pre>\n")
+	}
+	return b.String()
+}
+
+// sensitiveUsername reports whether user matches one of the patterns in
+// ALERT_USERNAMES.
+func sensitiveUsername(user string) bool {
+	for _, p := range options().AlertUsernames {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSpace(p)), strings.ToLower(user)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// countryNet is a network of GEOIP_CSV in one of ALERT_COUNTRIES.
+type countryNet struct {
+	net     *net.IPNet
+	country string
+}
+
+// the networks of GEOIP_CSV in ALERT_COUNTRIES
+var alertNets reloadable[[]countryNet]
+
+// initAlertCountries loads the networks of ALERT_COUNTRIES from GEOIP_CSV,
+// keeping only those, the whole list being far larger. The lines start
+// with a network in CIDR notation and an ISO 3166 country code, the other
+// columns, the header and the invalid networks being skipped, so that the
+// usual country lists fit.
+func initAlertCountries() error {
+	if len(options().AlertCountries) == 0 {
+		alertNets.set(nil)
+		return nil
+	}
+	if options().GeoIPCSV == "" {
+		return errors.New("ALERT_COUNTRIES needs GEOIP_CSV, the networks of the countries")
+	}
+	countries := map[string]bool{}
+	for _, c := range options().AlertCountries {
+		countries[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	f, err := os.Open(options().GeoIPCSV)
+	if err != nil {
+		return fmt.Errorf("Could not open GEOIP_CSV: %v", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord, r.Comment, r.ReuseRecord = -1, '#', true
+	var nets []countryNet
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Could not read GEOIP_CSV: %v", err)
+		}
+		if len(record) < 2 {
+			continue
+		}
+		country := strings.ToUpper(strings.TrimSpace(record[1]))
+		if !countries[country] {
+			continue
+		}
+		if _, n, err := net.ParseCIDR(strings.TrimSpace(record[0])); err == nil {
+			nets = append(nets, countryNet{net: n, country: country})
+		}
+	}
+	alertNets.set(nets)
+	return nil
+}
+
+// alertCountry returns the country of ALERT_COUNTRIES addr is in, empty if
+// it is in none of them.
+func alertCountry(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	for _, n := range alertNets.get() {
+		if n.net.Contains(ip) {
+			return n.country
+		}
+	}
+	return ""
+}
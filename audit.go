@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// the types of the audit events
+const (
+	auditInvited    = "invited"
+	auditTokenSent  = "token_sent"
+	auditVerified   = "verified"
+	auditFailed     = "failed"
+	auditLockedOut  = "locked_out"
+	auditRevoked    = "revoked"
+	auditRegistered = "registered"
+	// an external identity was linked to a new account, see identity.go
+	auditIdentityLinked = "identity_linked"
+	// an account was disabled, or enabled again, by an admin, see
+	// softdelete.go
+	auditDisabled = "disabled"
+	auditRestored = "restored"
+	// a phone number was verified, with VERIFY_PHONE
+	auditPhoneVerified = "phone_verified"
+)
+
+// auditBuffer is the number of events queued for a slow client of the
+// management API before the following ones are dropped.
+const auditBuffer = 64
+
+// auditEvent is a step of a registration, published to the subscribers of
+// the audit stream.
+type auditEvent struct {
+	Type   string    `json:"type"`
+	User   string    `json:"user"`
+	Mail   string    `json:"mail,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// auditBus fans the audit events out to the subscribers. Publishing never
+// blocks: a subscriber which doesn't keep up loses the events it can't
+// buffer.
+type auditBus struct {
+	mu   sync.Mutex
+	subs map[chan auditEvent]struct{}
+}
+
+var audits = &auditBus{subs: map[chan auditEvent]struct{}{}}
+
+// subscribe returns a channel receiving the events published from now on,
+// buffering up to size of them.
+func (b *auditBus) subscribe(size int) chan auditEvent {
+	ch := make(chan auditEvent, size)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *auditBus) unsubscribe(ch chan auditEvent) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *auditBus) publish(e auditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			logWarn("Dropping the %s audit event for %s: subscriber too slow", e.Type, e.User)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// authentikDirectory provisions users through the Authentik API, using an
+// API token with permissions to manage users and groups.
+type authentikDirectory struct {
+	base   string
+	header http.Header
+}
+
+func openAuthentik(ctx context.Context) (*authentikDirectory, error) {
+	if options().AuthentikToken == "" {
+		return nil, fmt.Errorf("AUTHENTIK_TOKEN must be set to use the authentik backend")
+	}
+	return &authentikDirectory{
+		base:   strings.TrimSuffix(options().AuthentikURL, "/") + "/api/v3",
+		header: http.Header{"Authorization": {"Bearer " + options().AuthentikToken}},
+	}, nil
+}
+
+func (a *authentikDirectory) Close() error {
+	return nil
+}
+
+func (a *authentikDirectory) Exists(ctx context.Context, user string) (_ bool, err error) {
+	_, sp := startSpan(ctx, "authentik.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	var res struct {
+		Results []struct {
+			PK int `json:"pk"`
+		} `json:"results"`
+	}
+	q := url.Values{"username": {user}}
+	if _, err := doJSON(ctx, http.MethodGet, a.base+"/core/users/?"+q.Encode(), a.header, nil, &res); err != nil {
+		return false, fmt.Errorf("Could not search Authentik users: %v", err)
+	}
+	return len(res.Results) > 0, nil
+}
+
+// group looks up the primary key of a group by name.
+func (a *authentikDirectory) group(ctx context.Context, name string) (string, error) {
+	var res struct {
+		Results []struct {
+			PK string `json:"pk"`
+		} `json:"results"`
+	}
+	q := url.Values{"name": {name}}
+	if _, err := doJSON(ctx, http.MethodGet, a.base+"/core/groups/?"+q.Encode(), a.header, nil, &res); err != nil {
+		return "", err
+	}
+	if len(res.Results) == 0 {
+		return "", fmt.Errorf("no such group")
+	}
+	return res.Results[0].PK, nil
+}
+
+func (a *authentikDirectory) Register(ctx context.Context, user, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "authentik.create", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	var groups []string
+	for _, name := range options().AuthentikGroups {
+		pk, err := a.group(ctx, name)
+		if err != nil {
+			return fmt.Errorf("Could not look up the Authentik group %s: %v", name, err)
+		}
+		groups = append(groups, pk)
+	}
+
+	body := map[string]any{
+		"username":  user,
+		"name":      user,
+		"email":     mail,
+		"is_active": true,
+		"path":      options().AuthentikUserPath,
+		"groups":    groups,
+	}
+	var created struct {
+		PK int `json:"pk"`
+	}
+	if _, err := doJSON(ctx, http.MethodPost, a.base+"/core/users/", a.header, body, &created); err != nil {
+		return fmt.Errorf("Could not create the Authentik user: %v", err)
+	}
+
+	setPassword := fmt.Sprintf("%s/core/users/%d/set_password/", a.base, created.PK)
+	if _, err := doJSON(ctx, http.MethodPost, setPassword, a.header, map[string]string{"password": password}, nil); err != nil {
+		return partialRegistration{fmt.Errorf("Could not add a password to the new user: %v", err)}
+	}
+	return nil
+}
+
+// ApplyDefaults sets the attributes of a user and adds it to the groups,
+// looked up by name.
+func (a *authentikDirectory) ApplyDefaults(ctx context.Context, user string, d userDefaults) (err error) {
+	_, sp := startSpan(ctx, "authentik.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	var res struct {
+		Results []struct {
+			PK         int            `json:"pk"`
+			Attributes map[string]any `json:"attributes"`
+		} `json:"results"`
+	}
+	q := url.Values{"username": {user}}
+	if _, err := doJSON(ctx, http.MethodGet, a.base+"/core/users/?"+q.Encode(), a.header, nil, &res); err != nil {
+		return fmt.Errorf("Could not search Authentik users: %v", err)
+	}
+	if len(res.Results) == 0 {
+		return fmt.Errorf("Could not find user %s", user)
+	}
+	pk := res.Results[0].PK
+
+	if len(d.Attributes) > 0 {
+		attrs := res.Results[0].Attributes
+		if attrs == nil {
+			attrs = map[string]any{}
+		}
+		for name, value := range d.Attributes {
+			attrs[name] = value
+		}
+		userURL := fmt.Sprintf("%s/core/users/%d/", a.base, pk)
+		if _, err := doJSON(ctx, http.MethodPatch, userURL, a.header, map[string]any{"attributes": attrs}, nil); err != nil {
+			return fmt.Errorf("Could not set the attributes of the Authentik user: %v", err)
+		}
+	}
+	for _, name := range d.Groups {
+		group, err := a.group(ctx, name)
+		if err != nil {
+			return fmt.Errorf("Could not look up the Authentik group %s: %v", name, err)
+		}
+		addUser := a.base + "/core/groups/" + url.PathEscape(group) + "/add_user/"
+		if _, err := doJSON(ctx, http.MethodPost, addUser, a.header, map[string]int{"pk": pk}, nil); err != nil {
+			return fmt.Errorf("Could not add the Authentik user to the group %s: %v", name, err)
+		}
+	}
+	return nil
+}
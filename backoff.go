@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// retryDelay returns how long to wait before the retry following attempt,
+// counted from 0, of an operation retried after base, as per RETRY_BACKOFF:
+// exponential doubles the wait after every attempt, linear adds base to it
+// and constant keeps it. The wait is capped at RETRY_BACKOFF_MAX and spread
+// by RETRY_JITTER, so that the instances don't retry in step.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	wait := base
+	switch options().RetryBackoff {
+	case "exponential":
+		for i := 0; i < attempt && (options().RetryBackoffMax <= 0 || wait < options().RetryBackoffMax); i++ {
+			wait *= 2
+		}
+	case "linear":
+		wait = base * time.Duration(attempt+1)
+	}
+	if options().RetryBackoffMax > 0 && wait > options().RetryBackoffMax {
+		wait = options().RetryBackoffMax
+	}
+	if spread := time.Duration(float64(wait) * options().RetryJitter); spread > 0 {
+		wait += time.Duration(rand.Int63n(int64(2*spread)+1)) - spread
+	}
+	return wait
+}
+
+// validateRetryBackoff checks the RETRY_* options.
+func validateRetryBackoff() error {
+	switch options().RetryBackoff {
+	case "exponential", "linear", "constant":
+	default:
+		return fmt.Errorf("Unknown RETRY_BACKOFF %q, expected one of exponential, linear or constant", options().RetryBackoff)
+	}
+	if options().RetryBackoffMax < 0 {
+		return fmt.Errorf("RETRY_BACKOFF_MAX must not be negative")
+	}
+	if options().RetryJitter < 0 || options().RetryJitter > 1 {
+		return fmt.Errorf("RETRY_JITTER must be between 0 and 1")
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// banStore counts authentication failures per IP and temporarily bans the
+// addresses exceeding the configured threshold within the failure window.
+type banStore interface {
+	// banned reports whether ip is currently banned.
+	banned(ip string) bool
+	// fail records a failure for ip, banning it once the threshold is reached.
+	fail(ip, user, reason string)
+	// ban bans ip for the ban duration, regardless of its failures.
+	ban(ip string)
+	// unban lifts the ban of ip and forgets its failures, reporting whether
+	// it was banned.
+	unban(ip string) bool
+	// list returns the currently banned addresses along with the ban expiry.
+	list() map[string]time.Time
+	// reconfigure changes the threshold, window and ban duration.
+	reconfigure(threshold int, window, duration time.Duration)
+}
+
+// validateBanMode checks the BAN_MODE option.
+func validateBanMode() error {
+	switch options().BanMode {
+	case "ban", "tarpit":
+		return nil
+	default:
+		return fmt.Errorf("Unknown BAN_MODE %q, expected one of ban or tarpit", options().BanMode)
+	}
+}
+
+// logFailure logs an authentication failure. The log lines are kept stable so
+// that they can be matched by fail2ban.
+func logFailure(ip, user, reason string) {
+	logWarn("Authentication failure for %s from %s: %s", user, ip, reason)
+}
+
+func logBan(ip string, duration time.Duration, failures int) {
+	logWarn("Banned %s for %s after %d failures", ip, duration, failures)
+	raiseAlert(securityAlert{Event: "ban", IP: ip, Detail: fmt.Sprintf("banned for %s after %d failures", duration, failures)})
+}
+
+// banList is the in-memory banStore, local to this instance.
+type banList struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	bans     map[string]time.Time
+	// when the failures and the bans were last swept
+	swept time.Time
+}
+
+func newBanList(threshold int, window, duration time.Duration) *banList {
+	return &banList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		failures:  map[string][]time.Time{},
+		bans:      map[string]time.Time{},
+	}
+}
+
+func (b *banList) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.bans[ip]
+	if !ok {
+		return false
+	}
+	if clockNow().After(until) {
+		delete(b.bans, ip)
+		return false
+	}
+	return true
+}
+
+func (b *banList) fail(ip, user, reason string) {
+	logFailure(ip, user, reason)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 {
+		return
+	}
+	now := clockNow()
+	if now.Sub(b.swept) >= b.window {
+		b.sweep(now)
+	}
+	recent := b.failures[ip][:0]
+	for _, t := range b.failures[ip] {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < b.threshold {
+		b.failures[ip] = recent
+		return
+	}
+
+	delete(b.failures, ip)
+	b.bans[ip] = now.Add(b.duration)
+	logBan(ip, b.duration, len(recent))
+}
+
+// sweep drops the failures older than the window and the expired bans, for
+// the addresses failing under the threshold and never coming back not to
+// be kept forever. It is called with the lock held, once per window.
+func (b *banList) sweep(now time.Time) {
+	b.swept = now
+	for ip, failures := range b.failures {
+		if len(failures) == 0 || now.Sub(failures[len(failures)-1]) >= b.window {
+			delete(b.failures, ip)
+		}
+	}
+	for ip, until := range b.bans {
+		if now.After(until) {
+			delete(b.bans, ip)
+		}
+	}
+}
+
+func (b *banList) ban(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, ip)
+	b.bans[ip] = clockNow().Add(b.duration)
+}
+
+func (b *banList) unban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, ip)
+	until, ok := b.bans[ip]
+	delete(b.bans, ip)
+	return ok && !clockNow().After(until)
+}
+
+func (b *banList) reconfigure(threshold int, window, duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold, b.window, b.duration = threshold, window, duration
+}
+
+func (b *banList) list() map[string]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := map[string]time.Time{}
+	now := clockNow()
+	for ip, until := range b.bans {
+		if now.After(until) {
+			delete(b.bans, ip)
+			continue
+		}
+		res[ip] = until
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisFailuresPrefix = "sshauth:failures:"
+	redisBanPrefix      = "sshauth:ban:"
+	redisTimeout        = 2 * time.Second
+)
+
+// redisBans is a banStore shared by all the instances using the same Redis
+// server. Redis errors are logged and the address is let through, so that
+// an outage of the shared state doesn't lock everybody out.
+type redisBans struct {
+	client    *redis.Client
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+}
+
+func (b *redisBans) reconfigure(threshold int, window, duration time.Duration) {
+	b.threshold, b.window, b.duration = threshold, window, duration
+}
+
+func (b *redisBans) banned(ip string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := b.client.Exists(ctx, redisBanPrefix+ip).Result()
+	if err != nil {
+		logError("Could not check the ban list in Redis: %v", err)
+		return false
+	}
+	return n > 0
+}
+
+func (b *redisBans) fail(ip, user, reason string) {
+	logFailure(ip, user, reason)
+	if b.threshold <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	now := clockNow()
+	key := redisFailuresPrefix + ip
+	pipe := b.client.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-b.window).UnixNano(), 10))
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixNano()), Member: now.UnixNano()})
+	count := pipe.ZCard(ctx, key)
+	pipe.Expire(ctx, key, b.window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logError("Could not record the failure in Redis: %v", err)
+		return
+	}
+	if int(count.Val()) < b.threshold {
+		return
+	}
+
+	until := now.Add(b.duration)
+	pipe = b.client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.Set(ctx, redisBanPrefix+ip, until.Unix(), b.duration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logError("Could not store the ban in Redis: %v", err)
+		return
+	}
+	logBan(ip, b.duration, int(count.Val()))
+}
+
+func (b *redisBans) ban(ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := b.client.TxPipeline()
+	pipe.Del(ctx, redisFailuresPrefix+ip)
+	pipe.Set(ctx, redisBanPrefix+ip, clockNow().Add(b.duration).Unix(), b.duration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logError("Could not store the ban in Redis: %v", err)
+	}
+}
+
+func (b *redisBans) unban(ip string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := b.client.TxPipeline()
+	pipe.Del(ctx, redisFailuresPrefix+ip)
+	n := pipe.Del(ctx, redisBanPrefix+ip)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logError("Could not lift the ban in Redis: %v", err)
+		return false
+	}
+	return n.Val() > 0
+}
+
+func (b *redisBans) list() map[string]time.Time {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	res := map[string]time.Time{}
+	iter := b.client.Scan(ctx, 0, redisBanPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		until, err := b.client.Get(ctx, iter.Val()).Int64()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			logError("Could not read the ban list from Redis: %v", err)
+			break
+		}
+		res[iter.Val()[len(redisBanPrefix):]] = time.Unix(until, 0)
+	}
+	if err := iter.Err(); err != nil {
+		logError("Could not read the ban list from Redis: %v", err)
+	}
+	return res
+}
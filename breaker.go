@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// directoryBreaker stops the sessions from waiting on a directory which is
+// down: after DIRECTORY_BREAKER_THRESHOLD connections failed in a row, the
+// registrations are suspended, with MAINTENANCE_MESSAGE, for
+// DIRECTORY_BREAKER_COOLDOWN. The next connection then probes the
+// directory, closing the breaker when it succeeds and opening it again
+// otherwise.
+var directoryBreaker struct {
+	sync.Mutex
+	failures int
+	// the breaker is open until then
+	until time.Time
+}
+
+// breakerOpen reports whether the directory is considered down.
+func breakerOpen() bool {
+	directoryBreaker.Lock()
+	defer directoryBreaker.Unlock()
+	return clockNow().Before(directoryBreaker.until)
+}
+
+// recordDirectory records the outcome of a connection to the directory.
+func recordDirectory(err error) {
+	directoryBreaker.Lock()
+	defer directoryBreaker.Unlock()
+	if err == nil {
+		if directoryBreaker.failures >= options().DirectoryBreakerThreshold && options().DirectoryBreakerThreshold > 0 {
+			logInfo("The directory is back up, resuming the registrations")
+		}
+		directoryBreaker.failures = 0
+		directoryBreaker.until = time.Time{}
+		return
+	}
+	directoryBreaker.failures++
+	if options().DirectoryBreakerThreshold > 0 && directoryBreaker.failures >= options().DirectoryBreakerThreshold {
+		if directoryBreaker.failures == options().DirectoryBreakerThreshold {
+			logError("Could not connect to the directory %d times in a row, suspending the registrations: %v", directoryBreaker.failures, err)
+		}
+		directoryBreaker.until = clockNow().Add(options().DirectoryBreakerCooldown)
+	}
+}
+
+// openRetrying opens the directory backend, retrying up to
+// DIRECTORY_RETRIES times after DIRECTORY_RETRY_BACKOFF, growing as per
+// RETRY_BACKOFF. Only the connection is retried, the writes being
+// unsafe to repeat.
+func openRetrying(ctx context.Context) (directory, error) {
+	if breakerOpen() {
+		return nil, fmt.Errorf("The directory is down, retrying after DIRECTORY_BREAKER_COOLDOWN")
+	}
+	for attempt := 0; ; attempt++ {
+		d, err := openBackend(ctx)
+		if err == nil || attempt >= options().DirectoryRetries {
+			recordDirectory(err)
+			return d, err
+		}
+		wait := retryDelay(options().DirectoryRetryBackoff, attempt)
+		logDebug("directory", "attempt %d failed, retrying in %s: %v", attempt+1, wait, err)
+		if !clockSleep(ctx, wait) {
+			recordDirectory(err)
+			return nil, err
+		}
+	}
+}
+
+// validateDirectoryRetries checks the DIRECTORY_RETRY_* and
+// DIRECTORY_BREAKER_* options.
+func validateDirectoryRetries() error {
+	if options().DirectoryRetries < 0 || options().DirectoryBreakerThreshold < 0 {
+		return fmt.Errorf("DIRECTORY_RETRIES and DIRECTORY_BREAKER_THRESHOLD must not be negative")
+	}
+	if options().DirectoryRetries > 0 && options().DirectoryRetryBackoff <= 0 {
+		return fmt.Errorf("DIRECTORY_RETRY_BACKOFF must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+var numberNames = []string{
+	"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+	"eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen", "twenty",
+}
+
+// validateChallenge checks the CHALLENGE option.
+func validateChallenge() error {
+	switch options().Challenge {
+	case "none", "math":
+		return nil
+	default:
+		return fmt.Errorf("Unknown CHALLENGE %q, expected one of none or math", options().Challenge)
+	}
+}
+
+// mathChallenge returns a small sum spelled out in words, which naive bots
+// scraping the prompt for digits can't answer, along with its result.
+func mathChallenge() (messageData, int) {
+	a, b := 1+rand.Intn(len(numberNames)-1), 1+rand.Intn(len(numberNames)-1)
+	return messageData{A: numberNames[a], B: numberNames[b]}, a + b
+}
+
+// challenge asks a question a human can answer easily before any mail is
+// sent, so that bots can't use the service to spam arbitrary addresses.
+func (s *session) challenge() bool {
+	if options().Challenge == "none" {
+		return true
+	}
+	for i := 0; i < options().ChallengeRetries; i++ {
+		question, answer := mathChallenge()
+		io.WriteString(s, s.textData(CHALLENGE_MATH, question))
+		buf, err := readN(s, 3, []byte("0123456789"), true)
+		if err != nil {
+			s.bye()
+			return false
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(string(buf))); err == nil && n == answer {
+			return true
+		}
+		bans.fail(s.ip, s.user, "failed challenge")
+		countFailure(failChallenge)
+		io.WriteString(s, s.text(CHALLENGE_FAILED))
+	}
+	s.bye()
+	return false
+}
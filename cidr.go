@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// the networks from ALLOWED_CIDRS, DENIED_CIDRS, TRUSTED_CIDRS,
+// PROXY_PROTOCOL_TRUSTED_CIDRS and WEB_REAL_IP_TRUSTED_CIDRS
+var allowedNets, deniedNets, trustedNets, proxyNets, webProxyNets reloadable[[]*net.IPNet]
+
+// parseCIDRs parses a list of networks in CIDR notation. Bare addresses are
+// accepted too, and match only themselves.
+func parseCIDRs(name string, list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address %q in %s", s, name)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q in %s: %v", s, name, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func initCIDRs() error {
+	allowed, err := parseCIDRs("ALLOWED_CIDRS", options().AllowedCIDRs)
+	if err != nil {
+		return err
+	}
+	denied, err := parseCIDRs("DENIED_CIDRS", options().DeniedCIDRs)
+	if err != nil {
+		return err
+	}
+	trusted, err := parseCIDRs("TRUSTED_CIDRS", options().TrustedCIDRs)
+	if err != nil {
+		return err
+	}
+	proxies, err := parseCIDRs("PROXY_PROTOCOL_TRUSTED_CIDRS", options().ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return err
+	}
+	if options().ProxyProtocol && len(proxies) == 0 {
+		// anyone could claim any address otherwise
+		return fmt.Errorf("PROXY_PROTOCOL needs PROXY_PROTOCOL_TRUSTED_CIDRS, the addresses of the proxies")
+	}
+	webProxies, err := parseCIDRs("WEB_REAL_IP_TRUSTED_CIDRS", options().WebRealIPTrustedCIDRs)
+	if err != nil {
+		return err
+	}
+	if options().WebRealIPHeader != "" && len(webProxies) == 0 {
+		return fmt.Errorf("WEB_REAL_IP_HEADER needs WEB_REAL_IP_TRUSTED_CIDRS, the addresses of the reverse proxies")
+	}
+	allowedNets.set(allowed)
+	deniedNets.set(denied)
+	trustedNets.set(trusted)
+	proxyNets.set(proxies)
+	webProxyNets.set(webProxies)
+	return nil
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed reports whether connections from ip are accepted: it must not be
+// in DENIED_CIDRS and, when ALLOWED_CIDRS is set, it must be in there.
+func ipAllowed(addr string) bool {
+	allowed := allowedNets.get()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return len(allowed) == 0
+	}
+	if inNets(deniedNets.get(), ip) {
+		return false
+	}
+	return len(allowed) == 0 || inNets(allowed, ip)
+}
+
+// ipTrusted reports whether ip is in TRUSTED_CIDRS.
+func ipTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && inNets(trustedNets.get(), ip)
+}
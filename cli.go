@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// command is a subcommand of the sshauth binary. Commands with configure set
+// need the whole configuration to be validated, and Vault to be read, before
+// they run.
+type command struct {
+	name      string
+	usage     string
+	configure bool
+	run       func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	// assigned here, as help refers back to the list of commands
+	commands = []command{
+		{"serve", "Run the SSH server (the default)", true, serve},
+		{"dev", "Run the server with an in-memory directory, printing the mails", false, devCommand},
+		{"healthcheck", "Check that the local server answers, for container health checks", false, func([]string) error { return healthcheck() }},
+		{"test-mail", "Send a test mail to the given address", true, testMail},
+		{"test-directory", "Connect to the directory and optionally look up a user", true, testDirectory},
+		{"check-directory", "Check the directory schema and permissions, adding and removing a test user", true, checkDirectoryCommand},
+		{"doctor", "Check the configuration, the listeners, the mail relays and the directory", false, doctorCommand},
+		{"preview-mail", "Print the mails rendered with sample data, or serve them over HTTP", true, previewMailCommand},
+		{"invite", "Mail invites to the users listed in a CSV file", true, inviteCommand},
+		{"replay", "Replay a session recorded in RECORD_DIR against a server", false, replayCommand},
+		{"service", "Install or remove the Windows service", false, serviceCommand},
+		{"config", "Print the effective configuration, with the credentials masked", false, printConfig},
+		{"version", "Print the version and exit", false, printVersion},
+		{"help", "Show this help", false, help},
+	}
+}
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "-h", "--help":
+		name = "help"
+	case "--print-config":
+		name = "config"
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if c.configure {
+			if err := initLogging(); err != nil {
+				return err
+			}
+			if err := initVault(); err != nil {
+				return err
+			}
+			if err := configure(); err != nil {
+				return err
+			}
+		}
+		return c.run(args)
+	}
+	help(nil)
+	return fmt.Errorf("Unknown command %q", name)
+}
+
+func help([]string) error {
+	var b strings.Builder
+	b.WriteString("Usage: sshauth [command] [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-16s %s\n", c.name, c.usage)
+	}
+	fmt.Fprint(os.Stderr, b.String())
+	return nil
+}
+
+// printVersion prints the version along with the VCS revision, when the
+// binary was built from a checkout.
+func printVersion([]string) error {
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				v += " (" + s.Value[:12] + ")"
+			}
+		}
+	}
+	fmt.Printf("sshauth %s %s/%s %s\n", v, runtime.GOOS, runtime.GOARCH, runtime.Version())
+	return nil
+}
@@ -0,0 +1,161 @@
+// Package client drives the sshauth registration over SSH, for integration
+// tests and onboarding tools. It runs the steps of the scripted mode, which
+// the server must enable with SCRIPTED_MODE:
+//
+//	c := client.New("register.example.com:22", hostKeyCallback)
+//	res, err := c.RequestToken(ctx, "alice", "")
+//	// ... read the token from the mail
+//	res, err = c.Verify(ctx, "alice", token, password)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Result is the reply to a step. Status is token_sent after RequestToken
+// and registered after Verify.
+type Result struct {
+	Status    string     `json:"status"`
+	User      string     `json:"user"`
+	Mail      string     `json:"mail,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Message   string     `json:"message,omitempty"`
+}
+
+// Error is a step refused by the server. Code is one of the error codes of
+// the scripted mode, such as invalid_token or mail_throttled.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Client connects to an sshauth server.
+type Client struct {
+	addr    string
+	hostKey ssh.HostKeyCallback
+	// Signers are offered to the server, for the servers binding the tokens
+	// to the client keys or verifying the users by their keys
+	Signers []ssh.Signer
+	// Timeout bounds the connection and the handshake, 30 seconds by default
+	Timeout time.Duration
+}
+
+// New returns a client for the server at addr, a host:port, whose host key
+// is checked with hostKey.
+func New(addr string, hostKey ssh.HostKeyCallback) *Client {
+	return &Client{addr: addr, hostKey: hostKey, Timeout: 30 * time.Second}
+}
+
+// RequestToken asks for a token to be mailed to user, at mail when the
+// server asks for the address, or else at the address it derives.
+func (c *Client) RequestToken(ctx context.Context, user, mail string) (*Result, error) {
+	args := []string{"request-token"}
+	if mail != "" {
+		args = append(args, mail)
+	}
+	return c.run(ctx, user, args)
+}
+
+// Verify submits the token mailed to user along with the password to set,
+// registering the user.
+func (c *Client) Verify(ctx context.Context, user, token, password string) (*Result, error) {
+	return c.run(ctx, user, []string{"verify", token, password})
+}
+
+// run runs a step as user, returning an *Error when the server refuses it.
+func (c *Client) run(ctx context.Context, user string, args []string) (*Result, error) {
+	conn, err := c.dial(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("Could not open a session: %v", err)
+	}
+	defer sess.Close()
+	var out bytes.Buffer
+	sess.Stdout = &out
+	// the exit status tells the error codes apart, which the reply names
+	runErr := sess.Run(command(args))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var res Result
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("Could not run %s: %v", args[0], runErr)
+		}
+		return nil, fmt.Errorf("Could not parse the reply to %s: %v", args[0], err)
+	}
+	if res.Status == "error" {
+		return &res, &Error{Code: res.Error, Message: res.Message}
+	}
+	return &res, nil
+}
+
+func (c *Client) dial(ctx context.Context, user string) (*ssh.Client, error) {
+	auth := []ssh.AuthMethod{
+		// the server lets everybody in, and verifies them by mail
+		ssh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) {
+			return nil, nil
+		}),
+	}
+	if len(c.Signers) > 0 {
+		auth = append([]ssh.AuthMethod{ssh.PublicKeys(c.Signers...)}, auth...)
+	}
+	config := &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: c.hostKey, Timeout: c.Timeout}
+
+	d := net.Dialer{Timeout: c.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s: %v", c.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	} else if c.Timeout > 0 {
+		nc.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(nc, c.addr, config)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("Could not connect to %s: %v", c.addr, err)
+	}
+	// the deadline only bounds the handshake, the steps are bound by ctx
+	nc.SetDeadline(time.Time{})
+	return ssh.NewClient(sc, chans, reqs), nil
+}
+
+// command quotes the arguments of a step, which the server splits like a
+// POSIX shell.
+func command(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
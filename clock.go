@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// clock tells the time to the tokens, the lockouts, the rate limits and
+// their expiry, and paces the retries and the cleanup jobs, so that all of
+// them move together when the clock is frozen, see seeded.go.
+type clock interface {
+	Now() time.Time
+	// After sends the time on the channel once d elapsed on the clock.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// frozenClock is a clock which only moves when advanced. Its timers fire as
+// it is advanced past them, so that the jobs waiting on it, such as the
+// janitor, can be fast-forwarded.
+type frozenClock struct {
+	mu      sync.Mutex
+	at      time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *frozenClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.at
+}
+
+func (c *frozenClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.at
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{at: c.at.Add(d), c: ch})
+	return ch
+}
+
+func (c *frozenClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.at = c.at.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.at) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- c.at
+	}
+	c.waiters = waiting
+	return c.at
+}
+
+// release fires all the timers, once the clock is replaced.
+func (c *frozenClock) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.waiters {
+		w.c <- c.at
+	}
+	c.waiters = nil
+}
+
+var clk = newReloadable[clock](systemClock{})
+
+// setClock replaces the clock of sshauth, the timers of a frozen clock
+// firing right away rather than waiting on a clock nobody advances anymore.
+func setClock(c clock) {
+	old := clk.get()
+	clk.set(c)
+	if old, ok := old.(*frozenClock); ok {
+		old.release()
+	}
+}
+
+// clockNow returns the time on the clock of sshauth.
+func clockNow() time.Time {
+	return clk.get().Now()
+}
+
+// clockSince returns the time elapsed since t on the clock of sshauth.
+func clockSince(t time.Time) time.Duration {
+	return clk.get().Now().Sub(t)
+}
+
+// clockUntil returns the time left until t on the clock of sshauth.
+func clockUntil(t time.Time) time.Duration {
+	return t.Sub(clk.get().Now())
+}
+
+// clockSleep waits for d on the clock of sshauth, returning false when ctx
+// is done first.
+func clockSleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-clk.get().After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
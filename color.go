@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// SGR parameters of the styles used in the output
+const (
+	styleBold    = "1"
+	styleError   = "31"
+	styleSuccess = "32"
+	stylePrompt  = "36"
+)
+
+// validateColor checks the COLOR option.
+func validateColor() error {
+	switch options().Color {
+	case "auto", "always", "never":
+		return nil
+	default:
+		return fmt.Errorf("Unknown COLOR %q, expected one of auto, always or never", options().Color)
+	}
+}
+
+// noColor reports whether the NO_COLOR convention (https://no-color.org)
+// asks for plain output, either in our environment or in the one sent by
+// the client.
+func noColor(s ssh.Session) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return true
+	}
+	for _, kv := range s.Environ() {
+		if name, value, _ := strings.Cut(kv, "="); name == "NO_COLOR" && value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// plainRequested reports whether the session gets the plain output, with
+// PLAIN or when the client sets SSHAUTH_PLAIN.
+func plainRequested(s ssh.Session) bool {
+	if options().Plain {
+		return true
+	}
+	for _, kv := range s.Environ() {
+		if name, value, _ := strings.Cut(kv, "="); name == "SSHAUTH_PLAIN" {
+			return value != "" && value != "0"
+		}
+	}
+	return false
+}
+
+// colorEnabled decides whether the session gets colored output. With the
+// default COLOR=auto, colors are used for the clients with a terminal which
+// is not dumb, unless NO_COLOR is set.
+func colorEnabled(s ssh.Session) bool {
+	switch options().Color {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	pty, _, isPty := s.Pty()
+	return isPty && pty.Term != "dumb" && !noColor(s)
+}
+
+// paint wraps msg, but not its trailing newlines, in the given style.
+func (s *session) paint(style, msg string) string {
+	if !s.color {
+		return msg
+	}
+	text := strings.TrimRight(msg, "\n")
+	return "\x1b[" + style + "m" + text + "\x1b[0m" + msg[len(text):]
+}
+
+// say writes msg in the given style.
+func (s *session) say(style, msg string) {
+	if s.jsonLines {
+		writeJSONEvent(s.Session, jsonEvent{Type: "message", Text: msg, Style: jsonStyles[style]})
+		return
+	}
+	io.WriteString(s, s.paint(style, msg))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// how often a session waiting for the confirmation link polls the store,
+// which may be shared with the instance serving the link
+const linkPollInterval = 2 * time.Second
+
+// validateTokenDelivery checks the TOKEN_DELIVERY option.
+func validateTokenDelivery() error {
+	switch options().TokenDelivery {
+	case "code":
+		return nil
+	case "link":
+		if options().WebListen == "" || options().WebPublicURL == "" {
+			return fmt.Errorf("TOKEN_DELIVERY=link needs WEB_LISTEN and WEB_PUBLIC_URL, to serve the links")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown TOKEN_DELIVERY %q, expected one of code or link", options().TokenDelivery)
+	}
+}
+
+// confirmURL is the link confirming the address of user, served by
+// confirmLink.
+func confirmURL(user, token string) string {
+	q := url.Values{"user": {user}, "token": {token}}
+	return strings.TrimSuffix(options().WebPublicURL, "/") + "/confirm?" + q.Encode()
+}
+
+// confirmLink serves the links mailed with TOKEN_DELIVERY=link. Opening a
+// link shows a button, which confirms the address: mail scanners following
+// the links they find must not confirm them.
+type confirmLink struct{}
+
+func (confirmLink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := webIP(r)
+	if !ipAllowed(ip) || bans.banned(ip) {
+		logWarn("Refusing confirmation from %s: address not allowed or banned", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	d := webData{Step: "confirm", User: r.FormValue("user"), Token: r.FormValue("token")}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		serveWebPage(w, http.StatusOK, d)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, sp := startSpan(r.Context(), "web.confirm", spanKindServer)
+	sp.setAttr("net.peer.ip", ip)
+	defer sp.finish(nil)
+
+	user, err := normalizeUsername(d.User)
+	if err != nil {
+		d.Error = "This link is not valid."
+		serveWebPage(w, http.StatusBadRequest, d)
+		return
+	}
+	sp.setAttr("ssh.user", user)
+	check, err := verifyPending(ctx, tokens, user, tokenClient{IP: ip, link: true}, d.Token)
+	if err == nil && check.Valid {
+		err = confirmPending(ctx, tokens, user)
+	}
+	switch {
+	case err != nil:
+		logError("Could not confirm the address of %s: %v", user, err)
+		d.Error = "Sorry, an internal error occurred. Please, try again later."
+		serveWebPage(w, http.StatusInternalServerError, d)
+	case !check.Found:
+		countFailure(failTokenExpired)
+		d.Error = "This link has expired, or was used already."
+		serveWebPage(w, http.StatusOK, d)
+	case !check.Valid:
+		countFailure(failTokenWrong)
+		bans.fail(ip, user, "invalid confirmation link")
+		d.Error = "This link is not valid."
+		serveWebPage(w, http.StatusOK, d)
+	default:
+		logInfo("Confirmed the address of %s from %s", user, ip)
+		serveWebPage(w, http.StatusOK, webData{Step: "confirmed", User: user})
+	}
+}
+
+// waitConfirmation waits for the link mailed to the user to be followed,
+// polling the token store.
+func (s *session) waitConfirmation() bool {
+	s.say(styleBold, s.textData(LINK_WAITING, messageData{Mail: s.mail, Wait: clockUntil(s.expiresAt).Round(time.Second)}))
+	tick := time.NewTicker(linkPollInterval)
+	defer tick.Stop()
+	for {
+		t, ok, err := tokens.Get(s.ctx, s.user)
+		if err != nil {
+			s.internalError("Could not look up the pending token", err)
+			return false
+		}
+		if !ok && clockNow().After(s.expiresAt) {
+			countFailure(failTokenExpired)
+			s.exit = exitTokenFailed
+			s.say(styleError, s.text(TOKEN_EXPIRED))
+			return false
+		} else if !ok {
+			countFailure(failTokenRevoked)
+			s.exit = exitTokenFailed
+			s.say(styleError, s.text(TOKEN_REVOKED))
+			return false
+		}
+		if !s.client().redeems(t) {
+			s.unboundToken()
+			s.exit = exitTokenFailed
+			s.say(styleError, s.text(TOKEN_BOUND))
+			return false
+		}
+		if t.Confirmed {
+			s.verified = true
+			audits.publish(auditEvent{Type: auditVerified, User: s.user, Mail: s.mail, IP: s.ip, Detail: "confirmation link"})
+			s.say(styleSuccess, s.text(LINK_CONFIRMED))
+			return true
+		}
+		select {
+		case <-tick.C:
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+}
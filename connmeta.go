@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// the lists offered by the SSH library when the SSH_* options are empty
+var (
+	defaultKexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+	}
+	defaultCiphers = []string{
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+)
+
+const (
+	msgKexInit = 20
+	// the largest amount of data buffered while looking for the key
+	// exchange init of the client
+	maxKexSniff = 64 * 1024
+)
+
+// contextKeyConnMeta holds the *kexSniffer of a connection.
+type contextKeyConnMeta struct{}
+
+// connMeta describes an SSH connection, for the logs and the audit records.
+type connMeta struct {
+	ClientVersion string    `json:"client_version,omitempty"`
+	Kex           string    `json:"kex,omitempty"`
+	Cipher        string    `json:"cipher,omitempty"`
+	MAC           string    `json:"mac,omitempty"`
+	Connected     time.Time `json:"connected"`
+}
+
+// kexSniffer wraps a connection to read the version and the key exchange
+// init sent in clear by the client, since the SSH library doesn't tell which
+// algorithms were negotiated.
+type kexSniffer struct {
+	net.Conn
+	connected time.Time
+
+	mu      sync.Mutex
+	buf     []byte
+	done    bool
+	version string
+	// the lists of the client, for the key exchange, the client to server
+	// ciphers and MACs
+	kex, ciphers, macs []string
+}
+
+func (k *kexSniffer) Read(p []byte) (int, error) {
+	n, err := k.Conn.Read(p)
+	if n > 0 {
+		k.mu.Lock()
+		if !k.done {
+			k.buf = append(k.buf, p[:n]...)
+			k.parse()
+		}
+		k.mu.Unlock()
+	}
+	return n, err
+}
+
+// parse looks for the version line followed by the first binary packet,
+// giving up on anything unexpected.
+func (k *kexSniffer) parse() {
+	if len(k.buf) > maxKexSniff {
+		k.finish()
+		return
+	}
+	for k.version == "" {
+		line, rest, ok := bytes.Cut(k.buf, []byte("\n"))
+		if !ok {
+			return
+		}
+		k.buf = rest
+		if v := strings.TrimRight(string(line), "\r"); strings.HasPrefix(v, "SSH-") {
+			k.version = v
+		}
+	}
+	rest := k.buf
+	if len(rest) < 5 {
+		return
+	}
+	length := int(binary.BigEndian.Uint32(rest))
+	padding := int(rest[4])
+	if length > maxKexSniff || padding+1 > length {
+		k.finish()
+		return
+	}
+	if len(rest) < 4+length {
+		return
+	}
+	payload := rest[5 : 4+length-padding]
+	// the message number and the cookie precede the name-lists
+	if len(payload) > 17 && payload[0] == msgKexInit {
+		lists := readNameLists(payload[17:], 6)
+		if len(lists) == 6 {
+			k.kex, k.ciphers, k.macs = lists[0], lists[2], lists[4]
+		}
+	}
+	k.finish()
+}
+
+func (k *kexSniffer) finish() {
+	k.done = true
+	k.buf = nil
+}
+
+// readNameLists decodes up to n consecutive name-lists.
+func readNameLists(b []byte, n int) [][]string {
+	var lists [][]string
+	for len(lists) < n && len(b) >= 4 {
+		l := int(binary.BigEndian.Uint32(b))
+		if l > len(b)-4 {
+			break
+		}
+		var names []string
+		if l > 0 {
+			names = strings.Split(string(b[4:4+l]), ",")
+		}
+		lists = append(lists, names)
+		b = b[4+l:]
+	}
+	return lists
+}
+
+// negotiate picks the first algorithm of the client also offered by the
+// server, as the key exchange does.
+func negotiate(client, server []string) string {
+	for _, c := range client {
+		if contains(server, c) {
+			return c
+		}
+	}
+	return ""
+}
+
+func (k *kexSniffer) meta() connMeta {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kex, ciphers, macs := options().SSHKexAlgorithms, options().SSHCiphers, options().SSHMACs
+	if len(kex) == 0 {
+		kex = defaultKexAlgorithms
+	}
+	if len(ciphers) == 0 {
+		ciphers = defaultCiphers
+	}
+	if len(macs) == 0 {
+		macs = supportedMACs
+	}
+	m := connMeta{
+		ClientVersion: k.version,
+		Kex:           negotiate(k.kex, kex),
+		Cipher:        negotiate(k.ciphers, ciphers),
+		Connected:     k.connected,
+	}
+	switch m.Cipher {
+	case "":
+	case "aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com":
+		// authenticated ciphers don't use a separate MAC
+		m.MAC = "implicit"
+	default:
+		m.MAC = negotiate(k.macs, macs)
+	}
+	return m
+}
+
+// watchConn records the metadata of an accepted connection, and logs it
+// along with the duration of the connection once it's closed.
+func watchConn(ctx ssh.Context, conn net.Conn, ip string) net.Conn {
+	k := &kexSniffer{Conn: conn, connected: time.Now()}
+	ctx.SetValue(contextKeyConnMeta{}, k)
+	go func() {
+		<-ctx.Done()
+		m := k.meta()
+		logInfo("Connection from %s closed after %s: client %q, kex %s, cipher %s, mac %s",
+			ip, time.Since(m.Connected).Round(time.Millisecond), m.ClientVersion, orNone(m.Kex), orNone(m.Cipher), orNone(m.MAC))
+	}()
+	return k
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// connectionMeta returns the metadata of the connection of a session.
+func connectionMeta(ctx ssh.Context) connMeta {
+	if k, ok := ctx.Value(contextKeyConnMeta{}).(*kexSniffer); ok {
+		return k.meta()
+	}
+	return connMeta{ClientVersion: ctx.ClientVersion()}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// userDefaults are the groups and attributes given to a new user, as per
+// DEFAULTS_FILE.
+type userDefaults struct {
+	Groups     []string
+	Attributes map[string]string
+	// how long the account lasts, 0 for ever
+	Expire time.Duration
+}
+
+// defaultsRule gives groups and attributes to the new users matching a
+// pattern. A defaults file looks like:
+//
+//	defaults:
+//	  - match: "*@students.example.com"
+//	    groups: [students]
+//	    attributes:
+//	      loginShell: /bin/bash
+//	  - match: "guest-*"
+//	    expire: 720h
+//	  - match: "adm-*"
+//	    groups: [admins]
+//
+// Patterns containing an @ are matched against the address, the others
+// against the username, case-insensitively and with the syntax of
+// path.Match. Every matching rule applies, the later ones overriding the
+// attributes and the expiry, ACCOUNT_EXPIRE by default, set by the earlier
+// ones.
+type defaultsRule struct {
+	Match      string            `yaml:"match"`
+	Groups     []string          `yaml:"groups"`
+	Attributes map[string]string `yaml:"attributes"`
+	Expire     time.Duration     `yaml:"expire"`
+}
+
+type defaultsFile struct {
+	Defaults []defaultsRule `yaml:"defaults"`
+}
+
+// defaultsDirectory is implemented by the directories which can give groups
+// and attributes to a user.
+type defaultsDirectory interface {
+	ApplyDefaults(ctx context.Context, user string, d userDefaults) error
+}
+
+var defaultsRules reloadable[[]defaultsRule]
+
+// loadDefaults reads and validates DEFAULTS_FILE, if set.
+func loadDefaults() error {
+	if options().AccountExpire > 0 && options().DirectoryBackend != "ldap" {
+		return fmt.Errorf("ACCOUNT_EXPIRE is only supported by the ldap directory backend")
+	}
+	if options().DefaultsFile == "" {
+		defaultsRules.set(nil)
+		return nil
+	}
+	data, err := os.ReadFile(options().DefaultsFile)
+	if err != nil {
+		return fmt.Errorf("Could not read DEFAULTS_FILE: %v", err)
+	}
+	var f defaultsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("Could not parse DEFAULTS_FILE: %v", err)
+	}
+	for i, r := range f.Defaults {
+		if r.Match == "" {
+			return fmt.Errorf("Defaults rule %d needs a match", i+1)
+		}
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return fmt.Errorf("Defaults rule %d: invalid match %q: %v", i+1, r.Match, err)
+		}
+		if len(r.Groups) == 0 && len(r.Attributes) == 0 && r.Expire == 0 {
+			return fmt.Errorf("Defaults rule %d must give groups, attributes or an expiry", i+1)
+		}
+		if r.Expire < 0 {
+			return fmt.Errorf("Defaults rule %d: the expiry must not be negative", i+1)
+		}
+		if r.Expire > 0 && options().DirectoryBackend != "ldap" {
+			return fmt.Errorf("Defaults rule %d: account expiry is only supported by the ldap directory backend", i+1)
+		}
+	}
+	if len(f.Defaults) > 0 && !contains([]string{"ldap", "keycloak", "authentik", "memory"}, options().DirectoryBackend) {
+		return fmt.Errorf("DEFAULTS_FILE is not supported by the %s directory backend", options().DirectoryBackend)
+	}
+	defaultsRules.set(f.Defaults)
+	return nil
+}
+
+// defaultsFor merges the rules of DEFAULTS_FILE matching a new user.
+func defaultsFor(user, mail string) userDefaults {
+	d := userDefaults{Expire: options().AccountExpire}
+	for _, r := range defaultsRules.get() {
+		subject := user
+		if strings.Contains(r.Match, "@") {
+			subject = mail
+		}
+		if ok, _ := path.Match(strings.ToLower(r.Match), strings.ToLower(subject)); !ok {
+			continue
+		}
+		for _, g := range r.Groups {
+			if !contains(d.Groups, g) {
+				d.Groups = append(d.Groups, g)
+			}
+		}
+		for k, v := range r.Attributes {
+			if d.Attributes == nil {
+				d.Attributes = map[string]string{}
+			}
+			d.Attributes[k] = v
+		}
+		if r.Expire > 0 {
+			d.Expire = r.Expire
+		}
+	}
+	return d
+}
+
+func (d userDefaults) empty() bool {
+	return len(d.Groups) == 0 && len(d.Attributes) == 0 && d.Expire == 0
+}
+
+// attributeNames returns the names of the attributes, sorted so that the
+// requests are made in a stable order.
+func (d userDefaults) attributeNames() []string {
+	names := make([]string, 0, len(d.Attributes))
+	for k := range d.Attributes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
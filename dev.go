@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// devCommand runs the server with everything it talks to replaced by
+// in-memory doubles, for contributors to try the whole flow locally: the
+// users go to the memory directory backend, the tokens to the memory store,
+// and the mails to an SMTP sink printing them on the standard output. The
+// server listens on 127.0.0.1:2222, unless SSH_HOST or SSH_PORT say
+// otherwise.
+func devCommand(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: sshauth dev")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("Could not start the SMTP sink: %v", err)
+	}
+	go serveSMTPSink(ln)
+
+	if _, ok := os.LookupEnv("SSH_HOST"); !ok {
+		options().Host = "127.0.0.1"
+	}
+	if _, ok := os.LookupEnv("SSH_PORT"); !ok {
+		options().Port = 2222
+	}
+	options().DirectoryBackend = "memory"
+	options().Store = "memory"
+	options().MailTransport = "smtp"
+	options().SMTPServer = []string{ln.Addr().String()}
+	options().SMTPUsername, options().SMTPPassword = "", ""
+	options().MailRoutes = nil
+	options().DryRun = false
+	fmt.Printf("Development mode: connect with ssh -p %d <user>@%s, the mails are printed below\n", options().Port, options().Host)
+	return runCommand("serve", nil)
+}
+
+// sinkOutput keeps the mails printed by concurrent connections apart.
+var sinkOutput sync.Mutex
+
+// sinkMail is given the mails caught by the SMTP sink, which it prints.
+var sinkMail = func(rcpt []string, msg string) {
+	sinkOutput.Lock()
+	defer sinkOutput.Unlock()
+	fmt.Printf("----- mail %s -----\n%s\n----- end of mail -----\n", strings.Join(rcpt, ", "), msg)
+}
+
+// serveSMTPSink accepts every mail sent to ln and prints it.
+func serveSMTPSink(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logError("The SMTP sink stopped: %v", err)
+			return
+		}
+		go sinkSMTP(conn)
+	}
+}
+
+// sinkSMTP speaks just enough SMTP for the mails of sshauth, with no
+// extension.
+func sinkSMTP(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 sshauth-dev ESMTP sink")
+	var rcpt []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250 sshauth-dev")
+		case "MAIL", "NOOP":
+			reply("250 OK")
+		case "RSET":
+			rcpt = nil
+			reply("250 OK")
+		case "RCPT":
+			to := strings.TrimSpace(line[len(verb):])
+			if len(to) > 3 && strings.EqualFold(to[:3], "TO:") {
+				to = strings.Trim(to[3:], "<> ")
+			}
+			rcpt = append(rcpt, to)
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" || l == ".\n" {
+					break
+				}
+				msg.WriteString(strings.TrimPrefix(l, "."))
+			}
+			sinkMail(rcpt, strings.ReplaceAll(msg.String(), "\r\n", "\n"))
+			rcpt = nil
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// testMail sends a sample token mail to the given address through the
+// configured transport, to check the mail settings before going live.
+func testMail(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: sshauth test-mail <address>")
+	}
+	addr, err := mail.ParseAddress(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid address %q: %v", args[0], err)
+	}
+	var servers []string
+	for _, r := range mailRelays(addr.Address) {
+		servers = append(servers, r.server)
+	}
+	fmt.Printf("Sending a test mail to %s through %s (%s transport)\n", addr.Address, strings.Join(servers, ", then "), options().MailTransport)
+	if err := sendmail(context.Background(), "test", addr.Address, issueToken("test", addr.Address, clockNow().Add(options().TokenTTL))); err != nil {
+		return fmt.Errorf("Could not send mail: %v", err)
+	}
+	fmt.Println("Mail sent")
+	return nil
+}
+
+// checkDirectoryCommand runs the directory schema and permission checks.
+func checkDirectoryCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Usage: sshauth check-directory")
+	}
+	ctx := context.Background()
+	d, err := openDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := checkDirectory(ctx, d, true); err != nil {
+		return err
+	}
+	fmt.Println("The directory is set up correctly")
+	return nil
+}
+
+// testDirectory connects to the configured directory backend and, when a
+// username is given, looks it up.
+func testDirectory(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: sshauth test-directory [user]")
+	}
+	ctx := context.Background()
+	fmt.Printf("Connecting to the %s directory backend\n", options().DirectoryBackend)
+	d, err := openDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	fmt.Println("Connected")
+
+	if len(args) == 1 {
+		exists, err := d.Exists(ctx, args[0])
+		if err != nil {
+			return fmt.Errorf("Could not look up %s: %v", args[0], err)
+		}
+		if exists {
+			fmt.Printf("User %s exists\n", args[0])
+		} else {
+			fmt.Printf("User %s does not exist\n", args[0])
+		}
+	}
+	return nil
+}
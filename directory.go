@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// directory is the backend users get registered into. A directory is opened
+// for each session and closed when the session ends.
+type directory interface {
+	// Exists reports whether user is already registered.
+	Exists(ctx context.Context, user string) (bool, error)
+	// Register creates user with the given mail address and password.
+	Register(ctx context.Context, user, mail, password string) error
+	Close() error
+}
+
+// partialRegistration is returned by Register when the user was added to the
+// directory but could not be completed, such as when the password is refused,
+// so that the entry can be rolled back.
+type partialRegistration struct {
+	err error
+}
+
+func (e partialRegistration) Error() string { return e.err.Error() }
+func (e partialRegistration) Unwrap() error { return e.err }
+
+// refusedRegistration is returned by Register when the directory refused the
+// new user, nothing being written, such as when an entry of the same name
+// was added after the lookup, so that an existing account is never taken
+// for an entry left by the failed registration.
+type refusedRegistration struct {
+	err error
+}
+
+func (e refusedRegistration) Error() string { return e.err.Error() }
+func (e refusedRegistration) Unwrap() error { return e.err }
+
+// registrationVerifier is implemented by the directories which can check
+// that a new user was written in full and can log in.
+type registrationVerifier interface {
+	Verify(ctx context.Context, user, mail, password string) error
+}
+
+// openDirectory connects to the configured directory backend, retrying as
+// told by openRetrying. In dry-run mode, writes to the directory are only
+// logged.
+func openDirectory(ctx context.Context) (directory, error) {
+	d, err := openRetrying(ctx)
+	if err != nil {
+		countFailure(failDirectoryError)
+		return nil, err
+	}
+	if options().DryRun {
+		return dryRunDirectory{d}, nil
+	}
+	return d, nil
+}
+
+func openBackend(ctx context.Context) (directory, error) {
+	switch options().DirectoryBackend {
+	case "ldap":
+		return openLDAP(ctx)
+	case "keycloak":
+		return openKeycloak(ctx)
+	case "authentik":
+		return openAuthentik(ctx)
+	case "scim":
+		return openSCIM(ctx)
+	case "webhook":
+		return openWebhook(ctx)
+	case "memory":
+		return memoryUsers, nil
+	default:
+		return nil, fmt.Errorf("Unknown DIRECTORY_BACKEND %q", options().DirectoryBackend)
+	}
+}
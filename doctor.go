@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const doctorUsage = "Usage: sshauth doctor [--prometheus]"
+
+// doctorTimeout bounds each of the checks reaching another server.
+const doctorTimeout = 15 * time.Second
+
+// errSkipped is returned by the checks which don't apply to the
+// configuration, the reason being wrapped in it.
+var errSkipped = errors.New("skipped")
+
+// doctorCheck is one of the checks of the doctor command, on target when it
+// runs once per address or file.
+type doctorCheck struct {
+	name, target string
+	run          func(ctx context.Context) (string, error)
+}
+
+// doctorResult is the outcome of a doctorCheck, with what it found.
+type doctorResult struct {
+	doctorCheck
+	detail string
+	err    error
+	took   time.Duration
+}
+
+func skip(reason string) error {
+	return fmt.Errorf("%w: %s", errSkipped, reason)
+}
+
+// doctorCommand runs the checks of a new deployment, from the configuration
+// to the directory, and prints a report, or the results as Prometheus
+// metrics with --prometheus, for the textfile collector of node_exporter.
+// The listening addresses are bound, so it fails while sshauth is running on
+// them, and the directory is probed by adding and removing a test user.
+func doctorCommand(args []string) error {
+	prometheus := false
+	for _, a := range args {
+		if a != "--prometheus" {
+			return errors.New(doctorUsage)
+		}
+		prometheus = true
+	}
+	var results []doctorResult
+	runChecks := func(checks ...doctorCheck) bool {
+		ok := true
+		for _, c := range checks {
+			ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+			start := time.Now()
+			detail, err := c.run(ctx)
+			cancel()
+			results = append(results, doctorResult{doctorCheck: c, detail: detail, err: err, took: time.Since(start)})
+			ok = ok && (err == nil || errors.Is(err, errSkipped))
+		}
+		return ok
+	}
+
+	runChecks(
+		doctorCheck{name: "templates", run: checkTemplates},
+		doctorCheck{name: "patterns", run: checkPatterns},
+	)
+	if runChecks(doctorCheck{name: "configuration", run: checkConfiguration}) {
+		runChecks(listenChecks()...)
+		runChecks(hostKeyCheck())
+		runChecks(smtpChecks()...)
+		runChecks(doctorCheck{name: "directory", target: options().DirectoryBackend, run: checkDirectoryAccess})
+	}
+
+	if prometheus {
+		printDoctorMetrics(results)
+	} else {
+		printDoctorReport(results)
+	}
+	failed := 0
+	for _, r := range results {
+		if r.err != nil && !errors.Is(r.err, errSkipped) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// checkTemplates parses the messages of MESSAGES_DIR and the welcome mail.
+func checkTemplates(context.Context) (string, error) {
+	if err := loadMessages(); err != nil {
+		return "", err
+	}
+	if err := loadWelcomeMail(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("languages: %d", len(catalogs.get())), nil
+}
+
+// checkPatterns compiles the regular expressions of the options and of the
+// flows.
+func checkPatterns(context.Context) (string, error) {
+	if err := initPasswordRules(); err != nil {
+		return "", err
+	}
+	if err := loadFlow(); err != nil {
+		return "", err
+	}
+	if err := loadProfiles(); err != nil {
+		return "", err
+	}
+	return "", loadIdentityVerifier()
+}
+
+// checkConfiguration validates all the options, as serve does.
+func checkConfiguration(context.Context) (string, error) {
+	if err := initLogging(); err != nil {
+		return "", err
+	}
+	if err := initVault(); err != nil {
+		return "", err
+	}
+	return "", configure()
+}
+
+// listenChecks binds the addresses of the SSH server and of the HTTP
+// listeners, closing them right away.
+func listenChecks() []doctorCheck {
+	addrs := options().Listen
+	if len(addrs) == 0 {
+		addrs = []string{net.JoinHostPort(options().Host, strconv.Itoa(options().Port))}
+	}
+	for _, a := range []string{options().AdminListen, options().GRPCListen, options().MetricsListen, options().WebListen} {
+		if a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	var checks []doctorCheck
+	for _, entry := range addrs {
+		entry := strings.TrimSpace(entry)
+		checks = append(checks, doctorCheck{name: "listen", target: entry, run: func(context.Context) (string, error) {
+			network, addr, err := parseListen(entry)
+			if err != nil {
+				return "", err
+			}
+			ln, err := net.Listen(network, addr)
+			if err != nil {
+				return "", err
+			}
+			defer ln.Close()
+			return addressFamily(network, ln.Addr()), nil
+		}})
+	}
+	return checks
+}
+
+// hostKeyCheck reads the keys of SSH_HOST_KEYS.
+func hostKeyCheck() doctorCheck {
+	return doctorCheck{name: "host keys", run: func(context.Context) (string, error) {
+		if len(options().SSHHostKeys) == 0 {
+			return "", skip("SSH_HOST_KEYS is not set, a new host key is generated at every start")
+		}
+		keys, err := hostKeys()
+		if err != nil {
+			return "", err
+		}
+		var types []string
+		for _, k := range keys {
+			types = append(types, k.PublicKey().Type())
+		}
+		return strings.Join(types, ", "), nil
+	}}
+}
+
+// smtpChecks connects to each of the mail relays, reading their banner.
+func smtpChecks() []doctorCheck {
+	if options().MailTransport == "sendmail" {
+		return []doctorCheck{{name: "smtp", run: func(context.Context) (string, error) {
+			return "", skip("MAIL_TRANSPORT=sendmail")
+		}}}
+	}
+	servers := map[string]bool{}
+	var checks []doctorCheck
+	add := func(routes []smtpRoute) {
+		for _, r := range routes {
+			if servers[r.server] {
+				continue
+			}
+			servers[r.server] = true
+			server := r.server
+			checks = append(checks, doctorCheck{name: "smtp", target: server, run: func(ctx context.Context) (string, error) {
+				return smtpBanner(ctx, server)
+			}})
+		}
+	}
+	add(mailRelays(""))
+	routes := mailRoutes.get()
+	domains := make([]string, 0, len(routes))
+	for d := range routes {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		add(routes[d])
+	}
+	return checks
+}
+
+// smtpBanner returns the greeting of the mail server at addr.
+func smtpBanner(ctx context.Context, addr string) (string, error) {
+	conn, err := dialMail(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, banner, err := textproto.NewConn(conn).ReadResponse(220)
+	if err != nil {
+		return "", fmt.Errorf("Unexpected greeting: %v", err)
+	}
+	return "220 " + banner, nil
+}
+
+// checkDirectoryAccess connects to the directory and runs the schema and
+// permission checks of check-directory, adding and removing a test user.
+func checkDirectoryAccess(ctx context.Context) (string, error) {
+	d, err := openDirectory(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+	if _, ok := d.(schemaChecker); !ok {
+		return "", skip("connected, but the directory backend has no schema checks")
+	}
+	if err := checkDirectory(ctx, d, true); err != nil {
+		return "", err
+	}
+	return "connected, the schema and the permissions are correct", nil
+}
+
+func printDoctorReport(results []doctorResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, r := range results {
+		status, detail := "PASS", r.detail
+		switch {
+		case errors.Is(r.err, errSkipped):
+			status, detail = "SKIP", strings.TrimPrefix(r.err.Error(), errSkipped.Error()+": ")
+		case r.err != nil:
+			// the problems found by the schema checks, one per line, are
+			// kept on the line of the check
+			status, detail = "FAIL", strings.Join(strings.Fields(strings.ReplaceAll(r.err.Error(), "\n  - ", " / ")), " ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status, r.name, r.target, detail)
+	}
+	w.Flush()
+}
+
+// printDoctorMetrics prints the results in the Prometheus text format, the
+// skipped checks being left out.
+func printDoctorMetrics(results []doctorResult) {
+	fmt.Println("# HELP sshauth_doctor_check_success Whether the check of the doctor command passed.")
+	fmt.Println("# TYPE sshauth_doctor_check_success gauge")
+	for _, r := range results {
+		if errors.Is(r.err, errSkipped) {
+			continue
+		}
+		success := 0
+		if r.err == nil {
+			success = 1
+		}
+		fmt.Printf("sshauth_doctor_check_success{check=%q,target=%q} %d\n", r.name, r.target, success)
+	}
+	fmt.Println("# HELP sshauth_doctor_check_duration_seconds Time taken by the check of the doctor command.")
+	fmt.Println("# TYPE sshauth_doctor_check_duration_seconds gauge")
+	for _, r := range results {
+		if errors.Is(r.err, errSkipped) {
+			continue
+		}
+		fmt.Printf("sshauth_doctor_check_duration_seconds{check=%q,target=%q} %g\n", r.name, r.target, r.took.Seconds())
+	}
+}
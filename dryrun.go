@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// dryRunDirectory wraps a directory so that lookups still hit the backend,
+// while writes are only logged.
+type dryRunDirectory struct {
+	directory
+}
+
+func (d dryRunDirectory) Register(ctx context.Context, user, mail, password string) error {
+	logInfo("[dry-run] Would register user %s with mail %s", user, mail)
+	return nil
+}
+
+func (d dryRunDirectory) PublicKeys(ctx context.Context, user string) ([]string, error) {
+	if kd, ok := d.directory.(keyDirectory); ok {
+		return kd.PublicKeys(ctx, user)
+	}
+	return nil, nil
+}
+
+// CheckSchema runs the read-only checks, without adding a test user.
+func (d dryRunDirectory) CheckSchema(ctx context.Context, probe bool) ([]string, error) {
+	if sc, ok := d.directory.(schemaChecker); ok {
+		if probe {
+			logInfo("[dry-run] Would add and remove a test user")
+		}
+		return sc.CheckSchema(ctx, false)
+	}
+	return nil, nil
+}
+
+func (d dryRunDirectory) Mail(ctx context.Context, user string) (string, error) {
+	if ad, ok := d.directory.(accountDirectory); ok {
+		return ad.Mail(ctx, user)
+	}
+	return "", errors.New("The directory backend can't look up addresses")
+}
+
+func (d dryRunDirectory) UserByMail(ctx context.Context, mail string) (string, error) {
+	if ad, ok := d.directory.(accountDirectory); ok {
+		return ad.UserByMail(ctx, mail)
+	}
+	return "", nil
+}
+
+func (d dryRunDirectory) Delete(ctx context.Context, user string) error {
+	logInfo("[dry-run] Would delete user %s", user)
+	return nil
+}
+
+func (d dryRunDirectory) SetMail(ctx context.Context, user, mail string) error {
+	logInfo("[dry-run] Would change the address of user %s to %s", user, mail)
+	return nil
+}
+
+func (d dryRunDirectory) SetPassword(ctx context.Context, user, password string) error {
+	logInfo("[dry-run] Would set the password of user %s", user)
+	return nil
+}
+
+func (d dryRunDirectory) Stub(ctx context.Context, user string) (bool, string, error) {
+	if sd, ok := d.directory.(stubDirectory); ok {
+		return sd.Stub(ctx, user)
+	}
+	return false, "", errors.New("The directory backend can't complete stub accounts")
+}
+
+func (d dryRunDirectory) Complete(ctx context.Context, user, mail, password string) error {
+	logInfo("[dry-run] Would complete the stub of user %s with mail %s", user, mail)
+	return nil
+}
+
+func (d dryRunDirectory) Disable(ctx context.Context, user string) error {
+	logInfo("[dry-run] Would disable user %s", user)
+	return nil
+}
+
+func (d dryRunDirectory) Enable(ctx context.Context, user string) error {
+	logInfo("[dry-run] Would enable user %s", user)
+	return nil
+}
+
+func (d dryRunDirectory) ApplyDefaults(ctx context.Context, user string, defaults userDefaults) error {
+	logInfo("[dry-run] Would give user %s the groups %v, the attributes %v and the expiry %s", user, defaults.Groups, defaults.Attributes, defaults.Expire)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"net/textproto"
+)
+
+// errRecipientRejected is returned when the mail server refuses the
+// recipient outright, usually because the mailbox doesn't exist.
+var errRecipientRejected = errors.New("Recipient rejected by the mail server")
+
+// smtpCmd sends a command and reads the reply, which must have the expected
+// code.
+func smtpCmd(c *smtp.Client, expect int, format string, args ...any) error {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expect)
+	return err
+}
+
+// useDSN reports whether delivery status notifications should be requested.
+func useDSN(c *smtp.Client) bool {
+	ok, _ := c.Extension("DSN")
+	return ok && options().MailDSN
+}
+
+// mailFrom starts a mail transaction. When the server supports DSN (RFC
+// 3461), only the headers of the message are returned in the bounces.
+func mailFrom(c *smtp.Client, from string) error {
+	if !useDSN(c) {
+		return c.Mail(from)
+	}
+	params := " RET=HDRS"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		params += " BODY=8BITMIME"
+	}
+	return smtpCmd(c, 250, "MAIL FROM:<%s>%s", from, params)
+}
+
+// rcptTo adds the recipient, asking for a notification if the delivery fails
+// or is delayed when the server supports DSN. Permanent rejections of the
+// mailbox are reported as errRecipientRejected.
+func rcptTo(c *smtp.Client, to string) error {
+	var err error
+	if useDSN(c) {
+		err = smtpCmd(c, 25, "RCPT TO:<%s> NOTIFY=FAILURE,DELAY", to)
+	} else {
+		err = c.Rcpt(to)
+	}
+	var tp *textproto.Error
+	if errors.As(err, &tp) {
+		switch tp.Code {
+		// no such user, user not local, bad mailbox syntax
+		case 550, 551, 553:
+			return fmt.Errorf("%w: %v", errRecipientRejected, err)
+		}
+	}
+	return err
+}
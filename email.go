@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// the maximum length of an email address, as per RFC 5321
+const maxMailLength = 254
+
+const maxMailAttempts = 3
+
+var errDomainNotAllowed = errors.New("Mail domain not allowed")
+
+// validateMailMode checks the MAIL_MODE option.
+func validateMailMode() error {
+	switch options().MailMode {
+	case "suffix", "prompt":
+		return nil
+	default:
+		return fmt.Errorf("Unknown MAIL_MODE %q, expected one of suffix or prompt", options().MailMode)
+	}
+}
+
+// validateMailNormalize checks the MAIL_NORMALIZE option.
+func validateMailNormalize() error {
+	for _, rule := range options().MailNormalize {
+		switch strings.TrimSpace(rule) {
+		case "lowercase", "plus", "dots", "":
+		default:
+			return fmt.Errorf("Unknown MAIL_NORMALIZE rule %q, expected lowercase, plus or dots", rule)
+		}
+	}
+	return nil
+}
+
+// normalizeMail applies the MAIL_NORMALIZE rules to a bare address, so that
+// the different spellings of a mailbox map to the same address: lowercase
+// lowercases the local part, plus strips the +tag and dots removes the dots
+// of the local part for the MAIL_DOTS_DOMAINS, which ignore them.
+func normalizeMail(address string) string {
+	i := strings.LastIndex(address, "@")
+	local, domain := address[:i], strings.ToLower(address[i+1:])
+	for _, rule := range options().MailNormalize {
+		switch strings.TrimSpace(rule) {
+		case "lowercase":
+			local = strings.ToLower(local)
+		case "plus":
+			if j := strings.Index(local, "+"); j > 0 {
+				local = local[:j]
+			}
+		case "dots":
+			for _, d := range options().MailDotsDomains {
+				if strings.ToLower(strings.TrimSpace(d)) == domain {
+					local = strings.ReplaceAll(local, ".", "")
+					break
+				}
+			}
+		}
+	}
+	return local + "@" + domain
+}
+
+// domainAllowed reports whether address belongs to one of the domains, those
+// of MAIL_ALLOWED_DOMAINS or of a profile. Any domain is allowed when the
+// list is empty.
+func domainAllowed(address string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	i := strings.LastIndex(address, "@")
+	domain := strings.ToLower(address[i+1:])
+	for _, d := range domains {
+		if strings.ToLower(strings.TrimSpace(d)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMail parses an address typed by the user, returning its bare form.
+func parseMail(input string) (string, error) {
+	return parseMailIn(input, options().MailAllowedDomains)
+}
+
+// parseMailIn is parseMail restricted to the given domains.
+func parseMailIn(input string, domains []string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(input))
+	if err != nil {
+		return "", err
+	}
+	if !domainAllowed(addr.Address, domains) {
+		return "", errDomainNotAllowed
+	}
+	return normalizeMail(addr.Address), nil
+}
+
+// mailTaken reports whether, with MAIL_UNIQUE, the address already belongs
+// to another user, either registered or with a pending token. The directory
+// is searched again by checkMailOwner before the user is created.
+func (s *session) mailTaken(address string) (bool, error) {
+	if !options().MailUnique {
+		return false, nil
+	}
+	pending, err := tokens.List(s.ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range pending {
+		if t.User != s.user && strings.EqualFold(t.Mail, address) {
+			return true, nil
+		}
+	}
+	ad, ok := s.dir.(accountDirectory)
+	if !ok {
+		return false, nil
+	}
+	owner, err := ad.UserByMail(s.ctx, address)
+	if err != nil {
+		return false, err
+	}
+	return owner != "" && owner != s.user, nil
+}
+
+// mailTakenError is returned by createAccount when, with MAIL_UNIQUE, the
+// address of the user turns out to belong to another account, as when two
+// users entered it at the same time.
+type mailTakenError struct {
+	Mail  string
+	Owner string
+}
+
+func (e *mailTakenError) Error() string {
+	return fmt.Sprintf("%s is already the address of %s", e.Mail, e.Owner)
+}
+
+// validateMailTaken checks the MAIL_TAKEN_ACTION option.
+func validateMailTaken() error {
+	switch options().MailTakenAction {
+	case "refuse":
+		return nil
+	case "reset":
+		if !options().LldapPasswordReset {
+			return fmt.Errorf("MAIL_TAKEN_ACTION=reset needs LLDAP_PASSWORD_RESET")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown MAIL_TAKEN_ACTION %q, expected one of refuse or reset", options().MailTakenAction)
+	}
+}
+
+// checkMailOwner searches the directory, right before the user is created,
+// for another account with the same address, returning a *mailTakenError
+// when there is one, with MAIL_UNIQUE.
+func (s *session) checkMailOwner() error {
+	if !options().MailUnique || s.mail == "" {
+		return nil
+	}
+	ad, ok := s.dir.(accountDirectory)
+	if !ok {
+		return nil
+	}
+	owner, err := ad.UserByMail(s.ctx, s.mail)
+	if err != nil {
+		return fmt.Errorf("Could not look up the owner of %s: %v", s.mail, err)
+	}
+	if owner == "" || owner == s.user {
+		return nil
+	}
+	countFailure(failMailTaken)
+	logWarn("Refusing to register %s: %s is already the address of %s", s.user, s.mail, owner)
+	return &mailTakenError{Mail: s.mail, Owner: owner}
+}
+
+// resetMailOwner, with MAIL_TAKEN_ACTION=reset, mails the owner of the
+// address taken a link to reset their password, the user having just shown
+// they can read that mailbox. It reports whether it did.
+func (s *session) resetMailOwner(taken *mailTakenError) bool {
+	if options().MailTakenAction != "reset" || !s.verified {
+		return false
+	}
+	if err := requestLLDAPReset(s.ctx, taken.Owner); err != nil {
+		reportError(err, s.tags())
+		logError("Could not reset the password of %s for %s: %v", taken.Owner, s.user, err)
+		return false
+	}
+	logInfo("Requested a password reset for %s, the owner of %s, from %s", taken.Owner, taken.Mail, s.ip)
+	return true
+}
+
+// askMail prompts the user for their email address until a valid one is
+// entered, returning false if they give up or run out of attempts.
+func (s *session) askMail(prompt string) (string, bool) {
+	s.say(stylePrompt, s.text(prompt))
+	for i := maxMailAttempts; i > 0; i-- {
+		recorded := s.recordSecret("mail")
+		buf, err := readN(s, maxMailLength, []byte{}, true)
+		recorded()
+		if err != nil {
+			s.bye()
+			return "", false
+		}
+		address, err := parseMailIn(string(buf), s.allowedDomains())
+		if err == nil {
+			taken, err := s.mailTaken(address)
+			if err != nil {
+				s.internalError("Could not check whether the address is in use", err)
+				return "", false
+			}
+			if !taken {
+				return address, true
+			}
+		}
+		if errors.Is(err, errDomainNotAllowed) {
+			s.say(styleError, s.textData(MAIL_DOMAIN_NOT_ALLOWED, messageData{Domains: strings.Join(s.allowedDomains(), ", ")}))
+		} else if err == nil {
+			s.say(styleError, s.text(MAIL_TAKEN))
+		} else {
+			s.say(styleError, s.text(MAIL_INVALID))
+		}
+		if i > 1 {
+			io.WriteString(s, s.text(MAIL_RETRY))
+		}
+	}
+	s.bye()
+	return "", false
+}
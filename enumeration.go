@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+)
+
+// With ENUMERATION_PROTECTION, the users who are already registered go
+// through the same flow as the new ones, so that the answers of the server
+// don't tell which usernames exist: they are asked the same questions, told
+// that a token was mailed, and every token they enter is refused. The token
+// is stored but never mailed; the owner of the account is notified of the
+// attempt instead, at the address on file.
+
+// deliverToken mails the token to s.mail or, for a decoy, notifies the owner
+// of the account.
+func (s *session) deliverToken(token string) error {
+	if s.decoy {
+		s.notifyExisting()
+		return nil
+	}
+	return sendmail(s.ctx, s.user, s.mail, token)
+}
+
+// notifyExisting mails the owner of an existing account about the attempt
+// to register it again. The address entered during the session can't be
+// trusted, as mailing it would tell an attacker that the user exists: the
+// notice goes to the address on file, or derived from the username, if any.
+// Otherwise it waits about as long as a mail takes, so that the timing
+// matches. Errors are only logged, as they would show too.
+func (s *session) notifyExisting() {
+	var mail string
+	if ad, ok := s.dir.(accountDirectory); ok {
+		var err error
+		if mail, err = ad.Mail(s.ctx, s.user); err != nil {
+			logWarn("Could not look up the address of %s: %v", s.user, err)
+		}
+	}
+	if mail == "" && s.mailMode() != "prompt" {
+		mail = s.user + s.toSuffix()
+	}
+	if mail == "" {
+		logInfo("Not notifying %s of the registration attempt from %s: no address on file", s.user, s.ip)
+		select {
+		case <-time.After(mailLatency.mean(time.Second)):
+		case <-s.ctx.Done():
+		}
+		return
+	}
+	login := options().LldapURI.JoinPath("/login").String()
+	body := renderText(ACCOUNT_EXISTS_BODY, messageData{User: s.user, IP: s.ip, URL: login})
+	if err := deliver(s.ctx, mail, options().Subject, body); err != nil {
+		logWarn("Could not notify %s of the registration attempt from %s: %v", s.user, s.ip, err)
+		return
+	}
+	logInfo("Notified %s <%s> of the registration attempt from %s", s.user, mail, s.ip)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// eventQueue is the number of events waiting to be published before
+	// the following ones are dropped
+	eventQueue = 1024
+	// eventRetries is the number of attempts to publish an event
+	eventRetries = 3
+	// eventTimeout bounds a single attempt
+	eventTimeout = 10 * time.Second
+)
+
+// validateEvents checks the EVENTS_* options.
+func validateEvents() error {
+	if options().EventsNATSURL != "" {
+		u, err := url.Parse(options().EventsNATSURL)
+		if err != nil {
+			return fmt.Errorf("Invalid EVENTS_NATS_URL: %v", err)
+		}
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return fmt.Errorf("Invalid EVENTS_NATS_URL: unknown scheme %q, expected nats or tls", u.Scheme)
+		}
+		if options().EventsNATSSubject == "" {
+			return fmt.Errorf("EVENTS_NATS_SUBJECT must not be empty")
+		}
+	}
+	if options().EventsKafkaRESTURL != "" {
+		if _, err := url.Parse(options().EventsKafkaRESTURL); err != nil {
+			return fmt.Errorf("Invalid EVENTS_KAFKA_REST_URL: %v", err)
+		}
+		if options().EventsKafkaTopic == "" {
+			return fmt.Errorf("EVENTS_KAFKA_TOPIC must not be empty")
+		}
+	}
+	for _, t := range options().EventsTypes {
+		switch t {
+		case auditInvited, auditTokenSent, auditVerified, auditFailed, auditLockedOut, auditRevoked, auditRegistered, auditIdentityLinked, auditDisabled, auditRestored, auditPhoneVerified:
+		default:
+			return fmt.Errorf("Unknown event %q in EVENTS_TYPES", t)
+		}
+	}
+	return nil
+}
+
+// publishEvents forwards the audit events to NATS and Kafka, in order, so
+// that downstream systems can react to the registrations. The options are
+// read for every event, so that a reload takes effect.
+func publishEvents() {
+	events := audits.subscribe(eventQueue)
+	go func() {
+		for e := range events {
+			if len(options().EventsTypes) > 0 && !contains(options().EventsTypes, e.Type) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logError("Could not encode the %s event: %v", e.Type, err)
+				continue
+			}
+			if options().EventsNATSURL != "" {
+				subject := options().EventsNATSSubject + "." + e.Type
+				retryEvent(e, "NATS", func(ctx context.Context) error {
+					return publishNATS(ctx, options().EventsNATSURL, subject, data)
+				})
+			}
+			if options().EventsKafkaRESTURL != "" {
+				retryEvent(e, "Kafka", func(ctx context.Context) error {
+					return publishKafka(ctx, options().EventsKafkaRESTURL, options().EventsKafkaTopic, e.User, e)
+				})
+			}
+		}
+	}()
+}
+
+func retryEvent(e auditEvent, bus string, publish func(context.Context) error) {
+	var err error
+	for i := 0; i < eventRetries; i++ {
+		if i > 0 {
+			<-clk.get().After(retryDelay(time.Second, i-1))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+		err = publish(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	logError("Could not publish the %s event for %s to %s: %v", e.Type, e.User, bus, err)
+}
+
+// natsConnect is the CONNECT message of the NATS protocol.
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	Protocol  int    `json:"protocol"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// publishNATS publishes a message with the text protocol of NATS, over a
+// connection of its own since registrations are rare. It waits for the
+// server to answer a PING, so that errors such as a denied subject are
+// reported. With the tls scheme, the connection is upgraded after the INFO
+// of the server. Credentials are taken from the URL: user:pass, or a token
+// as the user alone.
+func publishNATS(ctx context.Context, rawURL, subject string, payload []byte) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("Unexpected greeting from %s: %q", addr, strings.TrimSpace(line))
+	}
+	if u.Scheme == "tls" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+
+	connect := natsConnect{Name: "sshauth", Lang: "go", Version: "1", Protocol: 1}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect.User, connect.Pass = u.User.Username(), pass
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	c, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPUB %s %d\r\n%s\r\nPING\r\n", c, subject, len(payload), payload); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := io.WriteString(conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// kafkaRecords is the body of a produce request to the Kafka REST proxy.
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+type kafkaOffsets struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// publishKafka produces a JSON record through the Kafka REST proxy, keyed by
+// user so that the events of a user stay in order. Credentials in the URL
+// are sent with basic authentication.
+func publishKafka(ctx context.Context, baseURL, topic, key string, value any) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath("topics", topic)
+	header := http.Header{"Content-Type": {"application/vnd.kafka.json.v2+json"}}
+	var res kafkaOffsets
+	if _, err := doJSON(ctx, http.MethodPost, u.String(), header, kafkaRecords{Records: []kafkaRecord{{Key: key, Value: value}}}, &res); err != nil {
+		return err
+	}
+	for _, o := range res.Offsets {
+		if o.ErrorCode != nil {
+			return fmt.Errorf("Kafka error %d: %s", *o.ErrorCode, o.Error)
+		}
+	}
+	return nil
+}
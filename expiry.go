@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the seconds between the Windows epoch, 1601-01-01, and the Unix one
+const fileTimeEpoch = 11644473600
+
+// expiryAttribute is the attribute holding the expiry of the accounts,
+// ACCOUNT_EXPIRE_ATTRIBUTE or the default of the DIRECTORY_TYPE.
+func expiryAttribute() string {
+	switch {
+	case options().AccountExpireAttribute != "":
+		return options().AccountExpireAttribute
+	case options().DirectoryType == "ad":
+		return "accountExpires"
+	}
+	return "shadowExpire"
+}
+
+// expiryFormat is ACCOUNT_EXPIRE_FORMAT, or the format of the well known
+// expiry attributes, and generalized time for the others.
+func expiryFormat() string {
+	if options().AccountExpireFormat != "" {
+		return options().AccountExpireFormat
+	}
+	switch strings.ToLower(expiryAttribute()) {
+	case "shadowexpire":
+		return "days"
+	case "accountexpires":
+		return "filetime"
+	}
+	return "generalized"
+}
+
+// validateExpiry checks the ACCOUNT_EXPIRE_* options.
+func validateExpiry() error {
+	if options().AccountExpire < 0 {
+		return fmt.Errorf("ACCOUNT_EXPIRE must not be negative")
+	}
+	switch expiryFormat() {
+	case "days", "filetime", "generalized", "unix":
+		return nil
+	default:
+		return fmt.Errorf("Unknown ACCOUNT_EXPIRE_FORMAT %q, expected one of days, filetime, generalized or unix", options().AccountExpireFormat)
+	}
+}
+
+// expiryValue formats the expiry of an account for expiryAttribute: days
+// since the Unix epoch for shadowExpire, 100ns intervals since 1601 for
+// the accountExpires of Active Directory, or seconds since the Unix epoch.
+func expiryValue(t time.Time) string {
+	switch expiryFormat() {
+	case "days":
+		return fmt.Sprint(t.Unix() / 86400)
+	case "filetime":
+		return fmt.Sprint((t.Unix() + fileTimeEpoch) * 10000000)
+	case "unix":
+		return fmt.Sprint(t.Unix())
+	}
+	return t.UTC().Format("20060102150405Z")
+}
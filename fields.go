@@ -0,0 +1,68 @@
+package main
+
+import "fmt"
+
+// profileField is a preset for the flow prompts collecting a profile field,
+// chosen with the field key of a prompt step. Its prompt, variable, pattern
+// and attribute apply unless the step sets them:
+//
+//	steps:
+//	  - action: verify
+//	  - field: first_name
+//	  - field: phone
+//	    optional: true
+//	    attribute: mobile
+//	  - action: password
+//	  - action: register
+type profileField struct {
+	prompt    string
+	pattern   string
+	attribute string
+}
+
+// profileFields are the presets, with the attributes of inetOrgPerson.
+var profileFields = map[string]profileField{
+	"display_name": {"Your display name: ", `^[^\x00-\x1f\x7f]{1,64}$`, "displayName"},
+	"first_name":   {"Your first name: ", `^\p{L}[\p{L}\p{M}' .-]{0,63}$`, "givenName"},
+	"last_name":    {"Your last name: ", `^\p{L}[\p{L}\p{M}' .-]{0,63}$`, "sn"},
+	"phone":        {"Your phone number: ", `^\+?[0-9][0-9 ()./-]{4,24}$`, "telephoneNumber"},
+}
+
+// applyField fills in the prompt step st from the preset of its field.
+func applyField(st *flowStep) error {
+	if st.Field == "" {
+		return nil
+	}
+	f, ok := profileFields[st.Field]
+	if !ok {
+		return fmt.Errorf("unknown field %q, expected one of display_name, first_name, last_name or phone", st.Field)
+	}
+	if st.Message != "" || st.Action != "" {
+		return fmt.Errorf("fields can only be prompted for")
+	}
+	if st.Prompt == "" {
+		st.Prompt = f.prompt
+	}
+	if st.Var == "" {
+		st.Var = st.Field
+	}
+	if st.Pattern == "" {
+		st.Pattern = f.pattern
+	}
+	if st.Attribute == "" {
+		st.Attribute = f.attribute
+	}
+	return nil
+}
+
+// fieldAttributes returns the directory attributes set from the answers to
+// the prompts of the flow.
+func (s *session) fieldAttributes() map[string]string {
+	attrs := map[string]string{}
+	for _, st := range s.steps() {
+		if v := s.vars[st.Var]; st.Attribute != "" && v != "" {
+			attrs[st.Attribute] = v
+		}
+	}
+	return attrs
+}
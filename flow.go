@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// flowStep is a single step of the registration flow. Exactly one of
+// Message, Prompt and Action is set, or Field, a prompt for a profile field
+// preset in fields.go. When is a template which must render to "true" for
+// the step to run. The verify_phone action, see phone.go, stores the number
+// in Var, phone by default, and in Attribute, if set.
+//
+// A flow file looks like:
+//
+//	steps:
+//	  - message: "Welcome {{.User}}!"
+//	  - prompt: "Your department: "
+//	    var: department
+//	    pattern: "^[a-z]+$"
+//	  - action: verify
+//	  - action: password
+//	  - message: "Welcome to {{.Vars.department}}"
+//	    when: '{{ne .Vars.department ""}}'
+//	  - prompt: "Your office phone, if any: "
+//	    var: phone
+//	    pattern: "^[0-9 +]+$"
+//	    optional: true
+//	    attribute: telephoneNumber
+//	  - action: register
+type flowStep struct {
+	Message string `yaml:"message"`
+	Prompt  string `yaml:"prompt"`
+	Action  string `yaml:"action"`
+	When    string `yaml:"when"`
+
+	// for prompts, the variable holding the answer and the pattern it must
+	// match, with the number of attempts
+	Var     string `yaml:"var"`
+	Pattern string `yaml:"pattern"`
+	Retries int    `yaml:"retries"`
+	// Optional accepts an empty answer, and Attribute is the directory
+	// attribute the answer is stored in
+	Optional  bool   `yaml:"optional"`
+	Attribute string `yaml:"attribute"`
+	Field     string `yaml:"field"`
+
+	message *template.Template
+	prompt  *template.Template
+	when    *template.Template
+	pattern *regexp.Regexp
+}
+
+type flowFile struct {
+	Steps []*flowStep `yaml:"steps"`
+}
+
+// flowData is the data available to the flow templates.
+type flowData struct {
+	User string
+	Mail string
+	IP   string
+	Vars map[string]string
+}
+
+// the maximum length of an answer to a prompt
+const maxPromptAnswer = 256
+
+// defaultFlow is the flow used when no FLOW_FILE is given.
+const defaultFlow = `steps:
+  - action: verify
+  - message: "You're not registered. Proceeding with the registration process\n"
+  - action: password
+  - action: register
+`
+
+// defaultPhoneFlow is the default flow with VERIFY_PHONE.
+const defaultPhoneFlow = `steps:
+  - action: verify
+  - action: verify_phone
+  - message: "You're not registered. Proceeding with the registration process\n"
+  - action: password
+  - action: register
+`
+
+var flow reloadable[[]*flowStep]
+
+// loadFlow reads and validates FLOW_FILE, or the default flow.
+func loadFlow() error {
+	data := []byte(defaultFlow)
+	if options().VerifyPhone {
+		data = []byte(defaultPhoneFlow)
+	}
+	if options().FlowFile != "" {
+		var err error
+		if data, err = os.ReadFile(options().FlowFile); err != nil {
+			return fmt.Errorf("Could not read FLOW_FILE: %v", err)
+		}
+	}
+	steps, err := parseFlow(data, "FLOW_FILE")
+	if err != nil {
+		return err
+	}
+	flow.set(steps)
+	return nil
+}
+
+// parseFlow parses and validates a flow file, named name in the errors.
+func parseFlow(data []byte, name string) ([]*flowStep, error) {
+	var f flowFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %v", name, err)
+	}
+
+	seen := map[string]bool{}
+	attributes := false
+	for i, st := range f.Steps {
+		if err := applyField(st); err != nil {
+			return nil, fmt.Errorf("Flow step %d: %v", i+1, err)
+		}
+		n := 0
+		for _, s := range []string{st.Message, st.Prompt, st.Action} {
+			if s != "" {
+				n++
+			}
+		}
+		if n != 1 {
+			return nil, fmt.Errorf("Flow step %d must have exactly one of message, prompt or action", i+1)
+		}
+		var err error
+		if st.when, err = parseFlowTemplate(st.When); err != nil {
+			return nil, fmt.Errorf("Flow step %d: %v", i+1, err)
+		}
+		if st.message, err = parseFlowTemplate(st.Message); err != nil {
+			return nil, fmt.Errorf("Flow step %d: %v", i+1, err)
+		}
+		if st.prompt, err = parseFlowTemplate(st.Prompt); err != nil {
+			return nil, fmt.Errorf("Flow step %d: %v", i+1, err)
+		}
+		if st.Prompt != "" {
+			if st.Var == "" {
+				return nil, fmt.Errorf("Flow step %d: prompts need a var", i+1)
+			}
+			if st.pattern, err = regexp.Compile(st.Pattern); err != nil {
+				return nil, fmt.Errorf("Flow step %d: invalid pattern: %v", i+1, err)
+			}
+			if st.Retries <= 0 {
+				st.Retries = 3
+			}
+		}
+		if st.Action == "verify_phone" && st.Var == "" {
+			st.Var = "phone"
+		}
+		if st.Attribute != "" {
+			if st.Prompt == "" && st.Action != "verify_phone" {
+				return nil, fmt.Errorf("Flow step %d: only prompts and verify_phone can set an attribute", i+1)
+			}
+			attributes = true
+		}
+
+		switch st.Action {
+		case "":
+		case "verify", "password", "verify_phone":
+			if st.When != "" {
+				return nil, fmt.Errorf("Flow step %d: the %s action can't be conditional", i+1, st.Action)
+			}
+		case "register":
+			// never let anyone in without proving their address
+			if !seen["verify"] || !seen["password"] {
+				return nil, fmt.Errorf("Flow step %d: register must come after the verify and password actions", i+1)
+			}
+			if options().VerifyPhone && !seen["verify_phone"] {
+				return nil, fmt.Errorf("Flow step %d: with VERIFY_PHONE, register must come after the verify_phone action", i+1)
+			}
+			if st.When != "" {
+				return nil, fmt.Errorf("Flow step %d: the register action can't be conditional", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("Flow step %d: unknown action %q, expected one of verify, verify_phone, password or register", i+1, st.Action)
+		}
+		seen[st.Action] = true
+	}
+	if !seen["register"] {
+		return nil, fmt.Errorf("The flow must contain a register action")
+	}
+	if attributes && !contains([]string{"ldap", "keycloak", "authentik", "memory"}, options().DirectoryBackend) {
+		return nil, fmt.Errorf("Setting attributes from the flow is not supported by the %s directory backend", options().DirectoryBackend)
+	}
+	return f.Steps, nil
+}
+
+func parseFlowTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("flow").Option("missingkey=zero").Parse(text)
+}
+
+func (s *session) render(t *template.Template) (string, error) {
+	var b strings.Builder
+	err := t.Execute(&b, flowData{User: s.user, Mail: s.mail, IP: s.ip, Vars: s.vars})
+	return b.String(), err
+}
+
+// runFlow runs the steps of the flow in order, stopping at the first one
+// which ends the session.
+func (s *session) runFlow() {
+	for _, st := range s.steps() {
+		if st.when != nil {
+			cond, err := s.render(st.when)
+			if err != nil {
+				s.internalError("Could not evaluate a flow condition", err)
+				return
+			}
+			if strings.TrimSpace(cond) != "true" {
+				continue
+			}
+		}
+		if !s.runStep(st) {
+			return
+		}
+	}
+}
+
+func (s *session) runStep(st *flowStep) bool {
+	switch {
+	case st.message != nil:
+		msg, err := s.render(st.message)
+		if err != nil {
+			s.internalError("Could not render a flow message", err)
+			return false
+		}
+		io.WriteString(s, msg)
+		return true
+	case st.prompt != nil:
+		return s.ask(st)
+	}
+
+	switch st.Action {
+	case "verify":
+		return s.verify()
+	case "verify_phone":
+		return s.verifyPhone(st)
+	case "password":
+		passwd, ok := s.readNewPassword()
+		s.password = passwd
+		return ok
+	case "register":
+		s.register()
+	}
+	return false
+}
+
+// ask prompts for a variable until the answer matches the step's pattern.
+func (s *session) ask(st *flowStep) bool {
+	prompt, err := s.render(st.prompt)
+	if err != nil {
+		s.internalError("Could not render a flow prompt", err)
+		return false
+	}
+	for i := 0; i < st.Retries; i++ {
+		s.say(stylePrompt, prompt)
+		buf, err := readN(s, maxPromptAnswer, nil, true)
+		if err != nil {
+			s.bye()
+			return false
+		}
+		answer := strings.TrimSpace(string(buf))
+		if answer == "" && st.Optional || st.pattern.MatchString(answer) {
+			s.vars[st.Var] = answer
+			return true
+		}
+		io.WriteString(s, s.text(INVALID_ANSWER))
+	}
+	s.bye()
+	return false
+}
+
+// verify mails a token, or resumes the verification started by a previous
+// connection, and checks it.
+func (s *session) verify() bool {
+	if ipTrusted(s.ip) {
+		return s.trust()
+	}
+	pending, ok, err := tokens.Get(s.ctx, s.user)
+	if err != nil {
+		s.internalError("Could not look up the pending token", err)
+		return false
+	}
+	if ok && (s.fixedMail() == "" || pending.Mail == s.fixedMail()) {
+		// resume the flow started by a previous connection
+		s.mail = pending.Mail
+		s.expiresAt = pending.ExpiresAt
+		io.WriteString(s, s.text(TOKEN_PENDING))
+	} else if !s.sendToken() {
+		return false
+	}
+	return s.verifyToken()
+}
+
+// trust takes the address of a user connecting from TRUSTED_CIDRS without
+// mailing them a token.
+func (s *session) trust() bool {
+	io.WriteString(s, s.text(TRUSTED_NETWORK))
+	if s.mail = s.fixedMail(); s.mail == "" {
+		mail, ok := s.askMail(MAIL_PROMPT)
+		if !ok {
+			return false
+		}
+		s.mail = mail
+	}
+	logInfo("Skipping the verification of %s <%s> from the trusted address %s", s.user, s.mail, s.ip)
+	s.trusted = true
+	audits.publish(auditEvent{Type: auditVerified, User: s.user, Mail: s.mail, IP: s.ip, Detail: "trusted network"})
+	return true
+}
+
+func (s *session) register() {
+	err := s.progress(s.text(PROGRESS_REGISTER), s.createAccount)
+	if errors.Is(err, errQuotaExceeded) {
+		s.say(styleError, s.text(QUOTA_EXCEEDED))
+		return
+	}
+	if errors.Is(err, errTokenClaimed) {
+		s.exit = exitTokenFailed
+		s.say(styleError, s.text(TOKEN_REVOKED))
+		return
+	}
+	var taken *mailTakenError
+	if errors.As(err, &taken) {
+		if s.resetMailOwner(taken) {
+			s.say(styleError, s.text(MAIL_TAKEN_RESET))
+		} else {
+			s.say(styleError, s.text(MAIL_TAKEN))
+		}
+		return
+	}
+	if errors.Is(err, errRolledBack) {
+		reportError(err, s.tags())
+		logError("Could not register %s: %v", s.user, err)
+		s.exit = exitBackendError
+		s.say(styleError, s.text(REGISTRATION_ROLLED_BACK))
+		return
+	}
+	if err != nil {
+		s.internalError("Could not register the user", err)
+		return
+	}
+	s.exit = exitOK
+	login := options().LldapURI.JoinPath("/login").String()
+	s.say(styleSuccess, s.textData(REGISTRATION_SUCCESS, messageData{URL: login}))
+	s.loginQR(login)
+	s.linkIdentity()
+}
+
+var (
+	errQuotaExceeded = errors.New("registration quota exceeded")
+	errTokenClaimed  = errors.New("the token was claimed by another session")
+	// errRolledBack wraps the errors of the registrations which were undone,
+	// the user being free to start over
+	errRolledBack = errors.New("registration rolled back")
+)
+
+// createAccount adds the verified user to the directory with the chosen
+// password, then records the registration and runs the hooks. The token
+// verified by the session and the slot taken in the registration quota are
+// used up, unless the registration fails without leaving an entry behind,
+// for the user to retry with them.
+func (s *session) createAccount() (err error) {
+	if s.decoy {
+		// the token of a decoy is never mailed, so this can't happen
+		return fmt.Errorf("Refusing to register %s again", s.user)
+	}
+	if options().VerifyPhone && !s.phoneVerified {
+		return errPhoneUnverified
+	}
+	if err := s.checkMailOwner(); err != nil {
+		return err
+	}
+	// whether a failed registration left an entry in the directory
+	left := false
+	if s.verified {
+		t, claimed, cerr := claimPending(s.ctx, tokens, s.user)
+		if cerr != nil {
+			return fmt.Errorf("Could not claim the token: %v", cerr)
+		}
+		if !claimed {
+			countFailure(failTokenRevoked)
+			return errTokenClaimed
+		}
+		defer func() {
+			if err == nil || left {
+				return
+			}
+			// the session may be gone already, put it back regardless
+			if perr := tokens.Put(context.Background(), t); perr != nil {
+				logError("Could not put back the token of %s: %v", s.user, perr)
+			}
+		}()
+	}
+
+	slot, ok, err := quotas.consume(s.ctx)
+	if err != nil {
+		return fmt.Errorf("Could not update the registration quota: %v", err)
+	}
+	if !ok {
+		countFailure(failQuotaExceeded)
+		logWarn("Refusing to register %s: registration quota exceeded", s.user)
+		return errQuotaExceeded
+	}
+	defer func() {
+		// only the accounts in the directory count against the quota
+		if err != nil && !left {
+			quotas.refund(context.Background(), slot)
+		}
+	}()
+	if s.stub {
+		logInfo("Completing the stub account of %s <%s>", s.user, s.mail)
+		if err := s.dir.(stubDirectory).Complete(s.ctx, s.user, s.mail, s.password); err != nil {
+			countFailure(failDirectoryError)
+			return err
+		}
+	} else {
+		logInfo("Registering %s <%s>", s.user, s.mail)
+		if err := s.dir.Register(s.ctx, s.user, s.mail, s.password); err != nil {
+			countFailure(failDirectoryError)
+			if errors.As(err, new(partialRegistration)) {
+				err = s.rollback(err)
+				left = !errors.Is(err, errRolledBack)
+				return err
+			}
+			if errors.As(err, new(refusedRegistration)) {
+				return err
+			}
+			left = markIncomplete(s.dir, s.user)
+			return err
+		}
+	}
+	if d := s.defaults(); !d.empty() {
+		logInfo("Giving %s the groups %v, the attributes %v and the expiry %s", s.user, d.Groups, d.Attributes, d.Expire)
+		if err := s.dir.(defaultsDirectory).ApplyDefaults(s.ctx, s.user, d); err != nil {
+			countFailure(failDirectoryError)
+			if s.stub {
+				return err
+			}
+			err = s.rollback(err)
+			left = !errors.Is(err, errRolledBack)
+			return err
+		}
+	}
+	if v, ok := s.dir.(registrationVerifier); ok && options().DirectoryVerify {
+		if err := v.Verify(s.ctx, s.user, s.mail, s.password); err != nil {
+			countFailure(failDirectoryError)
+			err = fmt.Errorf("The registration of %s could not be verified: %v", s.user, err)
+			if s.stub {
+				return err
+			}
+			err = s.rollback(err)
+			left = !errors.Is(err, errRolledBack)
+			return err
+		}
+	}
+	r := registration{User: s.user, Mail: s.mail, IP: s.ip, Time: clockNow(), Trusted: s.trusted, Web: s.web}
+	if !s.web {
+		r.Conn = connectionMeta(s.Context())
+	}
+	registrations.add(r)
+	audits.publish(auditEvent{Type: auditRegistered, User: s.user, Mail: s.mail, IP: s.ip})
+	runHooks(flowData{User: s.user, Mail: s.mail, IP: s.ip, Vars: s.vars})
+	sendWelcome(s.user, s.mail)
+	if sensitiveUsername(s.user) {
+		s.raiseAlert(securityAlert{Event: "sensitive registration", User: s.user, Mail: s.mail, IP: s.ip, Detail: "a sensitive username was registered"})
+	}
+	return nil
+}
+
+// rollback undoes a registration which failed once the user was added to
+// the directory, wrapping err with errRolledBack when the user can start
+// over.
+func (s *session) rollback(err error) error {
+	if rollbackRegistration(s.dir, s.user) {
+		return fmt.Errorf("%w: %w", errRolledBack, err)
+	}
+	return err
+}
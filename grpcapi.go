@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lucat1/sshauth/managementpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The management API is the gRPC service sshauth.Management, defined in
+// proto/sshauth/management.proto, for the tools driving the registrations.
+// Every call must carry "authorization: Bearer $ADMIN_TOKEN" in its
+// metadata. It is served with TLS from GRPC_TLS_CERT and GRPC_TLS_KEY, or
+// in clear on the loopback interface only.
+
+// inviteRequest mails a token to a user who isn't registered yet, for them
+// to enter when they connect, as InviteRequest of the management API. Mail is required with MAIL_MODE=prompt, unless
+// the user is a stub with an address on file, and derived from the username
+// otherwise. TTLSeconds defaults to TOKEN_TTL. With NoToken, the mail only
+// tells how to register, the user getting a token on connecting.
+type inviteRequest struct {
+	User       string `json:"user"`
+	Mail       string `json:"mail"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	NoToken    bool   `json:"no_token"`
+}
+
+// inviteReply tells where the invite went. ExpiresAt is zero with NoToken.
+type inviteReply struct {
+	User      string    `json:"user"`
+	Mail      string    `json:"mail"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// jsonCodec keeps working the clients of the first releases, which sent
+// the messages JSON encoded, with the content type application/grpc+json.
+type jsonCodec struct{}
+
+var jsonMarshal = protojson.MarshalOptions{UseProtoNames: true}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return jsonMarshal.Marshal(v.(proto.Message)) }
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, v.(proto.Message))
+}
+func (jsonCodec) Name() string { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// grpcAPI implements the management API.
+type grpcAPI struct {
+	managementpb.UnimplementedManagementServer
+	token string
+}
+
+func (g *grpcAPI) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		auth, ok := strings.CutPrefix(v, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(auth), []byte(g.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+func (g *grpcAPI) unaryAuth(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := g.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *grpcAPI) streamAuth(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (g *grpcAPI) Invite(ctx context.Context, req *managementpb.InviteRequest) (*managementpb.InviteReply, error) {
+	rep, err := invite(ctx, &inviteRequest{User: req.User, Mail: req.Mail, TTLSeconds: req.TtlSeconds, NoToken: req.NoToken})
+	if err != nil {
+		return nil, err
+	}
+	logInfo("Invited %s <%s> through the management API", rep.User, rep.Mail)
+	return &managementpb.InviteReply{User: rep.User, Mail: rep.Mail, ExpiresAt: timestamp(rep.ExpiresAt)}, nil
+}
+
+// invite mails an invite, as requested through the management API or the
+// invite command, returning errors with a gRPC status.
+func invite(ctx context.Context, req *inviteRequest) (*inviteReply, error) {
+	user, err := normalizeUsername(req.User)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ttl := options().TokenTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	registered, stub, stubMail, err := userAccount(ctx, user)
+	if err != nil {
+		logError("Could not search the directory for %s: %v", user, err)
+		return nil, status.Error(codes.Unavailable, "could not search the directory")
+	}
+	if registered {
+		return nil, status.Errorf(codes.AlreadyExists, "%s is already registered", user)
+	}
+	if options().RegistrationMode == "complete" && !stub {
+		return nil, status.Errorf(codes.FailedPrecondition, "there is no stub account of %s to complete", user)
+	}
+
+	// the token goes where the session would send it
+	mail := stubMail
+	switch {
+	case mail != "":
+		if req.Mail != "" && !strings.EqualFold(req.Mail, mail) {
+			return nil, status.Errorf(codes.InvalidArgument, "the mail must be the one on file, %s", mail)
+		}
+	case options().MailMode == "prompt":
+		if req.Mail == "" {
+			return nil, status.Error(codes.InvalidArgument, "mail is required with MAIL_MODE=prompt")
+		}
+		if mail, err = parseMail(req.Mail); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid mail: %v", err)
+		}
+	default:
+		mail = user + options().ToSuffix
+		if req.Mail != "" && !strings.EqualFold(req.Mail, mail) {
+			return nil, status.Errorf(codes.InvalidArgument, "with MAIL_MODE=%s the mail must be %s", options().MailMode, mail)
+		}
+	}
+
+	var t pendingToken
+	if !req.NoToken {
+		t = pendingToken{User: user, Mail: mail, ExpiresAt: clockNow().Add(ttl)}
+		t.Token = issueToken(user, mail, t.ExpiresAt)
+		if err := tokens.Put(ctx, t); err != nil {
+			logError("Could not store the invite token for %s: %v", user, err)
+			return nil, status.Error(codes.Internal, "could not store the token")
+		}
+	}
+	body := renderText(INVITE_BODY, messageData{User: user, Mail: mail, Token: t.Token, Command: sshCommand(user)})
+	if err := deliver(ctx, mail, options().Subject, body); err != nil {
+		if !req.NoToken {
+			tokens.Remove(context.Background(), user)
+		}
+		logError("Could not mail the invite for %s to %s: %v", user, mail, err)
+		return nil, status.Error(codes.Unavailable, "could not send mail")
+	}
+	audits.publish(auditEvent{Type: auditInvited, User: user, Mail: mail})
+	return &inviteReply{User: user, Mail: mail, ExpiresAt: t.ExpiresAt}, nil
+}
+
+func (g *grpcAPI) Status(ctx context.Context, req *managementpb.StatusRequest) (*managementpb.StatusReply, error) {
+	user, err := normalizeUsername(req.User)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	reply := &managementpb.StatusReply{User: user}
+	if reply.Registered, reply.Stub, _, err = userAccount(ctx, user); err != nil {
+		logError("Could not search the directory for %s: %v", user, err)
+		return nil, status.Error(codes.Unavailable, "could not search the directory")
+	}
+	t, ok, err := tokens.Get(ctx, user)
+	if err != nil {
+		logError("Could not look up the pending token for %s: %v", user, err)
+		return nil, status.Error(codes.Internal, "could not look up the token")
+	}
+	if ok {
+		// never expose the token itself
+		reply.Pending = &managementpb.PendingToken{
+			User: t.User, Mail: t.Mail, Ip: t.IP, ExpiresAt: timestamp(t.ExpiresAt),
+			Attempts: int32(t.Attempts), Confirmed: t.Confirmed, Key: t.Key,
+		}
+	}
+	until, locked, err := tokens.LockedUntil(ctx, user)
+	if err != nil {
+		logError("Could not look up the lockout of %s: %v", user, err)
+		return nil, status.Error(codes.Internal, "could not look up the lockout")
+	}
+	if locked {
+		reply.LockedUntil = timestamp(until)
+	}
+	for _, r := range registrations.list() {
+		if r.User == user {
+			reply.Registration = &managementpb.Registration{
+				User: r.User, Mail: r.Mail, Ip: r.IP, Time: timestamp(r.Time),
+				Trusted: r.Trusted, Web: r.Web, Disabled: r.Disabled,
+				Connection: &managementpb.Connection{
+					ClientVersion: r.Conn.ClientVersion, Kex: r.Conn.Kex, Cipher: r.Conn.Cipher, Mac: r.Conn.MAC,
+					Connected: timestamp(r.Conn.Connected),
+				},
+			}
+			break
+		}
+	}
+	return reply, nil
+}
+
+func (g *grpcAPI) Revoke(ctx context.Context, req *managementpb.RevokeRequest) (*managementpb.RevokeReply, error) {
+	ok, err := tokens.Remove(ctx, req.User)
+	if err != nil {
+		logError("Could not revoke the pending token for %s: %v", req.User, err)
+		return nil, status.Error(codes.Internal, "could not revoke the token")
+	}
+	if ok {
+		logInfo("Revoked the pending token for %s through the management API", req.User)
+		audits.publish(auditEvent{Type: auditRevoked, User: req.User, Detail: "revoked through the management API"})
+	}
+	return &managementpb.RevokeReply{Revoked: ok}, nil
+}
+
+// Events streams the audit events until the client goes away.
+func (g *grpcAPI) Events(req *managementpb.EventsRequest, stream managementpb.Management_EventsServer) error {
+	events := audits.subscribe(auditBuffer)
+	defer audits.unsubscribe(events)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-events:
+			if len(req.Types) > 0 && !contains(req.Types, e.Type) {
+				continue
+			}
+			err := stream.Send(&managementpb.AuditEvent{Type: e.Type, User: e.User, Mail: e.Mail, Ip: e.IP, Detail: e.Detail, Time: timestamp(e.Time)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// timestamp converts t for the management API, leaving the zero time unset.
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// userAccount looks user up in the directory with lookupAccount.
+func userAccount(ctx context.Context, user string) (registered, stub bool, mail string, err error) {
+	dir, err := openDirectory(ctx)
+	if err != nil {
+		return false, false, "", err
+	}
+	defer dir.Close()
+	return lookupAccount(ctx, dir, user)
+}
+
+// validateGRPC checks the GRPC_* options: without TLS, the management API
+// may only listen on the loopback interface, the ADMIN_TOKEN travelling in
+// clear otherwise.
+func validateGRPC() error {
+	if options().GRPCListen == "" {
+		return nil
+	}
+	if (options().GRPCTLSCert == "") != (options().GRPCTLSKey == "") {
+		return fmt.Errorf("GRPC_TLS_CERT and GRPC_TLS_KEY must be set together")
+	}
+	if options().GRPCTLSCert != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(options().GRPCListen)
+	if err != nil {
+		return fmt.Errorf("Invalid GRPC_LISTEN %q: %v", options().GRPCListen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("GRPC_LISTEN %s is not a loopback address, GRPC_TLS_CERT and GRPC_TLS_KEY must be set", options().GRPCListen)
+	}
+	return nil
+}
+
+// serveGRPC starts the management API on GRPC_LISTEN, if configured.
+func serveGRPC() {
+	if options().GRPCListen == "" {
+		return
+	}
+	if options().AdminToken == "" {
+		log.Fatal("ADMIN_TOKEN must be set to enable the management API")
+	}
+	api := &grpcAPI{token: options().AdminToken}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(api.unaryAuth),
+		grpc.StreamInterceptor(api.streamAuth),
+	}
+	if options().GRPCTLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(options().GRPCTLSCert, options().GRPCTLSKey)
+		if err != nil {
+			log.Fatalf("Could not load GRPC_TLS_CERT and GRPC_TLS_KEY: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	ln, err := net.Listen("tcp", options().GRPCListen)
+	if err != nil {
+		log.Fatalf("Could not listen on GRPC_LISTEN: %v", err)
+	}
+	server := grpc.NewServer(opts...)
+	managementpb.RegisterManagementServer(server, api)
+	logInfo("Management API listening on %s", options().GRPCListen)
+	go func() {
+		log.Fatal(server.Serve(ln))
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// errInputLimit ends the sessions sending more than SESSION_MAX_INPUT bytes.
+var errInputLimit = errors.New("the session sent too much input")
+
+// limitedInput is the input of a session, failing once more than left bytes
+// are read. Every prompt reads through it, so a client pasting or streaming
+// without end can't grow the buffers of its session, such as the line of a
+// JSON mode answer, past the limit.
+type limitedInput struct {
+	r    io.Reader
+	ip   string
+	left int64
+}
+
+func (l *limitedInput) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		if l.left == 0 {
+			logWarn("Ending the session from %s: over SESSION_MAX_INPUT bytes of input", l.ip)
+			l.left--
+		}
+		return 0, errInputLimit
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// sessionInput wraps the input of a session from ip with the
+// SESSION_MAX_INPUT limit, if any.
+func sessionInput(r io.Reader, ip string) io.Reader {
+	if options().SessionMaxInput <= 0 {
+		return r
+	}
+	return &limitedInput{r: r, ip: ip, left: options().SessionMaxInput}
+}
+
+// tooManyGoroutines reports whether the process runs more goroutines than
+// MAX_GOROUTINES, in which case the new connections are refused until some
+// of the sessions end, rather than letting a flood of them exhaust the
+// memory.
+func tooManyGoroutines() bool {
+	return options().MaxGoroutines > 0 && runtime.NumGoroutine() >= options().MaxGoroutines
+}
+
+// servePprof serves the profiles of net/http/pprof under /debug/pprof/ on
+// the admin listener, with ADMIN_PPROF. It reports whether r was one of
+// them.
+func servePprof(w http.ResponseWriter, r *http.Request) bool {
+	if !options().AdminPprof || !strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+		return false
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+	return true
+}
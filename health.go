@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const healthcheckTimeout = 5 * time.Second
+
+// healthcheckAddr returns the address of the local instance to probe, mapping
+// wildcard listen addresses to the loopback interface.
+func healthcheckAddr() string {
+	addr := net.JoinHostPort(options().Host, strconv.Itoa(options().Port))
+	if len(options().Listen) > 0 {
+		addr = options().Listen[0]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// healthcheck dials the SSH port and expects an SSH identification string,
+// so that it can be used as a container healthcheck without extra tools.
+func healthcheck() error {
+	addr := healthcheckAddr()
+	conn, err := net.DialTimeout("tcp", addr, healthcheckTimeout)
+	if err != nil {
+		return fmt.Errorf("Could not connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(healthcheckTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Could not read the SSH banner from %s: %v", addr, err)
+	}
+	if !strings.HasPrefix(banner, "SSH-2.0-") {
+		return fmt.Errorf("Unexpected banner from %s: %q", addr, strings.TrimSpace(banner))
+	}
+	return nil
+}
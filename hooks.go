@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// hook is an action run after every successful registration: either a
+// command, whose arguments are templates, or an HTTP request, whose URL,
+// headers and body are templates. The templates see the same data as the
+// flow ones: .User, .Mail, .IP and .Vars.
+type hook struct {
+	Name    string            `yaml:"name"`
+	Exec    []string          `yaml:"exec"`
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Retries int               `yaml:"retries"`
+	// OnFailure is one of ignore (the default), which only logs the error,
+	// alert, which also raises a security alert, or abort, which skips the
+	// remaining hooks as well.
+	OnFailure string `yaml:"on_failure"`
+
+	exec    []*template.Template
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+type hooksFile struct {
+	Hooks []*hook `yaml:"hooks"`
+}
+
+const defaultHookTimeout = 30 * time.Second
+
+var hooks reloadable[[]*hook]
+
+var hookFuncs = template.FuncMap{
+	// json encodes a value, quotes included, for use in JSON bodies
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseHookTemplate(text string) (*template.Template, error) {
+	return template.New("hook").Funcs(hookFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// loadHooks reads and validates HOOKS_FILE.
+func loadHooks() error {
+	hooks.set(nil)
+	if options().HooksFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(options().HooksFile)
+	if err != nil {
+		return fmt.Errorf("Could not read HOOKS_FILE: %v", err)
+	}
+	var f hooksFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("Could not parse HOOKS_FILE: %v", err)
+	}
+	for i, h := range f.Hooks {
+		if h.Name == "" {
+			h.Name = fmt.Sprintf("hook %d", i+1)
+		}
+		if (len(h.Exec) > 0) == (h.URL != "") {
+			return fmt.Errorf("Hook %s must have exactly one of exec or url", h.Name)
+		}
+		switch h.OnFailure {
+		case "":
+			h.OnFailure = "ignore"
+		case "ignore", "alert", "abort":
+		default:
+			return fmt.Errorf("Hook %s: unknown on_failure %q, expected one of ignore, alert or abort", h.Name, h.OnFailure)
+		}
+		if h.Timeout <= 0 {
+			h.Timeout = defaultHookTimeout
+		}
+		if h.Method == "" {
+			h.Method = http.MethodPost
+		}
+
+		for _, arg := range h.Exec {
+			t, err := parseHookTemplate(arg)
+			if err != nil {
+				return fmt.Errorf("Hook %s: %v", h.Name, err)
+			}
+			h.exec = append(h.exec, t)
+		}
+		if h.URL != "" {
+			if h.url, err = parseHookTemplate(h.URL); err != nil {
+				return fmt.Errorf("Hook %s: %v", h.Name, err)
+			}
+			if h.body, err = parseHookTemplate(h.Body); err != nil {
+				return fmt.Errorf("Hook %s: %v", h.Name, err)
+			}
+			h.headers = map[string]*template.Template{}
+			for k, v := range h.Headers {
+				if h.headers[k], err = parseHookTemplate(v); err != nil {
+					return fmt.Errorf("Hook %s: %v", h.Name, err)
+				}
+			}
+		}
+	}
+	hooks.set(f.Hooks)
+	return nil
+}
+
+func renderHook(t *template.Template, data flowData) (string, error) {
+	var b strings.Builder
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
+
+// run runs the hook once, within its timeout.
+func (h *hook) run(data flowData) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	if len(h.exec) > 0 {
+		args := make([]string, len(h.exec))
+		for i, t := range h.exec {
+			var err error
+			if args[i], err = renderHook(t, data); err != nil {
+				return err
+			}
+		}
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	url, err := renderHook(h.url, data)
+	if err != nil {
+		return err
+	}
+	body, err := renderHook(h.body, data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, h.Method, url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return err
+	}
+	for k, t := range h.headers {
+		v, err := renderHook(t, data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(k, v)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s replied %d: %s", h.Method, url, res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// runHooks runs the post-registration hooks in order, in the background so
+// that the user doesn't wait for them.
+func runHooks(data flowData) {
+	if len(hooks.get()) == 0 {
+		return
+	}
+	hs := hooks.get()
+	go func() {
+		for _, h := range hs {
+			var err error
+			for i := 0; i <= h.Retries; i++ {
+				if err = h.run(data); err == nil {
+					break
+				}
+			}
+			if err == nil {
+				continue
+			}
+			logError("Could not run the %s hook for %s: %v", h.Name, data.User, err)
+			switch h.OnFailure {
+			case "alert":
+				raiseAlert(securityAlert{Event: "hook failed", User: data.User, Mail: data.Mail, IP: data.IP, Detail: fmt.Sprintf("the %s hook failed: %v", h.Name, err)})
+			case "abort":
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// hostKeys reads the private keys of SSH_HOST_KEYS, so that the server keeps
+// its identity across restarts. Without them, a new key is generated every
+// time, and the clients warn the users that the host key changed.
+func hostKeys() ([]gossh.Signer, error) {
+	var keys []gossh.Signer
+	for _, path := range options().SSHHostKeys {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the host key %s: %v", path, err)
+		}
+		key, err := gossh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse the host key %s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// httpClient is shared by all the HTTP based integrations. Requests are
+// bounded by HTTP_TIMEOUT through their context.
+var httpClient = &http.Client{Transport: httpTransport}
+
+// httpStatusError is returned by doJSON for non 2xx replies.
+type httpStatusError struct {
+	Method string
+	URL    string
+	Status int
+	Body   string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s %s replied %d: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// conflict reports whether err is a 409 Conflict reply, such as for a user
+// who already exists.
+func conflict(err error) bool {
+	var status *httpStatusError
+	return errors.As(err, &status) && status.Status == http.StatusConflict
+}
+
+// doJSON sends a request with an optional JSON body and decodes the JSON
+// reply into out, if not nil. It returns the response headers, so that
+// callers can inspect Location and the like.
+func doJSON(ctx context.Context, method, url string, header http.Header, body, out any) (http.Header, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return send(req, out)
+}
+
+// send performs req and decodes the JSON reply into out, if not nil, turning
+// non 2xx replies into an httpStatusError.
+func send(req *http.Request, out any) (http.Header, error) {
+	return sendWith(httpClient, req, out)
+}
+
+// sendWith is send through the given client.
+func sendWith(client *http.Client, req *http.Request, out any) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), options().HTTPTimeout)
+	defer cancel()
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return res.Header, &httpStatusError{Method: req.Method, URL: req.URL.String(), Status: res.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return res.Header, fmt.Errorf("Could not decode the reply from %s: %v", req.URL, err)
+		}
+	}
+	return res.Header, nil
+}
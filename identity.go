@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// the attempts at entering an identity the user is given
+const identityRetries = 3
+
+// errIdentityUnknown is returned by the verifiers for the identities which
+// don't exist, or are refused.
+var errIdentityUnknown = errors.New("unknown identity")
+
+// identityVerifier checks an external identity, such as a GitHub username
+// or a student ID, which a new user wants to link to their account,
+// returning it in its canonical form.
+type identityVerifier interface {
+	Verify(ctx context.Context, user, identity string) (string, error)
+}
+
+// the verifiers of LINK_IDENTITY
+var identityVerifiers = map[string]func() identityVerifier{
+	"github":  func() identityVerifier { return githubVerifier{} },
+	"gitlab":  func() identityVerifier { return gitlabVerifier{} },
+	"pattern": func() identityVerifier { return patternVerifier{} },
+	"webhook": func() identityVerifier { return webhookVerifier{} },
+}
+
+var (
+	linkVerifier    reloadable[identityVerifier]
+	identityPattern reloadable[*regexp.Regexp]
+)
+
+// loadIdentityVerifier checks the LINK_IDENTITY_* options.
+func loadIdentityVerifier() error {
+	linkVerifier.set(nil)
+	identityPattern.set(nil)
+	if options().LinkIdentity == "" {
+		return nil
+	}
+	newVerifier, ok := identityVerifiers[options().LinkIdentity]
+	if !ok {
+		return fmt.Errorf("Unknown LINK_IDENTITY %q, expected one of github, gitlab, pattern or webhook", options().LinkIdentity)
+	}
+	if options().LinkIdentityAttribute == "" {
+		return fmt.Errorf("LINK_IDENTITY needs LINK_IDENTITY_ATTRIBUTE")
+	}
+	switch options().LinkIdentity {
+	case "pattern":
+		re, err := regexp.Compile(options().LinkIdentityPattern)
+		if err != nil || options().LinkIdentityPattern == "" {
+			return fmt.Errorf("Invalid LINK_IDENTITY_PATTERN %q: %v", options().LinkIdentityPattern, err)
+		}
+		identityPattern.set(re)
+	case "webhook":
+		if options().LinkIdentityURL == "" {
+			return fmt.Errorf("LINK_IDENTITY=webhook needs LINK_IDENTITY_URL")
+		}
+	}
+	linkVerifier.set(newVerifier())
+	return nil
+}
+
+// githubVerifier accepts the existing GitHub users.
+type githubVerifier struct{}
+
+func (githubVerifier) Verify(ctx context.Context, _, identity string) (string, error) {
+	var u struct {
+		Login string `json:"login"`
+	}
+	_, err := doJSON(ctx, http.MethodGet, "https://api.github.com/users/"+url.PathEscape(identity), nil, nil, &u)
+	var se *httpStatusError
+	if errors.As(err, &se) && se.Status == http.StatusNotFound {
+		return "", errIdentityUnknown
+	}
+	return u.Login, err
+}
+
+// gitlabVerifier accepts the existing users of the GitLab instance at
+// LINK_IDENTITY_URL, gitlab.com by default.
+type gitlabVerifier struct{}
+
+func (gitlabVerifier) Verify(ctx context.Context, _, identity string) (string, error) {
+	base := options().LinkIdentityURL
+	if base == "" {
+		base = "https://gitlab.com"
+	}
+	var users []struct {
+		Username string `json:"username"`
+	}
+	_, err := doJSON(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/api/v4/users?username="+url.QueryEscape(identity), nil, nil, &users)
+	if err != nil {
+		return "", err
+	}
+	if len(users) == 0 {
+		return "", errIdentityUnknown
+	}
+	return users[0].Username, nil
+}
+
+// patternVerifier accepts the identities matching LINK_IDENTITY_PATTERN,
+// such as the student IDs.
+type patternVerifier struct{}
+
+func (patternVerifier) Verify(_ context.Context, _, identity string) (string, error) {
+	if !identityPattern.get().MatchString(identity) {
+		return "", errIdentityUnknown
+	}
+	return identity, nil
+}
+
+// webhookVerifier posts {"user": ..., "identity": ...} to LINK_IDENTITY_URL,
+// which replies with {"valid": true, "identity": ...}, the identity being
+// optional.
+type webhookVerifier struct{}
+
+func (webhookVerifier) Verify(ctx context.Context, user, identity string) (string, error) {
+	req := struct {
+		User     string `json:"user"`
+		Identity string `json:"identity"`
+	}{user, identity}
+	var rep struct {
+		Valid    bool   `json:"valid"`
+		Identity string `json:"identity"`
+	}
+	if _, err := doJSON(ctx, http.MethodPost, options().LinkIdentityURL, nil, req, &rep); err != nil {
+		return "", err
+	}
+	if !rep.Valid {
+		return "", errIdentityUnknown
+	}
+	if rep.Identity == "" {
+		rep.Identity = identity
+	}
+	return rep.Identity, nil
+}
+
+// linkIdentity offers the newly registered user to link the external
+// identity of LINK_IDENTITY, storing it in LINK_IDENTITY_ATTRIBUTE. An empty
+// answer skips it, and a failure is only logged: the account exists already.
+func (s *session) linkIdentity() {
+	if linkVerifier.get() == nil || s.web || s.decoy {
+		return
+	}
+	dir, ok := s.dir.(defaultsDirectory)
+	if !ok {
+		logWarn("Not linking the identity of %s: DIRECTORY_BACKEND can't store attributes", s.user)
+		return
+	}
+	d := messageData{Label: options().LinkIdentityLabel}
+	for i := 0; i < identityRetries; i++ {
+		s.say(stylePrompt, s.textData(IDENTITY_PROMPT, d))
+		buf, err := readN(s, 256, nil, true)
+		if err != nil {
+			return
+		}
+		identity := strings.TrimSpace(string(buf))
+		if identity == "" {
+			return
+		}
+		linked, err := linkVerifier.get().Verify(s.ctx, s.user, identity)
+		if errors.Is(err, errIdentityUnknown) {
+			s.say(styleError, s.textData(IDENTITY_UNKNOWN, d))
+			continue
+		}
+		if err == nil {
+			err = dir.ApplyDefaults(s.ctx, s.user, userDefaults{Attributes: map[string]string{options().LinkIdentityAttribute: linked}})
+		}
+		if err != nil {
+			reportError(err, s.tags())
+			logError("Could not link the identity %q to %s: %v", identity, s.user, err)
+			s.say(styleError, s.textData(IDENTITY_FAILED, d))
+			return
+		}
+		logInfo("Linked the identity %q to %s", linked, s.user)
+		audits.publish(auditEvent{Type: auditIdentityLinked, User: s.user, Mail: s.mail, IP: s.ip, Detail: options().LinkIdentity + ":" + linked})
+		s.say(styleSuccess, s.textData(IDENTITY_LINKED, messageData{Label: d.Label, Identity: linked}))
+		return
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// promptWatch watches a prompt of readN while the user is expected to
+// answer it. It closes the session once the prompt is left idle for
+// PROMPT_TIMEOUT, warning the user PROMPT_TIMEOUT_WARNING before, so that a
+// user who went looking for the token in their inbox gets a chance to come
+// back before the session is gone, and it shows the notices broadcast by the
+// admins.
+//
+// Those are written only while readN waits for input, holding mu the rest of
+// the time, so that they never land in the middle of its output.
+type promptWatch struct {
+	s  *session
+	mu sync.Mutex
+	// whether the prompt was answered, after which nothing is written
+	stopped  bool
+	activity chan struct{}
+	done     chan struct{}
+}
+
+// watchPrompt starts watching a prompt, which readN is reading.
+func (s *session) watchPrompt() *promptWatch {
+	w := &promptWatch{s: s, activity: make(chan struct{}, 1), done: make(chan struct{})}
+	w.mu.Lock()
+	go w.run()
+	return w
+}
+
+// wait is called by readN before waiting for input.
+func (w *promptWatch) wait() {
+	if w != nil {
+		w.mu.Unlock()
+	}
+}
+
+// resume is called by readN once some input is read, restarting the
+// countdown.
+func (w *promptWatch) resume() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	select {
+	case w.activity <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the watch once readN returns.
+func (w *promptWatch) stop() {
+	if w == nil {
+		return
+	}
+	w.stopped = true
+	w.mu.Unlock()
+	close(w.done)
+}
+
+func (w *promptWatch) run() {
+	timeout, notice := options().PromptTimeout, options().PromptTimeoutWarning
+	if notice < 0 || notice >= timeout {
+		notice = 0
+	}
+countdown:
+	for {
+		// a nil channel never fires, without a PROMPT_TIMEOUT
+		var expired <-chan time.Time
+		var t *time.Timer
+		if timeout > 0 {
+			t = time.NewTimer(timeout - notice)
+			expired = t.C
+		}
+		warned := notice == 0
+		for {
+			select {
+			case <-w.done:
+				if t != nil {
+					t.Stop()
+				}
+				return
+			case msg := <-w.s.notices:
+				if !w.show(styleBold, msg) {
+					// left for the next prompt
+					w.s.notify(msg)
+				}
+				continue
+			case <-w.activity:
+				if t != nil {
+					t.Stop()
+				}
+				continue countdown
+			case <-expired:
+			}
+			if !warned {
+				warned = true
+				w.show(styleError, w.s.textData(PROMPT_IDLE_WARNING, messageData{Wait: notice.Round(time.Second)}))
+				t.Reset(notice)
+				continue
+			}
+			logWarn("Closing the session of %s from %s: idle at a prompt for %s", w.s.user, w.s.ip, timeout)
+			w.show(styleError, w.s.text(PROMPT_TIMED_OUT))
+			w.s.Session.Close()
+			return
+		}
+	}
+}
+
+// show writes msg on a line of its own, the cursor being left at the
+// prompt. What was typed so far is kept, the user carrying on from the new
+// line. It reports false when the prompt was answered meanwhile.
+func (w *promptWatch) show(style, msg string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return false
+	}
+	if !w.s.jsonLines {
+		msg = "\n" + msg
+	}
+	w.s.say(style, msg)
+	return true
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInterrupted is returned by readN when the user aborts the current
+// prompt with Ctrl+C.
+var ErrInterrupted = errors.New("Prompt interrupted")
+
+// the parameters of the CSI ~ sequences wrapping a bracketed paste
+const (
+	pasteStart = 200
+	pasteEnd   = 201
+)
+
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlE     = 5
+	keyBackspace = 8
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+func contains[T comparable](elems []T, v T) bool {
+	for _, s := range elems {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lineEditor keeps the state of a single prompt being edited in the terminal.
+// When echo is disabled the buffer is still editable, but nothing is written
+// back to the client. The buffer holds runes, so that multi-byte characters
+// are edited as a whole, while max bounds its length in UTF-8 bytes.
+type lineEditor struct {
+	w      io.Writer
+	buf    []rune
+	size   int
+	pos    int
+	max    int
+	onlyIn []byte
+	echo   bool
+	// in the plain mode the cursor stays at the end of the line, and the
+	// edits other than typing are not echoed
+	plain bool
+
+	// whether a bracketed paste is in progress, and whether its first line
+	// is over, the rest of it being dropped
+	pasting, pasteEnded bool
+	// whether the input didn't fit the field, or was pasted, in which case
+	// the input left over when the line is entered is discarded
+	overflow, pasted bool
+}
+
+func (e *lineEditor) write(p []byte) {
+	if e.echo {
+		e.w.Write(p)
+	}
+}
+
+// moveTo moves the terminal cursor from the current position to pos.
+func (e *lineEditor) moveTo(pos int) {
+	if e.plain {
+		return
+	}
+	for ; e.pos > pos; e.pos-- {
+		e.write([]byte{'\b'})
+	}
+	if e.pos < pos {
+		e.write([]byte(string(e.buf[e.pos:pos])))
+		e.pos = pos
+	}
+}
+
+// redraw rewrites the buffer from the cursor onwards, blanking the given
+// number of trailing cells left over from deleted characters, and then puts
+// the cursor back in place.
+func (e *lineEditor) redraw(blank int) {
+	if e.plain {
+		return
+	}
+	tail := e.buf[e.pos:]
+	e.write([]byte(string(tail)))
+	for i := 0; i < blank; i++ {
+		e.write([]byte{' '})
+	}
+	for i := 0; i < len(tail)+blank; i++ {
+		e.write([]byte{'\b'})
+	}
+}
+
+func (e *lineEditor) insert(r rune) {
+	if !unicode.IsPrint(r) {
+		return
+	}
+	if len(e.onlyIn) > 0 && (r >= utf8.RuneSelf || !contains(e.onlyIn, byte(r))) {
+		return
+	}
+	if e.pasteEnded {
+		return
+	}
+	if e.size+utf8.RuneLen(r) > e.max {
+		e.overflow = true
+		return
+	}
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.size += utf8.RuneLen(r)
+	e.write([]byte(string(r)))
+	e.pos++
+	e.redraw(0)
+}
+
+// decode reads the continuation bytes of the UTF-8 sequence starting with
+// lead, returning utf8.RuneError for invalid sequences.
+func decode(r io.Reader, lead byte) (rune, error) {
+	n := 0
+	switch {
+	case lead&0xe0 == 0xc0:
+		n = 2
+	case lead&0xf0 == 0xe0:
+		n = 3
+	case lead&0xf8 == 0xf0:
+		n = 4
+	default:
+		return utf8.RuneError, nil
+	}
+	p := make([]byte, n)
+	p[0] = lead
+	if _, err := io.ReadFull(r, p[1:]); err != nil {
+		return utf8.RuneError, err
+	}
+	c, _ := utf8.DecodeRune(p)
+	return c, nil
+}
+
+// remove deletes the character at index i, which is either the one under the
+// cursor or the one right before it.
+func (e *lineEditor) remove(i int) {
+	if i < 0 || i >= len(e.buf) {
+		return
+	}
+	if e.plain {
+		// only the last character can be removed
+		if i == len(e.buf)-1 {
+			e.size -= utf8.RuneLen(e.buf[i])
+			e.buf = e.buf[:i]
+			e.pos = i
+		}
+		return
+	}
+	if i < e.pos {
+		e.moveTo(i)
+	}
+	e.size -= utf8.RuneLen(e.buf[i])
+	e.buf = append(e.buf[:i], e.buf[i+1:]...)
+	e.redraw(1)
+}
+
+func (e *lineEditor) clear() {
+	if e.plain {
+		e.buf, e.size, e.pos = e.buf[:0], 0, 0
+		return
+	}
+	n := len(e.buf)
+	e.moveTo(0)
+	e.buf = e.buf[:0]
+	e.size = 0
+	e.redraw(n)
+}
+
+// escape consumes the rest of an ANSI escape sequence (the ESC byte has
+// already been read) and applies the cursor movements we understand.
+func (e *lineEditor) escape(r io.Reader) error {
+	b := make([]byte, 1)
+	if _, err := r.Read(b); err != nil {
+		return err
+	}
+	if b[0] != '[' && b[0] != 'O' {
+		return nil
+	}
+
+	// CSI sequences carry optional numeric parameters before the final byte
+	param := 0
+	for {
+		if _, err := r.Read(b); err != nil {
+			return err
+		}
+		if b[0] >= '0' && b[0] <= '9' {
+			param = param*10 + int(b[0]-'0')
+			continue
+		}
+		if b[0] == ';' {
+			param = 0
+			continue
+		}
+		break
+	}
+
+	switch b[0] {
+	case 'C':
+		if e.pos < len(e.buf) {
+			e.moveTo(e.pos + 1)
+		}
+	case 'D':
+		if e.pos > 0 {
+			e.moveTo(e.pos - 1)
+		}
+	case 'H':
+		e.moveTo(0)
+	case 'F':
+		e.moveTo(len(e.buf))
+	case '~':
+		switch param {
+		case 1, 7:
+			e.moveTo(0)
+		case 4, 8:
+			e.moveTo(len(e.buf))
+		case 3:
+			e.remove(e.pos)
+		case pasteStart:
+			e.pasting, e.pasted = true, true
+		case pasteEnd:
+			e.pasting, e.pasteEnded = false, false
+		}
+	}
+	return nil
+}
+
+// bufferedInput is implemented by the sessions, which keep the input read
+// past the end of a prompt, such as a pasted answer to the next one.
+type bufferedInput interface {
+	input() *bufio.Reader
+}
+
+// terminalInput returns the buffered input of s.
+func terminalInput(s io.Reader) *bufio.Reader {
+	if b, ok := s.(bufferedInput); ok {
+		return b.input()
+	}
+	return bufio.NewReader(s)
+}
+
+// readN reads a line of at most l bytes of UTF-8 text from the terminal,
+// accepting only the bytes in onlyIn (or any printable character, if empty)
+// and echoing the input back when write is set. The usual line editing keys
+// are supported: backspace, delete, the arrow keys, home/end (and
+// Ctrl+A/Ctrl+E), Ctrl+U to clear the line and Ctrl+C to abort the prompt,
+// in which case ErrInterrupted is returned.
+//
+// The input is read in chunks, and the echo of a whole chunk, such as a
+// pasted line, is written at once before waiting for more, so that slow
+// links don't pay a round trip per character. Only the first line of a
+// bracketed paste is taken, and the input left over by a paste, or by input
+// too long for the field, is discarded when the line is entered, instead of
+// leaking into the next prompt. In the JSON mode, the answer is read as a
+// line instead, see jsonPrompt, and in the plain mode only the last
+// character can be erased, without moving the cursor. A prompt left idle
+// for PROMPT_TIMEOUT closes the session, and the notices of the admins are
+// shown while waiting for input, see promptWatch.
+func readN(s io.ReadWriter, l uint, onlyIn []byte, write bool) (res []byte, err error) {
+	ps, _ := s.(*session)
+	var w *promptWatch
+	if ps != nil {
+		w = ps.watchPrompt()
+		defer w.stop()
+	}
+	if ps != nil && ps.jsonLines {
+		w.wait()
+		defer w.resume()
+		return ps.jsonPrompt(l, onlyIn, !write)
+	}
+	in := terminalInput(s)
+	var out bytes.Buffer
+	e := &lineEditor{w: &out, buf: make([]rune, 0, l), max: int(l), onlyIn: onlyIn, echo: write, plain: ps != nil && ps.plain}
+	defer func() {
+		if out.Len() > 0 {
+			s.Write(out.Bytes())
+		}
+	}()
+	for {
+		if in.Buffered() == 0 && out.Len() > 0 {
+			s.Write(out.Bytes())
+			out.Reset()
+		}
+		var b byte
+		w.wait()
+		b, err = in.ReadByte()
+		w.resume()
+		if err != nil {
+			return
+		}
+
+		switch b {
+		case keyBackspace, keyDelete:
+			e.remove(e.pos - 1)
+
+		case keyCtrlA:
+			e.moveTo(0)
+
+		case keyCtrlE:
+			e.moveTo(len(e.buf))
+
+		case keyCtrlU:
+			e.clear()
+
+		case keyCtrlC:
+			out.WriteString("\n")
+			return nil, ErrInterrupted
+
+		case keyEscape:
+			if err = e.escape(in); err != nil {
+				return
+			}
+
+		case '\r', '\n':
+			if e.pasting {
+				// only the first line of a paste is taken, and the user
+				// still has to press Enter
+				e.pasteEnded = true
+				continue
+			}
+			// clients without a PTY send \n, some send \r\n
+			if b == '\r' && in.Buffered() > 0 {
+				if next, _ := in.Peek(1); next[0] == '\n' {
+					in.ReadByte()
+				}
+			}
+			if e.overflow || e.pasted {
+				// don't let the surplus of a paste leak into the next prompt
+				in.Discard(in.Buffered())
+			}
+			out.WriteString("\n")
+			return []byte(string(e.buf)), nil
+
+		default:
+			if b < utf8.RuneSelf {
+				e.insert(rune(b))
+				continue
+			}
+			r, err := decode(in, b)
+			if err != nil {
+				return nil, err
+			}
+			if r != utf8.RuneError {
+				e.insert(r)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+const inviteUsage = "Usage: sshauth invite --csv <file> [--codes] [--ttl <duration>]"
+
+// sshCommand returns the command connecting to SSH_PUBLIC_ADDRESS as user,
+// or nothing when it is not set.
+func sshCommand(user string) string {
+	if options().SSHPublicAddress == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(options().SSHPublicAddress)
+	if err != nil || port == "22" {
+		return "ssh " + user + "@" + strings.TrimSuffix(options().SSHPublicAddress, ":22")
+	}
+	return "ssh -p " + port + " " + user + "@" + host
+}
+
+// inviteCommand mails invites to the users listed in a CSV file, whose
+// header names the user column and, optionally, the mail column, which is
+// required with MAIL_MODE=prompt. With --codes, the invites come with a
+// token valid for --ttl, TOKEN_TTL by default; otherwise they only tell how
+// to register. The users which can't be invited are reported, and don't
+// stop the others.
+func inviteCommand(args []string) error {
+	var path string
+	req := inviteRequest{NoToken: true}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--csv" && i+1 < len(args):
+			i++
+			path = args[i]
+		case args[i] == "--codes":
+			req.NoToken = false
+		case args[i] == "--ttl" && i+1 < len(args):
+			i++
+			ttl, err := time.ParseDuration(args[i])
+			if err != nil || ttl <= 0 {
+				return fmt.Errorf("Invalid --ttl %q", args[i])
+			}
+			req.TTLSeconds = int64(ttl / time.Second)
+		default:
+			return errors.New(inviteUsage)
+		}
+	}
+	if path == "" {
+		return errors.New(inviteUsage)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not open the CSV file: %v", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("Could not read the CSV header: %v", err)
+	}
+	userCol, mailCol := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "user", "username":
+			userCol = i
+		case "mail", "email":
+			mailCol = i
+		}
+	}
+	if userCol < 0 {
+		return fmt.Errorf("The CSV header has no user column")
+	}
+
+	ctx := context.Background()
+	var invited, failed int
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Could not read the CSV file: %v", err)
+		}
+		req.User, req.Mail = record[userCol], ""
+		if mailCol >= 0 {
+			req.Mail = record[mailCol]
+		}
+		rep, err := invite(ctx, &req)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Could not invite %s: %s\n", req.User, status.Convert(err).Message())
+			continue
+		}
+		invited++
+		logInfo("Invited %s <%s> from %s", rep.User, rep.Mail, path)
+		fmt.Printf("Invited %s <%s>\n", rep.User, rep.Mail)
+	}
+	fmt.Printf("Invited %d users, %d failed\n", invited, failed)
+	if failed > 0 {
+		return fmt.Errorf("Could not invite %d of the users", failed)
+	}
+	return nil
+}
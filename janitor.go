@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// entryDeleter and entryDisabler are implemented by the directories whose
+// incomplete entries the janitor can clean up.
+type entryDeleter interface {
+	Delete(ctx context.Context, user string) error
+}
+
+type entryDisabler interface {
+	Disable(ctx context.Context, user string) error
+}
+
+// entryEnabler is implemented by the directories which can enable again the
+// users they disabled, see restoreRegistration.
+type entryEnabler interface {
+	Enable(ctx context.Context, user string) error
+}
+
+// validateCleanup checks the CLEANUP_* options against the directory
+// backend.
+func validateCleanup() error {
+	if options().CleanupAfter <= 0 {
+		return nil
+	}
+	if options().CleanupInterval <= 0 {
+		return fmt.Errorf("CLEANUP_INTERVAL must be positive when CLEANUP_AFTER is set")
+	}
+	var backends []string
+	switch options().CleanupAction {
+	case "delete":
+		backends = []string{"ldap", "keycloak", "scim"}
+	case "disable":
+		backends = []string{"keycloak", "scim"}
+		if options().DirectoryType == "ad" || options().LdapLockAttribute != "" {
+			backends = append(backends, "ldap")
+		}
+	default:
+		return fmt.Errorf("Unknown CLEANUP_ACTION %q, expected one of delete or disable", options().CleanupAction)
+	}
+	if !contains(backends, options().DirectoryBackend) {
+		return fmt.Errorf("CLEANUP_ACTION=%s is not supported by the %s directory backend", options().CleanupAction, options().DirectoryBackend)
+	}
+	return nil
+}
+
+// markIncomplete records the entry left behind by a registration which
+// failed after the user was added to the directory, such as when the
+// password is refused, so that the janitor cleans it up. It reports whether
+// an entry was left, or could be.
+func markIncomplete(dir directory, user string) bool {
+	// the session may be gone already, look up regardless
+	ctx := context.Background()
+	exists, err := dir.Exists(ctx, user)
+	if err != nil {
+		return true
+	}
+	if !exists {
+		return false
+	}
+	logWarn("The failed registration of %s left an incomplete entry in the directory", user)
+	if err := tokens.MarkIncomplete(ctx, user, clockNow()); err != nil {
+		logError("Could not record the incomplete entry of %s: %v", user, err)
+	}
+	return true
+}
+
+// rollbackRegistration undoes the partial registration of user, deleting its
+// entry or, with the backends which can't, disabling it. The entry is marked
+// for the janitor when neither works. It reports whether the username is free
+// again, for the user to start over.
+func rollbackRegistration(dir directory, user string) bool {
+	// the session may be gone already, roll back regardless
+	ctx := context.Background()
+	if d, ok := dir.(entryDeleter); ok {
+		err := d.Delete(ctx, user)
+		if err == nil {
+			logInfo("Rolled back the partial registration of %s: entry deleted", user)
+			return true
+		}
+		logError("Could not delete the partial entry of %s: %v", user, err)
+	}
+	if d, ok := dir.(entryDisabler); ok {
+		err := d.Disable(ctx, user)
+		if err == nil {
+			logInfo("Rolled back the partial registration of %s: entry disabled", user)
+		} else {
+			logError("Could not disable the partial entry of %s: %v", user, err)
+		}
+	}
+	markIncomplete(dir, user)
+	return false
+}
+
+// janitor cleans up the incomplete entries every CLEANUP_INTERVAL, as long
+// as CLEANUP_AFTER is set.
+func janitor() {
+	for {
+		interval := options().CleanupInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		<-clk.get().After(interval)
+		if options().CleanupAfter <= 0 {
+			continue
+		}
+		if err := cleanupIncomplete(context.Background()); err != nil {
+			logError("Could not clean up the incomplete entries: %v", err)
+		}
+	}
+}
+
+// cleanupIncomplete deletes or disables, as per CLEANUP_ACTION, the entries
+// marked as incomplete more than CLEANUP_AFTER ago which are still in the
+// directory. Operators fixing an entry by hand within CLEANUP_AFTER must
+// clear its mark with the keep command of the admin shell.
+func cleanupIncomplete(ctx context.Context) error {
+	marked, err := tokens.ListIncomplete(ctx)
+	if err != nil {
+		return err
+	}
+	var dir directory
+	for user, since := range marked {
+		if clockSince(since) < options().CleanupAfter {
+			continue
+		}
+		if dir == nil {
+			if dir, err = openDirectory(ctx); err != nil {
+				return err
+			}
+			defer dir.Close()
+		}
+		exists, err := dir.Exists(ctx, user)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := cleanupEntry(ctx, dir, user); err != nil {
+				logError("Could not clean up the incomplete entry of %s: %v", user, err)
+				continue
+			}
+			logInfo("Cleaned up the incomplete entry of %s (%s), marked %s ago", user, options().CleanupAction, clockSince(since).Round(time.Second))
+		}
+		if err := tokens.ClearIncomplete(ctx, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cleanupEntry(ctx context.Context, dir directory, user string) error {
+	if options().CleanupAction == "disable" {
+		d, ok := dir.(entryDisabler)
+		if !ok {
+			return fmt.Errorf("The directory backend can't disable users")
+		}
+		return d.Disable(ctx, user)
+	}
+	d, ok := dir.(entryDeleter)
+	if !ok {
+		return fmt.Errorf("The directory backend can't delete users")
+	}
+	return d.Delete(ctx, user)
+}
+
+// deleteUnverified drops what a user who never completed the registration
+// left behind: the pending token and, when a failed registration marked it
+// as incomplete, the entry in the directory. The entries of the registered
+// users are left alone. It reports whether there was anything to drop.
+func deleteUnverified(ctx context.Context, user string) (bool, error) {
+	found, err := tokens.Remove(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	marked, err := tokens.ListIncomplete(ctx)
+	if err != nil {
+		return found, err
+	}
+	if _, ok := marked[user]; !ok {
+		return found, nil
+	}
+	dir, err := openDirectory(ctx)
+	if err != nil {
+		return found, err
+	}
+	defer dir.Close()
+	exists, err := dir.Exists(ctx, user)
+	if err != nil {
+		return found, err
+	}
+	if exists {
+		d, ok := dir.(entryDeleter)
+		if !ok {
+			return found, fmt.Errorf("The directory backend can't delete users")
+		}
+		if err := d.Delete(ctx, user); err != nil {
+			return found, err
+		}
+	}
+	return true, tokens.ClearIncomplete(ctx, user)
+}
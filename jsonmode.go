@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// In the JSON mode, asked for by connecting with SSHAUTH_JSON=1 in the
+// environment (with SetEnv or SendEnv) or with the --json command, the
+// interactive flow writes JSON lines instead of text, for TUI clients and
+// tests to drive it:
+//
+//	{"type":"message","text":"...","style":"error"}
+//	{"type":"prompt","max":1,"choices":"yn"}
+//	{"type":"result","status":"ok","exit":0}
+//
+// Every prompt is answered with a line of plain text. A prompt is secret
+// when its answer, such as a password, would not be echoed, and choices
+// lists the characters accepted, if restricted. The result is the last line.
+const (
+	jsonModeEnv     = "SSHAUTH_JSON"
+	jsonModeCommand = "--json"
+)
+
+// jsonEvent is a line of the JSON mode.
+type jsonEvent struct {
+	Type    string `json:"type"`
+	Text    string `json:"text,omitempty"`
+	Style   string `json:"style,omitempty"`
+	Max     uint   `json:"max,omitempty"`
+	Choices string `json:"choices,omitempty"`
+	Secret  bool   `json:"secret,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Exit    *int   `json:"exit,omitempty"`
+}
+
+// the names of the styles in the JSON mode
+var jsonStyles = map[string]string{
+	styleBold:    "bold",
+	styleError:   "error",
+	styleSuccess: "success",
+	stylePrompt:  "prompt",
+}
+
+// jsonCommand reports whether the session was started with the --json
+// command.
+func jsonCommand(s ssh.Session) bool {
+	return s.RawCommand() == jsonModeCommand
+}
+
+// jsonRequested reports whether the client asked for the JSON mode.
+func jsonRequested(s ssh.Session) bool {
+	if jsonCommand(s) {
+		return true
+	}
+	for _, kv := range s.Environ() {
+		if name, value, _ := strings.Cut(kv, "="); name == jsonModeEnv {
+			return value != "" && value != "0"
+		}
+	}
+	return false
+}
+
+func writeJSONEvent(w io.Writer, e jsonEvent) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+}
+
+// turnAway ends a session which has not started yet with one of the
+// messages, such as SERVER_BUSY.
+func turnAway(s ssh.Session, name string) {
+	sayConn(s, name)
+	if jsonRequested(s) {
+		exit := exitDeclined
+		writeJSONEvent(s, jsonEvent{Type: "result", Status: exitNames[exit], Exit: &exit})
+	}
+	s.Exit(exitDeclined)
+}
+
+// sayConn writes one of the messages to a session which has not started
+// yet.
+func sayConn(s ssh.Session, name string) {
+	if jsonRequested(s) {
+		writeJSONEvent(s, jsonEvent{Type: "message", Text: connText(s, name)})
+		return
+	}
+	io.WriteString(newTerminal(s), connText(s, name))
+}
+
+// jsonPrompt reads the answer to a prompt of readN in the JSON mode. The
+// answer is filtered like the typed ones.
+func (s *session) jsonPrompt(l uint, onlyIn []byte, secret bool) ([]byte, error) {
+	writeJSONEvent(s.Session, jsonEvent{Type: "prompt", Max: l, Choices: string(onlyIn), Secret: secret})
+	line, err := s.input().ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, err
+	}
+	e := &lineEditor{w: io.Discard, buf: make([]rune, 0, l), max: int(l), onlyIn: onlyIn}
+	for _, r := range strings.TrimRight(line, "\r\n") {
+		e.insert(r)
+	}
+	return []byte(string(e.buf)), nil
+}
+
+// jsonResult writes the result line at the end of a session in the JSON
+// mode.
+func (s *session) jsonResult() {
+	if s.jsonLines {
+		writeJSONEvent(s.Session, jsonEvent{Type: "result", Status: exitNames[s.exit], Exit: &s.exit})
+	}
+}
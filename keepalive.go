@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// contextKeyKeepalive marks the connections already probed by keepalive.
+type contextKeyKeepalive struct{}
+
+// keepalive probes the client of a connection every KEEPALIVE_INTERVAL with
+// the keepalive@openssh.com request, which every client answers, if only
+// with a failure. After KEEPALIVE_MAX probes in a row go unanswered the
+// connection is closed, so that a client which vanished mid-prompt, leaving
+// a half-open connection behind, doesn't hold its session slots for hours.
+func keepalive(ctx ssh.Context, ip string) {
+	interval, max := options().KeepaliveInterval, options().KeepaliveMax
+	if interval <= 0 || max <= 0 || ctx.Value(contextKeyKeepalive{}) != nil {
+		return
+	}
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return
+	}
+	ctx.SetValue(contextKeyKeepalive{}, true)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		missed := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-reply:
+				if err != nil {
+					return
+				}
+				missed = 0
+			case <-time.After(interval):
+				if missed++; missed >= max {
+					logWarn("Closing the connection of %s from %s: %d keepalives unanswered", ctx.User(), ip, missed)
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+}
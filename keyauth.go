@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// keyDirectory is implemented by the directories which store SSH public
+// keys, allowing stub accounts provisioned with a key (but no password) to
+// prove their identity with it instead of by mail.
+type keyDirectory interface {
+	PublicKeys(ctx context.Context, user string) ([]string, error)
+	SetPassword(ctx context.Context, user, password string) error
+}
+
+// The extensions of the permissions of a connection, recording what the
+// method which authenticated it proved: whether the key is an admin one or
+// one stored in the directory for the user, and its fingerprint. x/crypto
+// calls the public key callback for the keys a client merely offers, before
+// it proves holding them, so the handlers give every call permissions of
+// their own, and only those of the method which succeeded reach the
+// connection.
+const (
+	extensionAdmin  = "sshauth-admin"
+	extensionStored = "sshauth-stored"
+	extensionKey    = "sshauth-key"
+)
+
+// setPermissions gives the authentication attempt in progress permissions
+// with the extensions, which gliderlabs/ssh returns to x/crypto.
+func setPermissions(ctx ssh.Context, extensions map[string]string) {
+	ctx.SetValue(ssh.ContextKeyPermissions, &ssh.Permissions{Permissions: &gossh.Permissions{Extensions: extensions}})
+}
+
+// authExtension returns the extension name of the permissions the
+// connection of ctx was authenticated with, empty if it has none.
+func authExtension(ctx ssh.Context, name string) string {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok || conn.Permissions == nil {
+		return ""
+	}
+	return conn.Permissions.Extensions[name]
+}
+
+// publicKeyHandler accepts the admin keys for ADMIN_SSH_USER and, with
+// KEY_VERIFICATION, the keys stored in the directory for the user, so that
+// an accepted key proves the user's identity. With TOKEN_BINDING=key or
+// strict, every other key is accepted too, proving only that the client
+// holds it, for the tokens to be bound to. Everyone else falls through to
+// keyboardInteractiveHandler and the mail verification.
+func publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+	setPermissions(ctx, nil)
+	if !clientAllowed(ctx.ClientVersion()) {
+		// turned away by handle, without looking up the key
+		return false
+	}
+	extensions := map[string]string{extensionKey: gossh.FingerprintSHA256(key)}
+	switch {
+	case isAdminKey(ctx.User(), key):
+		extensions[extensionAdmin] = "yes"
+	case directoryKey(ctx, key):
+		extensions[extensionStored] = "yes"
+	case !keyBinding():
+		return false
+	}
+	setPermissions(ctx, extensions)
+	return true
+}
+
+// contextKeyStoredKeys holds the *storedKeys of a connection.
+type contextKeyStoredKeys struct{}
+
+// storedKeys are the keys stored in the directory for the user a connection
+// last offered keys for.
+type storedKeys struct {
+	user string
+	keys []string
+}
+
+// directoryKey reports whether, with KEY_VERIFICATION, key is one of the keys
+// stored in the directory for the user.
+func directoryKey(ctx ssh.Context, key ssh.PublicKey) bool {
+	if !options().KeyVerification {
+		return false
+	}
+	user, err := normalizeUsername(ctx.User())
+	if err != nil {
+		return false
+	}
+	for _, k := range lookupStoredKeys(ctx, user) {
+		stored, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+		if err == nil && bytes.Equal(stored.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupStoredKeys returns the keys stored in the directory for user. They
+// are looked up once per connection, and kept in its context for the
+// other keys the client offers, which would otherwise cost a connection to
+// the directory each before the client even proves holding them. A failed
+// lookup is kept as no keys, for the client to fall through to the mail.
+func lookupStoredKeys(ctx ssh.Context, user string) []string {
+	if cached, ok := ctx.Value(contextKeyStoredKeys{}).(*storedKeys); ok && cached.user == user {
+		return cached.keys
+	}
+	cached := &storedKeys{user: user}
+	ctx.SetValue(contextKeyStoredKeys{}, cached)
+	d, err := openDirectory(ctx)
+	if err != nil {
+		logError("Could not connect to the directory: %v", err)
+		return nil
+	}
+	defer d.Close()
+	kd, ok := d.(keyDirectory)
+	if !ok {
+		return nil
+	}
+	if cached.keys, err = kd.PublicKeys(ctx, user); err != nil {
+		logError("Could not look up the public keys of %s: %v", user, err)
+		return nil
+	}
+	return cached.keys
+}
+
+// keyboardInteractiveHandler lets in everybody without asking anything, with
+// permissions proving nothing.
+func keyboardInteractiveHandler(ctx ssh.Context, _ gossh.KeyboardInteractiveChallenge) bool {
+	setPermissions(ctx, nil)
+	return true
+}
+
+// completeWithKey lets a user who authenticated with one of the keys stored
+// in the directory set their password right away.
+func (s *session) completeWithKey() {
+	kd, ok := s.dir.(keyDirectory)
+	if !ok {
+		return
+	}
+	if s.lockedOut() {
+		return
+	}
+	logInfo("%s verified with their public key from %s", s.user, s.ip)
+	io.WriteString(s, s.text(KEY_VERIFIED))
+	passwd, ok := s.readNewPassword()
+	if !ok {
+		return
+	}
+	err := s.progress(s.text(PROGRESS_PASSWORD), func() error {
+		return kd.SetPassword(s.ctx, s.user, passwd)
+	})
+	if err != nil {
+		s.internalError("Could not set the password", err)
+		return
+	}
+	registrations.add(registration{User: s.user, IP: s.ip, Time: clockNow(), Conn: connectionMeta(s.Context())})
+	audits.publish(auditEvent{Type: auditRegistered, User: s.user, IP: s.ip, Detail: "verified with a public key"})
+	s.exit = exitOK
+	login := options().LldapURI.JoinPath("/login").String()
+	s.say(styleSuccess, s.textData(REGISTRATION_SUCCESS, messageData{URL: login}))
+	s.loginQR(login)
+}
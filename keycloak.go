@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// keycloakDirectory provisions users through the Keycloak admin REST API,
+// authenticating with the client credentials grant. The client needs the
+// manage-users (and, to assign roles, view-realm) role of realm-management.
+type keycloakDirectory struct {
+	base   string
+	header http.Header
+}
+
+func openKeycloak(ctx context.Context) (*keycloakDirectory, error) {
+	base := strings.TrimSuffix(options().KeycloakURL, "/")
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {options().KeycloakClientID},
+		"client_secret": {options().KeycloakClientSecret},
+	}
+	tokenURL := base + "/realms/" + url.PathEscape(options().KeycloakRealm) + "/protocol/openid-connect/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if _, err := send(req, &token); err != nil {
+		return nil, fmt.Errorf("Could not authenticate with Keycloak: %v", err)
+	}
+
+	return &keycloakDirectory{
+		base:   base + "/admin/realms/" + url.PathEscape(options().KeycloakRealm),
+		header: http.Header{"Authorization": {"Bearer " + token.AccessToken}},
+	}, nil
+}
+
+func (k *keycloakDirectory) Close() error {
+	return nil
+}
+
+// keycloakUser is the part of a Keycloak user we look at.
+type keycloakUser struct {
+	ID      string `json:"id"`
+	Email   string `json:"email"`
+	Enabled bool   `json:"enabled"`
+}
+
+// find looks up a user by username.
+func (k *keycloakDirectory) find(ctx context.Context, user string) (*keycloakUser, error) {
+	var users []keycloakUser
+	q := url.Values{"username": {user}, "exact": {"true"}}
+	if _, err := doJSON(ctx, http.MethodGet, k.base+"/users?"+q.Encode(), k.header, nil, &users); err != nil {
+		return nil, fmt.Errorf("Could not search Keycloak users: %v", err)
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
+
+// Stub reports whether user exists and is disabled, returning its address.
+func (k *keycloakDirectory) Stub(ctx context.Context, user string) (_ bool, _ string, err error) {
+	_, sp := startSpan(ctx, "keycloak.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := k.find(ctx, user)
+	if err != nil || u == nil || u.Enabled {
+		return false, "", err
+	}
+	return true, u.Email, nil
+}
+
+// Complete sets the password of a disabled user, then enables it with the
+// verified address and grants it the KEYCLOAK_ROLES.
+func (k *keycloakDirectory) Complete(ctx context.Context, user, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "keycloak.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := k.find(ctx, user)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("Could not find user %s", user)
+	}
+	userURL := k.base + "/users/" + url.PathEscape(u.ID)
+	cred := map[string]any{"type": "password", "value": password, "temporary": false}
+	if _, err := doJSON(ctx, http.MethodPut, userURL+"/reset-password", k.header, cred, nil); err != nil {
+		return fmt.Errorf("Could not set the password of the Keycloak user: %v", err)
+	}
+	body := map[string]any{"email": mail, "emailVerified": true, "enabled": true}
+	if _, err := doJSON(ctx, http.MethodPut, userURL, k.header, body, nil); err != nil {
+		return fmt.Errorf("Could not enable the Keycloak user: %v", err)
+	}
+	return k.assignRoles(ctx, u.ID)
+}
+
+func (k *keycloakDirectory) Exists(ctx context.Context, user string) (_ bool, err error) {
+	_, sp := startSpan(ctx, "keycloak.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := k.find(ctx, user)
+	return u != nil, err
+}
+
+func (k *keycloakDirectory) Register(ctx context.Context, user, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "keycloak.create", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	body := map[string]any{
+		"username":      user,
+		"email":         mail,
+		"enabled":       true,
+		"emailVerified": true,
+		"credentials": []map[string]any{
+			{"type": "password", "value": password, "temporary": false},
+		},
+	}
+	header, err := doJSON(ctx, http.MethodPost, k.base+"/users", k.header, body, nil)
+	if err != nil {
+		if conflict(err) {
+			return refusedRegistration{fmt.Errorf("Could not create the Keycloak user: %v", err)}
+		}
+		return fmt.Errorf("Could not create the Keycloak user: %v", err)
+	}
+	// the id of the new user is only returned in the Location header
+	if err := k.assignRoles(ctx, path.Base(header.Get("Location"))); err != nil {
+		return partialRegistration{err}
+	}
+	return nil
+}
+
+// assignRoles grants the KEYCLOAK_ROLES to the user with the given id.
+func (k *keycloakDirectory) assignRoles(ctx context.Context, id string) error {
+	if len(options().KeycloakRoles) == 0 {
+		return nil
+	}
+	var roles []map[string]any
+	for _, name := range options().KeycloakRoles {
+		var role map[string]any
+		if _, err := doJSON(ctx, http.MethodGet, k.base+"/roles/"+url.PathEscape(name), k.header, nil, &role); err != nil {
+			return fmt.Errorf("Could not look up the Keycloak role %s: %v", name, err)
+		}
+		roles = append(roles, role)
+	}
+	if _, err := doJSON(ctx, http.MethodPost, k.base+"/users/"+id+"/role-mappings/realm", k.header, roles, nil); err != nil {
+		return fmt.Errorf("Could not assign roles to the Keycloak user: %v", err)
+	}
+	return nil
+}
+
+// ApplyDefaults sets the attributes of a user and adds it to the groups,
+// looked up by name.
+func (k *keycloakDirectory) ApplyDefaults(ctx context.Context, user string, d userDefaults) (err error) {
+	_, sp := startSpan(ctx, "keycloak.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := k.find(ctx, user)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("Could not find user %s", user)
+	}
+	if len(d.Attributes) > 0 {
+		attrs := map[string][]string{}
+		for name, value := range d.Attributes {
+			attrs[name] = []string{value}
+		}
+		if _, err := doJSON(ctx, http.MethodPut, k.base+"/users/"+url.PathEscape(u.ID), k.header, map[string]any{"attributes": attrs}, nil); err != nil {
+			return fmt.Errorf("Could not set the attributes of the Keycloak user: %v", err)
+		}
+	}
+	for _, name := range d.Groups {
+		var groups []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		q := url.Values{"search": {name}, "exact": {"true"}}
+		if _, err := doJSON(ctx, http.MethodGet, k.base+"/groups?"+q.Encode(), k.header, nil, &groups); err != nil {
+			return fmt.Errorf("Could not look up the Keycloak group %s: %v", name, err)
+		}
+		if len(groups) == 0 || groups[0].Name != name {
+			return fmt.Errorf("Could not find the Keycloak group %s", name)
+		}
+		if _, err := doJSON(ctx, http.MethodPut, k.base+"/users/"+url.PathEscape(u.ID)+"/groups/"+url.PathEscape(groups[0].ID), k.header, nil, nil); err != nil {
+			return fmt.Errorf("Could not add the Keycloak user to the group %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes a user.
+func (k *keycloakDirectory) Delete(ctx context.Context, user string) (err error) {
+	_, sp := startSpan(ctx, "keycloak.delete", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := k.find(ctx, user)
+	if err != nil || u == nil {
+		return err
+	}
+	if _, err := doJSON(ctx, http.MethodDelete, k.base+"/users/"+url.PathEscape(u.ID), k.header, nil, nil); err != nil {
+		return fmt.Errorf("Could not delete the Keycloak user: %v", err)
+	}
+	return nil
+}
+
+// Disable disables a user.
+func (k *keycloakDirectory) Disable(ctx context.Context, user string) (err error) {
+	_, sp := startSpan(ctx, "keycloak.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := k.find(ctx, user)
+	if err != nil || u == nil {
+		return err
+	}
+	body := map[string]any{"enabled": false}
+	if _, err := doJSON(ctx, http.MethodPut, k.base+"/users/"+url.PathEscape(u.ID), k.header, body, nil); err != nil {
+		return fmt.Errorf("Could not disable the Keycloak user: %v", err)
+	}
+	return nil
+}
+
+// Enable enables a user again.
+func (k *keycloakDirectory) Enable(ctx context.Context, user string) (err error) {
+	_, sp := startSpan(ctx, "keycloak.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := k.find(ctx, user)
+	if err != nil || u == nil {
+		return err
+	}
+	body := map[string]any{"enabled": true}
+	if _, err := doJSON(ctx, http.MethodPut, k.base+"/users/"+url.PathEscape(u.ID), k.header, body, nil); err != nil {
+		return fmt.Errorf("Could not enable the Keycloak user: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf16"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// userAccountControl flags used when creating Active Directory accounts
+const (
+	adNormalAccount   = 0x0200
+	adAccountDisabled = 0x0002
+)
+
+// ldapDirectory registers users in an LDAP server. DIRECTORY_TYPE selects
+// between plain LDAP (OpenLDAP, LLDAP, ...) and Active Directory, which needs
+// different attributes and takes the passwords in clear in unicodePwd.
+type ldapDirectory struct {
+	conn *ldap.Conn
+	// the server conn is bound to
+	uri string
+	// closed when the directory is closed, stopping watch
+	done chan struct{}
+}
+
+// ldapHealth remembers when each of the LDAP_URI servers last failed, so
+// that the servers which are down are tried last.
+var ldapHealth = struct {
+	sync.Mutex
+	failed map[string]time.Time
+}{failed: map[string]time.Time{}}
+
+// ldapServers returns the LDAP_URI servers in the order they should be
+// tried: the ones which haven't failed in the last LDAP_RETRY_AFTER first,
+// in the configured order, then the others.
+func ldapServers() []string {
+	ldapHealth.Lock()
+	defer ldapHealth.Unlock()
+	var healthy, down []string
+	for _, uri := range options().LdapURI {
+		uri = strings.TrimSpace(uri)
+		if uri == "" {
+			continue
+		}
+		if t, ok := ldapHealth.failed[uri]; ok && clockSince(t) < options().LdapRetryAfter {
+			down = append(down, uri)
+		} else {
+			healthy = append(healthy, uri)
+		}
+	}
+	return append(healthy, down...)
+}
+
+func markLDAP(uri string, err error) {
+	ldapHealth.Lock()
+	defer ldapHealth.Unlock()
+	_, wasDown := ldapHealth.failed[uri]
+	if err != nil {
+		if !wasDown {
+			logWarn("LDAP server %s is down: %v", uri, err)
+		}
+		ldapHealth.failed[uri] = clockNow()
+	} else if wasDown {
+		logInfo("LDAP server %s is back up", uri)
+		delete(ldapHealth.failed, uri)
+	}
+}
+
+// bind connects to the first LDAP server which accepts the bind, failing
+// over to the next ones on errors. It returns the server it connected to.
+func bind(ctx context.Context) (*ldap.Conn, string, error) {
+	servers := ldapServers()
+	if len(servers) == 0 {
+		return nil, "", fmt.Errorf("No LDAP server in LDAP_URI")
+	}
+	var err error
+	for _, uri := range servers {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		var l *ldap.Conn
+		if l, err = bindServer(ctx, uri); err == nil {
+			markLDAP(uri, nil)
+			return l, uri, nil
+		}
+		markLDAP(uri, err)
+	}
+	return nil, "", err
+}
+
+func bindServer(ctx context.Context, uri string) (_ *ldap.Conn, err error) {
+	_, sp := startSpan(ctx, "ldap.bind", spanKindClient)
+	sp.setAttr("ldap.uri", uri)
+	defer func() { sp.finish(err) }()
+
+	logDebug("ldap", "dial %s", uri)
+	l, err := ldap.DialURL(uri, ldap.DialWithDialer(&net.Dialer{Timeout: options().LdapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to the LDAP server %s: %v", uri, err)
+	}
+	l.SetTimeout(options().LdapTimeout)
+
+	logDebug("ldap", "bind dn=%q password=<redacted>", options().LdapBindDN)
+	if err := l.Bind(options().LdapBindDN, options().LdapBindPassword); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Could not bind with the given user on %s: %v", uri, err)
+	}
+	return l, nil
+}
+
+func openLDAP(ctx context.Context) (*ldapDirectory, error) {
+	if options().DirectoryType != "ldap" && options().DirectoryType != "ad" {
+		return nil, fmt.Errorf("Unknown DIRECTORY_TYPE %q, expected one of ldap or ad", options().DirectoryType)
+	}
+	l, uri, err := bind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := &ldapDirectory{conn: l, uri: uri, done: make(chan struct{})}
+	go d.watch(ctx)
+	return d, nil
+}
+
+// watch closes the connection as soon as ctx is done, typically because the
+// SSH session went away, aborting the pending requests.
+func (d *ldapDirectory) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		logDebug("ldap", "closing the connection: %v", ctx.Err())
+		d.conn.Close()
+	case <-d.done:
+	}
+}
+
+func (d *ldapDirectory) Close() error {
+	close(d.done)
+	d.conn.Unbind()
+	d.conn.Close()
+	return nil
+}
+
+func (d *ldapDirectory) ad() bool {
+	return options().DirectoryType == "ad"
+}
+
+var ldapFilter reloadable[*template.Template]
+
+// userObjectClass is the object class of the users, LDAP_USER_OBJECT_CLASS
+// or the default of the DIRECTORY_TYPE.
+func userObjectClass() string {
+	switch {
+	case options().LdapUserObjectClass != "":
+		return options().LdapUserObjectClass
+	case options().DirectoryType == "ad":
+		return "user"
+	}
+	return "person"
+}
+
+// userAttribute is the attribute holding the username, LDAP_USER_ATTRIBUTE
+// or the default of the DIRECTORY_TYPE.
+func userAttribute() string {
+	switch {
+	case options().LdapUserAttribute != "":
+		return options().LdapUserAttribute
+	case options().DirectoryType == "ad":
+		return "sAMAccountName"
+	}
+	return "uid"
+}
+
+func searchBase() string {
+	if options().LdapSearchBase != "" {
+		return options().LdapSearchBase
+	}
+	return options().LdapUserScope
+}
+
+// initLDAPFilter parses LDAP_USER_FILTER, or builds the default filter.
+func initLDAPFilter() error {
+	text := options().LdapUserFilter
+	if text == "" {
+		text = fmt.Sprintf("(&(objectClass=%s)(%s={{.User}}))", userObjectClass(), userAttribute())
+	}
+	t, err := template.New("filter").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("Could not parse LDAP_USER_FILTER: %v", err)
+	}
+	// render once so mistakes in the filter are caught at startup
+	filter, err := renderFilter(t, "user")
+	if err != nil {
+		return err
+	}
+	if _, err = ldap.CompileFilter(filter); err != nil {
+		return fmt.Errorf("Invalid LDAP_USER_FILTER: %v", err)
+	}
+	ldapFilter.set(t)
+	return nil
+}
+
+// userFilter renders the search filter for the given user.
+func userFilter(uid string) (string, error) {
+	return renderFilter(ldapFilter.get(), uid)
+}
+
+func renderFilter(t *template.Template, uid string) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, struct{ User string }{ldap.EscapeFilter(uid)}); err != nil {
+		return "", fmt.Errorf("Could not render LDAP_USER_FILTER: %v", err)
+	}
+	return b.String(), nil
+}
+
+// search looks up the entries of the given user, returning attrs.
+func (d *ldapDirectory) search(uid string, attrs []string) ([]*ldap.Entry, error) {
+	filter, err := userFilter(uid)
+	if err != nil {
+		return nil, err
+	}
+	searchRequest := ldap.NewSearchRequest(
+		searchBase(),
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		attrs,
+		nil,
+	)
+
+	logDebug("ldap", "search base=%q filter=%q", searchRequest.BaseDN, filter)
+	sr, err := d.conn.Search(searchRequest)
+	if err != nil {
+		logDebug("ldap", "search failed: %v", err)
+		return nil, err
+	}
+	logDebug("ldap", "search returned %d entries", len(sr.Entries))
+	return sr.Entries, nil
+}
+
+func (d *ldapDirectory) Exists(ctx context.Context, uid string) (_ bool, err error) {
+	_, sp := startSpan(ctx, "ldap.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+// PublicKeys returns the SSH public keys stored in LDAP_SSH_KEY_ATTRIBUTE for
+// the given user, if any.
+func (d *ldapDirectory) PublicKeys(ctx context.Context, uid string) (_ []string, err error) {
+	_, sp := startSpan(ctx, "ldap.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{options().LdapSSHKeyAttribute})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return entries[0].GetAttributeValues(options().LdapSSHKeyAttribute), nil
+}
+
+// mailAttribute is the attribute holding the address of the users.
+func (d *ldapDirectory) mailAttribute() string {
+	if d.ad() {
+		return "mail"
+	}
+	return "email"
+}
+
+// Mail returns the address of an existing user.
+func (d *ldapDirectory) Mail(ctx context.Context, uid string) (_ string, err error) {
+	_, sp := startSpan(ctx, "ldap.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{d.mailAttribute()})
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("Could not find user %s", uid)
+	}
+	return entries[0].GetAttributeValue(d.mailAttribute()), nil
+}
+
+// UserByMail returns the user with the given address, or "".
+func (d *ldapDirectory) UserByMail(ctx context.Context, mail string) (_ string, err error) {
+	_, sp := startSpan(ctx, "ldap.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	filter := fmt.Sprintf("(&(objectClass=%s)(%s=%s))", userObjectClass(), d.mailAttribute(), ldap.EscapeFilter(mail))
+	logDebug("ldap", "search base=%q filter=%q", searchBase(), filter)
+	sr, err := d.conn.Search(ldap.NewSearchRequest(searchBase(), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, 0, false,
+		filter, []string{userAttribute()}, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", err
+	}
+	if sr == nil || len(sr.Entries) == 0 {
+		return "", nil
+	}
+	return sr.Entries[0].GetAttributeValue(userAttribute()), nil
+}
+
+// SetMail changes the address of an existing user.
+func (d *ldapDirectory) SetMail(ctx context.Context, uid, mail string) (err error) {
+	_, sp := startSpan(ctx, "ldap.modify", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("Could not find user %s", uid)
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+	logDebug("ldap", "modify dn=%q replace %s=%s", dn, d.mailAttribute(), mail)
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Replace(d.mailAttribute(), []string{mail})
+	if err := d.conn.Modify(modify); err != nil {
+		return fmt.Errorf("Could not change the address: %v", err)
+	}
+	return nil
+}
+
+// Delete removes an existing user.
+func (d *ldapDirectory) Delete(ctx context.Context, uid string) (err error) {
+	_, sp := startSpan(ctx, "ldap.delete", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("Could not find user %s", uid)
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+	logDebug("ldap", "delete dn=%q", dn)
+	if err := d.conn.Del(ldap.NewDelRequest(dn, nil)); err != nil {
+		return fmt.Errorf("Could not delete the user: %v", err)
+	}
+	return nil
+}
+
+// ApplyDefaults sets the attributes and the expiry of a user, and adds it
+// to the groups named under LDAP_GROUP_SCOPE.
+func (d *ldapDirectory) ApplyDefaults(ctx context.Context, uid string, defaults userDefaults) (err error) {
+	_, sp := startSpan(ctx, "ldap.modify", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("Could not find user %s", uid)
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+
+	if len(defaults.Attributes) > 0 || defaults.Expire > 0 {
+		modify := ldap.NewModifyRequest(dn, nil)
+		for _, attr := range defaults.attributeNames() {
+			logDebug("ldap", "modify dn=%q replace %s=%s", dn, attr, defaults.Attributes[attr])
+			modify.Replace(attr, []string{defaults.Attributes[attr]})
+		}
+		if defaults.Expire > 0 {
+			expiry := expiryValue(clockNow().Add(defaults.Expire))
+			logDebug("ldap", "modify dn=%q replace %s=%s", dn, expiryAttribute(), expiry)
+			modify.Replace(expiryAttribute(), []string{expiry})
+		}
+		if err := d.conn.Modify(modify); err != nil {
+			return fmt.Errorf("Could not set the default attributes: %v", err)
+		}
+	}
+
+	// groups of the posixGroup kind list their members by username
+	member := dn
+	if strings.EqualFold(options().LdapGroupMemberAttribute, "memberUid") {
+		member = uid
+	}
+	for _, group := range defaults.Groups {
+		groupDN := "cn=" + escapeDN(group) + "," + options().LdapGroupScope
+		logDebug("ldap", "modify dn=%q add %s=%s", groupDN, options().LdapGroupMemberAttribute, member)
+		modify := ldap.NewModifyRequest(groupDN, nil)
+		modify.Add(options().LdapGroupMemberAttribute, []string{member})
+		if err := d.conn.Modify(modify); err != nil {
+			return fmt.Errorf("Could not add the user to the group %s: %v", group, err)
+		}
+	}
+	return nil
+}
+
+// SetPassword sets the password of an existing user.
+func (d *ldapDirectory) SetPassword(ctx context.Context, uid, password string) (err error) {
+	_, sp := startSpan(ctx, "ldap.modify", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("Could not find user %s", uid)
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+
+	if err := d.writePassword(dn, password); err != nil {
+		return fmt.Errorf("Could not set the password: %v", err)
+	}
+	return nil
+}
+
+// writePassword sets the password of an entry with the PASSWORD_METHOD:
+// through the password modify extended operation, by replacing userPassword
+// with a hash computed here, or in clear, leaving the hashing to the server.
+// Active Directory takes the clear password in unicodePwd.
+func (d *ldapDirectory) writePassword(dn, password string) error {
+	attr, value := "userPassword", password
+	switch passwordMethod() {
+	case passwordExop:
+		logDebug("ldap", "password modify dn=%q password=<redacted>", dn)
+		_, err := d.conn.PasswordModify(ldap.NewPasswordModifyRequest(dn, "", password))
+		return err
+	case passwordHash:
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		value = hash
+	case passwordPlain:
+		if d.ad() {
+			attr, value = "unicodePwd", adPassword(password)
+		}
+	default:
+		return fmt.Errorf("The LDAP backend does not support PASSWORD_METHOD=%s", passwordMethod())
+	}
+	logDebug("ldap", "modify dn=%q replace %s=<redacted>", dn, attr)
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Replace(attr, []string{value})
+	return d.conn.Modify(modify)
+}
+
+func (d *ldapDirectory) Register(ctx context.Context, uid, email, password string) (err error) {
+	_, sp := startSpan(ctx, "ldap.add", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	addRequest, err := d.addRequest(uid, email)
+	if err != nil {
+		return err
+	}
+	sp.setAttr("ldap.dn", addRequest.DN)
+	logAdd(addRequest)
+	if err := d.conn.Add(addRequest); err != nil {
+		var lerr *ldap.Error
+		if errors.As(err, &lerr) && lerr.ResultCode < ldap.ErrorNetwork {
+			// the server replied, the entry was not added
+			return refusedRegistration{fmt.Errorf("Could not add new user: %v", err)}
+		}
+		return fmt.Errorf("Could not add new user: %v", err)
+	}
+
+	if d.ad() {
+		if err := d.enableAD(addRequest.DN, password); err != nil {
+			return partialRegistration{err}
+		}
+		return nil
+	}
+	if err := d.writePassword(addRequest.DN, password); err != nil {
+		return partialRegistration{fmt.Errorf("Could not add a password to the new user: %v", err)}
+	}
+	return nil
+}
+
+// Verify reads the entry of a user back and binds as the user with the
+// password, on the server the entry was written to, so that a registration
+// which only half worked is reported instead of leaving an account nobody
+// can log in with.
+func (d *ldapDirectory) Verify(ctx context.Context, uid, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "ldap.verify", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{"dn", d.mailAttribute()})
+	if err != nil {
+		return fmt.Errorf("Could not read back the new user: %v", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("The new user %s cannot be found under %s", uid, searchBase())
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+	if got := entries[0].GetAttributeValue(d.mailAttribute()); !strings.EqualFold(got, mail) {
+		return fmt.Errorf("The new user %s has the address %q instead of %q", dn, got, mail)
+	}
+
+	logDebug("ldap", "dial %s to verify dn=%q", d.uri, dn)
+	l, err := ldap.DialURL(d.uri, ldap.DialWithDialer(&net.Dialer{Timeout: options().LdapTimeout}))
+	if err != nil {
+		return fmt.Errorf("Could not connect to the LDAP server %s to verify the new user: %v", d.uri, err)
+	}
+	defer l.Close()
+	l.SetTimeout(options().LdapTimeout)
+	logDebug("ldap", "bind dn=%q password=<redacted>", dn)
+	if err := l.Bind(dn, password); err != nil {
+		return fmt.Errorf("The new user %s cannot bind with the chosen password: %v", dn, err)
+	}
+	l.Unbind()
+	return nil
+}
+
+// Stub reports whether uid matches LDAP_STUB_FILTER, returning its address.
+func (d *ldapDirectory) Stub(ctx context.Context, uid string) (_ bool, _ string, err error) {
+	_, sp := startSpan(ctx, "ldap.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	filter, err := userFilter(uid)
+	if err != nil {
+		return false, "", err
+	}
+	filter = "(&" + filter + stubFilter() + ")"
+	logDebug("ldap", "search base=%q filter=%q", searchBase(), filter)
+	sr, err := d.conn.Search(ldap.NewSearchRequest(searchBase(), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{d.mailAttribute()}, nil))
+	if err != nil {
+		return false, "", err
+	}
+	if len(sr.Entries) == 0 {
+		return false, "", nil
+	}
+	return true, sr.Entries[0].GetAttributeValue(d.mailAttribute()), nil
+}
+
+// Complete sets the address and the password of a stub, then enables it by
+// clearing ACCOUNTDISABLE with Active Directory, or by applying the
+// LDAP_STUB_ENABLE changes otherwise.
+func (d *ldapDirectory) Complete(ctx context.Context, uid, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "ldap.modify", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("Could not find user %s", uid)
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+
+	logDebug("ldap", "modify dn=%q replace %s=%s", dn, d.mailAttribute(), mail)
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Replace(d.mailAttribute(), []string{mail})
+	if err := d.conn.Modify(modify); err != nil {
+		return fmt.Errorf("Could not set the address of the stub: %v", err)
+	}
+	if d.ad() {
+		return d.enableAD(dn, password)
+	}
+	if err := d.writePassword(dn, password); err != nil {
+		return fmt.Errorf("Could not add a password to the stub: %v", err)
+	}
+	if len(options().LdapStubEnable) == 0 {
+		return nil
+	}
+	modify = ldap.NewModifyRequest(dn, nil)
+	for _, c := range options().LdapStubEnable {
+		attr, value, _ := strings.Cut(c, "=")
+		if value == "" {
+			logDebug("ldap", "modify dn=%q delete %s", dn, attr)
+			modify.Delete(attr, nil)
+		} else {
+			logDebug("ldap", "modify dn=%q replace %s=%s", dn, attr, value)
+			modify.Replace(attr, []string{value})
+		}
+	}
+	if err := d.conn.Modify(modify); err != nil {
+		return fmt.Errorf("Could not enable the stub: %v", err)
+	}
+	return nil
+}
+
+// Disable disables an Active Directory account by setting ACCOUNTDISABLE,
+// and the other accounts by setting LDAP_LOCK_ATTRIBUTE.
+func (d *ldapDirectory) Disable(ctx context.Context, uid string) (err error) {
+	_, sp := startSpan(ctx, "ldap.modify", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	if d.ad() {
+		err = d.accountControl(sp, uid, adNormalAccount|adAccountDisabled)
+	} else {
+		err = d.lock(sp, uid, true)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not disable the user: %v", err)
+	}
+	return nil
+}
+
+// Enable enables again an account disabled by Disable.
+func (d *ldapDirectory) Enable(ctx context.Context, uid string) (err error) {
+	_, sp := startSpan(ctx, "ldap.modify", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	if d.ad() {
+		err = d.accountControl(sp, uid, adNormalAccount)
+	} else {
+		err = d.lock(sp, uid, false)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not enable the user: %v", err)
+	}
+	return nil
+}
+
+// lock sets LDAP_LOCK_ATTRIBUTE on the entry of uid, or deletes it.
+func (d *ldapDirectory) lock(sp *span, uid string, locked bool) error {
+	attr, value, _ := strings.Cut(options().LdapLockAttribute, "=")
+	if attr == "" {
+		return fmt.Errorf("LDAP_LOCK_ATTRIBUTE must be set to disable the accounts of plain LDAP")
+	}
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("Could not find user %s", uid)
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+	modify := ldap.NewModifyRequest(dn, nil)
+	if locked {
+		logDebug("ldap", "modify dn=%q replace %s=%s", dn, attr, value)
+		modify.Replace(attr, []string{value})
+	} else {
+		logDebug("ldap", "modify dn=%q delete %s", dn, attr)
+		modify.Delete(attr, nil)
+	}
+	err = d.conn.Modify(modify)
+	if !locked && ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) {
+		// not locked in the first place
+		return nil
+	}
+	return err
+}
+
+// accountControl sets the userAccountControl of an Active Directory account.
+func (d *ldapDirectory) accountControl(sp *span, uid string, flags int) error {
+	entries, err := d.search(uid, []string{"dn"})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("Could not find user %s", uid)
+	}
+	dn := entries[0].DN
+	sp.setAttr("ldap.dn", dn)
+	logDebug("ldap", "modify dn=%q replace userAccountControl=%d", dn, flags)
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Replace("userAccountControl", []string{fmt.Sprint(flags)})
+	return d.conn.Modify(modify)
+}
+
+// adPassword encodes a password for the unicodePwd attribute: the quoted
+// password in UTF-16LE.
+func adPassword(password string) string {
+	units := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, len(units)*2)
+	for i, u := range units {
+		b[2*i] = byte(u)
+		b[2*i+1] = byte(u >> 8)
+	}
+	return string(b)
+}
+
+// addRequest builds the request creating a new user. Active Directory
+// accounts are created disabled, and only enabled by enableAD once they have
+// a password, as AD refuses to enable accounts which don't satisfy the
+// domain password policy.
+func (d *ldapDirectory) addRequest(uid, email string) (*ldap.AddRequest, error) {
+	if !d.ad() {
+		dn, err := userDN(userAttribute(), uid)
+		if err != nil {
+			return nil, err
+		}
+		return &ldap.AddRequest{
+			DN: dn,
+			Attributes: []ldap.Attribute{
+				{Type: "email", Vals: []string{email}},
+			},
+		}, nil
+	}
+
+	dn, err := userDN("CN", uid)
+	if err != nil {
+		return nil, err
+	}
+
+	upn := uid + "@" + options().ADUPNSuffix
+	if options().ADUPNSuffix == "" {
+		upn = uid + "@" + domainFromDN(options().LdapUserScope)
+	}
+	return &ldap.AddRequest{
+		DN: dn,
+		Attributes: []ldap.Attribute{
+			{Type: "objectClass", Vals: []string{"top", "person", "organizationalPerson", "user"}},
+			{Type: "cn", Vals: []string{uid}},
+			{Type: "sAMAccountName", Vals: []string{uid}},
+			{Type: "userPrincipalName", Vals: []string{upn}},
+			{Type: "mail", Vals: []string{email}},
+			{Type: "userAccountControl", Vals: []string{fmt.Sprint(adNormalAccount | adAccountDisabled)}},
+		},
+	}, nil
+}
+
+// userDN builds the DN of a new user under LDAP_USER_SCOPE, making sure
+// that, once escaped, the username can't add RDNs or attributes and end up
+// anywhere else in the tree.
+func userDN(attr, uid string) (string, error) {
+	dn := attr + "=" + escapeDN(uid) + "," + options().LdapUserScope
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", fmt.Errorf("Could not build the DN of %q: %v", uid, err)
+	}
+	scope, err := ldap.ParseDN(options().LdapUserScope)
+	if err != nil {
+		return "", fmt.Errorf("Could not parse LDAP_USER_SCOPE: %v", err)
+	}
+	rdn := parsed.RDNs[0]
+	if len(parsed.RDNs) != len(scope.RDNs)+1 || len(rdn.Attributes) != 1 || rdn.Attributes[0].Value != uid {
+		return "", fmt.Errorf("Refusing to build the DN of %q: it would be %s", uid, dn)
+	}
+	return dn, nil
+}
+
+// enableAD sets the password of a new Active Directory account and enables
+// it. The password can only be set over an encrypted connection, so LDAP_URI
+// must use ldaps:// (or StartTLS).
+func (d *ldapDirectory) enableAD(user, password string) error {
+	if err := d.writePassword(user, password); err != nil {
+		return fmt.Errorf("Could not add a password to the new user: %v", err)
+	}
+
+	logDebug("ldap", "modify dn=%q replace userAccountControl=%d", user, adNormalAccount)
+	modify := ldap.NewModifyRequest(user, nil)
+	modify.Replace("userAccountControl", []string{fmt.Sprint(adNormalAccount)})
+	if err := d.conn.Modify(modify); err != nil {
+		return fmt.Errorf("Could not enable the new user: %v", err)
+	}
+	return nil
+}
+
+// domainFromDN derives a DNS domain from the DC components of a DN, such as
+// example.com for ou=people,dc=example,dc=com.
+func domainFromDN(dn string) string {
+	var parts []string
+	for _, rdn := range strings.Split(dn, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(rdn), "=")
+		if ok && strings.EqualFold(k, "dc") {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// logAdd logs an add request. None of the attributes we add carry secrets.
+func logAdd(req *ldap.AddRequest) {
+	if !debugEnabled("ldap") {
+		return
+	}
+	attrs := make([]string, len(req.Attributes))
+	for i, a := range req.Attributes {
+		attrs[i] = a.Type + "=" + strings.Join(a.Vals, "|")
+	}
+	logDebug("ldap", "add dn=%q %s", req.DN, strings.Join(attrs, " "))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// TestHostileUsernames checks that the usernames made of the special
+// characters of DNs and filters stay within their RDN and their assertion.
+func TestHostileUsernames(t *testing.T) {
+	options().DirectoryType = "ldap"
+	options().LdapUserFilter, options().LdapUserObjectClass, options().LdapUserAttribute = "", "", ""
+	options().LdapUserScope = "ou=people,dc=example,dc=com"
+	if err := initLDAPFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, user, rdn, filter string
+	}{
+		{"comma", "a,ou=admins", `uid=a\,ou\=admins`, `(&(objectClass=person)(uid=a,ou=admins))`},
+		{"plus", "a+cn=b", `uid=a\+cn\=b`, `(&(objectClass=person)(uid=a+cn=b))`},
+		{"equals", "a=b", `uid=a\=b`, `(&(objectClass=person)(uid=a=b))`},
+		{"backslash", `a\2cb`, `uid=a\\2cb`, `(&(objectClass=person)(uid=a\5c2cb))`},
+		{"leading hash", "#a", `uid=\#a`, `(&(objectClass=person)(uid=#a))`},
+		{"inner hash", "a#b", `uid=a#b`, `(&(objectClass=person)(uid=a#b))`},
+		{"leading space", " a", `uid=\ a`, `(&(objectClass=person)(uid= a))`},
+		{"trailing space", "a ", `uid=a\ `, `(&(objectClass=person)(uid=a ))`},
+		{"nul", "a\x00b", `uid=a\00b`, `(&(objectClass=person)(uid=a\00b))`},
+		{"quotes and angles", `a"<b>;`, `uid=a\"\<b\>\;`, `(&(objectClass=person)(uid=a"<b>;))`},
+		{"filter injection", "*)(uid=*", `uid=*)(uid\=*`, `(&(objectClass=person)(uid=\2a\29\28uid=\2a))`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dn, err := userDN("uid", tc.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.rdn + "," + options().LdapUserScope; dn != want {
+				t.Errorf("userDN(%q) = %q, want %q", tc.user, dn, want)
+			}
+			parsed, err := ldap.ParseDN(dn)
+			if err != nil {
+				t.Fatalf("ParseDN(%q): %v", dn, err)
+			}
+			if len(parsed.RDNs) != 4 || len(parsed.RDNs[0].Attributes) != 1 || parsed.RDNs[0].Attributes[0].Value != tc.user {
+				t.Errorf("%q parses to %v, not to a single RDN holding the username", dn, parsed)
+			}
+
+			filter, err := userFilter(tc.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filter != tc.filter {
+				t.Errorf("userFilter(%q) = %q, want %q", tc.user, filter, tc.filter)
+			}
+			compiled, err := ldap.CompileFilter(filter)
+			if err != nil {
+				t.Fatalf("CompileFilter(%q): %v", filter, err)
+			}
+			// the filter is an AND of the class and of an equality
+			// assertion, with the username as its value
+			if len(compiled.Children) != 2 || len(compiled.Children[1].Children) != 2 ||
+				compiled.Children[1].Tag != ldap.FilterEqualityMatch ||
+				compiled.Children[1].Children[1].Data.String() != tc.user {
+				t.Errorf("%q does not match the username with a single equality assertion", filter)
+			}
+		})
+	}
+}
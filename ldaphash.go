@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id parameters, as recommended by RFC 9106 for memory constrained
+// environments
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+// validatePasswordHash checks the LDAP_PASSWORD_HASH option.
+func validatePasswordHash() error {
+	switch options().LdapPasswordHash {
+	case "", "ssha", "argon2", "bcrypt":
+		return nil
+	default:
+		return fmt.Errorf("Unknown LDAP_PASSWORD_HASH %q, expected one of ssha, argon2 or bcrypt", options().LdapPasswordHash)
+	}
+}
+
+func salt(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// hashPassword hashes a password for the userPassword attribute with the
+// LDAP_PASSWORD_HASH scheme, in the RFC 3112 {SCHEME} format.
+func hashPassword(password string) (string, error) {
+	switch options().LdapPasswordHash {
+	case "ssha":
+		s, err := salt(8)
+		if err != nil {
+			return "", err
+		}
+		sum := sha1.Sum(append([]byte(password), s...))
+		return "{SSHA}" + base64.StdEncoding.EncodeToString(append(sum[:], s...)), nil
+	case "argon2":
+		s, err := salt(16)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), s, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("{ARGON2}$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(s), base64.RawStdEncoding.EncodeToString(key)), nil
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return "{CRYPT}" + string(hash), nil
+	}
+	return "", fmt.Errorf("Unknown LDAP_PASSWORD_HASH %q", options().LdapPasswordHash)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionLimiter bounds the number of sessions served at the same time, both
+// globally and per remote IP. A zero limit means unlimited. The global limit
+// protects this process' resources and is always local, while the per-IP
+// counters are kept in Redis when shared is set, so that they span all the
+// instances.
+type sessionLimiter struct {
+	slots    chan struct{}
+	maxPerIP int
+	shared   *redis.Client
+
+	mu    sync.Mutex
+	perIP map[string]int
+}
+
+func newSessionLimiter(max, maxPerIP int) *sessionLimiter {
+	l := &sessionLimiter{maxPerIP: maxPerIP, perIP: map[string]int{}}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// setMaxPerIP changes the per-IP limit. Sessions over the new limit are not
+// interrupted.
+func (l *sessionLimiter) setMaxPerIP(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxPerIP = n
+}
+
+func (l *sessionLimiter) perIPLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxPerIP
+}
+
+// acquireIP reserves a per-IP slot, returning false if the IP already has too
+// many open sessions.
+func (l *sessionLimiter) acquireIP(ip string) bool {
+	if max := l.perIPLimit(); max > 0 && l.shared != nil {
+		return l.acquireSharedIP(ip, max)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+func (l *sessionLimiter) releaseIP(ip string) {
+	if l.perIPLimit() > 0 && l.shared != nil {
+		l.releaseSharedIP(ip)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// redisSessionsTTL bounds how long a per-IP counter survives in Redis, so
+// that counters left behind by a crashed instance eventually go away.
+const redisSessionsTTL = time.Hour
+
+const redisSessionsPrefix = "sshauth:sessions:"
+
+func (l *sessionLimiter) acquireSharedIP(ip string, max int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := l.shared.TxPipeline()
+	n := pipe.Incr(ctx, redisSessionsPrefix+ip)
+	pipe.Expire(ctx, redisSessionsPrefix+ip, redisSessionsTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logError("Could not update the session count in Redis: %v", err)
+		return true
+	}
+	if int(n.Val()) > max {
+		l.releaseSharedIP(ip)
+		return false
+	}
+	return true
+}
+
+func (l *sessionLimiter) releaseSharedIP(ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := l.shared.Decr(ctx, redisSessionsPrefix+ip).Err(); err != nil {
+		logError("Could not update the session count in Redis: %v", err)
+	}
+}
+
+// tryAcquire reserves a global slot without waiting.
+func (l *sessionLimiter) tryAcquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire waits for a global slot for at most wait, or until ctx is done.
+func (l *sessionLimiter) acquire(ctx context.Context, wait time.Duration) bool {
+	if l.slots == nil {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *sessionLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// remoteIP extracts the IP portion of a remote address.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// systemdListeners returns the sockets passed by systemd via LISTEN_FDS, if
+// any were meant for this process.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	lns := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not use systemd socket %d: %v", fd, err)
+		}
+		logInfo("Listening on %s (%s, from systemd)", ln.Addr(), addressFamily("tcp", ln.Addr()))
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// parseListen splits a LISTEN entry into its network and address. The
+// optional tcp4:// and tcp6:// prefixes restrict the socket to a single
+// address family, so that [::] and 0.0.0.0 can be bound separately, or IPv6
+// alone be served.
+func parseListen(entry string) (network, addr string, err error) {
+	network, addr, ok := strings.Cut(entry, "://")
+	if !ok {
+		return "tcp", entry, nil
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return network, addr, nil
+	default:
+		return "", "", fmt.Errorf("Unknown network %q in LISTEN, expected one of tcp, tcp4 or tcp6", network)
+	}
+}
+
+// addressFamily describes the families of the addresses a socket accepts.
+// Wildcard sockets of the plain tcp network accept both.
+func addressFamily(network string, addr net.Addr) string {
+	switch network {
+	case "tcp4":
+		return "IPv4"
+	case "tcp6":
+		return "IPv6 only"
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	switch {
+	case !ok:
+		return "unknown family"
+	case ta.IP.To4() != nil:
+		return "IPv4"
+	case ta.IP.IsUnspecified():
+		return "IPv4 and IPv6"
+	}
+	return "IPv6"
+}
+
+// listeners opens all the configured listening sockets. Sockets passed by
+// systemd take precedence over the LISTEN and SSH_HOST/SSH_PORT options.
+func listeners() ([]net.Listener, error) {
+	lns, err := systemdListeners()
+	if err != nil || len(lns) > 0 {
+		return lns, err
+	}
+
+	addrs := options().Listen
+	if len(addrs) == 0 {
+		addrs = []string{net.JoinHostPort(options().Host, strconv.Itoa(options().Port))}
+	}
+	for _, entry := range addrs {
+		network, addr, err := parseListen(strings.TrimSpace(entry))
+		if err == nil {
+			var ln net.Listener
+			if ln, err = net.Listen(network, addr); err == nil {
+				logInfo("Listening on %s (%s)", ln.Addr(), addressFamily(network, ln.Addr()))
+				lns = append(lns, ln)
+				continue
+			}
+			err = fmt.Errorf("Could not listen on %s: %v", entry, err)
+		}
+		for _, l := range lns {
+			l.Close()
+		}
+		return nil, err
+	}
+	return lns, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// requestLLDAPReset asks LLDAP to mail the user a link to reset their
+// password, through the endpoint behind its "forgot password" page. LLDAP
+// replies the same way whether or not the user exists, and needs its own
+// SMTP settings to send the mail.
+func requestLLDAPReset(ctx context.Context, user string) error {
+	u := options().LldapURI.JoinPath("/auth/reset/step1", url.PathEscape(user)).String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := sendWith(lldapClient.get(), req, nil); err != nil {
+		return fmt.Errorf("Could not request a password reset from LLDAP: %v", err)
+	}
+	return nil
+}
+
+// offerReset lets an already registered user reset their password, when
+// LLDAP_PASSWORD_RESET is set.
+func (s *session) offerReset() {
+	io.WriteString(s, s.text(RESET_PROMPT))
+	buf, err := readN(s, 1, []byte{'y', 'n'}, true)
+	if err != nil || len(buf) < 1 || buf[0] != 'y' {
+		s.bye()
+		return
+	}
+	if !s.challenge() {
+		return
+	}
+	err = s.progress(s.text(PROGRESS_RESET), func() error {
+		return requestLLDAPReset(s.ctx, s.user)
+	})
+	if err != nil {
+		s.internalError("Could not reset the password", err)
+		return
+	}
+	logInfo("Requested a password reset for %s from %s", s.user, s.ip)
+	s.exit = exitOK
+	s.say(styleSuccess, s.text(RESET_SENT))
+}
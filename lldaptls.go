@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// lldapClient talks to the HTTP API of LLDAP, trusting the certificates of
+// LLDAP_CA_FILE on top of the system ones, since LLDAP often runs with a
+// self-signed certificate.
+var lldapClient = newReloadable(httpClient)
+
+// loadLLDAPTLS sets up lldapClient from the LLDAP_CA_FILE, LLDAP_CLIENT_*
+// and LLDAP_INSECURE_SKIP_VERIFY options.
+func loadLLDAPTLS() error {
+	if options().LldapCAFile == "" && options().LldapClientCert == "" && options().LldapClientKey == "" && !options().LldapInsecureSkipVerify {
+		lldapClient.set(httpClient)
+		return nil
+	}
+	config := &tls.Config{}
+	if options().LldapCAFile != "" {
+		pem, err := os.ReadFile(options().LldapCAFile)
+		if err != nil {
+			return fmt.Errorf("Could not read LLDAP_CA_FILE: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("LLDAP_CA_FILE %s holds no PEM certificate", options().LldapCAFile)
+		}
+		config.RootCAs = pool
+	}
+	if (options().LldapClientCert == "") != (options().LldapClientKey == "") {
+		return fmt.Errorf("LLDAP_CLIENT_CERT and LLDAP_CLIENT_KEY must be set together")
+	}
+	if options().LldapClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(options().LldapClientCert, options().LldapClientKey)
+		if err != nil {
+			return fmt.Errorf("Could not load the LLDAP client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if options().LldapInsecureSkipVerify {
+		logWarn("LLDAP_INSECURE_SKIP_VERIFY is set, the certificate of %s is not verified", options().LldapURI.Host)
+		config.InsecureSkipVerify = true
+	}
+	t := newHTTPTransport()
+	t.TLSClientConfig = config
+	lldapClient.set(&http.Client{Transport: t})
+	return nil
+}
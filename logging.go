@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var (
+	logLevel = newReloadable(levelInfo)
+	// debugSubsystems holds the subsystems listed in LOG_DEBUG, whose debug
+	// output is printed regardless of LOG_LEVEL.
+	debugSubsystems reloadable[map[string]bool]
+)
+
+var levelNames = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func initLogging() error {
+	lvl, ok := levelNames[strings.ToLower(options().LogLevel)]
+	if !ok {
+		return fmt.Errorf("Unknown LOG_LEVEL %q, expected one of debug, info, warn or error", options().LogLevel)
+	}
+	debug := map[string]bool{}
+	for _, sub := range options().LogDebug {
+		switch sub = strings.ToLower(strings.TrimSpace(sub)); sub {
+		case "smtp", "ldap":
+			debug[sub] = true
+		case "":
+		default:
+			return fmt.Errorf("Unknown LOG_DEBUG subsystem %q, expected smtp or ldap", sub)
+		}
+	}
+	logLevel.set(lvl)
+	debugSubsystems.set(debug)
+	return initLogSink()
+}
+
+func debugEnabled(subsystem string) bool {
+	return logLevel.get() <= levelDebug || debugSubsystems.get()[subsystem]
+}
+
+func logDebug(subsystem, format string, v ...any) {
+	if debugEnabled(subsystem) {
+		output(levelDebug, subsystem, "[debug] ["+subsystem+"] ", fmt.Sprintf(format, v...))
+	}
+}
+
+func logInfo(format string, v ...any) {
+	if logLevel.get() <= levelInfo {
+		output(levelInfo, "", "", fmt.Sprintf(format, v...))
+	}
+}
+
+func logWarn(format string, v ...any) {
+	if logLevel.get() <= levelWarn {
+		output(levelWarn, "", "[warn] ", fmt.Sprintf(format, v...))
+	}
+}
+
+func logError(format string, v ...any) {
+	output(levelError, "", "[error] ", fmt.Sprintf(format, v...))
+}
+
+// output writes a line to the LOG_OUTPUT sink, or to the standard error with
+// its prefix when there is none or it fails.
+func output(level int, subsystem, prefix, msg string) {
+	if !writeSink(level, subsystem, msg) {
+		log.Print(prefix + msg)
+	}
+}
+
+// wireLog wraps a connection and logs every line going through it with the
+// given subsystem. Lines for which redact returns true are logged with their
+// arguments masked.
+type wireLog struct {
+	net.Conn
+	subsystem string
+	redact    func(line string) bool
+}
+
+func (w *wireLog) dump(dir string, p []byte) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if w.redact != nil && w.redact(line) {
+			if cmd, _, ok := strings.Cut(line, " "); ok {
+				line = cmd + " <redacted>"
+			} else {
+				line = "<redacted>"
+			}
+		}
+		logDebug(w.subsystem, "%s %s", dir, line)
+	}
+}
+
+func (w *wireLog) Read(p []byte) (int, error) {
+	n, err := w.Conn.Read(p)
+	if n > 0 {
+		w.dump("<", p[:n])
+	}
+	return n, err
+}
+
+func (w *wireLog) Write(p []byte) (int, error) {
+	w.dump(">", p)
+	return w.Conn.Write(p)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logSink receives the log lines instead of the standard error, as per
+// LOG_OUTPUT.
+type logSink interface {
+	write(level int, subsystem, msg string) error
+	Close() error
+}
+
+var (
+	sinkMu sync.Mutex
+	sink   logSink
+)
+
+// the syslog severities of the levels
+var severities = map[int]int{
+	levelDebug: 7,
+	levelInfo:  6,
+	levelWarn:  4,
+	levelError: 3,
+}
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// initLogSink opens the sink selected by LOG_OUTPUT, closing the previous
+// one.
+func initLogSink() error {
+	var s logSink
+	switch options().LogOutput {
+	case "stderr":
+	case "syslog":
+		facility, ok := facilities[strings.ToLower(options().LogSyslogFacility)]
+		if !ok {
+			return fmt.Errorf("Unknown LOG_SYSLOG_FACILITY %q", options().LogSyslogFacility)
+		}
+		u, err := url.Parse(options().LogSyslogAddress)
+		if err != nil {
+			return fmt.Errorf("Invalid LOG_SYSLOG_ADDRESS: %v", err)
+		}
+		sl := &syslogSink{facility: facility}
+		switch u.Scheme {
+		case "udp", "tcp":
+			sl.network, sl.address = u.Scheme, u.Host
+		case "unix":
+			sl.network, sl.address = "unixgram", u.Path
+		default:
+			return fmt.Errorf("Invalid LOG_SYSLOG_ADDRESS %q, expected udp://host:port, tcp://host:port or unix:///path", options().LogSyslogAddress)
+		}
+		if sl.hostname, err = os.Hostname(); err != nil || sl.hostname == "" {
+			sl.hostname = "-"
+		}
+		if err := sl.dial(); err != nil {
+			return fmt.Errorf("Could not connect to syslog at %s: %v", options().LogSyslogAddress, err)
+		}
+		s = sl
+	case "journald":
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("Could not connect to journald: %v", err)
+		}
+		s = &journalSink{conn: conn}
+	case "eventlog":
+		var err error
+		if s, err = openEventLog(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown LOG_OUTPUT %q, expected one of stderr, syslog, journald or eventlog", options().LogOutput)
+	}
+
+	sinkMu.Lock()
+	old := sink
+	sink = s
+	sinkMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// writeSink writes a line to the sink, reporting false when there is none
+// or it failed, for the line to go to the standard error.
+func writeSink(level int, subsystem, msg string) bool {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	if sink == nil {
+		return false
+	}
+	return sink.write(level, subsystem, msg) == nil
+}
+
+// syslogSink sends RFC 5424 messages to a syslog server, framed with the
+// octet counting of RFC 6587 over TCP.
+type syslogSink struct {
+	network, address string
+	facility         int
+	hostname         string
+	conn             net.Conn
+}
+
+func (s *syslogSink) dial() (err error) {
+	s.conn, err = net.DialTimeout(s.network, s.address, 5*time.Second)
+	return
+}
+
+func (s *syslogSink) write(level int, subsystem, msg string) error {
+	msgid := subsystem
+	if msgid == "" {
+		msgid = "-"
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		s.facility*8+severities[level], time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, options().LogSyslogTag, os.Getpid(), msgid, msg)
+	if s.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	if s.conn != nil {
+		if _, err := s.conn.Write([]byte(line)); err == nil {
+			return nil
+		}
+		s.conn.Close()
+	}
+	// the server may have restarted, try once more
+	if err := s.dial(); err != nil {
+		s.conn = nil
+		return err
+	}
+	_, err := s.conn.Write([]byte(line))
+	return err
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// journalSink sends the lines to journald with its native protocol, along
+// with the subsystem in the SSHAUTH_SUBSYSTEM field.
+type journalSink struct {
+	conn *net.UnixConn
+}
+
+func (j *journalSink) write(level int, subsystem, msg string) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", fmt.Sprint(severities[level]))
+	journalField(&b, "SYSLOG_IDENTIFIER", options().LogSyslogTag)
+	if subsystem != "" {
+		journalField(&b, "SSHAUTH_SUBSYSTEM", subsystem)
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// journalField encodes a field of the journal protocol, with the length
+// prefixed form for the values spanning several lines.
+func journalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+func (j *journalSink) Close() error {
+	return j.conn.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// relayHealth remembers the relays which failed lately, skipped until then,
+// so that a dead primary doesn't cost every mail a connection timeout.
+var relayHealth = struct {
+	sync.Mutex
+	down map[string]time.Time
+}{down: map[string]time.Time{}}
+
+// orderRelays puts the relays considered down after the others, keeping
+// their order otherwise, so that they are still tried when all of them are.
+func orderRelays(relays []smtpRoute) []smtpRoute {
+	relayHealth.Lock()
+	defer relayHealth.Unlock()
+	var up, down []smtpRoute
+	for _, r := range relays {
+		if clockNow().Before(relayHealth.down[r.server]) {
+			down = append(down, r)
+		} else {
+			up = append(up, r)
+		}
+	}
+	return append(up, down...)
+}
+
+// recordRelay records the outcome of a send through a relay.
+func recordRelay(server string, err error) {
+	relayHealth.Lock()
+	defer relayHealth.Unlock()
+	if err != nil && failover(err) {
+		if _, ok := relayHealth.down[server]; !ok {
+			logWarn("Mail relay %s is failing, skipping it for %s: %v", server, options().MailRelayCooldown, err)
+		}
+		relayHealth.down[server] = clockNow().Add(options().MailRelayCooldown)
+		return
+	}
+	if _, ok := relayHealth.down[server]; ok {
+		logInfo("Mail relay %s is back up", server)
+		delete(relayHealth.down, server)
+	}
+}
+
+// failover reports whether a mail which failed with err may be sent through
+// another relay: the relay couldn't be reached, dropped the connection or
+// answered with a temporary 4xx error. The permanent 5xx errors would be
+// the same with every relay.
+func failover(err error) bool {
+	var tp *textproto.Error
+	if errors.As(err, &tp) {
+		return tp.Code >= 400 && tp.Code < 500
+	}
+	return !errors.Is(err, errRecipientRejected)
+}
+
+// sendFailover sends a message through the first of the relays accepting
+// it.
+func sendFailover(ctx context.Context, relays []smtpRoute, to, msg string) (err error) {
+	for i, route := range relays {
+		err = sendSMTP(ctx, route, to, msg)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// the user leaving says nothing of the relay
+			return err
+		}
+		recordRelay(route.server, err)
+		if ctx.Err() != nil {
+			// MAIL_TIMEOUT is spent, the relay being too slow
+			return err
+		}
+		if err == nil || !failover(err) {
+			return err
+		}
+		if i+1 < len(relays) {
+			logWarn("Could not send mail through %s, trying %s: %v", route.server, relays[i+1].server, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// reservedHeaders are set by buildMessage itself and cannot be overridden by
+// MAIL_HEADERS.
+var reservedHeaders = []string{"date", "message-id", "from", "to", "subject", "mime-version", "content-type", "content-transfer-encoding"}
+
+// mailHeaders are the extra headers of every mail, as given by MAIL_HEADERS.
+var mailHeaders reloadable[[][2]string]
+
+// parseMailHeaders parses MAIL_HEADERS, a semicolon separated list of
+// Name: value entries, and checks MAIL_ENVELOPE_FROM.
+func parseMailHeaders() error {
+	if options().MailEnvelopeFrom != "" {
+		if _, err := mail.ParseAddress(options().MailEnvelopeFrom); err != nil {
+			return fmt.Errorf("Invalid MAIL_ENVELOPE_FROM %q: %v", options().MailEnvelopeFrom, err)
+		}
+	}
+	var headers [][2]string
+	for _, entry := range options().MailHeaders {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !validHeaderName(name) {
+			return fmt.Errorf("Invalid MAIL_HEADERS entry %q, expected Name: value", entry)
+		}
+		if contains(reservedHeaders, strings.ToLower(name)) {
+			return fmt.Errorf("MAIL_HEADERS cannot set the %s header", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("Invalid MAIL_HEADERS value for %s: line breaks are not allowed", name)
+		}
+		headers = append(headers, [2]string{name, mime.QEncoding.Encode("utf-8", value)})
+	}
+	mailHeaders.set(headers)
+	return nil
+}
+
+// validHeaderName reports whether name is a header field name as per RFC
+// 5322: printable ASCII characters but the colon.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// envelopeFrom returns the address given as the envelope sender, to which
+// the bounces and the delivery status notifications are sent.
+func envelopeFrom() string {
+	if options().MailEnvelopeFrom != "" {
+		a, _ := mail.ParseAddress(options().MailEnvelopeFrom)
+		return a.Address
+	}
+	return options().FromAddress
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// smtpRoute is a mail server along with the credentials to use with it.
+type smtpRoute struct {
+	server   string
+	username string
+	password string
+}
+
+// mailRoutes maps recipient domains to the relays handling them, as given
+// by MAIL_ROUTES. Domains starting with "*." also match their subdomains.
+var mailRoutes reloadable[map[string][]smtpRoute]
+
+// parseMailRoutes parses MAIL_ROUTES, a comma separated list of
+// domain=smtp://[user:password@]host:port entries, where several relays
+// separated by | are tried in order, see sendFailover.
+func parseMailRoutes() error {
+	routes := map[string][]smtpRoute{}
+	for _, entry := range options().MailRoutes {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		domain, targets, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("Invalid MAIL_ROUTES entry %q, expected domain=smtp://host:port", entry)
+		}
+		var relays []smtpRoute
+		for _, target := range strings.Split(targets, "|") {
+			u, err := url.Parse(strings.TrimSpace(target))
+			if err != nil || u.Scheme != "smtp" || u.Host == "" {
+				return fmt.Errorf("Invalid MAIL_ROUTES target %q, expected smtp://[user:password@]host:port", target)
+			}
+			r := smtpRoute{server: u.Host}
+			if u.User != nil {
+				r.username = u.User.Username()
+				r.password, _ = u.User.Password()
+			}
+			relays = append(relays, r)
+		}
+		routes[strings.ToLower(strings.TrimSpace(domain))] = relays
+	}
+	mailRoutes.set(routes)
+	return nil
+}
+
+// mailRelays picks the relays for the given recipient, falling back to
+// MAIL_SERVER when no route matches its domain.
+func mailRelays(address string) []smtpRoute {
+	domain := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+	if r, ok := mailRoutes.get()[domain]; ok {
+		return r
+	}
+	for d := domain; ; {
+		_, parent, ok := strings.Cut(d, ".")
+		if !ok {
+			break
+		}
+		if r, ok := mailRoutes.get()["*."+parent]; ok {
+			return r
+		}
+		d = parent
+	}
+	var relays []smtpRoute
+	for _, server := range options().SMTPServer {
+		if server = strings.TrimSpace(server); server != "" {
+			relays = append(relays, smtpRoute{server: server, username: options().SMTPUsername, password: options().SMTPPassword})
+		}
+	}
+	if len(relays) == 0 {
+		relays = append(relays, smtpRoute{server: "localhost:25"})
+	}
+	return relays
+}
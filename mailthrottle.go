@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisMailThrottlePrefix = "sshauth:mailthrottle:"
+
+// mailThrottle limits how many tokens are mailed to the same address within
+// MAIL_THROTTLE_WINDOW, whoever asks for them, so that the service can't be
+// used to flood someone's inbox. The sends are logged in Redis when shared
+// is set, so that the limit spans all the instances.
+type mailThrottle struct {
+	shared *redis.Client
+
+	mu    sync.Mutex
+	sends map[string][]time.Time
+}
+
+var mailThrottles = &mailThrottle{sends: map[string][]time.Time{}}
+
+// validateMailThrottle checks the MAIL_THROTTLE options.
+func validateMailThrottle() error {
+	if options().MailThrottle > 0 && options().MailThrottleWindow <= 0 {
+		return fmt.Errorf("MAIL_THROTTLE_WINDOW must be positive when MAIL_THROTTLE is set")
+	}
+	return nil
+}
+
+// take records a mail to addr, unless MAIL_THROTTLE mails were sent to it
+// within the window already. In that case it returns how long to wait before
+// the next one is allowed.
+func (m *mailThrottle) take(ctx context.Context, addr string) (time.Duration, error) {
+	if options().MailThrottle <= 0 {
+		return 0, nil
+	}
+	addr = strings.ToLower(addr)
+	now := clockNow()
+	window := options().MailThrottleWindow
+	if m.shared != nil {
+		return m.takeShared(ctx, addr, now, window)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// drop the sends which left the window, for every address
+	for a, sends := range m.sends {
+		i := 0
+		for i < len(sends) && now.Sub(sends[i]) >= window {
+			i++
+		}
+		if i == len(sends) {
+			delete(m.sends, a)
+		} else {
+			m.sends[a] = sends[i:]
+		}
+	}
+	sends := m.sends[addr]
+	if len(sends) >= options().MailThrottle {
+		return sends[0].Add(window).Sub(now), nil
+	}
+	m.sends[addr] = append(sends, now)
+	return 0, nil
+}
+
+// takeShared keeps the sends to an address in a sorted set scored by time.
+func (m *mailThrottle) takeShared(ctx context.Context, addr string, now time.Time, window time.Duration) (time.Duration, error) {
+	key := redisMailThrottlePrefix + addr
+	member := fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int63())
+	pipe := m.shared.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprint(now.Add(-window).UnixNano()))
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixNano()), Member: member})
+	count := pipe.ZCard(ctx, key)
+	oldest := pipe.ZRangeWithScores(ctx, key, 0, 0)
+	pipe.PExpire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	if int(count.Val()) <= options().MailThrottle {
+		return 0, nil
+	}
+	// over the limit, give the slot back
+	if err := m.shared.ZRem(ctx, key, member).Err(); err != nil {
+		return 0, err
+	}
+	var first time.Time
+	if z := oldest.Val(); len(z) > 0 {
+		first = time.Unix(0, int64(z[0].Score))
+	}
+	return first.Add(window).Sub(now), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// maintenanceFlag is set through the admin API or the admin shell.
+var maintenanceFlag atomic.Bool
+
+// inMaintenance reports whether registrations are suspended, either at
+// runtime, because MAINTENANCE_FILE exists or because the directory is down.
+func inMaintenance() bool {
+	if maintenanceFlag.Load() || breakerOpen() {
+		return true
+	}
+	if options().MaintenanceFile == "" {
+		return false
+	}
+	_, err := os.Stat(options().MaintenanceFile)
+	return err == nil
+}
+
+// setMaintenance suspends or resumes the registrations at runtime.
+func setMaintenance(on bool) {
+	if maintenanceFlag.Swap(on) == on {
+		return
+	}
+	if on {
+		logInfo("Entering maintenance mode")
+	} else {
+		logInfo("Leaving maintenance mode")
+	}
+}
+
+// maintenanceMessage returns MAINTENANCE_MESSAGE, ending with a newline.
+func maintenanceMessage() string {
+	msg := options().MaintenanceMessage
+	if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+		msg += "\n"
+	}
+	return msg
+}
@@ -0,0 +1,5 @@
+// Package managementpb holds the messages and the client of the management
+// API of sshauth, generated from proto/sshauth/management.proto.
+package managementpb
+
+//go:generate protoc -I ../proto --go_out=.. --go_opt=module=github.com/lucat1/sshauth --go-grpc_out=.. --go-grpc_opt=module=github.com/lucat1/sshauth sshauth/management.proto
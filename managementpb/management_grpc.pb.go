@@ -0,0 +1,265 @@
+// The management API of sshauth, served on GRPC_LISTEN for the tools driving
+// the registrations. Every call must carry "authorization: Bearer
+// $ADMIN_TOKEN" in its metadata.
+//
+// The Go code in managementpb is generated from this file, with
+// go generate ./managementpb.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: sshauth/management.proto
+
+package managementpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Management_Invite_FullMethodName = "/sshauth.Management/Invite"
+	Management_Status_FullMethodName = "/sshauth.Management/Status"
+	Management_Revoke_FullMethodName = "/sshauth.Management/Revoke"
+	Management_Events_FullMethodName = "/sshauth.Management/Events"
+)
+
+// ManagementClient is the client API for Management service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ManagementClient interface {
+	// Invite mails a token to a user who isn't registered yet, for them to
+	// enter when they connect.
+	Invite(ctx context.Context, in *InviteRequest, opts ...grpc.CallOption) (*InviteReply, error)
+	// Status describes where a user is in the registration.
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusReply, error)
+	// Revoke drops the pending token of a user.
+	Revoke(ctx context.Context, in *RevokeRequest, opts ...grpc.CallOption) (*RevokeReply, error)
+	// Events streams the audit events until the client goes away.
+	Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (Management_EventsClient, error)
+}
+
+type managementClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewManagementClient(cc grpc.ClientConnInterface) ManagementClient {
+	return &managementClient{cc}
+}
+
+func (c *managementClient) Invite(ctx context.Context, in *InviteRequest, opts ...grpc.CallOption) (*InviteReply, error) {
+	out := new(InviteReply)
+	err := c.cc.Invoke(ctx, Management_Invite_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusReply, error) {
+	out := new(StatusReply)
+	err := c.cc.Invoke(ctx, Management_Status_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) Revoke(ctx context.Context, in *RevokeRequest, opts ...grpc.CallOption) (*RevokeReply, error) {
+	out := new(RevokeReply)
+	err := c.cc.Invoke(ctx, Management_Revoke_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (Management_EventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Management_ServiceDesc.Streams[0], Management_Events_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managementEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Management_EventsClient interface {
+	Recv() (*AuditEvent, error)
+	grpc.ClientStream
+}
+
+type managementEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *managementEventsClient) Recv() (*AuditEvent, error) {
+	m := new(AuditEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ManagementServer is the server API for Management service.
+// All implementations must embed UnimplementedManagementServer
+// for forward compatibility
+type ManagementServer interface {
+	// Invite mails a token to a user who isn't registered yet, for them to
+	// enter when they connect.
+	Invite(context.Context, *InviteRequest) (*InviteReply, error)
+	// Status describes where a user is in the registration.
+	Status(context.Context, *StatusRequest) (*StatusReply, error)
+	// Revoke drops the pending token of a user.
+	Revoke(context.Context, *RevokeRequest) (*RevokeReply, error)
+	// Events streams the audit events until the client goes away.
+	Events(*EventsRequest, Management_EventsServer) error
+	mustEmbedUnimplementedManagementServer()
+}
+
+// UnimplementedManagementServer must be embedded to have forward compatible implementations.
+type UnimplementedManagementServer struct {
+}
+
+func (UnimplementedManagementServer) Invite(context.Context, *InviteRequest) (*InviteReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Invite not implemented")
+}
+func (UnimplementedManagementServer) Status(context.Context, *StatusRequest) (*StatusReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
+func (UnimplementedManagementServer) Revoke(context.Context, *RevokeRequest) (*RevokeReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Revoke not implemented")
+}
+func (UnimplementedManagementServer) Events(*EventsRequest, Management_EventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Events not implemented")
+}
+func (UnimplementedManagementServer) mustEmbedUnimplementedManagementServer() {}
+
+// UnsafeManagementServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ManagementServer will
+// result in compilation errors.
+type UnsafeManagementServer interface {
+	mustEmbedUnimplementedManagementServer()
+}
+
+func RegisterManagementServer(s grpc.ServiceRegistrar, srv ManagementServer) {
+	s.RegisterService(&Management_ServiceDesc, srv)
+}
+
+func _Management_Invite_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InviteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagementServer).Invite(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Management_Invite_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagementServer).Invite(ctx, req.(*InviteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Management_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagementServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Management_Status_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagementServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Management_Revoke_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagementServer).Revoke(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Management_Revoke_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagementServer).Revoke(ctx, req.(*RevokeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Management_Events_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(EventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ManagementServer).Events(m, &managementEventsServer{stream})
+}
+
+type Management_EventsServer interface {
+	Send(*AuditEvent) error
+	grpc.ServerStream
+}
+
+type managementEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *managementEventsServer) Send(m *AuditEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Management_ServiceDesc is the grpc.ServiceDesc for Management service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Management_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sshauth.Management",
+	HandlerType: (*ManagementServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Invite",
+			Handler:    _Management_Invite_Handler,
+		},
+		{
+			MethodName: "Status",
+			Handler:    _Management_Status_Handler,
+		},
+		{
+			MethodName: "Revoke",
+			Handler:    _Management_Revoke_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Events",
+			Handler:       _Management_Events_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sshauth/management.proto",
+}
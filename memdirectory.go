@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// memoryDirectory keeps the users in memory, for the dev command and for
+// trying the flows out without a directory. The users are lost when the
+// process exits, and the passwords are only checked to be set.
+type memoryDirectory struct {
+	mu    sync.Mutex
+	users map[string]*memoryUser
+}
+
+type memoryUser struct {
+	mail     string
+	password bool
+	disabled bool
+	defaults userDefaults
+}
+
+// memoryUsers is shared by the connections, each of which opens the
+// directory.
+var memoryUsers = &memoryDirectory{users: map[string]*memoryUser{}}
+
+func (d *memoryDirectory) Close() error {
+	return nil
+}
+
+func (d *memoryDirectory) Exists(_ context.Context, user string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.users[user]
+	return ok, nil
+}
+
+func (d *memoryDirectory) Register(_ context.Context, user, mail, password string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users[user] = &memoryUser{mail: mail, password: password != ""}
+	logInfo("[memory] Added user %s <%s>", user, mail)
+	return nil
+}
+
+func (d *memoryDirectory) ApplyDefaults(_ context.Context, user string, defaults userDefaults) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u, ok := d.users[user]; ok {
+		u.defaults = defaults
+	}
+	return nil
+}
+
+func (d *memoryDirectory) Mail(_ context.Context, user string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u, ok := d.users[user]; ok {
+		return u.mail, nil
+	}
+	return "", nil
+}
+
+func (d *memoryDirectory) UserByMail(_ context.Context, mail string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for user, u := range d.users {
+		if strings.EqualFold(u.mail, mail) {
+			return user, nil
+		}
+	}
+	return "", nil
+}
+
+func (d *memoryDirectory) SetMail(_ context.Context, user, mail string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u, ok := d.users[user]; ok {
+		u.mail = mail
+		logInfo("[memory] Changed the address of user %s to %s", user, mail)
+	}
+	return nil
+}
+
+func (d *memoryDirectory) SetPassword(_ context.Context, user, password string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u, ok := d.users[user]; ok {
+		u.password = password != ""
+		logInfo("[memory] Set the password of user %s", user)
+	}
+	return nil
+}
+
+func (d *memoryDirectory) PublicKeys(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+func (d *memoryDirectory) Disable(_ context.Context, user string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u, ok := d.users[user]; ok {
+		u.disabled = true
+		logInfo("[memory] Disabled user %s", user)
+	}
+	return nil
+}
+
+func (d *memoryDirectory) Enable(_ context.Context, user string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u, ok := d.users[user]; ok {
+		u.disabled = false
+		logInfo("[memory] Enabled user %s", user)
+	}
+	return nil
+}
+
+func (d *memoryDirectory) Delete(_ context.Context, user string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.users, user)
+	logInfo("[memory] Deleted user %s", user)
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// messageID generates a globally unique Message-ID in the domain of the
+// sender address.
+func messageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// buildMessage formats an RFC 5322 message, with the headers in a fixed
+// order followed by MAIL_HEADERS, and non-ASCII values encoded as per RFC
+// 2047.
+func buildMessage(from, to mail.Address, subject, body string) string {
+	header := [][2]string{
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID(from.Address)},
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `text/html; charset="UTF-8"`},
+		{"Content-Transfer-Encoding", "8bit"},
+	}
+	header = append(header, mailHeaders.get()...)
+	var b strings.Builder
+	for _, h := range header {
+		b.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return b.String()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// defaultMessages defines every message shown to the users, in English.
+//
+//go:embed messages.tmpl
+var defaultMessages string
+
+// messageData is the data available to the message templates. User, Mail
+// and IP are always set when known, the other fields only for the messages
+// using them.
+type messageData struct {
+	User string
+	Mail string
+	IP   string
+
+	URL       string
+	Token     string
+	Rules     string
+	Domains   string
+	Subsystem string
+	Retries   int
+	Wait      time.Duration
+	// the attempt at entering the token about to be made, out of Attempts
+	Attempt, Attempts int
+	// the numbers of the challenge
+	A, B string
+	// the command connecting to SSH_PUBLIC_ADDRESS as User, if set
+	Command string
+	// the reason given by the policy service, if any
+	Reason string
+	// the free usernames suggested when User is taken
+	Suggestions []string
+	// the external identity linked to the account, and what it is, see
+	// LINK_IDENTITY_LABEL
+	Identity, Label string
+	// the phone number being verified, see VERIFY_PHONE
+	Phone string
+}
+
+var (
+	builtinMessages = template.Must(template.New("messages").Parse(defaultMessages))
+	// catalogs holds the messages by language, such as en or pt_br
+	catalogs = newReloadable(map[string]*template.Template{"en": builtinMessages})
+	// messages is the catalog of MESSAGES_LANGUAGE, used when the client
+	// doesn't ask for a language we have
+	messages = newReloadable(builtinMessages)
+)
+
+// loadMessages builds the message catalogs. The *.tmpl files in MESSAGES_DIR
+// are parsed over the built-in messages, so that operators can override only
+// some of them, making up the en catalog. Each subdirectory, named after a
+// language such as it or pt_BR, holds the overrides for that language.
+func loadMessages() error {
+	cats := map[string]*template.Template{"en": builtinMessages}
+	if options().MessagesDir != "" {
+		base, err := parseMessages(builtinMessages, options().MessagesDir)
+		if err != nil {
+			return err
+		}
+		cats["en"] = base
+		entries, err := os.ReadDir(options().MessagesDir)
+		if err != nil {
+			return fmt.Errorf("Could not read MESSAGES_DIR: %v", err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			t, err := parseMessages(base, filepath.Join(options().MessagesDir, e.Name()))
+			if err != nil {
+				return err
+			}
+			cats[languageKey(e.Name())] = t
+		}
+	}
+	def, ok := cats[languageKey(options().MessagesLanguage)]
+	if !ok {
+		return fmt.Errorf("No messages for MESSAGES_LANGUAGE %q in MESSAGES_DIR", options().MessagesLanguage)
+	}
+	catalogs.set(cats)
+	messages.set(def)
+	return nil
+}
+
+// parseMessages parses the *.tmpl files in dir over a copy of base.
+func parseMessages(base *template.Template, dir string) (*template.Template, error) {
+	t := template.Must(base.Clone())
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not list %s: %v", dir, err)
+	}
+	if len(files) == 0 {
+		return t, nil
+	}
+	if _, err := t.ParseFiles(files...); err != nil {
+		return nil, fmt.Errorf("Could not parse the messages in %s: %v", dir, err)
+	}
+	// render every message once so mistakes are caught at startup
+	for _, d := range builtinMessages.Templates() {
+		if err := t.ExecuteTemplate(&strings.Builder{}, d.Name(), messageData{}); err != nil {
+			return nil, fmt.Errorf("Could not render the %s message in %s: %v", d.Name(), dir, err)
+		}
+	}
+	return t, nil
+}
+
+// languageKey normalizes a language such as pt-BR or pt_BR.UTF-8 to pt_br.
+func languageKey(lang string) string {
+	if i := strings.IndexAny(lang, ".@"); i >= 0 {
+		lang = lang[:i]
+	}
+	return strings.ToLower(strings.ReplaceAll(lang, "-", "_"))
+}
+
+// catalogFor picks the catalog matching the locale sent by the client in
+// LC_ALL, LC_MESSAGES or LANG, with SendEnv, trying pt_br before pt. It
+// returns the MESSAGES_LANGUAGE catalog when none matches.
+func catalogFor(environ []string) *template.Template {
+	cats := catalogs.get()
+	env := map[string]string{}
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			env[name] = value
+		}
+	}
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		lang := languageKey(env[name])
+		if lang == "" {
+			continue
+		}
+		if t, ok := cats[lang]; ok {
+			return t
+		}
+		if base, _, ok := strings.Cut(lang, "_"); ok {
+			if t, ok := cats[base]; ok {
+				return t
+			}
+		}
+		// the first variable set decides, as for the C library
+		break
+	}
+	return messages.get()
+}
+
+// renderText renders the named message in the MESSAGES_LANGUAGE catalog.
+func renderText(name string, d messageData) string {
+	return renderIn(messages.get(), name, d)
+}
+
+// renderIn renders the named message from a catalog, falling back to the
+// built-in one when the override can't be rendered.
+func renderIn(t *template.Template, name string, d messageData) string {
+	var b strings.Builder
+	err := t.ExecuteTemplate(&b, name, d)
+	if err == nil {
+		return b.String()
+	}
+	logError("Could not render the %s message: %v", name, err)
+	b.Reset()
+	if err := builtinMessages.ExecuteTemplate(&b, name, d); err != nil {
+		logError("Could not render the built-in %s message: %v", name, err)
+	}
+	return b.String()
+}
+
+// connText renders a message for a connection which has no session yet.
+func connText(s ssh.Session, name string) string {
+	return renderIn(catalogFor(s.Environ()), name, messageData{User: s.User(), IP: remoteIP(s.RemoteAddr())})
+}
+
+// textData renders the named message for the user of the session.
+func (s *session) textData(name string, d messageData) string {
+	d.User, d.IP = s.user, s.ip
+	if d.Mail == "" {
+		d.Mail = s.mail
+	}
+	t := s.messages
+	if t == nil {
+		t = messages.get()
+	}
+	return renderIn(t, name, d)
+}
+
+// text renders a message which needs no more than the session data.
+func (s *session) text(name string) string {
+	return s.textData(name, messageData{})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the reasons of the failures counted by sshauth_failures_total
+const (
+	failMailError        = "mail_error"
+	failMailRejected     = "mail_rejected"
+	failMailThrottled    = "mail_throttled"
+	failChallenge        = "challenge_failed"
+	failTokenExpired     = "token_expired"
+	failTokenRevoked     = "token_revoked"
+	failTokenWrong       = "token_wrong"
+	failTokenBound       = "token_bound"
+	failPasswordPolicy   = "password_policy"
+	failPasswordMismatch = "password_mismatch"
+	failDirectoryError   = "directory_error"
+	failQuotaExceeded    = "quota_exceeded"
+	failLockedOut        = "locked_out"
+	failPolicyDenied     = "policy_denied"
+	failPolicyReview     = "policy_review"
+	failMailTaken        = "mail_taken"
+)
+
+// failureKinds tells the failures caused by the users from the ones caused
+// by the infrastructure, and from the limits enforced on purpose.
+var failureKinds = map[string]string{
+	failMailError:        "infrastructure",
+	failMailRejected:     "user",
+	failMailThrottled:    "policy",
+	failChallenge:        "user",
+	failTokenExpired:     "user",
+	failTokenRevoked:     "policy",
+	failTokenWrong:       "user",
+	failTokenBound:       "policy",
+	failPasswordPolicy:   "user",
+	failPasswordMismatch: "user",
+	failDirectoryError:   "infrastructure",
+	failQuotaExceeded:    "policy",
+	failMailTaken:        "policy",
+	failLockedOut:        "policy",
+	failPolicyDenied:     "policy",
+	failPolicyReview:     "policy",
+}
+
+// counterVec is a Prometheus counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// inc adds one to the counter with the given label values, in the order of
+// the labels.
+func (c *counterVec) inc(values ...string) {
+	pairs := make([]string, len(c.labels))
+	for i, l := range c.labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l, values[i])
+	}
+	c.mu.Lock()
+	c.values[strings.Join(pairs, ",")]++
+	c.mu.Unlock()
+}
+
+// write writes the counter in the Prometheus text format or, with
+// openMetrics, in OpenMetrics, where the family name has no _total suffix.
+func (c *counterVec) write(w io.Writer, openMetrics bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	family := c.name
+	if openMetrics {
+		family = strings.TrimSuffix(family, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", family, c.help, family)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %g\n", c.name, k, c.values[k])
+	}
+}
+
+// exemplar is the last observation of a histogram bucket, along with the
+// trace it was made in.
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+// histogram is a Prometheus histogram whose buckets keep an exemplar,
+// exposed in the OpenMetrics format only.
+type histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu sync.Mutex
+	// counts[i] counts the observations in (buckets[i-1], buckets[i]], the
+	// last one those above every bucket
+	counts    []uint64
+	exemplars []exemplar
+	sum       float64
+}
+
+func newHistogram(name, help string, buckets ...float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets)+1), exemplars: make([]exemplar, len(buckets)+1)}
+}
+
+// observe records v, with the trace it belongs to, if traced.
+func (h *histogram) observe(v float64, traceID string) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	if traceID != "" {
+		h.exemplars[i] = exemplar{traceID: traceID, value: v, at: time.Now()}
+	}
+}
+
+// mean returns the mean of the observations, or def when there is none.
+func (h *histogram) mean(def time.Duration) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n uint64
+	for _, c := range h.counts {
+		n += c
+	}
+	if n == 0 {
+		return def
+	}
+	return time.Duration(h.sum / float64(n) * float64(time.Second))
+}
+
+func (h *histogram) write(w io.Writer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = fmt.Sprint(h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d", h.name, le, total)
+		if e := h.exemplars[i]; openMetrics && e.traceID != "" {
+			fmt.Fprintf(w, " # {trace_id=%q} %g %.3f", e.traceID, e.value, float64(e.at.UnixMilli())/1000)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, total)
+}
+
+var (
+	sessionOutcomes = newCounterVec("sshauth_sessions_total", "Registration sessions, by outcome.", "outcome")
+	failures        = newCounterVec("sshauth_failures_total", "Failures during the registrations, by reason and by kind: user, policy or infrastructure.", "reason", "kind")
+	mailLatency     = newHistogram("sshauth_mail_delivery_seconds", "Time taken to hand a mail over to the mail server.", 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30)
+)
+
+// writeMetrics writes all the metrics in the Prometheus text format or in
+// OpenMetrics.
+func writeMetrics(w io.Writer, openMetrics bool) {
+	sessionOutcomes.write(w, openMetrics)
+	failures.write(w, openMetrics)
+	mailLatency.write(w, openMetrics)
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
+
+// countFailure counts a failure in sshauth_failures_total.
+func countFailure(reason string) {
+	failures.inc(reason, failureKinds[reason])
+}
+
+// validateMetrics checks the METRICS_PUSH_* options.
+func validateMetrics() error {
+	if options().MetricsPushURL != "" && options().MetricsPushInterval <= 0 {
+		return fmt.Errorf("METRICS_PUSH_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// serveMetrics exposes the metrics to Prometheus on METRICS_LISTEN, in
+// OpenMetrics to the scrapers asking for it, and pushes them to
+// METRICS_PUSH_URL, if configured.
+func serveMetrics() {
+	if options().MetricsPushURL != "" {
+		go pushMetrics()
+	}
+	if options().MetricsListen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			writeMetrics(w, true)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, false)
+	})
+	logInfo("Metrics listening on %s", options().MetricsListen)
+	go func() {
+		log.Fatal(http.ListenAndServe(options().MetricsListen, mux))
+	}()
+}
+
+// pushMetrics pushes the metrics to the Pushgateway at METRICS_PUSH_URL
+// every METRICS_PUSH_INTERVAL, grouped by METRICS_PUSH_JOB and the host
+// name, for the hosts Prometheus can't scrape.
+func pushMetrics() {
+	instance, _ := os.Hostname()
+	if instance == "" {
+		instance = "unknown"
+	}
+	target := strings.TrimSuffix(options().MetricsPushURL, "/") + "/metrics/job/" + url.PathEscape(options().MetricsPushJob) + "/instance/" + url.PathEscape(instance)
+	logInfo("Pushing metrics to %s every %s", options().MetricsPushURL, options().MetricsPushInterval)
+	for range time.Tick(options().MetricsPushInterval) {
+		var b bytes.Buffer
+		writeMetrics(&b, false)
+		req, err := http.NewRequest(http.MethodPut, target, &b)
+		if err != nil {
+			logError("Could not push the metrics: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		if _, err := send(req, nil); err != nil {
+			logWarn("Could not push the metrics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// maxNotices bounds the notices waiting for a session to reach a prompt,
+// the older ones being shown first and the newer ones dropped.
+const maxNotices = 4
+
+// liveSessions are the sessions connected at the moment, which the notices
+// broadcast by the admins are sent to.
+var liveSessions = struct {
+	sync.Mutex
+	m map[*session]struct{}
+}{m: map[*session]struct{}{}}
+
+// track adds the session to liveSessions, until the returned function is
+// called.
+func (s *session) track() func() {
+	s.notices = make(chan string, maxNotices)
+	liveSessions.Lock()
+	liveSessions.m[s] = struct{}{}
+	liveSessions.Unlock()
+	return func() {
+		liveSessions.Lock()
+		delete(liveSessions.m, s)
+		liveSessions.Unlock()
+	}
+}
+
+// notify queues msg for the session, to be shown at its current prompt or
+// at the next one, see promptWatch. It reports false when too many notices
+// are waiting already.
+func (s *session) notify(msg string) bool {
+	select {
+	case s.notices <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// broadcastNotice sends a one-line notice, such as "maintenance in 5
+// minutes", to every connected session, returning how many got it.
+func broadcastNotice(msg string) (int, error) {
+	msg = strings.TrimSpace(msg)
+	if msg == "" || strings.ContainsAny(msg, "\r\n") {
+		return 0, fmt.Errorf("The notice must be a single, non-empty line")
+	}
+	// nothing else but text reaches the terminals of the users
+	msg = strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, msg) + "\n"
+	liveSessions.Lock()
+	defer liveSessions.Unlock()
+	n := 0
+	for s := range liveSessions.m {
+		if s.notify(msg) {
+			n++
+		}
+	}
+	logInfo("Broadcast a notice to %d sessions: %s", n, strings.TrimSpace(msg))
+	return n, nil
+}
+
+// broadcastNoticeFile broadcasts the first line of NOTICE_FILE, on SIGUSR1.
+func broadcastNoticeFile() {
+	if options().NoticeFile == "" {
+		logWarn("Received SIGUSR1 but NOTICE_FILE is not set")
+		return
+	}
+	data, err := os.ReadFile(options().NoticeFile)
+	if err != nil {
+		logError("Could not read NOTICE_FILE: %v", err)
+		return
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	if _, err := broadcastNotice(line); err != nil {
+		logError("Could not broadcast NOTICE_FILE: %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// noticeOnSIGUSR1 broadcasts NOTICE_FILE whenever SIGUSR1 is received.
+func noticeOnSIGUSR1() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		broadcastNoticeFile()
+	}
+}
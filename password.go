@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// passwordChars are the bytes accepted at the password prompt: printable
+// ASCII without the space.
+var passwordChars = func() []byte {
+	b := make([]byte, 0, '~'-'!'+1)
+	for c := byte('!'); c <= '~'; c++ {
+		b = append(b, c)
+	}
+	return b
+}()
+
+// passwordRulesData is the data available to the PASSWORD_RULES_TEXT template.
+type passwordRulesData struct {
+	Min    uint
+	Max    uint
+	Regexp string
+}
+
+var (
+	passwordRegexp        reloadable[*regexp.Regexp]
+	passwordRulesTemplate reloadable[*template.Template]
+)
+
+// initPasswordRules compiles PASSWORD_REGEXP, if any, and parses
+// PASSWORD_RULES_TEXT, falling back to a description derived from the
+// policy options.
+func initPasswordRules() error {
+	if options().PasswordMin > options().PasswordMax {
+		return fmt.Errorf("PASSWORD_MIN (%d) is greater than PASSWORD_MAX (%d)", options().PasswordMin, options().PasswordMax)
+	}
+	var re *regexp.Regexp
+	if options().PasswordRegexp != "" {
+		var err error
+		if re, err = regexp.Compile(options().PasswordRegexp); err != nil {
+			return fmt.Errorf("Could not compile PASSWORD_REGEXP: %v", err)
+		}
+	}
+
+	text := options().PasswordRulesText
+	if text == "" {
+		text = describePolicy()
+	}
+	t, err := template.New("rules").Parse(text)
+	if err != nil {
+		return fmt.Errorf("Could not parse PASSWORD_RULES_TEXT: %v", err)
+	}
+	// the rules are shown at every password prompt: a field other than .Min,
+	// .Max and .Regexp is refused here rather than in front of a user
+	if _, err := renderPasswordRules(t); err != nil {
+		return err
+	}
+	passwordRegexp.set(re)
+	passwordRulesTemplate.set(t)
+	return nil
+}
+
+// describePolicy builds a rules template matching the policy options.
+func describePolicy() string {
+	rules := []string{"The length must be between {{.Min}} and {{.Max}} (included)"}
+	if options().PasswordRequireLetter {
+		rules = append(rules, "It must contain at least one letter")
+	}
+	if options().PasswordRequireUpper {
+		rules = append(rules, "It must contain at least one uppercase letter")
+	}
+	if options().PasswordRequireLower {
+		rules = append(rules, "It must contain at least one lowercase letter")
+	}
+	if options().PasswordRequireDigit {
+		rules = append(rules, "It must contain at least one digit")
+	}
+	if options().PasswordRequireSymbol {
+		rules = append(rules, "It must contain at least one symbol")
+	}
+	if options().PasswordForbidUsername {
+		rules = append(rules, "It must not contain your username")
+	}
+	if options().PasswordRegexp != "" {
+		rules = append(rules, "It must match the pattern {{.Regexp}}")
+	}
+	return "- " + strings.Join(rules, "\n- ") + "\n"
+}
+
+// passwordRules renders the description of the password requirements.
+func passwordRules() (string, error) {
+	return renderPasswordRules(passwordRulesTemplate.get())
+}
+
+func renderPasswordRules(t *template.Template) (string, error) {
+	var b strings.Builder
+	data := passwordRulesData{Min: options().PasswordMin, Max: options().PasswordMax, Regexp: options().PasswordRegexp}
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("Could not render PASSWORD_RULES_TEXT: %v", err)
+	}
+	rules := b.String()
+	if !strings.HasSuffix(rules, "\n") {
+		rules += "\n"
+	}
+	return rules, nil
+}
+
+// checkPassword evaluates the password policy, returning a message for the
+// user describing the first rule which isn't satisfied, or "" if the
+// password is acceptable.
+func checkPassword(user, passwd string) string {
+	if uint(len(passwd)) < options().PasswordMin {
+		return "Password is too short"
+	}
+
+	var letter, upper, lower, digit, symbol bool
+	for _, r := range passwd {
+		switch {
+		case unicode.IsUpper(r):
+			letter, upper = true, true
+		case unicode.IsLower(r):
+			letter, lower = true, true
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	switch {
+	case options().PasswordRequireLetter && !letter:
+		return "Password must contain a letter"
+	case options().PasswordRequireUpper && !upper:
+		return "Password must contain an uppercase letter"
+	case options().PasswordRequireLower && !lower:
+		return "Password must contain a lowercase letter"
+	case options().PasswordRequireDigit && !digit:
+		return "Password must contain a digit"
+	case options().PasswordRequireSymbol && !symbol:
+		return "Password must contain a symbol"
+	}
+
+	if options().PasswordForbidUsername && user != "" && strings.Contains(strings.ToLower(passwd), strings.ToLower(user)) {
+		return "Password must not contain your username"
+	}
+	if re := passwordRegexp.get(); re != nil && !re.MatchString(passwd) {
+		return "Password does not comply with the rules"
+	}
+	return ""
+}
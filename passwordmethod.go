@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the ways of handing the passwords to the directory
+const (
+	passwordExop  = "exop"
+	passwordHash  = "hash"
+	passwordPlain = "plain"
+	passwordAPI   = "api"
+)
+
+// backendPasswordMethods declares the password methods each backend
+// supports, the first one being its default. LLDAP and OpenLDAP take the
+// extended operation, while Active Directory only takes the clear password,
+// in unicodePwd. The webhook hashes with bcrypt.
+var backendPasswordMethods = map[string][]string{
+	"ldap":      {passwordExop, passwordHash, passwordPlain},
+	"ad":        {passwordPlain},
+	"keycloak":  {passwordAPI},
+	"authentik": {passwordAPI},
+	"scim":      {passwordAPI},
+	"webhook":   {passwordHash, passwordPlain},
+}
+
+// passwordBackend names the backend in backendPasswordMethods.
+func passwordBackend() string {
+	if options().DirectoryBackend == "ldap" && options().DirectoryType == "ad" {
+		return "ad"
+	}
+	return options().DirectoryBackend
+}
+
+// passwordMethod returns the PASSWORD_METHOD or, when it is not set, the one
+// selected by the older LDAP_PASSWORD_HASH and WEBHOOK_PASSWORD_MODE, or else
+// the default of the backend.
+func passwordMethod() string {
+	if options().PasswordMethod != "" {
+		return options().PasswordMethod
+	}
+	switch passwordBackend() {
+	case "ldap":
+		if options().LdapPasswordHash != "" {
+			return passwordHash
+		}
+	case "webhook":
+		if options().WebhookPasswordMode == "plaintext" {
+			return passwordPlain
+		}
+	}
+	if methods := backendPasswordMethods[passwordBackend()]; len(methods) > 0 {
+		return methods[0]
+	}
+	return ""
+}
+
+// validatePasswordMethod checks the PASSWORD_METHOD against the methods
+// supported by the backend.
+func validatePasswordMethod() error {
+	methods, ok := backendPasswordMethods[passwordBackend()]
+	if !ok {
+		// refused when the directory is opened
+		return nil
+	}
+	method := passwordMethod()
+	if !contains(methods, method) {
+		return fmt.Errorf("The %s backend does not support PASSWORD_METHOD=%s, expected one of %s", passwordBackend(), method, strings.Join(methods, ", "))
+	}
+	if method == passwordHash && options().DirectoryBackend == "ldap" && options().LdapPasswordHash == "" {
+		return fmt.Errorf("PASSWORD_METHOD=hash needs LDAP_PASSWORD_HASH, the scheme to hash with")
+	}
+	if method == passwordPlain && options().DirectoryBackend == "ldap" {
+		for _, uri := range options().LdapURI {
+			if uri = strings.TrimSpace(uri); uri != "" && !strings.HasPrefix(uri, "ldaps://") && !strings.HasPrefix(uri, "ldapi://") {
+				logWarn("PASSWORD_METHOD=plain sends the passwords in clear to %s, which is not ldaps://", uri)
+			}
+		}
+	}
+	return nil
+}
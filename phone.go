@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// With VERIFY_PHONE, the users prove a phone number too, entering a code
+// sent to it by SMS after the token mailed to them, before the account is
+// created. The flow does so with the verify_phone action, which the default
+// flow gets, and which a FLOW_FILE must have before register.
+
+// the attempts at entering a phone number the user is given
+const phoneRetries = 3
+
+// phonePattern is what a phone number may look like, as the phone field of
+// fields.go, with the separators dropped before sending.
+var phonePattern = regexp.MustCompile(profileFields["phone"].pattern)
+
+// errPhoneUnverified is returned by createAccount when VERIFY_PHONE is set
+// and the session didn't verify a phone number, such as the scripted ones.
+var errPhoneUnverified = errors.New("the phone number was not verified")
+
+// smsNotifier sends a text message to a phone number.
+type smsNotifier interface {
+	Send(ctx context.Context, to, text string) error
+}
+
+// the notifiers of SMS_BACKEND
+var smsNotifiers = map[string]func() smsNotifier{
+	"webhook": func() smsNotifier { return webhookSMS{} },
+	"twilio":  func() smsNotifier { return twilioSMS{} },
+}
+
+var smsSender reloadable[smsNotifier]
+
+// loadSMSNotifier checks the VERIFY_PHONE and SMS_* options.
+func loadSMSNotifier() error {
+	smsSender.set(nil)
+	if !options().VerifyPhone {
+		return nil
+	}
+	if options().WebListen != "" || options().ScriptedMode {
+		return fmt.Errorf("VERIFY_PHONE can't be used with WEB_LISTEN or SCRIPTED_MODE, which don't prompt for a phone number")
+	}
+	newNotifier, ok := smsNotifiers[options().SMSBackend]
+	if !ok {
+		return fmt.Errorf("Unknown SMS_BACKEND %q, expected one of webhook or twilio", options().SMSBackend)
+	}
+	switch options().SMSBackend {
+	case "webhook":
+		if options().SMSWebhookURL == "" {
+			return fmt.Errorf("SMS_BACKEND=webhook needs SMS_WEBHOOK_URL")
+		}
+	case "twilio":
+		if options().TwilioAccountSID == "" || options().TwilioAuthToken == "" || options().SMSFrom == "" {
+			return fmt.Errorf("SMS_BACKEND=twilio needs TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and SMS_FROM")
+		}
+	}
+	if options().SMSCodeLength < 4 {
+		return fmt.Errorf("SMS_CODE_LENGTH must be at least 4")
+	}
+	smsSender.set(newNotifier())
+	return nil
+}
+
+// webhookSMS posts {"to": ..., "text": ...} to SMS_WEBHOOK_URL, for a
+// gateway of the deployment to send.
+type webhookSMS struct{}
+
+func (webhookSMS) Send(ctx context.Context, to, text string) error {
+	body := struct {
+		To   string `json:"to"`
+		Text string `json:"text"`
+	}{to, text}
+	_, err := doJSON(ctx, http.MethodPost, options().SMSWebhookURL, nil, body, nil)
+	return err
+}
+
+// twilioSMS sends the messages through the API of Twilio, from SMS_FROM.
+type twilioSMS struct{}
+
+func (twilioSMS) Send(ctx context.Context, to, text string) error {
+	form := url.Values{"To": {to}, "From": {options().SMSFrom}, "Body": {text}}
+	u := "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(options().TwilioAccountSID) + "/Messages.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(options().TwilioAccountSID, options().TwilioAuthToken)
+	_, err = send(req, nil)
+	return err
+}
+
+// normalizePhone drops the separators of a phone number, keeping the
+// leading + and the digits.
+func normalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' || r == '+' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+// verifyPhone asks for a phone number and checks the code sent to it by
+// SMS, storing the number in the variable of the step, phone by default.
+// The user gets TOKEN_RETRIES attempts at the code, after which the session
+// ends.
+func (s *session) verifyPhone(st *flowStep) bool {
+	if s.decoy {
+		// nothing is registered, and nobody is texted
+		return true
+	}
+	for i := 0; i < phoneRetries; i++ {
+		s.say(stylePrompt, s.text(PHONE_PROMPT))
+		recorded := s.recordSecret("phone")
+		buf, err := readN(s, maxPromptAnswer, nil, true)
+		recorded()
+		if err != nil {
+			s.bye()
+			return false
+		}
+		phone := strings.TrimSpace(string(buf))
+		if !phonePattern.MatchString(phone) {
+			s.say(styleError, s.text(INVALID_ANSWER))
+			continue
+		}
+		phone = normalizePhone(phone)
+		if !s.checkPhone(phone) {
+			return false
+		}
+		s.vars[st.Var] = phone
+		return true
+	}
+	s.bye()
+	return false
+}
+
+// checkPhone texts a code to phone and reads it back.
+func (s *session) checkPhone(phone string) bool {
+	code := randomRunes(numericRunes, options().SMSCodeLength)
+	err := s.progress(s.textData(PROGRESS_SMS, messageData{Phone: phone}), func() error {
+		return smsSender.get().Send(s.ctx, phone, s.textData(SMS_BODY, messageData{User: s.user, Token: code}))
+	})
+	if err != nil {
+		s.internalError("Could not send the SMS", err)
+		return false
+	}
+	logInfo("Sent a verification code by SMS to %s for %s", phone, s.user)
+	for left := options().TokenRetries; left > 0; left-- {
+		s.say(stylePrompt, s.text(PHONE_CODE_PROMPT))
+		recorded := s.recordSecret("sms")
+		buf, err := readN(s, options().SMSCodeLength+tokenInputSlack, nil, true)
+		recorded()
+		if err != nil {
+			s.bye()
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(string(buf))), []byte(code)) == 1 {
+			s.phoneVerified = true
+			audits.publish(auditEvent{Type: auditPhoneVerified, User: s.user, Mail: s.mail, IP: s.ip, Detail: phone})
+			return true
+		}
+		bans.fail(s.ip, s.user, "invalid SMS code")
+		countFailure(failTokenWrong)
+		if left > 1 {
+			s.say(styleError, s.textData(TOKEN_RETRY, messageData{Retries: left - 1}))
+		}
+	}
+	s.exit = exitTokenFailed
+	s.say(styleError, s.text(PHONE_CODE_FAILED))
+	return false
+}
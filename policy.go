@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// the decisions of the policy service
+const (
+	policyAllow  = "allow"
+	policyDeny   = "deny"
+	policyReview = "review"
+)
+
+// policyRequest is posted to POLICY_URL before a registration starts.
+type policyRequest struct {
+	User    string `json:"user"`
+	IP      string `json:"ip"`
+	Profile string `json:"profile,omitempty"`
+	// whether the user came through the web form
+	Web bool `json:"web,omitempty"`
+}
+
+// policyReply is the decision of the policy service: allow, deny, or review
+// when an operator has to approve the registration, inviting the user once
+// approved. Message, if any, is shown to the user.
+type policyReply struct {
+	Decision string `json:"decision"`
+	Message  string `json:"message"`
+}
+
+// validatePolicy checks the POLICY_* options.
+func validatePolicy() error {
+	switch options().PolicyFailure {
+	case "deny", "allow":
+		return nil
+	default:
+		return fmt.Errorf("Unknown POLICY_FAILURE %q, expected one of deny or allow", options().PolicyFailure)
+	}
+}
+
+// askPolicy asks the policy service at POLICY_URL whether the user may
+// register, allowing everyone when it is not set. When the service can't be
+// reached, or its reply is not understood, POLICY_FAILURE decides.
+func (s *session) askPolicy() policyReply {
+	if options().PolicyURL == "" {
+		return policyReply{Decision: policyAllow}
+	}
+	ctx, sp := startSpan(s.ctx, "policy", spanKindClient)
+	req := policyRequest{User: s.user, IP: s.ip, Web: s.web}
+	if s.profile != nil {
+		req.Profile = s.profile.Name
+	}
+	header := http.Header{}
+	if options().PolicyToken != "" {
+		header.Set("Authorization", "Bearer "+options().PolicyToken)
+	}
+	var rep policyReply
+	_, err := doJSON(ctx, http.MethodPost, options().PolicyURL, header, req, &rep)
+	if err == nil && rep.Decision != policyAllow && rep.Decision != policyDeny && rep.Decision != policyReview {
+		err = fmt.Errorf("unknown decision %q", rep.Decision)
+	}
+	sp.finish(err)
+	if err != nil {
+		logError("Could not ask the policy service about %s from %s, applying POLICY_FAILURE=%s: %v", s.user, s.ip, options().PolicyFailure, err)
+		return policyReply{Decision: options().PolicyFailure}
+	}
+	sp.setAttr("policy.decision", rep.Decision)
+	switch rep.Decision {
+	case policyDeny:
+		logWarn("The policy service denied the registration of %s from %s", s.user, s.ip)
+		countFailure(failPolicyDenied)
+		audits.publish(auditEvent{Type: auditFailed, User: s.user, IP: s.ip, Detail: "denied by the policy service"})
+	case policyReview:
+		logInfo("The policy service asked for the registration of %s from %s to be approved", s.user, s.ip)
+		countFailure(failPolicyReview)
+		s.raiseAlert(securityAlert{Event: "approval required", User: s.user, IP: s.ip, Detail: "the policy service asked for the registration to be approved, invite the user to approve it"})
+	}
+	return rep
+}
+
+// policyAllows asks the policy service whether the user may register,
+// telling them why not.
+func (s *session) policyAllows() bool {
+	rep := s.askPolicy()
+	switch rep.Decision {
+	case policyDeny:
+		s.say(styleError, s.textData(POLICY_DENIED, messageData{Reason: rep.Message}))
+	case policyReview:
+		s.say(styleBold, s.textData(POLICY_REVIEW, messageData{Reason: rep.Message}))
+	default:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const previewUsage = "Usage: sshauth preview-mail [--lang <language>] [--listen <address>]"
+
+// previewMail is a mail rendered with sample data by previewMails.
+type previewMail struct {
+	Name    string
+	Subject string
+	Body    string
+}
+
+// previewMails renders every mail sshauth sends, in the catalog of lang, or
+// MESSAGES_LANGUAGE when empty, with sample data standing in for the user.
+func previewMails(lang string) ([]previewMail, error) {
+	if err := loadMessages(); err != nil {
+		return nil, err
+	}
+	// the welcome mail is shown even when WELCOME_MAIL is off
+	welcome := options().WelcomeMail
+	options().WelcomeMail = true
+	err := loadWelcomeMail()
+	options().WelcomeMail = welcome
+	if err != nil {
+		return nil, err
+	}
+	t := messages.get()
+	if lang != "" {
+		var ok bool
+		if t, ok = catalogs.get()[languageKey(lang)]; !ok {
+			return nil, fmt.Errorf("No messages for the language %q in MESSAGES_DIR", lang)
+		}
+	}
+
+	const user, mail, ip = "jdoe", "jdoe@example.com", "203.0.113.7"
+	token := issueToken(user, mail, clockNow().Add(options().TokenTTL))
+	login := options().LldapURI.JoinPath("/login").String()
+	var welcomeBody strings.Builder
+	if err := welcomeTemplate.get().Execute(&welcomeBody, welcomeData{User: user, Mail: mail, LoginURL: login}); err != nil {
+		return nil, fmt.Errorf("Could not render WELCOME_MAIL_TEMPLATE: %v", err)
+	}
+	return []previewMail{
+		{"token", options().Subject, renderIn(t, MAIL_BODY, messageData{User: user, Mail: mail, IP: ip, Token: token})},
+		{"link", options().Subject, renderIn(t, LINK_BODY, messageData{User: user, Mail: mail, IP: ip, URL: confirmURL(user, token)})},
+		{"invite", options().Subject, renderIn(t, INVITE_BODY, messageData{User: user, Mail: mail, Token: token, Command: sshCommand(user)})},
+		{"account-exists", options().Subject, renderIn(t, ACCOUNT_EXISTS_BODY, messageData{User: user, Mail: mail, IP: ip, URL: login})},
+		{"welcome", options().WelcomeMailSubject, welcomeBody.String()},
+	}, nil
+}
+
+// previewMailCommand prints the mails rendered with sample data, so that the
+// templates of MESSAGES_DIR and WELCOME_MAIL_TEMPLATE can be worked on
+// without mailing anyone. With --listen, they are served over HTTP instead,
+// rendered again on every request, for a browser to show the changes as the
+// templates are saved.
+func previewMailCommand(args []string) error {
+	var lang, listen string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--lang" && i+1 < len(args):
+			i++
+			lang = args[i]
+		case args[i] == "--listen" && i+1 < len(args):
+			i++
+			listen = args[i]
+		default:
+			return errors.New(previewUsage)
+		}
+	}
+	if listen != "" {
+		fmt.Printf("Serving the mail previews on http://%s/\n", listen)
+		return http.ListenAndServe(listen, &previewServer{lang: lang})
+	}
+	mails, err := previewMails(lang)
+	if err != nil {
+		return err
+	}
+	for _, m := range mails {
+		fmt.Fprintf(os.Stdout, "==> %s: %s\n%s\n\n", m.Name, m.Subject, m.Body)
+	}
+	return nil
+}
+
+// previewServer serves an index of the mails at /, each one as HTML at
+// /<name>, and in plain text with ?plain.
+type previewServer struct {
+	lang string
+	// the catalogs are rebuilt by every request
+	mu sync.Mutex
+}
+
+func (p *previewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	mails, err := previewMails(p.lang)
+	p.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" {
+		var b strings.Builder
+		b.WriteString("<!DOCTYPE html>\n<title>sshauth mail previews</title>\n<ul>\n")
+		for _, m := range mails {
+			fmt.Fprintf(&b, "<li><a href=\"/%s\">%s</a>: %s (<a href=\"/%[1]s?plain\">plain</a>)</li>\n", m.Name, m.Name, html.EscapeString(m.Subject))
+		}
+		b.WriteString("</ul>\n")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(b.String()))
+		return
+	}
+	for _, m := range mails {
+		if m.Name != name {
+			continue
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if r.URL.Query().Has("plain") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		w.Write([]byte(m.Body))
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// secretSuffixes mark the options holding credentials, masked by the config
+// command, along with secretOptions.
+var (
+	secretSuffixes = []string{"_PASSWORD", "_SECRET", "_SECRET_ID", "_TOKEN"}
+	secretOptions  = []string{"OTEL_EXPORTER_OTLP_HEADERS"}
+)
+
+// vaultNames records the options read from Vault, for the config command.
+var vaultNames = map[string]bool{}
+
+// urlPattern matches the URLs in the option values, whose credentials are
+// masked.
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s,]+`)
+
+const masked = "xxxxx"
+
+// printConfig prints where every option comes from and its effective value,
+// once the configuration file, the secret files, Vault and the environment
+// are merged. Credentials are masked.
+func printConfig(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: sshauth config")
+	}
+	if err := initVault(); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	t, v := reflect.TypeOf(Options{}), reflect.ValueOf(*options())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s=%s\n", optionSource(name), name, maskOption(name, optionValue(f, v.Field(i))))
+	}
+	return w.Flush()
+}
+
+// optionValue formats the value of an option the way it would be set.
+func optionValue(f reflect.StructField, v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case url.URL:
+		return x.String()
+	case time.Duration:
+		return x.String()
+	case []string:
+		sep := f.Tag.Get("envSeparator")
+		if sep == "" {
+			sep = ","
+		}
+		return strings.Join(x, sep)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func maskOption(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if contains(secretOptions, name) {
+		return masked
+	}
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return masked
+		}
+	}
+	return urlPattern.ReplaceAllStringFunc(value, func(s string) string {
+		u, err := url.Parse(s)
+		if err != nil || u.User == nil {
+			return s
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), masked)
+		} else {
+			// a token, as for NATS or the Sentry DSN
+			u.User = url.User(masked)
+		}
+		return u.String()
+	})
+}
+
+// optionSource tells where the value of an option comes from, the last one
+// applied winning.
+func optionSource(name string) string {
+	switch {
+	case vaultNames[name]:
+		return "Vault"
+	case os.Getenv(name+"_FILE") != "":
+		return name + "_FILE"
+	}
+	if _, ok := configFileEnv[name]; ok {
+		return "CONFIG_FILE"
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		return "environment"
+	}
+	return "default"
+}
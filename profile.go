@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/gliderlabs/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// profile is a logical endpoint of the server, listening on its own
+// addresses and overriding the flow of the sessions connecting to them.
+// PROFILES_FILE lists them:
+//
+//	profiles:
+//	  - name: students
+//	    listen: ["0.0.0.0:2222"]
+//	    mail_to_suffix: "@students.example.com"
+//	    groups: [students]
+//	  - name: staff
+//	    listen: ["0.0.0.0:2223"]
+//	    mail_mode: prompt
+//	    mail_allowed_domains: [example.com]
+//	    flow_file: /etc/sshauth/staff-flow.yaml
+//
+// The settings left out are taken from the global options. The groups and
+// attributes are given to the new users on top of the DEFAULTS_FILE ones.
+// The listen addresses are only read at startup, like LISTEN.
+type profile struct {
+	Name               string            `yaml:"name"`
+	Listen             []string          `yaml:"listen"`
+	MailMode           string            `yaml:"mail_mode"`
+	MailToSuffix       string            `yaml:"mail_to_suffix"`
+	MailAllowedDomains []string          `yaml:"mail_allowed_domains"`
+	FlowFile           string            `yaml:"flow_file"`
+	Groups             []string          `yaml:"groups"`
+	Attributes         map[string]string `yaml:"attributes"`
+
+	flow []*flowStep
+}
+
+type profilesFile struct {
+	Profiles []*profile `yaml:"profiles"`
+}
+
+// profiles holds the profiles of PROFILES_FILE by name.
+var profiles = newReloadable(map[string]*profile{})
+
+// contextKeyProfile holds the name of the profile of a connection.
+type contextKeyProfile struct{}
+
+// loadProfiles reads and validates PROFILES_FILE.
+func loadProfiles() error {
+	loaded := map[string]*profile{}
+	if options().ProfilesFile == "" {
+		profiles.set(loaded)
+		return nil
+	}
+	data, err := os.ReadFile(options().ProfilesFile)
+	if err != nil {
+		return fmt.Errorf("Could not read PROFILES_FILE: %v", err)
+	}
+	var f profilesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("Could not parse PROFILES_FILE: %v", err)
+	}
+	for i, p := range f.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("Profile %d has no name", i+1)
+		}
+		if loaded[p.Name] != nil {
+			return fmt.Errorf("Profile %s is defined twice", p.Name)
+		}
+		if len(p.Listen) == 0 {
+			return fmt.Errorf("Profile %s has no listen address", p.Name)
+		}
+		switch p.MailMode {
+		case "", "suffix", "prompt":
+		default:
+			return fmt.Errorf("Profile %s: unknown mail_mode %q, expected one of suffix or prompt", p.Name, p.MailMode)
+		}
+		if p.FlowFile != "" {
+			data, err := os.ReadFile(p.FlowFile)
+			if err != nil {
+				return fmt.Errorf("Profile %s: could not read the flow file: %v", p.Name, err)
+			}
+			if p.flow, err = parseFlow(data, p.FlowFile); err != nil {
+				return fmt.Errorf("Profile %s: %v", p.Name, err)
+			}
+		}
+		loaded[p.Name] = p
+	}
+	profiles.set(loaded)
+	return nil
+}
+
+// profileListener tags the connections it accepts with the profile of the
+// listener, by name, so that a reload applies to them.
+type profileListener struct {
+	net.Listener
+	name string
+}
+
+type profileConn struct {
+	net.Conn
+	profile string
+}
+
+func (l profileListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return profileConn{Conn: c, profile: l.name}, nil
+}
+
+// profileListeners opens the listeners of the profiles.
+func profileListeners() ([]net.Listener, error) {
+	var lns []net.Listener
+	for name, p := range profiles.get() {
+		for _, entry := range p.Listen {
+			network, addr, err := parseListen(entry)
+			if err != nil {
+				return lns, err
+			}
+			ln, err := net.Listen(network, addr)
+			if err != nil {
+				return lns, fmt.Errorf("Could not listen on %s for profile %s: %v", entry, name, err)
+			}
+			logInfo("Listening on %s (%s) for profile %s", ln.Addr(), addressFamily(network, ln.Addr()), name)
+			lns = append(lns, profileListener{Listener: ln, name: name})
+		}
+	}
+	return lns, nil
+}
+
+// tagProfile records the profile of conn in ctx, for sessionProfile.
+func tagProfile(ctx ssh.Context, conn net.Conn) {
+	if pc, ok := conn.(profileConn); ok {
+		ctx.SetValue(contextKeyProfile{}, pc.profile)
+	}
+}
+
+// sessionProfile returns the profile of the listener a session connected
+// to, or nil for the LISTEN ones.
+func sessionProfile(ctx ssh.Context) *profile {
+	name, _ := ctx.Value(contextKeyProfile{}).(string)
+	if name == "" {
+		return nil
+	}
+	p := profiles.get()[name]
+	if p == nil {
+		logWarn("Profile %s is gone since the last reload, using the global options", name)
+	}
+	return p
+}
+
+// mailMode returns the MAIL_MODE of the session.
+func (s *session) mailMode() string {
+	if s.profile != nil && s.profile.MailMode != "" {
+		return s.profile.MailMode
+	}
+	return options().MailMode
+}
+
+// toSuffix returns the MAIL_TO_SUFFIX of the session.
+func (s *session) toSuffix() string {
+	if s.profile != nil && s.profile.MailToSuffix != "" {
+		return s.profile.MailToSuffix
+	}
+	return options().ToSuffix
+}
+
+// allowedDomains returns the MAIL_ALLOWED_DOMAINS of the session.
+func (s *session) allowedDomains() []string {
+	if s.profile != nil && len(s.profile.MailAllowedDomains) > 0 {
+		return s.profile.MailAllowedDomains
+	}
+	return options().MailAllowedDomains
+}
+
+// steps returns the flow of the session.
+func (s *session) steps() []*flowStep {
+	if s.profile != nil && s.profile.flow != nil {
+		return s.profile.flow
+	}
+	return flow.get()
+}
+
+// defaults returns the defaults of the new user, with the groups and the
+// attributes of the profile, and the attributes answered in the flow unless
+// the ones configured set them.
+func (s *session) defaults() userDefaults {
+	d := defaultsFor(s.user, s.mail)
+	if s.profile != nil {
+		for _, g := range s.profile.Groups {
+			if !contains(d.Groups, g) {
+				d.Groups = append(d.Groups, g)
+			}
+		}
+		for k, v := range s.profile.Attributes {
+			if d.Attributes == nil {
+				d.Attributes = map[string]string{}
+			}
+			d.Attributes[k] = v
+		}
+	}
+	for k, v := range s.fieldAttributes() {
+		if d.Attributes == nil {
+			d.Attributes = map[string]string{}
+		}
+		if _, ok := d.Attributes[k]; !ok {
+			d.Attributes[k] = v
+		}
+	}
+	return d
+}
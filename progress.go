@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// spinnerFrames are drawn in turn while a slow operation runs.
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+const spinnerInterval = 150 * time.Millisecond
+
+// progress runs op, telling the user what is going on so that they don't
+// give up on a silent session: label is shown right away, followed by a
+// spinner on terminals, and replaced by the outcome once op returns.
+func (s *session) progress(label string, op func() error) error {
+	io.WriteString(s, label+"... ")
+	_, _, isPty := s.Pty()
+	isPty = isPty && !s.jsonLines && !s.plain
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if !isPty {
+			<-done
+			return
+		}
+		t := time.NewTicker(spinnerInterval)
+		defer t.Stop()
+		for i := 0; ; i++ {
+			io.WriteString(s, spinnerFrames[i%len(spinnerFrames)]+"\b")
+			select {
+			case <-done:
+				io.WriteString(s, " \b")
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	err := op()
+	close(done)
+	<-stopped
+	if err != nil {
+		s.say(styleError, s.text(PROGRESS_FAILED))
+	} else {
+		s.say(styleSuccess, s.text(PROGRESS_DONE))
+	}
+	return err
+}
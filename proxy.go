@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// httpTransport is used by every HTTP integration, going through the proxy
+// named by HTTPS_PROXY, HTTP_PROXY and NO_PROXY, for the hosts without
+// direct egress.
+var httpTransport = newHTTPTransport()
+
+func newHTTPTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxyFor
+	return t
+}
+
+// proxyFor returns the proxy of a request. Unlike http.ProxyFromEnvironment,
+// the environment is read again every time, so that the proxy variables set
+// in CONFIG_FILE follow a reload.
+func proxyFor(req *http.Request) (*url.URL, error) {
+	return httpproxy.FromEnvironment().ProxyFunc()(req.URL)
+}
+
+// mailDialer connects to the mail servers, through the SOCKS5 proxy of
+// MAIL_PROXY when set. The HTTP proxies can't carry SMTP.
+var mailDialer = newReloadable[proxy.ContextDialer](&net.Dialer{})
+
+// validateMailProxy checks the MAIL_PROXY option and sets up mailDialer.
+func validateMailProxy() error {
+	if options().MailProxy == "" {
+		mailDialer.set(&net.Dialer{})
+		return nil
+	}
+	u, err := url.Parse(options().MailProxy)
+	if err != nil {
+		return fmt.Errorf("Could not parse MAIL_PROXY: %v", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return fmt.Errorf("Unknown MAIL_PROXY scheme %q, expected socks5 or socks5h", u.Scheme)
+	}
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return fmt.Errorf("Could not set up MAIL_PROXY: %v", err)
+	}
+	mailDialer.set(d.(proxy.ContextDialer))
+	return nil
+}
+
+// dialMail connects to a mail server within the deadline of ctx.
+func dialMail(ctx context.Context, addr string) (net.Conn, error) {
+	return mailDialer.get().DialContext(ctx, "tcp", addr)
+}
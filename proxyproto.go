@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener wraps a listener whose connections are prefixed with a PROXY
+// protocol (v1 or v2) header, as sent by HAProxy and most TCP load balancers.
+// Only the proxies of PROXY_PROTOCOL_TRUSTED_CIDRS may connect: the headers
+// of anyone else would forge their address, past the bans, the rate limits
+// and TRUSTED_CIDRS.
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !proxyTrusted(c.RemoteAddr()) {
+			logWarn("Closed the connection from %s, which is not in PROXY_PROTOCOL_TRUSTED_CIDRS", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: l.timeout}, nil
+	}
+}
+
+// proxyTrusted reports whether addr is in PROXY_PROTOCOL_TRUSTED_CIDRS.
+func proxyTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && inNets(proxyNets.get(), tcp.IP)
+}
+
+// proxyConn lazily parses the PROXY header on the first Read or RemoteAddr
+// call, so that a slow client can't block the accept loop.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remote, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a PROXY header from r and returns the original
+// client address, or nil when the proxy reports a local/unknown connection.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the v1 header is at most 107 bytes long, including the CRLF
+	line := make([]byte, 0, 107)
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("Invalid PROXY header: missing CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("Invalid PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY header: %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Invalid PROXY source address: %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("Could not read PROXY header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("Could not read PROXY header: %v", err)
+	}
+
+	// LOCAL commands are health checks from the proxy itself
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("Invalid PROXY header: short IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("Invalid PROXY header: short IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the number of blank modules around the code, which
+// scanners need to find it.
+const qrQuietZone = 2
+
+// renderQR draws a QR code with half block characters, two modules per
+// character cell. Light modules are drawn, so that the code reads correctly
+// on the usual dark terminal background.
+func renderQR(text string) (string, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			top, bottom := !code.Black(x, y), !code.Black(x, y+1)
+			// the last row of the quiet zone may fall outside of the loop
+			if y+1 >= code.Size+qrQuietZone {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String(), nil
+}
+
+// loginQR shows the login URL as a QR code, with LOGIN_QR, to the users with
+// a terminal able to display it.
+func (s *session) loginQR(url string) {
+	if !options().LoginQR {
+		return
+	}
+	if _, _, isPty := s.Pty(); !isPty || s.jsonLines || s.plain {
+		return
+	}
+	code, err := renderQR(url)
+	if err != nil {
+		logWarn("Could not render the login QR code: %v", err)
+		return
+	}
+	io.WriteString(s, code)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisQuotaPrefix = "sshauth:quota:"
+
+// quotaWindow is a fixed window limiting the number of registrations.
+type quotaWindow struct {
+	name   string
+	length time.Duration
+	limit  func() int
+}
+
+var quotaWindows = []quotaWindow{
+	{"hour", time.Hour, func() int { return options().RegistrationQuotaHourly }},
+	{"day", 24 * time.Hour, func() int { return options().RegistrationQuotaDaily }},
+}
+
+// registrationQuota caps the registrations per hour and per day, to contain
+// the damage of a flood of sign ups. The counters live in Redis when shared
+// is set, so that the quota spans all the instances.
+type registrationQuota struct {
+	shared *redis.Client
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var quotas = &registrationQuota{counts: map[string]int{}}
+
+func (w quotaWindow) key(now time.Time) string {
+	return fmt.Sprintf("%s:%d", w.name, now.Truncate(w.length).Unix())
+}
+
+// exceeded reports whether any of the quotas is used up already, so that
+// users can be turned away before receiving a mail.
+func (q *registrationQuota) exceeded(ctx context.Context) (bool, error) {
+	now := clockNow()
+	for _, w := range quotaWindows {
+		limit := w.limit()
+		if limit <= 0 {
+			continue
+		}
+		n, err := q.count(ctx, w.key(now))
+		if err != nil {
+			return false, err
+		}
+		if n >= limit {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// quotaSlot is a registration counted by consume, in the windows it was
+// counted in.
+type quotaSlot struct {
+	at      time.Time
+	windows []quotaWindow
+}
+
+// consume counts a registration, returning false, and giving the slot back,
+// when it would exceed one of the quotas.
+func (q *registrationQuota) consume(ctx context.Context) (quotaSlot, bool, error) {
+	slot := quotaSlot{at: clockNow()}
+	for _, w := range quotaWindows {
+		limit := w.limit()
+		if limit <= 0 {
+			continue
+		}
+		n, err := q.incr(ctx, w.key(slot.at), w.length, 1)
+		if err != nil {
+			q.refund(ctx, slot)
+			return quotaSlot{}, false, err
+		}
+		slot.windows = append(slot.windows, w)
+		if n > limit {
+			q.refund(ctx, slot)
+			return quotaSlot{}, false, nil
+		}
+	}
+	return slot, true, nil
+}
+
+// refund gives back a slot taken by consume, for a registration which
+// failed.
+func (q *registrationQuota) refund(ctx context.Context, slot quotaSlot) {
+	for _, w := range slot.windows {
+		if _, err := q.incr(ctx, w.key(slot.at), w.length, -1); err != nil {
+			logError("Could not refund the %s registration quota: %v", w.name, err)
+		}
+	}
+}
+
+func (q *registrationQuota) count(ctx context.Context, key string) (int, error) {
+	if q.shared != nil {
+		n, err := q.shared.Get(ctx, redisQuotaPrefix+key).Int()
+		if errors.Is(err, redis.Nil) {
+			return 0, nil
+		}
+		return n, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.counts[key], nil
+}
+
+func (q *registrationQuota) incr(ctx context.Context, key string, ttl time.Duration, by int64) (int, error) {
+	if q.shared != nil {
+		pipe := q.shared.TxPipeline()
+		n := pipe.IncrBy(ctx, redisQuotaPrefix+key, by)
+		pipe.Expire(ctx, redisQuotaPrefix+key, ttl)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return 0, err
+		}
+		return int(n.Val()), nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// drop the counters of the past windows
+	for k := range q.counts {
+		if k != key && !q.current(k) {
+			delete(q.counts, k)
+		}
+	}
+	q.counts[key] += int(by)
+	return q.counts[key], nil
+}
+
+func (q *registrationQuota) current(key string) bool {
+	now := clockNow()
+	for _, w := range quotaWindows {
+		if w.key(now) == key {
+			return true
+		}
+	}
+	return false
+}
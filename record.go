@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// the placeholders replacing the details of the user in the recordings
+const (
+	recordUser = "user"
+	recordMail = "user@example.com"
+	recordIP   = "192.0.2.1"
+)
+
+// recorder writes the transcript of a session to RECORD_DIR, in the
+// asciinema v2 format, for reviewing the flow as the users see it. The
+// transcripts are anonymized: the username, the address and the IP are
+// replaced with placeholders in the output, and the answers to the secret
+// prompts, the token, the address and the password, are left out of the
+// input, where a marker event named after the prompt takes their place, for
+// replay to fill them in.
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+	s     *session
+	// the label of the secret prompt being read, if any, and whether any of
+	// its answer was read
+	secret     string
+	secretRead bool
+}
+
+// recordedSession records what goes through an SSH session.
+type recordedSession struct {
+	ssh.Session
+	rec *recorder
+}
+
+func (r recordedSession) Read(p []byte) (int, error) {
+	n, err := r.Session.Read(p)
+	if n > 0 {
+		r.rec.input(p[:n])
+	}
+	return n, err
+}
+
+func (r recordedSession) Write(p []byte) (int, error) {
+	r.rec.output(p)
+	return r.Session.Write(p)
+}
+
+// startRecording records the session to a new file in RECORD_DIR. A failure
+// to record doesn't stop the session.
+func (s *session) startRecording() {
+	b := make([]byte, 4)
+	rand.Read(b)
+	name := filepath.Join(options().RecordDir, fmt.Sprintf("%s-%s.cast", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(b)))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		logError("Could not record the session of %s: %v", s.user, err)
+		return
+	}
+	header := map[string]any{"version": 2, "width": 80, "height": 24, "timestamp": time.Now().Unix()}
+	if pty, _, ok := s.Pty(); ok {
+		header["width"], header["height"] = pty.Window.Width, pty.Window.Height
+		header["env"] = map[string]string{"TERM": pty.Term}
+	}
+	line, _ := json.Marshal(header)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logError("Could not record the session of %s: %v", s.user, err)
+		f.Close()
+		return
+	}
+	rec := &recorder{f: f, start: time.Now(), s: s}
+	s.rec = rec
+	s.Session = recordedSession{Session: s.Session, rec: rec}
+	logDebug("record", "recording the session of %s to %s", s.user, name)
+}
+
+// stopRecording closes the recording of the session, if any.
+func (s *session) stopRecording() {
+	if s.rec == nil {
+		return
+	}
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+	s.rec.f.Close()
+}
+
+// recordSecret marks the input read until the returned function is called
+// as the answer to a secret prompt, replaced in the recording with a marker
+// named label, and masked in the transcript.
+func (s *session) recordSecret(label string) func() {
+	s.transcript.mask(true)
+	if s.rec == nil {
+		return func() { s.transcript.mask(false) }
+	}
+	s.rec.mu.Lock()
+	s.rec.secret, s.rec.secretRead = label, false
+	s.rec.mu.Unlock()
+	return func() {
+		s.transcript.mask(false)
+		s.rec.mu.Lock()
+		defer s.rec.mu.Unlock()
+		if s.rec.secretRead {
+			s.rec.event("m", label)
+		}
+		s.rec.secret = ""
+	}
+}
+
+func (r *recorder) input(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.secret == "" {
+		r.event("i", string(p))
+	} else {
+		r.secretRead = true
+	}
+}
+
+func (r *recorder) output(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := string(p)
+	if r.secret != "" {
+		// the echo of the secret
+		out = strings.Map(func(c rune) rune {
+			if unicode.IsPrint(c) && c != ' ' {
+				return '*'
+			}
+			return c
+		}, out)
+	}
+	r.event("o", r.anonymize(out))
+}
+
+// anonymize replaces the details of the user in the output.
+func (r *recorder) anonymize(out string) string {
+	pairs := []string{}
+	for _, p := range [][2]string{{r.s.mail, recordMail}, {r.s.ip, recordIP}, {r.s.user, recordUser}} {
+		if p[0] != "" {
+			pairs = append(pairs, p[0], p[1])
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(out)
+}
+
+// event writes an event of the recording, with r.mu held.
+func (r *recorder) event(kind, data string) {
+	line, _ := json.Marshal([]any{time.Since(r.start).Seconds(), kind, data})
+	if _, err := r.f.Write(append(line, '\n')); err != nil {
+		logDebug("record", "could not write the recording: %v", err)
+	}
+}
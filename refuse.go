@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sshauth only serves interactive sessions, and the scripted commands when
+// SCRIPTED_MODE is set: everything else clients may ask for, such as scp,
+// sftp or port forwarding, is refused right away with a message instead of
+// leaving them hanging.
+
+// refuseExec turns away a session started with a command.
+func refuseExec(s ssh.Session, ip string) {
+	logWarn("Refusing the command %q of %s from %s", s.RawCommand(), s.User(), ip)
+	io.WriteString(s.Stderr(), connText(s, EXEC_REFUSED))
+	s.Exit(exitDeclined)
+}
+
+// refuseSubsystem handles every subsystem, such as sftp.
+func refuseSubsystem(s ssh.Session) {
+	ip := remoteIP(s.RemoteAddr())
+	logWarn("Refusing the %s subsystem of %s from %s", s.Subsystem(), s.User(), ip)
+	io.WriteString(s.Stderr(), renderText(SUBSYSTEM_REFUSED, messageData{User: s.User(), IP: ip, Subsystem: s.Subsystem()}))
+	s.Exit(exitDeclined)
+}
+
+// refuseForwardChannel rejects the channels opened for local forwarding,
+// with ssh -L or -W.
+func refuseForwardChannel(srv *ssh.Server, conn *gossh.ServerConn, ch gossh.NewChannel, ctx ssh.Context) {
+	ip := remoteIP(conn.RemoteAddr())
+	logWarn("Refusing a %s channel of %s from %s", ch.ChannelType(), conn.User(), ip)
+	ch.Reject(gossh.Prohibited, renderText(FORWARDING_REFUSED, messageData{User: conn.User(), IP: ip}))
+}
+
+// refuseForwardRequest rejects the requests for remote forwarding, with
+// ssh -R.
+func refuseForwardRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	logWarn("Refusing a %s request of %s from %s", req.Type, ctx.User(), remoteIP(ctx.RemoteAddr()))
+	return false, nil
+}
+
+var (
+	refusingChannelHandlers = map[string]ssh.ChannelHandler{
+		"session":                        ssh.DefaultSessionHandler,
+		"direct-tcpip":                   refuseForwardChannel,
+		"direct-streamlocal@openssh.com": refuseForwardChannel,
+	}
+	refusingRequestHandlers = map[string]ssh.RequestHandler{
+		"tcpip-forward":                   refuseForwardRequest,
+		"streamlocal-forward@openssh.com": refuseForwardRequest,
+	}
+	refusingSubsystemHandlers = map[string]ssh.SubsystemHandler{
+		"default": refuseSubsystem,
+	}
+)
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	env "github.com/caarlos0/env/v7"
+)
+
+// restartOnly lists the options bound to resources created at startup, which
+// a reload leaves untouched.
+var restartOnly = []string{
+	"SSH_HOST", "SSH_PORT", "LISTEN", "SSH_HOST_KEYS", "MAX_SESSIONS", "MAX_GOROUTINES",
+	"PROXY_PROTOCOL", "PROXY_PROTOCOL_TIMEOUT",
+	"LOG_OUTPUT",
+	"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS", "OTEL_SERVICE_NAME",
+	"SENTRY_DSN", "SENTRY_ENVIRONMENT",
+	"STORE", "STORE_SQLITE_PATH", "REDIS_URL",
+	"ADMIN_LISTEN", "ADMIN_TOKEN",
+	"GRPC_LISTEN", "GRPC_TLS_CERT", "GRPC_TLS_KEY",
+	"WEB_LISTEN", "WEB_TLS_CERT", "WEB_TLS_KEY",
+	"METRICS_LISTEN", "METRICS_PUSH_URL", "METRICS_PUSH_INTERVAL", "METRICS_PUSH_JOB",
+	"EVENTS_NATS_URL", "EVENTS_NATS_SUBJECT", "EVENTS_KAFKA_REST_URL", "EVENTS_KAFKA_TOPIC",
+	"VAULT_ADDR", "VAULT_TOKEN", "VAULT_ROLE_ID", "VAULT_SECRET_ID", "VAULT_AUTH_PATH", "VAULT_SECRET_PATH", "VAULT_REFRESH",
+	"CONFIG_FILE",
+}
+
+// reloadable holds a value derived from the options by configure, replaced
+// as a whole on reload while the sessions read it.
+type reloadable[T any] struct {
+	v atomic.Pointer[T]
+}
+
+func newReloadable[T any](v T) *reloadable[T] {
+	r := &reloadable[T]{}
+	r.set(v)
+	return r
+}
+
+// get returns the current value, or the zero value before the first set.
+func (r *reloadable[T]) get() T {
+	if p := r.v.Load(); p != nil {
+		return *p
+	}
+	var zero T
+	return zero
+}
+
+func (r *reloadable[T]) set(v T) {
+	r.v.Store(&v)
+}
+
+// configFileEnv remembers the environment as it was before CONFIG_FILE was
+// applied, so that removing a line from the file restores the original value
+// on reload. A nil value means the variable was not set.
+var configFileEnv = map[string]*string{}
+
+// loadConfigFile reads CONFIG_FILE, a list of NAME=value lines, into the
+// environment. Values from the file override the ones from the environment,
+// so that they can be changed and reloaded with SIGHUP.
+func loadConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not open CONFIG_FILE: %v", err)
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return fmt.Errorf("Could not parse CONFIG_FILE line %d: expected NAME=value", n)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, ok := configFileEnv[name]; !ok {
+			if orig, set := os.LookupEnv(name); set {
+				configFileEnv[name] = &orig
+			} else {
+				configFileEnv[name] = nil
+			}
+		}
+		seen[name] = true
+		if err := os.Setenv(name, value); err != nil {
+			return fmt.Errorf("Could not set %s from CONFIG_FILE: %v", name, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("Could not read CONFIG_FILE: %v", err)
+	}
+
+	for name, orig := range configFileEnv {
+		if seen[name] {
+			continue
+		}
+		if orig == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *orig)
+		}
+		delete(configFileEnv, name)
+	}
+	return nil
+}
+
+// loadOptions reads the configuration file, the secret files and the
+// environment into o.
+func loadOptions(o *Options) error {
+	if err := loadConfigFile(); err != nil {
+		return err
+	}
+	if err := loadSecretFiles(); err != nil {
+		return err
+	}
+	return env.Parse(o)
+}
+
+// configure validates the options and sets up everything derived from them
+// which can change at runtime.
+func configure() error {
+	if err := initLogging(); err != nil {
+		return err
+	}
+	if err := initPasswordRules(); err != nil {
+		return err
+	}
+	if err := loadFlow(); err != nil {
+		return err
+	}
+	if err := loadProfiles(); err != nil {
+		return err
+	}
+	if err := validateExpiry(); err != nil {
+		return err
+	}
+	if err := loadDefaults(); err != nil {
+		return err
+	}
+	if err := loadHooks(); err != nil {
+		return err
+	}
+	if err := loadWelcomeMail(); err != nil {
+		return err
+	}
+	if err := loadIdentityVerifier(); err != nil {
+		return err
+	}
+	if err := loadSMSNotifier(); err != nil {
+		return err
+	}
+	if err := loadMessages(); err != nil {
+		return err
+	}
+	if err := loadAdminKeys(); err != nil {
+		return err
+	}
+	if err := validateChallenge(); err != nil {
+		return err
+	}
+	if err := validateBanMode(); err != nil {
+		return err
+	}
+	if err := initCIDRs(); err != nil {
+		return err
+	}
+	if err := parseMailHeaders(); err != nil {
+		return err
+	}
+	if err := parseMailRoutes(); err != nil {
+		return err
+	}
+	if err := validateMailTransport(); err != nil {
+		return err
+	}
+	if err := validateMailProxy(); err != nil {
+		return err
+	}
+	if err := initLDAPFilter(); err != nil {
+		return err
+	}
+	if err := validatePasswordHash(); err != nil {
+		return err
+	}
+	if err := validatePasswordMethod(); err != nil {
+		return err
+	}
+	if err := validateDirectoryRetries(); err != nil {
+		return err
+	}
+	if err := validateRetryBackoff(); err != nil {
+		return err
+	}
+	if err := validateTranscript(); err != nil {
+		return err
+	}
+	if err := initAlertCountries(); err != nil {
+		return err
+	}
+	if err := validateRetention(); err != nil {
+		return err
+	}
+	if err := initSeeded(); err != nil {
+		return err
+	}
+	if err := validateTokenFormat(); err != nil {
+		return err
+	}
+	if err := validateTransport(); err != nil {
+		return err
+	}
+	if err := validateColor(); err != nil {
+		return err
+	}
+	if err := validateNewlines(); err != nil {
+		return err
+	}
+	if err := validateMailThrottle(); err != nil {
+		return err
+	}
+	if err := validateMailTaken(); err != nil {
+		return err
+	}
+	if err := validateMailNormalize(); err != nil {
+		return err
+	}
+	if err := validateEvents(); err != nil {
+		return err
+	}
+	if err := validateRegistrationMode(); err != nil {
+		return err
+	}
+	if err := validateWeb(); err != nil {
+		return err
+	}
+	if err := loadLLDAPTLS(); err != nil {
+		return err
+	}
+	if err := validateTokenDelivery(); err != nil {
+		return err
+	}
+	if err := validateTokenBinding(); err != nil {
+		return err
+	}
+	if err := validatePolicy(); err != nil {
+		return err
+	}
+	if err := validateMetrics(); err != nil {
+		return err
+	}
+	if err := validateGRPC(); err != nil {
+		return err
+	}
+	if err := validateLockAttribute(); err != nil {
+		return err
+	}
+	if err := validateCleanup(); err != nil {
+		return err
+	}
+	return validateMailMode()
+}
+
+// reload reads the configuration again and applies it, keeping the previous
+// one if it is invalid. Listeners and sessions are not affected.
+func reload() error {
+	optionsMu.Lock()
+	defer optionsMu.Unlock()
+	next := new(Options)
+	if err := loadOptions(next); err != nil {
+		return err
+	}
+	prev := reflect.ValueOf(options()).Elem()
+	cur := reflect.ValueOf(next).Elem()
+	for _, name := range restartOnly {
+		i := optionField(name)
+		if !reflect.DeepEqual(prev.Field(i).Interface(), cur.Field(i).Interface()) {
+			logWarn("Ignoring the new value of %s, a restart is needed to change it", name)
+			cur.Field(i).Set(prev.Field(i))
+		}
+	}
+
+	old := swapOptions(next)
+	if err := configure(); err != nil {
+		swapOptions(old)
+		configure()
+		return err
+	}
+	limiter.setMaxPerIP(options().MaxSessionsPerIP)
+	bans.reconfigure(options().BanThreshold, options().BanWindow, options().BanDuration)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the configuration whenever SIGHUP is received.
+func reloadOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		sdNotify("RELOADING=1")
+		if err := reload(); err != nil {
+			logError("Could not reload the configuration: %v", err)
+		} else {
+			logInfo("Configuration reloaded")
+		}
+		sdNotify("READY=1")
+	}
+}
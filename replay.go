@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const replayUsage = "Usage: sshauth replay [--known-hosts <file>] [--input <prompt>=<value>]... <host:port> <user> <recording>"
+
+// the longest pause between two inputs of a replay
+const replayMaxDelay = time.Second
+
+// castHeader is the first line of an asciinema v2 recording.
+type castHeader struct {
+	Version int               `json:"version"`
+	Width   int               `json:"width"`
+	Height  int               `json:"height"`
+	Env     map[string]string `json:"env"`
+}
+
+// replayCommand feeds the input of a recording back through the flow of the
+// server at the given address, printing its output, for tests to compare
+// with the recording. The secret answers left out of the recordings are
+// given with --input, such as --input token=123456, or else asked for on the
+// terminal. It fails when the session ends with another status than 0.
+func replayCommand(args []string) error {
+	inputs := map[string]string{}
+	var knownHosts string
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		if len(args) < 2 {
+			return errors.New(replayUsage)
+		}
+		switch args[0] {
+		case "--input":
+			label, value, ok := strings.Cut(args[1], "=")
+			if !ok {
+				return fmt.Errorf("Invalid --input %q, expected <prompt>=<value>", args[1])
+			}
+			inputs[label] = value
+		case "--known-hosts":
+			knownHosts = args[1]
+		default:
+			return errors.New(replayUsage)
+		}
+		args = args[2:]
+	}
+	if len(args) != 3 {
+		return errors.New(replayUsage)
+	}
+	addr, user, path := args[0], args[1], args[2]
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not open the recording: %v", err)
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	lines.Buffer(nil, 1<<20)
+	var header castHeader
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &header) != nil || header.Version != 2 {
+		return fmt.Errorf("%s is not an asciinema v2 recording", path)
+	}
+
+	hostKey := gossh.InsecureIgnoreHostKey()
+	if knownHosts != "" {
+		if hostKey, err = knownhosts.New(knownHosts); err != nil {
+			return fmt.Errorf("Could not read the known hosts: %v", err)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "Not checking the host key, use --known-hosts outside of tests")
+	}
+	config := &gossh.ClientConfig{
+		User: user,
+		Auth: []gossh.AuthMethod{gossh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) {
+			return nil, nil
+		})},
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	}
+	conn, err := gossh.Dial("tcp", addr, config)
+	if err != nil {
+		return fmt.Errorf("Could not connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+	sess, err := conn.NewSession()
+	if err != nil {
+		return fmt.Errorf("Could not open a session: %v", err)
+	}
+	defer sess.Close()
+	if term := header.Env["TERM"]; term != "" {
+		if err := sess.RequestPty(term, header.Height, header.Width, gossh.TerminalModes{}); err != nil {
+			return fmt.Errorf("Could not request a terminal: %v", err)
+		}
+	}
+	sess.Stdout = os.Stdout
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := sess.Shell(); err != nil {
+		return fmt.Errorf("Could not start the session: %v", err)
+	}
+
+	answers := bufio.NewReader(os.Stdin)
+	var last float64
+	for lines.Scan() {
+		var event [3]any
+		if err := json.Unmarshal(lines.Bytes(), &event); err != nil {
+			return fmt.Errorf("Invalid event in the recording: %v", err)
+		}
+		at, _ := event[0].(float64)
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+		var input string
+		switch kind {
+		case "i":
+			input = data
+		case "m":
+			value, ok := inputs[data]
+			if !ok {
+				if value, err = askReplayInput(answers, data); err != nil {
+					return err
+				}
+			}
+			input = value + "\r"
+		default:
+			continue
+		}
+		delay := time.Duration((at - last) * float64(time.Second))
+		if delay > replayMaxDelay {
+			delay = replayMaxDelay
+		}
+		time.Sleep(delay)
+		last = at
+		if _, err := stdin.Write([]byte(input)); err != nil {
+			return fmt.Errorf("Could not send the input: %v", err)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return fmt.Errorf("Could not read the recording: %v", err)
+	}
+	stdin.Close()
+
+	err = sess.Wait()
+	var exit *gossh.ExitError
+	if errors.As(err, &exit) {
+		return fmt.Errorf("The session ended with status %d", exit.ExitStatus())
+	} else if err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("The session failed: %v", err)
+	}
+	return nil
+}
+
+// askReplayInput asks on the terminal for the answer to a secret prompt left
+// out of a recording.
+func askReplayInput(in *bufio.Reader, label string) (string, error) {
+	fmt.Fprintf(os.Stderr, "\nAnswer to the %s prompt: ", label)
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("No answer to the %s prompt, give it with --input %s=<value>", label, label)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestReplay feeds the recording of a registration through replay against a
+// test server, handing out the same token, for the user to end up
+// registered again.
+func TestReplay(t *testing.T) {
+	t.Setenv("TOKEN_SEQUENCE", "123456")
+	mails := make(chan sinkedMail, 1)
+	go func() {
+		for range mails {
+		}
+	}()
+	addr := startTestServer(t, mails)
+
+	// replay prints the output of the session to the standard output
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&out, r)
+		close(copied)
+	}()
+
+	err = replayCommand([]string{
+		"--input", "token=123456",
+		"--input", "password=Correct-Horse-Battery-9",
+		addr, "replayed", "testdata/register.cast",
+	})
+	w.Close()
+	<-copied
+	if err != nil {
+		t.Fatalf("Could not replay: %v, got:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "You are now registered!") {
+		t.Errorf("The replay did not register, got:\n%s", out.String())
+	}
+	if exists, err := memoryUsers.Exists(context.Background(), "replayed"); err != nil || !exists {
+		t.Errorf("replayed was not registered: %v", err)
+	}
+}
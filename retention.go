@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// validateRetention checks the RETENTION_* options.
+func validateRetention() error {
+	if options().RetentionTokens < 0 || options().RetentionRegistrations < 0 || options().RetentionRecordings < 0 {
+		return fmt.Errorf("RETENTION_TOKENS, RETENTION_REGISTRATIONS and RETENTION_RECORDINGS must not be negative")
+	}
+	if options().RetentionInterval <= 0 {
+		return fmt.Errorf("RETENTION_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// purger drops the data kept longer than the RETENTION_* options every
+// RETENTION_INTERVAL.
+func purger() {
+	for {
+		interval := options().RetentionInterval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		<-clk.get().After(interval)
+		purge(context.Background())
+	}
+}
+
+// purge drops the expired tokens and locks RETENTION_TOKENS after they
+// expire, and the registrations and the recordings older than
+// RETENTION_REGISTRATIONS and RETENTION_RECORDINGS, when set.
+func purge(ctx context.Context) {
+	now := clockNow()
+	if n, err := tokens.Purge(ctx, now.Add(-options().RetentionTokens)); err != nil {
+		logError("Could not purge the expired tokens: %v", err)
+	} else if n > 0 {
+		logInfo("Purged %d expired tokens and locks", n)
+	}
+	if options().RetentionRegistrations > 0 {
+		if n := registrations.purge(now.Add(-options().RetentionRegistrations)); n > 0 {
+			logInfo("Purged %d registrations older than %s", n, options().RetentionRegistrations)
+		}
+	}
+	if options().RetentionRecordings > 0 && options().RecordDir != "" {
+		if n, err := purgeRecordings(now.Add(-options().RetentionRecordings)); err != nil {
+			logError("Could not purge the recordings: %v", err)
+		} else if n > 0 {
+			logInfo("Purged %d recordings older than %s", n, options().RetentionRecordings)
+		}
+	}
+}
+
+// purgeRecordings removes the recordings of RECORD_DIR written before the
+// given time.
+func purgeRecordings(before time.Time) (int, error) {
+	files, err := filepath.Glob(filepath.Join(options().RecordDir, "*.cast"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil || !fi.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// storedData is everything stored about a user, or about the users of an
+// address, as exported by the admin shell and API. The recordings are not
+// included, the identities being replaced by placeholders in them.
+type storedData struct {
+	Subject       string               `json:"subject"`
+	Registrations []registration       `json:"registrations"`
+	Pending       []pendingToken       `json:"pending"`
+	LockedUntil   map[string]time.Time `json:"locked_until,omitempty"`
+	Incomplete    map[string]time.Time `json:"incomplete,omitempty"`
+}
+
+// subjectUsers returns the users a subject is about: the username itself,
+// or the users registered or with a token pending for an address.
+func subjectUsers(ctx context.Context, subject string) ([]string, error) {
+	if !strings.Contains(subject, "@") {
+		return []string{subject}, nil
+	}
+	var users []string
+	add := func(user, mail string) {
+		if strings.EqualFold(mail, subject) && !contains(users, user) {
+			users = append(users, user)
+		}
+	}
+	for _, r := range registrations.list() {
+		add(r.User, r.Mail)
+	}
+	pending, err := tokens.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range pending {
+		add(t.User, t.Mail)
+	}
+	return users, nil
+}
+
+// exportData collects everything stored about subject, a username or an
+// address. The tokens themselves are left out.
+func exportData(ctx context.Context, subject string) (storedData, error) {
+	d := storedData{Subject: subject, Registrations: []registration{}, Pending: []pendingToken{}}
+	users, err := subjectUsers(ctx, subject)
+	if err != nil {
+		return d, err
+	}
+	incomplete, err := tokens.ListIncomplete(ctx)
+	if err != nil {
+		return d, err
+	}
+	for _, r := range registrations.list() {
+		if contains(users, r.User) {
+			d.Registrations = append(d.Registrations, r)
+		}
+	}
+	for _, user := range users {
+		t, ok, err := tokens.Get(ctx, user)
+		if err != nil {
+			return d, err
+		}
+		if ok {
+			t.Token = ""
+			d.Pending = append(d.Pending, t)
+		}
+		until, locked, err := tokens.LockedUntil(ctx, user)
+		if err != nil {
+			return d, err
+		}
+		if locked {
+			if d.LockedUntil == nil {
+				d.LockedUntil = map[string]time.Time{}
+			}
+			d.LockedUntil[user] = until
+		}
+		if since, ok := incomplete[user]; ok {
+			if d.Incomplete == nil {
+				d.Incomplete = map[string]time.Time{}
+			}
+			d.Incomplete[user] = since
+		}
+	}
+	return d, nil
+}
+
+// eraseData drops everything stored about subject, a username or an
+// address, returning the users it was about. The entries in the directory
+// are left alone, as are the events already published.
+func eraseData(ctx context.Context, subject string) ([]string, error) {
+	users, err := subjectUsers(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if err := tokens.Forget(ctx, user); err != nil {
+			return nil, err
+		}
+		registrations.forget(user)
+	}
+	return users, nil
+}
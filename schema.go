@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// schemaChecker is implemented by the directories which can verify, before
+// the first registration, that they are set up the way sshauth expects.
+type schemaChecker interface {
+	// CheckSchema returns the problems found, each with a hint on how to fix
+	// it. With probe set, it also makes sure new users can be added, by
+	// adding and removing a test entry.
+	CheckSchema(ctx context.Context, probe bool) ([]string, error)
+}
+
+// schemaName matches the names in an RFC 4512 definition, either
+// NAME 'cn' or NAME ( 'cn' 'commonName' ).
+var schemaName = regexp.MustCompile(`NAME\s+(?:'([^']+)'|\(([^)]*)\))`)
+
+// schemaNames collects the lowercased names of the given definitions.
+func schemaNames(defs []string) map[string]bool {
+	names := map[string]bool{}
+	for _, def := range defs {
+		m := schemaName.FindStringSubmatch(def)
+		if m == nil {
+			continue
+		}
+		if m[1] != "" {
+			names[strings.ToLower(m[1])] = true
+			continue
+		}
+		for _, n := range strings.Fields(m[2]) {
+			names[strings.ToLower(strings.Trim(n, "'"))] = true
+		}
+	}
+	return names
+}
+
+// requiredSchema returns the object classes and attributes sshauth uses with
+// the current options.
+func (d *ldapDirectory) requiredSchema() (classes, attrs []string) {
+	classes = []string{userObjectClass()}
+	attrs = []string{userAttribute(), d.mailAttribute()}
+	if d.ad() {
+		classes = append(classes, "user")
+		attrs = append(attrs, "cn", "userPrincipalName", "userAccountControl", "unicodePwd")
+	} else if options().LdapPasswordHash != "" {
+		attrs = append(attrs, "userPassword")
+	}
+	if options().KeyVerification {
+		attrs = append(attrs, options().LdapSSHKeyAttribute)
+	}
+	return
+}
+
+// readSchema reads the object classes and attributes from the subschema entry
+// advertised by the root DSE. It returns nil maps if the server doesn't
+// publish its schema.
+func (d *ldapDirectory) readSchema() (classes, attrs map[string]bool, err error) {
+	logDebug("ldap", "search base=\"\" scope=base attrs=subschemaSubentry")
+	root, err := d.conn.Search(ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"subschemaSubentry"}, nil))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read the root DSE: %v", err)
+	}
+	if len(root.Entries) == 0 || root.Entries[0].GetAttributeValue("subschemaSubentry") == "" {
+		return nil, nil, nil
+	}
+	dn := root.Entries[0].GetAttributeValue("subschemaSubentry")
+	logDebug("ldap", "search base=%q scope=base attrs=objectClasses,attributeTypes", dn)
+	sr, err := d.conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=subschema)", []string{"objectClasses", "attributeTypes"}, nil))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read the schema from %s: %v", dn, err)
+	}
+	if len(sr.Entries) == 0 {
+		return nil, nil, nil
+	}
+	e := sr.Entries[0]
+	return schemaNames(e.GetAttributeValues("objectClasses")), schemaNames(e.GetAttributeValues("attributeTypes")), nil
+}
+
+func (d *ldapDirectory) CheckSchema(ctx context.Context, probe bool) (problems []string, err error) {
+	_, sp := startSpan(ctx, "ldap.schema", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	logDebug("ldap", "search base=%q scope=base", options().LdapUserScope)
+	_, err = d.conn.Search(ldap.NewSearchRequest(options().LdapUserScope, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"dn"}, nil))
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("LDAP_USER_SCOPE %s can't be read by %s: %v", options().LdapUserScope, options().LdapBindDN, err))
+	}
+
+	classes, attrs, err := d.readSchema()
+	if err != nil {
+		return nil, err
+	}
+	if classes == nil {
+		logWarn("The LDAP server doesn't publish its schema, skipping the schema checks")
+	} else {
+		needClasses, needAttrs := d.requiredSchema()
+		for _, c := range needClasses {
+			if !classes[strings.ToLower(c)] {
+				problems = append(problems, fmt.Sprintf("The object class %s is not in the schema, check LDAP_USER_OBJECT_CLASS", c))
+			}
+		}
+		for _, a := range needAttrs {
+			if !attrs[strings.ToLower(a)] {
+				problems = append(problems, fmt.Sprintf("The attribute %s is not in the schema, check the LDAP_*_ATTRIBUTE options", a))
+			}
+		}
+	}
+
+	if probe {
+		if err := d.probeAdd(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems, nil
+}
+
+// probeAdd adds a test user under LDAP_USER_SCOPE and removes it right away.
+func (d *ldapDirectory) probeAdd() error {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	// short enough for sAMAccountName, which is limited to 20 characters
+	uid := "sshauth-probe-" + hex.EncodeToString(b)
+	req, err := d.addRequest(uid, uid+"@example.invalid")
+	if err != nil {
+		return err
+	}
+	logAdd(req)
+	if err := d.conn.Add(req); err != nil {
+		return fmt.Errorf("%s can't add users under LDAP_USER_SCOPE %s: %v", options().LdapBindDN, options().LdapUserScope, err)
+	}
+	logDebug("ldap", "delete dn=%q", req.DN)
+	if err := d.conn.Del(ldap.NewDelRequest(req.DN, nil)); err != nil {
+		return fmt.Errorf("%s can add users but can't delete them, remove the test user %s by hand: %v", options().LdapBindDN, req.DN, err)
+	}
+	return nil
+}
+
+// checkDirectory runs the schema checks of the directory, if it supports
+// them, returning an error listing the problems found.
+func checkDirectory(ctx context.Context, d directory, probe bool) error {
+	sc, ok := d.(schemaChecker)
+	if !ok {
+		logInfo("The %s directory backend has no schema checks", options().DirectoryBackend)
+		return nil
+	}
+	problems, err := sc.CheckSchema(ctx, probe)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("The directory is not set up correctly:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimPatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+)
+
+// scimDirectory provisions users in any SCIM 2.0 capable identity provider.
+// Users are created with POST /Users and get their password with a PATCH,
+// as many providers refuse passwords in the creation request.
+type scimDirectory struct {
+	base   string
+	header http.Header
+}
+
+func openSCIM(ctx context.Context) (*scimDirectory, error) {
+	header := http.Header{"Content-Type": {"application/scim+json"}}
+	if options().SCIMToken != "" {
+		header.Set("Authorization", "Bearer "+options().SCIMToken)
+	}
+	return &scimDirectory{base: strings.TrimSuffix(options().SCIMURL, "/"), header: header}, nil
+}
+
+func (d *scimDirectory) Close() error {
+	return nil
+}
+
+func (d *scimDirectory) Exists(ctx context.Context, user string) (_ bool, err error) {
+	_, sp := startSpan(ctx, "scim.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	var res struct {
+		TotalResults int `json:"totalResults"`
+	}
+	filter := fmt.Sprintf("userName eq %q", user)
+	q := url.Values{"filter": {filter}}
+	if _, err := doJSON(ctx, http.MethodGet, d.base+"/Users?"+q.Encode(), d.header, nil, &res); err != nil {
+		return false, fmt.Errorf("Could not search SCIM users: %v", err)
+	}
+	return res.TotalResults > 0, nil
+}
+
+func (d *scimDirectory) Register(ctx context.Context, user, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "scim.create", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	body := map[string]any{
+		"schemas":  []string{scimUserSchema},
+		"userName": user,
+		"active":   true,
+		"emails":   []map[string]any{{"value": mail, "primary": true}},
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if _, err := doJSON(ctx, http.MethodPost, d.base+"/Users", d.header, body, &created); err != nil {
+		if conflict(err) {
+			return refusedRegistration{fmt.Errorf("Could not create the SCIM user: %v", err)}
+		}
+		return fmt.Errorf("Could not create the SCIM user: %v", err)
+	}
+
+	patch := map[string]any{
+		"schemas": []string{scimPatchSchema},
+		"Operations": []map[string]any{
+			{"op": "replace", "path": "password", "value": password},
+		},
+	}
+	if _, err := doJSON(ctx, http.MethodPatch, d.base+"/Users/"+url.PathEscape(created.ID), d.header, patch, nil); err != nil {
+		return partialRegistration{fmt.Errorf("Could not add a password to the new user: %v", err)}
+	}
+	return nil
+}
+
+// scimUser is the part of a SCIM user we look at.
+type scimUser struct {
+	ID     string `json:"id"`
+	Active bool   `json:"active"`
+	Emails []struct {
+		Value   string `json:"value"`
+		Primary bool   `json:"primary"`
+	} `json:"emails"`
+}
+
+// Stub reports whether user exists and is inactive, returning its primary
+// address.
+func (d *scimDirectory) Stub(ctx context.Context, user string) (_ bool, _ string, err error) {
+	_, sp := startSpan(ctx, "scim.search", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := d.find(ctx, user)
+	if err != nil || u == nil || u.Active {
+		return false, "", err
+	}
+	mail := ""
+	for _, e := range u.Emails {
+		if mail == "" || e.Primary {
+			mail = e.Value
+		}
+	}
+	return true, mail, nil
+}
+
+// Complete sets the password of an inactive user, then activates it with the
+// verified address.
+func (d *scimDirectory) Complete(ctx context.Context, user, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "scim.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := d.find(ctx, user)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("Could not find user %s", user)
+	}
+	userURL := d.base + "/Users/" + url.PathEscape(u.ID)
+	patch := map[string]any{
+		"schemas": []string{scimPatchSchema},
+		"Operations": []map[string]any{
+			{"op": "replace", "path": "password", "value": password},
+		},
+	}
+	if _, err := doJSON(ctx, http.MethodPatch, userURL, d.header, patch, nil); err != nil {
+		return fmt.Errorf("Could not add a password to the stub: %v", err)
+	}
+	patch = map[string]any{
+		"schemas": []string{scimPatchSchema},
+		"Operations": []map[string]any{
+			{"op": "replace", "path": "emails", "value": []map[string]any{{"value": mail, "primary": true}}},
+			{"op": "replace", "path": "active", "value": true},
+		},
+	}
+	if _, err := doJSON(ctx, http.MethodPatch, userURL, d.header, patch, nil); err != nil {
+		return fmt.Errorf("Could not enable the stub: %v", err)
+	}
+	return nil
+}
+
+// Delete removes a user.
+func (d *scimDirectory) Delete(ctx context.Context, user string) (err error) {
+	_, sp := startSpan(ctx, "scim.delete", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := d.find(ctx, user)
+	if err != nil || u == nil {
+		return err
+	}
+	if _, err := doJSON(ctx, http.MethodDelete, d.base+"/Users/"+url.PathEscape(u.ID), d.header, nil, nil); err != nil {
+		return fmt.Errorf("Could not delete the SCIM user: %v", err)
+	}
+	return nil
+}
+
+// Disable deactivates a user.
+func (d *scimDirectory) Disable(ctx context.Context, user string) (err error) {
+	_, sp := startSpan(ctx, "scim.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := d.find(ctx, user)
+	if err != nil || u == nil {
+		return err
+	}
+	patch := map[string]any{
+		"schemas": []string{scimPatchSchema},
+		"Operations": []map[string]any{
+			{"op": "replace", "path": "active", "value": false},
+		},
+	}
+	if _, err := doJSON(ctx, http.MethodPatch, d.base+"/Users/"+url.PathEscape(u.ID), d.header, patch, nil); err != nil {
+		return fmt.Errorf("Could not disable the SCIM user: %v", err)
+	}
+	return nil
+}
+
+// Enable activates a user again.
+func (d *scimDirectory) Enable(ctx context.Context, user string) (err error) {
+	_, sp := startSpan(ctx, "scim.update", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u, err := d.find(ctx, user)
+	if err != nil || u == nil {
+		return err
+	}
+	patch := map[string]any{
+		"schemas": []string{scimPatchSchema},
+		"Operations": []map[string]any{
+			{"op": "replace", "path": "active", "value": true},
+		},
+	}
+	if _, err := doJSON(ctx, http.MethodPatch, d.base+"/Users/"+url.PathEscape(u.ID), d.header, patch, nil); err != nil {
+		return fmt.Errorf("Could not enable the SCIM user: %v", err)
+	}
+	return nil
+}
+
+// find looks up a user by userName.
+func (d *scimDirectory) find(ctx context.Context, user string) (*scimUser, error) {
+	var res struct {
+		Resources []scimUser `json:"Resources"`
+	}
+	q := url.Values{"filter": {fmt.Sprintf("userName eq %q", user)}}
+	if _, err := doJSON(ctx, http.MethodGet, d.base+"/Users?"+q.Encode(), d.header, nil, &res); err != nil {
+		return nil, fmt.Errorf("Could not search SCIM users: %v", err)
+	}
+	if len(res.Resources) == 0 {
+		return nil, nil
+	}
+	return &res.Resources[0], nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scriptResult is the JSON object written by the scripted commands:
+//
+//	ssh user@host request-token [address]
+//	ssh user@host verify <token> <password>
+//
+// Status is token_sent, token_pending or registered on success, and error
+// otherwise, with Error holding one of the codes below.
+type scriptResult struct {
+	Status    string     `json:"status"`
+	User      string     `json:"user"`
+	Mail      string     `json:"mail,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	// the free usernames, when the user is already registered
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+const (
+	scriptUsage             = "usage"
+	scriptMaintenance       = "maintenance"
+	scriptPolicyDenied      = "policy_denied"
+	scriptApprovalRequired  = "approval_required"
+	scriptAlreadyRegistered = "already_registered"
+	scriptNotProvisioned    = "not_provisioned"
+	scriptLockedOut         = "locked_out"
+	scriptQuotaExceeded     = "quota_exceeded"
+	scriptRolledBack        = "rolled_back"
+	scriptInvalidMail       = "invalid_mail"
+	scriptMailRejected      = "mail_rejected"
+	scriptMailTaken         = "mail_taken"
+	scriptMailThrottled     = "mail_throttled"
+	scriptNoPendingToken    = "no_pending_token"
+	scriptInvalidToken      = "invalid_token"
+	scriptTokenFailed       = "token_failed"
+	scriptTokenBound        = "token_bound"
+	scriptInvalidPassword   = "invalid_password"
+	scriptInternalError     = "internal_error"
+)
+
+// the exit status matching each error code, exitDeclined for the others
+var scriptExits = map[string]int{
+	scriptNoPendingToken:  exitTokenFailed,
+	scriptInvalidToken:    exitTokenFailed,
+	scriptTokenFailed:     exitTokenFailed,
+	scriptTokenBound:      exitTokenFailed,
+	scriptInvalidPassword: exitPasswordFailed,
+	scriptRolledBack:      exitBackendError,
+	scriptInternalError:   exitBackendError,
+}
+
+const scriptHelp = "Usage: request-token [address] | verify <token> <password>"
+
+func (s *session) reply(r scriptResult) {
+	r.User = s.user
+	s.exit = exitOK
+	if r.Status == "error" {
+		s.exit = exitDeclined
+		if code, ok := scriptExits[r.Error]; ok {
+			s.exit = code
+		}
+	}
+	json.NewEncoder(s).Encode(r)
+}
+
+func scriptError(code, msg string) scriptResult {
+	return scriptResult{Status: "error", Error: code, Message: msg}
+}
+
+func (s *session) scriptInternalError(msg string, err error) scriptResult {
+	reportError(err, s.tags())
+	logError("%s for %s: %v", msg, s.user, err)
+	return scriptError(scriptInternalError, "an internal error occurred")
+}
+
+// script runs a registration step given as the SSH command, so that it can
+// be automated, replying with a scriptResult on stdout.
+func (s *session) script(args []string) {
+	s.reply(s.scriptStep(args))
+}
+
+// scriptStep runs a registration step of the scripted mode, or of the web
+// form, which drives the same steps.
+func (s *session) scriptStep(args []string) scriptResult {
+	if inMaintenance() {
+		return scriptError(scriptMaintenance, options().MaintenanceMessage)
+	}
+	switch rep := s.askPolicy(); rep.Decision {
+	case policyDeny:
+		return scriptError(scriptPolicyDenied, s.textData(POLICY_DENIED, messageData{Reason: rep.Message}))
+	case policyReview:
+		return scriptError(scriptApprovalRequired, s.textData(POLICY_REVIEW, messageData{Reason: rep.Message}))
+	}
+	dir, err := openDirectory(s.ctx)
+	if err != nil {
+		return s.scriptInternalError("Could not connect to the directory", err)
+	}
+	s.dir = dir
+	defer dir.Close()
+	exists, stub, stubMail, err := lookupAccount(s.ctx, dir, s.user)
+	if err != nil {
+		return s.scriptInternalError("Could not search the directory", err)
+	}
+	if exists && options().EnumerationProtection {
+		s.decoy = true
+	} else if exists {
+		var mail string
+		if len(args) > 1 && args[0] == "request-token" {
+			mail = args[1]
+		}
+		res := scriptError(scriptAlreadyRegistered, "the user is already registered")
+		if res.Suggestions = suggestUsernames(s.ctx, dir, s.user, mail); len(res.Suggestions) > 0 {
+			res.Message += ", these usernames are free: " + strings.Join(res.Suggestions, ", ")
+		}
+		return res
+	}
+	if options().RegistrationMode == "complete" && !stub {
+		return scriptError(scriptNotProvisioned, "there is no account waiting for the user to be completed")
+	}
+	s.stub, s.stubMail = stub, stubMail
+	until, locked, err := tokens.LockedUntil(s.ctx, s.user)
+	if err != nil {
+		return s.scriptInternalError("Could not look up the lockout", err)
+	}
+	if locked {
+		countFailure(failLockedOut)
+		return scriptError(scriptLockedOut, fmt.Sprintf("too many failed attempts, try again in %s", clockUntil(until).Round(time.Second)))
+	}
+
+	switch {
+	case args[0] == "request-token" && len(args) <= 2:
+		return s.scriptRequestToken(args[1:])
+	case args[0] == "verify" && len(args) == 3:
+		return s.scriptVerify(args[1], args[2])
+	default:
+		return scriptError(scriptUsage, scriptHelp)
+	}
+}
+
+func (s *session) scriptRequestToken(args []string) scriptResult {
+	full, err := quotas.exceeded(s.ctx)
+	if err != nil {
+		return s.scriptInternalError("Could not check the registration quota", err)
+	}
+	if full {
+		countFailure(failQuotaExceeded)
+		return scriptError(scriptQuotaExceeded, "the registration quota is exhausted, try again later")
+	}
+
+	if mail := s.fixedMail(); mail != "" {
+		if len(args) != 0 && s.stubMail != "" {
+			return scriptError(scriptUsage, "the address on file is used")
+		}
+		if len(args) != 0 {
+			return scriptError(scriptUsage, "the address is derived from the username")
+		}
+		s.mail = mail
+	} else {
+		if len(args) != 1 {
+			return scriptError(scriptUsage, "an address is required")
+		}
+		mail, err := parseMailIn(args[0], s.allowedDomains())
+		if err != nil {
+			return scriptError(scriptInvalidMail, err.Error())
+		}
+		taken, err := s.mailTaken(mail)
+		if err != nil {
+			return s.scriptInternalError("Could not check whether the address is in use", err)
+		}
+		if taken {
+			return scriptError(scriptMailTaken, "the address is already used by another account")
+		}
+		s.mail = mail
+	}
+
+	pending, ok, err := tokens.Get(s.ctx, s.user)
+	if err != nil {
+		return s.scriptInternalError("Could not look up the pending token", err)
+	}
+	if ok && pending.Mail == s.mail {
+		// don't mail the same address over and over
+		return scriptResult{Status: "token_pending", Mail: s.mail, ExpiresAt: &pending.ExpiresAt}
+	}
+
+	wait, err := mailThrottles.take(s.ctx, s.mail)
+	if err != nil {
+		return s.scriptInternalError("Could not check the mail throttle", err)
+	}
+	if wait > 0 {
+		countFailure(failMailThrottled)
+		logWarn("Not mailing %s for %s: too many mails sent to the address", s.mail, s.user)
+		return scriptError(scriptMailThrottled, fmt.Sprintf("too many mails were sent to the address, try again in %s", wait.Round(time.Second)))
+	}
+
+	s.expiresAt = clockNow().Add(options().TokenTTL)
+	token := issueToken(s.user, s.mail, s.expiresAt)
+	t := pendingToken{User: s.user, Mail: s.mail, IP: s.ip, Key: s.client().Key, Token: token, ExpiresAt: s.expiresAt}
+	if err := tokens.Put(s.ctx, t); err != nil {
+		return s.scriptInternalError("Could not store the token", err)
+	}
+	if err := s.deliverToken(token); err != nil {
+		tokens.Remove(context.Background(), s.user)
+		if errors.Is(err, errRecipientRejected) {
+			logWarn("Mail to %s for %s was rejected: %v", s.mail, s.user, err)
+			return scriptError(scriptMailRejected, "the mail server rejected the address")
+		}
+		return s.scriptInternalError("Could not send mail", err)
+	}
+	logDebug("smtp", "token for %s is %s", s.mail, token)
+	audits.publish(auditEvent{Type: auditTokenSent, User: s.user, Mail: s.mail, IP: s.ip})
+	return scriptResult{Status: "token_sent", Mail: s.mail, ExpiresAt: &s.expiresAt}
+}
+
+func (s *session) scriptVerify(token, passwd string) scriptResult {
+	t, ok, err := pendingFor(s.ctx, tokens, s.user, token)
+	if err != nil {
+		return s.scriptInternalError("Could not look up the pending token", err)
+	}
+	if !ok {
+		countFailure(failTokenExpired)
+		return scriptError(scriptNoPendingToken, "no token was requested, or it expired")
+	}
+	s.mail = t.Mail
+
+	// check the password first, so that a rejected one doesn't waste the token
+	if len(passwd) > int(options().PasswordMax) {
+		countFailure(failPasswordPolicy)
+		return scriptError(scriptInvalidPassword, "Password is too long")
+	}
+	if strings.Trim(passwd, string(passwordChars)) != "" {
+		countFailure(failPasswordPolicy)
+		return scriptError(scriptInvalidPassword, "Password must only contain printable ASCII characters")
+	}
+	if msg := checkPassword(s.user, passwd); msg != "" {
+		countFailure(failPasswordPolicy)
+		return scriptError(scriptInvalidPassword, msg)
+	}
+
+	check, err := verifyPending(s.ctx, tokens, s.user, s.client(), token)
+	if err != nil {
+		return s.scriptInternalError("Could not check the token", err)
+	}
+	if !check.Found {
+		countFailure(failTokenExpired)
+		return scriptError(scriptNoPendingToken, "no token was requested, or it expired")
+	}
+	if check.Unbound {
+		s.unboundToken()
+		return scriptError(scriptTokenBound, "the token was issued to another connection")
+	}
+	if !check.Valid {
+		if left := s.failToken(check); left > 0 {
+			return scriptError(scriptInvalidToken, fmt.Sprintf("invalid token, %d attempts left", left))
+		}
+		return scriptError(scriptTokenFailed, "too many failed attempts")
+	}
+
+	s.verified = true
+	audits.publish(auditEvent{Type: auditVerified, User: s.user, Mail: s.mail, IP: s.ip})
+	s.password = passwd
+	err = s.createAccount()
+	if errors.Is(err, errQuotaExceeded) {
+		return scriptError(scriptQuotaExceeded, "the registration quota is exhausted, try again later")
+	}
+	if errors.Is(err, errTokenClaimed) {
+		return scriptError(scriptNoPendingToken, "the token was used by another session")
+	}
+	var taken *mailTakenError
+	if errors.As(err, &taken) {
+		if s.resetMailOwner(taken) {
+			return scriptError(scriptMailTaken, "the address is already used by another account, a link to reset its password was mailed to it")
+		}
+		return scriptError(scriptMailTaken, "the address is already used by another account")
+	}
+	if errors.Is(err, errRolledBack) {
+		logError("Could not register %s: %v", s.user, err)
+		return scriptError(scriptRolledBack, "the registration failed and was undone, verify the token again to retry")
+	}
+	if err != nil {
+		return s.scriptInternalError("Could not register the user", err)
+	}
+	return scriptResult{Status: "registered", Mail: s.mail}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// loadSecretFiles looks for a NAME_FILE variable for every option and, when
+// it is set, reads the value of NAME from that file. This is how Docker and
+// Kubernetes secrets are usually mounted, and keeps credentials out of the
+// environment. It must run before env.Parse, and NAME_FILE wins over NAME.
+func loadSecretFiles() error {
+	t := reflect.TypeOf(Options{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		path, ok := os.LookupEnv(name + "_FILE")
+		if !ok {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Could not read %s_FILE: %v", name, err)
+		}
+		// editors and `echo` usually leave a trailing newline behind
+		if err := os.Setenv(name, strings.TrimRight(string(b), "\r\n")); err != nil {
+			return fmt.Errorf("Could not set %s from %s_FILE: %v", name, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// In the seeded mode, for tests and demos, the tokens come from TOKEN_SEED
+// or TOKEN_SEQUENCE and the clock stops at FROZEN_CLOCK, so that the same
+// sessions get the same tokens and expire at the same times. The clock only
+// moves when advanced from the admin shell, which fast-forwards the retries
+// and the cleanup jobs waiting on it too. With STORE=redis the pending
+// tokens still expire in real time, Redis keeping their TTL.
+
+// tokenSource picks the characters and words of the tokens.
+type tokenSource interface {
+	Intn(n int) int
+}
+
+// cryptoSource draws from crypto/rand, for the tokens to be unpredictable
+// outside of the seeded mode.
+type cryptoSource struct{}
+
+func (cryptoSource) Intn(n int) int {
+	v, err := cryptorand.Int(cryptorand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// the system has no randomness left to give, there is no token
+		// safe to hand out
+		panic(fmt.Sprintf("Could not read random bytes: %v", err))
+	}
+	return int(v.Int64())
+}
+
+// seededSource is a tokenSource drawing from its own seeded generator,
+// which is not safe for concurrent use by itself.
+type seededSource struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (s *seededSource) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Intn(n)
+}
+
+var (
+	tokenRand = newReloadable[tokenSource](cryptoSource{})
+
+	// the next token of TOKEN_SEQUENCE
+	sequenceMu   sync.Mutex
+	sequenceNext int
+
+	// the options the seeded mode was last set up with, so that a reload
+	// changing none of them neither reseeds nor turns the clock back
+	seededWith string
+)
+
+// initSeeded sets up the clock and the tokens from the FROZEN_CLOCK,
+// TOKEN_SEED and TOKEN_SEQUENCE options.
+func initSeeded() error {
+	var frozen time.Time
+	if options().FrozenClock != "" {
+		var err error
+		if frozen, err = time.Parse(time.RFC3339, options().FrozenClock); err != nil {
+			return fmt.Errorf("Could not parse FROZEN_CLOCK, expected an RFC 3339 time: %v", err)
+		}
+	}
+	with := fmt.Sprint(options().FrozenClock, options().TokenSeed, options().TokenSequence)
+	if with == seededWith {
+		return nil
+	}
+	seededWith = with
+
+	setClock(systemClock{})
+	if !frozen.IsZero() {
+		setClock(&frozenClock{at: frozen})
+		logWarn("The clock is frozen at %s, never do this in production", frozen.Format(time.RFC3339))
+	}
+	tokenRand.set(cryptoSource{})
+	if options().TokenSeed != 0 {
+		tokenRand.set(&seededSource{r: rand.New(rand.NewSource(options().TokenSeed))})
+	}
+	sequenceMu.Lock()
+	sequenceNext = 0
+	sequenceMu.Unlock()
+	if options().TokenSeed != 0 || len(options().TokenSequence) > 0 {
+		logWarn("The tokens are predictable with TOKEN_SEED or TOKEN_SEQUENCE, never do this in production")
+	}
+	return nil
+}
+
+// sequenceToken returns the next token of TOKEN_SEQUENCE, starting over
+// after the last one, if set.
+func sequenceToken() (string, bool) {
+	if len(options().TokenSequence) == 0 {
+		return "", false
+	}
+	sequenceMu.Lock()
+	defer sequenceMu.Unlock()
+	t := options().TokenSequence[sequenceNext%len(options().TokenSequence)]
+	sequenceNext++
+	return t, true
+}
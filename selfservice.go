@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// accountDirectory is implemented by the directories which let existing
+// users manage their account on their own, once they have proven they own
+// the address on file.
+type accountDirectory interface {
+	Mail(ctx context.Context, user string) (string, error)
+	Delete(ctx context.Context, user string) error
+	SetMail(ctx context.Context, user, mail string) error
+	// UserByMail returns the user with the given address, or "".
+	UserByMail(ctx context.Context, mail string) (string, error)
+}
+
+// selfService offers the account management actions to an existing user,
+// returning false when the directory doesn't support them or the user
+// doesn't pick any.
+func (s *session) selfService() bool {
+	ad, ok := s.dir.(accountDirectory)
+	if !ok {
+		return false
+	}
+	io.WriteString(s, s.text(ACCOUNT_MENU))
+	buf, err := readN(s, 1, []byte{'d', 'm', 'q'}, true)
+	if err != nil || len(buf) < 1 || buf[0] == 'q' {
+		s.bye()
+		return true
+	}
+
+	switch buf[0] {
+	case 'd':
+		if !s.proveOwnership(ad) {
+			return true
+		}
+		s.deleteAccount(ad)
+	case 'm':
+		if !s.proveOwnership(ad) {
+			return true
+		}
+		s.changeMail(ad)
+	}
+	return true
+}
+
+// proveOwnership mails a token to the address on file and checks it.
+func (s *session) proveOwnership(ad accountDirectory) bool {
+	if s.lockedOut() {
+		return false
+	}
+	var err error
+	if s.mail, err = ad.Mail(s.ctx, s.user); err != nil {
+		s.internalError("Could not look up the address", err)
+		return false
+	}
+	if s.mail == "" {
+		io.WriteString(s, s.text(NO_MAIL_ON_FILE))
+		return false
+	}
+	if !s.challenge() || !s.mailToken() {
+		return false
+	}
+	io.WriteString(s, s.text(TOKEN_SENT))
+	return s.verifyToken()
+}
+
+// changeMail asks for a new address and, once the user proves they own it
+// too, stores it in the directory.
+func (s *session) changeMail(ad accountDirectory) {
+	old := s.mail
+	mail, ok := s.askMail(MAIL_CHANGE_PROMPT)
+	if !ok {
+		return
+	}
+	if mail == old {
+		io.WriteString(s, s.text(MAIL_UNCHANGED))
+		return
+	}
+	s.mail = mail
+	if !s.mailToken() {
+		return
+	}
+	io.WriteString(s, s.text(TOKEN_SENT))
+	if !s.verifyToken() {
+		return
+	}
+	err := s.progress(s.text(PROGRESS_MAIL_CHANGE), func() error {
+		return ad.SetMail(s.ctx, s.user, s.mail)
+	})
+	if err != nil {
+		s.internalError("Could not change the address", err)
+		return
+	}
+	logInfo("%s changed their address from %s to %s", s.user, old, s.mail)
+	s.exit = exitOK
+	s.say(styleSuccess, s.text(MAIL_CHANGED))
+}
+
+func (s *session) deleteAccount(ad accountDirectory) {
+	io.WriteString(s, s.text(ACCOUNT_DELETE_CONFIRM))
+	buf, err := readN(s, 256, nil, true)
+	if err != nil {
+		s.bye()
+		return
+	}
+	if string(buf) != s.user {
+		io.WriteString(s, s.text(ACCOUNT_NOT_DELETED))
+		return
+	}
+	err = s.progress(s.text(PROGRESS_DELETE), func() error {
+		return ad.Delete(s.ctx, s.user)
+	})
+	if err != nil {
+		s.internalError("Could not delete the account", err)
+		return
+	}
+	logInfo("%s deleted their account from %s", s.user, s.ip)
+	s.exit = exitOK
+	s.say(styleSuccess, s.text(ACCOUNT_DELETED))
+}
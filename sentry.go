@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// errorReporter ships errors and panics to a Sentry compatible endpoint
+// (Sentry, GlitchTip, ...) using the envelope API.
+type errorReporter struct {
+	dsn      string
+	endpoint string
+	auth     string
+	env      string
+	client   *http.Client
+}
+
+var reporter *errorReporter
+
+func initErrorReporting() error {
+	if options().SentryDSN == "" {
+		return nil
+	}
+	u, err := url.Parse(options().SentryDSN)
+	if err != nil {
+		return fmt.Errorf("Invalid SENTRY_DSN: %v", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return fmt.Errorf("Invalid SENTRY_DSN: missing public key")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return fmt.Errorf("Invalid SENTRY_DSN: missing project id")
+	}
+
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path[:i] + "/api/" + project + "/envelope/"}
+	reporter = &errorReporter{
+		dsn:      options().SentryDSN,
+		endpoint: endpoint.String(),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=sshauth, sentry_key=%s", u.User.Username()),
+		env:      options().SentryEnvironment,
+		client:   &http.Client{Transport: httpTransport, Timeout: 5 * time.Second},
+	}
+	return nil
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+// stacktrace collects the caller frames, skipping the given number of them,
+// in the oldest-first order expected by Sentry.
+func stacktrace(skip int) []sentryFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var res []sentryFrame
+	for {
+		f, more := frames.Next()
+		res = append([]sentryFrame{{Function: f.Function, Filename: f.File, Lineno: f.Line}}, res...)
+		if !more {
+			break
+		}
+	}
+	return res
+}
+
+func (r *errorReporter) capture(level, kind, msg string, tags map[string]string, skip int) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	host, _ := os.Hostname()
+
+	exc := sentryException{Type: kind, Value: msg}
+	exc.Stacktrace.Frames = stacktrace(skip + 1)
+	event := map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+		"level":       level,
+		"platform":    "go",
+		"logger":      "sshauth",
+		"server_name": host,
+		"tags":        tags,
+		"exception":   map[string]any{"values": []sentryException{exc}},
+	}
+	if r.env != "" {
+		event["environment"] = r.env
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logError("Could not encode error report: %v", err)
+		return
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "{\"event_id\":%q,\"dsn\":%q}\n", event["event_id"], r.dsn)
+	fmt.Fprintf(&body, "{\"type\":\"event\",\"length\":%d}\n", len(payload))
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, &body)
+	if err != nil {
+		logError("Could not send error report: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	res, err := r.client.Do(req)
+	if err != nil {
+		logError("Could not send error report: %v", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		logError("Could not send error report: server replied %s", res.Status)
+	}
+}
+
+// reportError sends err to the error reporter, if one is configured.
+func reportError(err error, tags map[string]string) {
+	if reporter == nil || err == nil {
+		return
+	}
+	reporter.capture("error", fmt.Sprintf("%T", err), err.Error(), tags, 2)
+}
+
+// reportPanic sends a recovered panic value to the error reporter, if one is
+// configured. It must be called from the deferred function that recovered.
+func reportPanic(v any, tags map[string]string) {
+	if reporter == nil {
+		return
+	}
+	reporter.capture("fatal", "panic", fmt.Sprint(v), tags, 3)
+}
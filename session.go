@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"text/template"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// session holds all the state of a single registration attempt. A new one is
+// created for every incoming SSH session, so concurrent users never share any
+// mutable data.
+type session struct {
+	ssh.Session
+	ctx context.Context
+
+	ip   string
+	user string
+	mail string
+	dir  directory
+
+	// answers to the prompts of the flow, and the chosen password
+	vars     map[string]string
+	password string
+
+	// expiry of the token mailed during this session
+	expiresAt time.Time
+
+	// whether the verification was skipped, for a trusted network
+	trusted bool
+	// whether the token was verified, and is to be claimed by createAccount
+	verified bool
+	// whether a phone number was verified, with VERIFY_PHONE
+	phoneVerified bool
+	// with ENUMERATION_PROTECTION, whether the user exists already and the
+	// flow only pretends to register them, see enumeration.go
+	decoy bool
+	// with REGISTRATION_MODE=complete, whether the user is a stub waiting to
+	// be completed, and the address on file for them, if any
+	stub     bool
+	stubMail string
+	// whether the user came through the web form, without an SSH session
+	web bool
+	// the profile of the listener the session connected to, if any
+	profile *profile
+
+	// the exit status sent when the session ends
+	exit int
+	// whether the output is colored
+	color bool
+	// whether the session speaks JSON lines, see jsonmode.go
+	jsonLines bool
+	// whether the output is linear, without colors or cursor movements, see
+	// plainRequested
+	plain bool
+	// the messages in the language of the user
+	messages *template.Template
+	// the input of the user, buffered across prompts, and the output
+	in  *bufio.Reader
+	out *terminal
+	// the recording of the session, with RECORD_DIR
+	rec *recorder
+	// the transcript attached to the alerts, with ALERT_TRANSCRIPT
+	transcript *transcript
+	// the notices broadcast by the admins, waiting for a prompt
+	notices chan string
+}
+
+// input returns the buffered input of the session, see readN.
+func (s *session) input() *bufio.Reader {
+	if s.in == nil {
+		s.in = bufio.NewReader(sessionInput(s.Session, s.ip))
+	}
+	return s.in
+}
+
+// Read reads through the buffered input, so that nothing read ahead by a
+// prompt is lost.
+func (s *session) Read(p []byte) (int, error) {
+	return s.input().Read(p)
+}
+
+// exit statuses of a session, so that wrappers can tell the outcomes apart
+const (
+	exitOK = iota
+	// the user gave up, or was turned away before verifying anything
+	exitDeclined
+	exitTokenFailed
+	exitPasswordFailed
+	exitBackendError
+)
+
+// exitNames names the exit statuses in the JSON mode and the metrics.
+var exitNames = map[int]string{
+	exitOK:             "ok",
+	exitDeclined:       "declined",
+	exitTokenFailed:    "token_failed",
+	exitPasswordFailed: "password_failed",
+	exitBackendError:   "backend_error",
+}
+
+// acceptConn refuses connections from banned addresses, and from the ones
+// outside of the allowed networks, before the SSH handshake even starts.
+func acceptConn(ctx ssh.Context, conn net.Conn) net.Conn {
+	ip := remoteIP(conn.RemoteAddr())
+	if tooManyGoroutines() {
+		logWarn("Refusing connection from %s: MAX_GOROUTINES reached", ip)
+		return nil
+	}
+	if !ipAllowed(ip) {
+		logWarn("Refusing connection from %s: address not allowed", ip)
+		return nil
+	}
+	if bans.banned(ip) {
+		if options().BanMode == "tarpit" {
+			delay := tarpits.delay(ip)
+			logWarn("Tarpitting connection from banned address %s with a %s delay", ip, delay)
+			return watchConn(ctx, &tarpitConn{Conn: conn, delay: delay}, ip)
+		}
+		logWarn("Refusing connection from banned address %s", ip)
+		return nil
+	}
+	tarpits.forget(ip)
+	tagProfile(ctx, conn)
+	return watchConn(ctx, conn, ip)
+}
+
+// recoverPanics wraps a session handler so that a bug triggered by a single
+// session only ends that session, instead of crashing the whole server.
+func recoverPanics(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		defer s.Close()
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			ip := remoteIP(s.RemoteAddr())
+			reportPanic(r, map[string]string{"user": s.User(), "ip": ip})
+			logError("Session of %s from %s panicked: %v\n%s", s.User(), ip, r, debug.Stack())
+			io.WriteString(newTerminal(s), connText(s, INTERNAL_ERROR))
+			s.Exit(exitBackendError)
+		}()
+		next(s)
+	}
+}
+
+func handle(s ssh.Session) {
+	ip := remoteIP(s.RemoteAddr())
+	keepalive(s.Context(), ip)
+	if version := s.Context().ClientVersion(); !clientAllowed(version) {
+		logWarn("Rejecting session from %s: client %q is too old", ip, version)
+		turnAway(s, CLIENT_TOO_OLD)
+		return
+	}
+	if s.RawCommand() != "" && !jsonCommand(s) && (!options().ScriptedMode || isAdminSession(s)) {
+		refuseExec(s, ip)
+		return
+	}
+	if isAdminSession(s) {
+		// operators are not subject to the session limits
+		admin := &session{Session: s, ctx: s.Context(), ip: ip, user: s.User()}
+		defer admin.track()()
+		admin.adminShell()
+		return
+	}
+	if !limiter.acquireIP(ip) {
+		logWarn("Rejecting session from %s: too many sessions from this address", ip)
+		turnAway(s, TOO_MANY_SESSIONS)
+		return
+	}
+	defer limiter.releaseIP(ip)
+	if !limiter.tryAcquire() {
+		if options().SessionQueueWait <= 0 {
+			logWarn("Rejecting session from %s: session limit reached", ip)
+			turnAway(s, SERVER_BUSY)
+			return
+		}
+		sayConn(s, SERVER_QUEUED)
+		if !limiter.acquire(s.Context(), options().SessionQueueWait) {
+			turnAway(s, SERVER_BUSY)
+			return
+		}
+	}
+	defer limiter.release()
+
+	ctx, sp := startSpan(s.Context(), "session", spanKindServer)
+	sp.setAttr("ssh.user", s.User())
+	sp.setAttr("net.peer.ip", ip)
+	defer sp.finish(nil)
+
+	user, err := normalizeUsername(s.User())
+	if err != nil {
+		logWarn("Rejecting session from %s: %v", ip, err)
+		turnAway(s, INVALID_USERNAME)
+		return
+	}
+	sess := &session{Session: s, ctx: ctx, ip: ip, user: user, vars: map[string]string{}, exit: exitDeclined, color: colorEnabled(s), messages: catalogFor(s.Environ())}
+	if sess.profile = sessionProfile(s.Context()); sess.profile != nil {
+		sp.setAttr("sshauth.profile", sess.profile.Name)
+	}
+	if options().ScriptedMode && len(s.Command()) > 0 && !jsonCommand(s) {
+		sess.script(s.Command())
+	} else {
+		sess.jsonLines, sess.plain = jsonRequested(s), plainRequested(s)
+		if sess.jsonLines || sess.plain {
+			sess.color = false
+		}
+		if options().AlertTranscript && alertsEnabled() {
+			sess.startTranscript()
+		}
+		if options().RecordDir != "" {
+			sess.startRecording()
+			defer sess.stopRecording()
+		}
+		defer sess.track()()
+		sess.bracketedPaste(true)
+		sess.run()
+		sess.bracketedPaste(false)
+		if country := alertCountry(ip); country != "" {
+			sess.raiseAlert(securityAlert{Event: "country", User: sess.user, Mail: sess.mail, IP: ip, Detail: fmt.Sprintf("session from %s, listed in ALERT_COUNTRIES", country)})
+		}
+		sess.jsonResult()
+	}
+	sessionOutcomes.inc(exitNames[sess.exit])
+	s.Exit(sess.exit)
+}
+
+// tags returns the session details attached to error reports.
+func (s *session) tags() map[string]string {
+	tags := map[string]string{"user": s.user, "ip": s.ip}
+	if id := spanFromContext(s.ctx).TraceID(); id != "" {
+		tags["trace_id"] = id
+	}
+	return tags
+}
+
+// internalError logs and reports an unexpected backend error, showing the user
+// a generic apology.
+func (s *session) internalError(msg string, err error) {
+	reportError(err, s.tags())
+	logError("%s for %s: %v", msg, s.user, err)
+	s.exit = exitBackendError
+	s.say(styleError, s.text(INTERNAL_ERROR))
+}
+
+func (s *session) bye() {
+	io.WriteString(s, s.text(BYE))
+}
+
+func (s *session) run() {
+	if inMaintenance() {
+		io.WriteString(s, maintenanceMessage())
+		return
+	}
+	if !s.policyAllows() {
+		return
+	}
+
+	// initalize the directory connection
+	dir, err := openDirectory(s.ctx)
+	if err != nil {
+		s.internalError("Could not connect to the directory", err)
+		return
+	}
+	s.dir = dir
+	defer dir.Close()
+	exists, stub, stubMail, err := lookupAccount(s.ctx, dir, s.user)
+	if err != nil {
+		s.internalError("Could not search the directory", err)
+		return
+	}
+	if exists {
+		if authExtension(s.Context(), extensionStored) != "" {
+			// the key was checked against the directory on authentication
+			s.completeWithKey()
+			return
+		}
+		if options().EnumerationProtection {
+			logInfo("Running a decoy flow for %s from %s: the user is already registered", s.user, s.ip)
+			s.decoy = true
+		} else {
+			if options().SelfService && s.selfService() {
+				return
+			}
+			// already registered
+			data := messageData{URL: options().LldapURI.JoinPath("/login").String(), Suggestions: suggestUsernames(s.ctx, dir, s.user, "")}
+			if options().LldapPasswordReset {
+				io.WriteString(s, s.textData(ALREADY_REGISTERED_RESET, data))
+				s.offerReset()
+				return
+			}
+			io.WriteString(s, s.textData(ALREADY_REGISTERED, data))
+			return
+		}
+	}
+	if options().RegistrationMode == "complete" && !stub {
+		logWarn("Rejecting %s from %s: no stub account to complete", s.user, s.ip)
+		s.say(styleError, s.text(NOT_PROVISIONED))
+		return
+	}
+	s.stub, s.stubMail = stub, stubMail
+
+	if s.lockedOut() {
+		return
+	}
+
+	full, err := quotas.exceeded(s.ctx)
+	if err != nil {
+		s.internalError("Could not check the registration quota", err)
+		return
+	}
+	if full {
+		countFailure(failQuotaExceeded)
+		s.say(styleError, s.text(QUOTA_EXCEEDED))
+		return
+	}
+
+	s.runFlow()
+}
+
+// sendToken asks the user for their address, or derives it from the
+// username, and after they consent mails them a new token.
+func (s *session) sendToken() bool {
+	if !s.challenge() {
+		return false
+	}
+	if mail := s.fixedMail(); mail != "" {
+		s.mail = mail
+		io.WriteString(s, s.text(WELCOME_BODY))
+	} else {
+		mail, ok := s.askMail(MAIL_PROMPT)
+		if !ok {
+			return false
+		}
+		s.mail = mail
+		io.WriteString(s, s.text(MAIL_CONFIRM))
+	}
+	buf, err := readN(s, 1, []byte{'y', 'n'}, true)
+	if err != nil || len(buf) < 1 || buf[0] != 'y' {
+		s.bye()
+		return false
+	}
+	return s.mailToken()
+}
+
+// fixedMail returns the address the tokens of the user go to: the one on file
+// for a stub, or the one derived from the username with MAIL_MODE=suffix. It
+// returns "" when the user enters it.
+func (s *session) fixedMail() string {
+	switch {
+	case s.stubMail != "":
+		return s.stubMail
+	case s.mailMode() == "prompt":
+		return ""
+	}
+	return s.user + s.toSuffix()
+}
+
+// mailToken stores a new token for the user and mails it to s.mail.
+func (s *session) mailToken() bool {
+	wait, err := mailThrottles.take(s.ctx, s.mail)
+	if err != nil {
+		s.internalError("Could not check the mail throttle", err)
+		return false
+	}
+	if wait > 0 {
+		countFailure(failMailThrottled)
+		logWarn("Not mailing %s for %s: too many mails sent to the address", s.mail, s.user)
+		s.say(styleError, s.textData(MAIL_THROTTLED, messageData{Wait: wait.Round(time.Second)}))
+		return false
+	}
+	s.expiresAt = clockNow().Add(options().TokenTTL)
+	token := issueToken(s.user, s.mail, s.expiresAt)
+	t := pendingToken{User: s.user, Mail: s.mail, IP: s.ip, Key: s.client().Key, Token: token, ExpiresAt: s.expiresAt}
+	if err := tokens.Put(s.ctx, t); err != nil {
+		s.internalError("Could not store the token", err)
+		return false
+	}
+	err = s.progress(s.text(PROGRESS_MAIL), func() error {
+		return s.deliverToken(token)
+	})
+	if err != nil {
+		// the session may be gone already, clean up regardless
+		tokens.Remove(context.Background(), s.user)
+		if errors.Is(err, errRecipientRejected) {
+			logWarn("Mail to %s for %s was rejected: %v", s.mail, s.user, err)
+			s.say(styleError, s.text(MAIL_REJECTED))
+			return false
+		}
+		reportError(err, s.tags())
+		logError("Could not send mail: %v", err)
+		s.exit = exitBackendError
+		io.WriteString(s, s.text(MAIL_FAILED))
+		return false
+	}
+	logDebug("smtp", "token for %s is %s", s.mail, token)
+	audits.publish(auditEvent{Type: auditTokenSent, User: s.user, Mail: s.mail, IP: s.ip})
+	return true
+}
+
+// lockout prevents the user from starting over for LOCKOUT_DURATION after
+// running out of token or password attempts. The lock lives in the token
+// store, so reconnecting, even to another instance, doesn't lift it.
+func (s *session) lockout() {
+	if options().LockoutDuration <= 0 {
+		return
+	}
+	logWarn("Locking out %s for %s after too many failed attempts from %s", s.user, options().LockoutDuration, s.ip)
+	audits.publish(auditEvent{Type: auditLockedOut, User: s.user, Mail: s.mail, IP: s.ip})
+	// the session may be gone already, lock regardless
+	if err := tokens.Lock(context.Background(), s.user, clockNow().Add(options().LockoutDuration)); err != nil {
+		reportError(err, s.tags())
+		logError("Could not lock out %s: %v", s.user, err)
+	}
+}
+
+// lockedOut tells the user, and returns true, when they are locked out.
+func (s *session) lockedOut() bool {
+	until, locked, err := tokens.LockedUntil(s.ctx, s.user)
+	if err != nil {
+		s.internalError("Could not look up the lockout", err)
+		return true
+	}
+	if locked {
+		countFailure(failLockedOut)
+		s.say(styleError, s.textData(LOCKED_OUT, messageData{Wait: clockUntil(until).Round(time.Second)}))
+	}
+	return locked
+}
+
+// verifyToken prompts for the token sent by mail, allowing TOKEN_RETRIES
+// attempts in total across all the connections using the same token.
+func (s *session) verifyToken() (ok bool) {
+	_, sp := startSpan(s.ctx, "token.verify", spanKindInternal)
+	defer func() {
+		sp.setAttr("token.verified", ok)
+		sp.finish(nil)
+	}()
+
+	if options().TokenDelivery == "link" {
+		return s.waitConfirmation()
+	}
+	for {
+		d, err := s.tokenPromptData()
+		if err != nil {
+			s.internalError("Could not look up the token attempts", err)
+			return false
+		}
+		s.say(styleBold, s.textData(TOKEN_BODY, d))
+		recorded := s.recordSecret("token")
+		buf, err := readN(s, tokenInputLength(), []byte{}, true)
+		recorded()
+		if err != nil {
+			s.bye()
+			return false
+		}
+		check, err := verifyPending(s.ctx, tokens, s.user, s.client(), string(buf))
+		if err != nil {
+			s.internalError("Could not check the token", err)
+			return false
+		}
+		if !check.Found && clockNow().After(s.expiresAt) {
+			countFailure(failTokenExpired)
+			s.exit = exitTokenFailed
+			s.say(styleError, s.text(TOKEN_EXPIRED))
+			return false
+		} else if !check.Found {
+			countFailure(failTokenRevoked)
+			s.exit = exitTokenFailed
+			s.say(styleError, s.text(TOKEN_REVOKED))
+			return false
+		}
+		if check.Unbound {
+			s.unboundToken()
+			s.exit = exitTokenFailed
+			s.say(styleError, s.text(TOKEN_BOUND))
+			return false
+		}
+		if check.Valid {
+			s.verified = true
+			audits.publish(auditEvent{Type: auditVerified, User: s.user, Mail: s.mail, IP: s.ip})
+			return true
+		}
+
+		left := s.failToken(check)
+		if left <= 0 {
+			s.exit = exitTokenFailed
+			s.say(styleError, s.text(TOKEN_FAILED))
+			return false
+		}
+		s.say(styleError, s.textData(TOKEN_RETRY, messageData{Retries: left}))
+	}
+}
+
+// tokenPromptData tells the time left before the token expires and, out of
+// the attempts allowed from this address, the one about to be made.
+func (s *session) tokenPromptData() (messageData, error) {
+	total, fromIP, err := tokens.Failures(s.ctx, s.user, s.ip)
+	if err != nil {
+		return messageData{}, err
+	}
+	left := options().TokenRetries - fromIP
+	if n := options().TokenMaxAttempts - total; n < left {
+		left = n
+	}
+	wait := clockUntil(s.expiresAt).Round(time.Second)
+	if wait < 0 {
+		wait = 0
+	}
+	return messageData{Wait: wait, Attempt: fromIP + 1, Attempts: fromIP + left}, nil
+}
+
+// failToken handles a wrong token, burning it or locking the user out when
+// they run out of attempts, and returns the attempts left from this address.
+func (s *session) failToken(check tokenCheck) int {
+	bans.fail(s.ip, s.user, "invalid token")
+	countFailure(failTokenWrong)
+	audits.publish(auditEvent{Type: auditFailed, User: s.user, Mail: s.mail, IP: s.ip, Detail: "invalid token"})
+	total, fromIP := check.Total, check.FromIP
+	if total >= options().TokenMaxAttempts {
+		// too many failures overall, the token is burnt
+		s.raiseAlert(securityAlert{Event: "token failures", User: s.user, Mail: s.mail, IP: s.ip, Detail: fmt.Sprintf("token burnt after %d failed attempts", total)})
+		tokens.Remove(s.ctx, s.user)
+		s.lockout()
+		return 0
+	}
+	if fromIP >= options().TokenRetries {
+		s.raiseAlert(securityAlert{Event: "token failures", User: s.user, Mail: s.mail, IP: s.ip, Detail: fmt.Sprintf("locked out after %d failed attempts from this address", fromIP)})
+		s.lockout()
+		return 0
+	}
+	return options().TokenRetries - fromIP
+}
+
+// readNewPassword asks for the new password twice, making sure it complies
+// with the configured rules and that both entries match.
+func (s *session) readNewPassword() (passwd string, ok bool) {
+	rules, err := passwordRules()
+	if err != nil {
+		s.internalError("Could not describe the password rules", err)
+		return "", false
+	}
+	io.WriteString(s, s.textData(PASSWORD_RULES, messageData{Rules: rules}))
+	i := options().PasswordRetries
+	for {
+		s.say(stylePrompt, s.text(PASSWORD_PROMPT))
+		ok, firstPasswd, err := readPassword(s, s.user)
+		if err != nil {
+			s.bye()
+			return "", false
+		}
+		i--
+		if ok {
+			passwd = firstPasswd
+			break
+		}
+		countFailure(failPasswordPolicy)
+		io.WriteString(s, firstPasswd+"\n")
+		if i <= 0 {
+			s.lockout()
+			s.exit = exitPasswordFailed
+			s.say(styleError, s.text(PASSWORD_FAILED))
+			return "", false
+		}
+	}
+	for {
+		s.say(stylePrompt, s.text(PASSWORD_REPEAT))
+		ok, secondPassword, err := readPassword(s, s.user)
+		if err != nil {
+			s.bye()
+			return "", false
+		}
+		i--
+		if ok && secondPassword != passwd {
+			countFailure(failPasswordMismatch)
+			ok = false
+			secondPassword = s.text(PASSWORDS_DIFFER)
+		} else if !ok {
+			countFailure(failPasswordPolicy)
+		}
+		if ok {
+			return passwd, true
+		}
+		io.WriteString(s, secondPassword+"\n")
+		if i <= 0 {
+			s.lockout()
+			s.exit = exitPasswordFailed
+			s.say(styleError, s.text(PASSWORD_FAILED))
+			return "", false
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/lucat1/sshauth/sshauthtest"
+)
+
+// sinkedMail is a mail caught by the SMTP sink.
+type sinkedMail struct {
+	rcpt []string
+	msg  string
+}
+
+// startTestServer serves handle on a free port with the memory directory
+// and store, the mails going to the SMTP sink and then to mails.
+func startTestServer(t *testing.T, mails chan<- sinkedMail) string {
+	t.Helper()
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	sinkMail = func(rcpt []string, msg string) { mails <- sinkedMail{rcpt, msg} }
+	go serveSMTPSink(sink)
+
+	// as devCommand does, through the environment for reload to keep it
+	t.Setenv("DIRECTORY_BACKEND", "memory")
+	t.Setenv("STORE", "memory")
+	t.Setenv("MAIL_TRANSPORT", "smtp")
+	t.Setenv("MAIL_SERVER", sink.Addr().String())
+	swapOptions(&Options{})
+	if err := loadOptions(options()); err != nil {
+		t.Fatal(err)
+	}
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+	// a fresh directory, for the users of a previous test not to be taken
+	memoryUsers = &memoryDirectory{users: map[string]*memoryUser{}}
+	limiter = newSessionLimiter(options().MaxSessions, options().MaxSessionsPerIP)
+	bans = newBanList(options().BanThreshold, options().BanWindow, options().BanDuration)
+	if tokens, err = newPendingStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &ssh.Server{
+		Handler:              recoverPanics(handle),
+		ConnCallback:         acceptConn,
+		ServerConfigCallback: serverConfig,
+		ChannelHandlers:      refusingChannelHandlers,
+		RequestHandlers:      refusingRequestHandlers,
+		SubsystemHandlers:    refusingSubsystemHandlers,
+	}
+	keys, err := hostKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		server.AddHostKey(k)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+// TestConcurrentSessions registers users in parallel sessions, while the
+// configuration is reloaded, for go test -race to check that they share no
+// state but through the stores.
+func TestConcurrentSessions(t *testing.T) {
+	const users = 8
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	mails := make(chan sinkedMail, users)
+	srv := &sshauthtest.Server{Addr: startTestServer(t, mails)}
+	// the tokens, by the user they were mailed to
+	mailed := map[string]chan string{}
+	for i := 0; i < users; i++ {
+		mailed[fmt.Sprintf("user%d", i)] = make(chan string, 1)
+	}
+	suffix := options().ToSuffix
+	go func() {
+		tokenPattern := regexp.MustCompile(`token is: (\S+)`)
+		for m := range mails {
+			user := strings.TrimSuffix(strings.Join(m.rcpt, ""), suffix)
+			if match := tokenPattern.FindStringSubmatch(m.msg); match != nil && mailed[user] != nil {
+				mailed[user] <- match[1]
+			}
+		}
+	}()
+
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for ctx.Err() == nil {
+			if err := reload(); err != nil {
+				t.Errorf("Could not reload: %v", err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, users)
+	for i := 0; i < users; i++ {
+		user := fmt.Sprintf("user%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := register(ctx, srv, user, mailed[user]); err != nil {
+				errs <- fmt.Errorf("%s: %v", user, err)
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	<-reloaded
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i := 0; i < users; i++ {
+		user := fmt.Sprintf("user%d", i)
+		exists, err := memoryUsers.Exists(ctx, user)
+		if err != nil || !exists {
+			t.Errorf("%s was not registered: %v", user, err)
+		}
+	}
+}
+
+// register runs the interactive flow for user, reading the token from
+// token.
+func register(ctx context.Context, srv *sshauthtest.Server, user string, token <-chan string) error {
+	conn, err := srv.Dial(user)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	step := func(expect, send string) error {
+		if got, err := conn.Expect(ctx, expect); err != nil {
+			return fmt.Errorf("%v, got:\n%s", err, got)
+		}
+		return conn.Send(send)
+	}
+	if err := step("do you accept?", "y"); err != nil {
+		return err
+	}
+	var tok string
+	select {
+	case tok = <-token:
+	case <-ctx.Done():
+		return fmt.Errorf("No token was mailed: %v", ctx.Err())
+	}
+	for _, s := range [][2]string{
+		{"Enter the token", tok},
+		{"Password: ", "Correct-Horse-Battery-9"},
+		{"Repeat your password: ", "Correct-Horse-Battery-9"},
+	} {
+		if err := step(s[0], s[1]); err != nil {
+			return err
+		}
+	}
+	if got, err := conn.Expect(ctx, "You are now registered!"); err != nil {
+		return fmt.Errorf("%v, got:\n%s", err, got)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// With TOKEN_FORMAT=signed, the tokens carry the user, the address and the
+// expiry, signed with TOKEN_SECRET, so that any instance sharing the secret
+// can verify them without a shared STORE: the instance a token is entered
+// on adopts it into its own store, see pendingFor. The price is that the
+// counters of the attempts, the locks and the revocations stay with each
+// instance, and that a token may be entered again on another instance until
+// it expires, the directory refusing to register the same user twice.
+// TOKEN_BINDING only applies on the instance which issued the token.
+
+// the bytes of the HMAC-SHA256 kept in a signed token
+const signedTokenMAC = 16
+
+// the signed tokens use base32 without padding, made of upper case letters
+// and digits only, so that TOKEN_CASE_INSENSITIVE doesn't break them
+var signedEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// maxSignedToken is the length of the longest signed token, for a username
+// of up to 256 bytes and the longest address.
+var maxSignedToken = signedEncoding.EncodedLen(8 + 256 + 1 + maxMailLength + signedTokenMAC)
+
+// validateSignedTokens checks TOKEN_SECRET for TOKEN_FORMAT=signed.
+func validateSignedTokens() error {
+	if options().TokenFormat != "signed" {
+		return nil
+	}
+	if len(options().TokenSecret) < 32 {
+		return fmt.Errorf("TOKEN_FORMAT=signed needs a TOKEN_SECRET of at least 32 characters")
+	}
+	return nil
+}
+
+func signedTokenMACOf(payload []byte) []byte {
+	m := hmac.New(sha256.New, []byte(options().TokenSecret))
+	m.Write(payload)
+	return m.Sum(nil)[:signedTokenMAC]
+}
+
+// signToken returns the token of user, mailed to mail, expiring at expires.
+func signToken(user, mail string, expires time.Time) string {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	payload = append(payload, user...)
+	payload = append(payload, 0)
+	payload = append(payload, mail...)
+	return signedEncoding.EncodeToString(append(payload, signedTokenMACOf(payload)...))
+}
+
+// parseSignedToken returns the pending token of user carried by input, if
+// it is properly signed and hasn't expired.
+func parseSignedToken(user, input string) (pendingToken, bool) {
+	data, err := signedEncoding.DecodeString(strings.ToUpper(normalizeToken(input)))
+	if err != nil || len(data) < 8+1+signedTokenMAC {
+		return pendingToken{}, false
+	}
+	payload, mac := data[:len(data)-signedTokenMAC], data[len(data)-signedTokenMAC:]
+	if !hmac.Equal(mac, signedTokenMACOf(payload)) {
+		return pendingToken{}, false
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	owner, mail, ok := bytes.Cut(payload[8:], []byte{0})
+	if !ok || string(owner) != user || !clockNow().Before(expires) {
+		return pendingToken{}, false
+	}
+	return pendingToken{User: user, Mail: string(mail), Token: normalizeToken(input), ExpiresAt: expires}, true
+}
+
+// pendingFor returns the pending token of user, as the store has it or,
+// with TOKEN_FORMAT=signed, as carried by input, the token being entered,
+// when another instance issued it. Such a token is put in the store, where
+// the rest of the flow finds it.
+func pendingFor(ctx context.Context, store pendingStore, user, input string) (pendingToken, bool, error) {
+	t, ok, err := store.Get(ctx, user)
+	if err != nil || ok || options().TokenFormat != "signed" {
+		return t, ok, err
+	}
+	if t, ok = parseSignedToken(user, input); !ok {
+		return pendingToken{}, false, nil
+	}
+	logInfo("Adopting the signed token of %s, issued by another instance", user)
+	if err := store.Put(ctx, t); err != nil {
+		return pendingToken{}, false, err
+	}
+	return t, true, nil
+}
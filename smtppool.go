@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// maxIdleSMTP bounds the idle connections kept for each relay.
+const maxIdleSMTP = 4
+
+// smtpConn is a client along with its connection, whose deadline bounds the
+// exchanges with the relay.
+type smtpConn struct {
+	*smtp.Client
+	conn net.Conn
+}
+
+// setDeadline applies the deadline of ctx, if any, to the connection.
+func (c *smtpConn) setDeadline(ctx context.Context) {
+	d, _ := ctx.Deadline()
+	c.conn.SetDeadline(d)
+}
+
+type idleSMTP struct {
+	c    *smtpConn
+	used time.Time
+}
+
+// smtpPool keeps authenticated connections to the relays open for
+// MAIL_IDLE_TIMEOUT after a send, so that bursts of registrations don't pay
+// for a new connection, EHLO, STARTTLS and AUTH every time.
+type smtpPool struct {
+	mu   sync.Mutex
+	idle map[smtpRoute][]idleSMTP
+}
+
+var mailPool = &smtpPool{idle: map[smtpRoute][]idleSMTP{}}
+
+// get returns a connection to the route's relay, reusing an idle one when it
+// still answers NOOP. The connection is bound to the deadline of ctx.
+func (p *smtpPool) get(ctx context.Context, route smtpRoute) (*smtpConn, error) {
+	for {
+		c := p.pop(route)
+		if c == nil {
+			break
+		}
+		c.setDeadline(ctx)
+		if err := c.Noop(); err == nil {
+			return c, nil
+		}
+		c.Close()
+	}
+
+	c, err := dialSMTP(ctx, route.server)
+	if err != nil {
+		return nil, err
+	}
+	if err := authSMTP(c.Client, route); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *smtpPool) pop(route smtpRoute) *smtpConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[route]
+	for len(conns) > 0 {
+		last := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(last.used) < options().MailIdleTimeout {
+			p.idle[route] = conns
+			return last.c
+		}
+		last.c.Close()
+	}
+	delete(p.idle, route)
+	return nil
+}
+
+// put hands a connection back after a successful send. It is closed instead
+// when pooling is disabled or enough connections are idle already.
+func (p *smtpPool) put(route smtpRoute, c *smtpConn) {
+	if options().MailIdleTimeout <= 0 {
+		c.Quit()
+		return
+	}
+	if err := c.Reset(); err != nil {
+		c.Close()
+		return
+	}
+	c.conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[route]) >= maxIdleSMTP {
+		c.Quit()
+		return
+	}
+	p.idle[route] = append(p.idle[route], idleSMTP{c: c, used: time.Now()})
+	time.AfterFunc(options().MailIdleTimeout, p.prune)
+}
+
+// prune closes the connections which have been idle for too long.
+func (p *smtpPool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for route, conns := range p.idle {
+		fresh := conns[:0]
+		for _, i := range conns {
+			if time.Since(i.used) < options().MailIdleTimeout {
+				fresh = append(fresh, i)
+			} else {
+				i.c.Quit()
+			}
+		}
+		if len(fresh) == 0 {
+			delete(p.idle, route)
+		} else {
+			p.idle[route] = fresh
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The admins take back a registration which shouldn't have happened, such
+// as one made with a stolen address, by disabling the account rather than
+// deleting it, so that a mistake is undone by restoring it: the entry, its
+// groups and its password are kept as they were.
+
+var (
+	errNotRegistered = errors.New("no such user in the directory")
+	errCannotDisable = errors.New("the directory backend can't disable users")
+	errCannotRestore = errors.New("the directory backend can't enable users")
+)
+
+// validateLockAttribute checks the LDAP_LOCK_ATTRIBUTE option.
+func validateLockAttribute() error {
+	if options().LdapLockAttribute == "" {
+		return nil
+	}
+	if attr, value, _ := strings.Cut(options().LdapLockAttribute, "="); attr == "" || value == "" {
+		return fmt.Errorf("Invalid LDAP_LOCK_ATTRIBUTE %q, expected attribute=value", options().LdapLockAttribute)
+	}
+	return nil
+}
+
+// disableRegistration disables the account of user in the directory, by
+// the admin described by by, such as "the admin API".
+func disableRegistration(ctx context.Context, user, by string) error {
+	return setRegistrationEnabled(ctx, user, false, by)
+}
+
+// restoreRegistration enables again the account of user, disabled by
+// disableRegistration.
+func restoreRegistration(ctx context.Context, user, by string) error {
+	return setRegistrationEnabled(ctx, user, true, by)
+}
+
+func setRegistrationEnabled(ctx context.Context, user string, enabled bool, by string) error {
+	dir, err := openDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	exists, err := dir.Exists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errNotRegistered
+	}
+	if enabled {
+		d, ok := dir.(entryEnabler)
+		if !ok {
+			return errCannotRestore
+		}
+		if err := d.Enable(ctx, user); err != nil {
+			return err
+		}
+		logInfo("Admin restored the account of %s through %s", user, by)
+		audits.publish(auditEvent{Type: auditRestored, User: user, Detail: "restored through " + by})
+	} else {
+		d, ok := dir.(entryDisabler)
+		if !ok {
+			return errCannotDisable
+		}
+		if err := d.Disable(ctx, user); err != nil {
+			return err
+		}
+		logInfo("Admin disabled the account of %s through %s", user, by)
+		audits.publish(auditEvent{Type: auditDisabled, User: user, Detail: "disabled through " + by})
+	}
+	registrations.setDisabled(user, !enabled)
+	return nil
+}
@@ -1,142 +1,685 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"net"
 	"net/mail"
 	"net/smtp"
 	"net/url"
-	"regexp"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	env "github.com/caarlos0/env/v7"
 	"github.com/gliderlabs/ssh"
-	ldap "github.com/go-ldap/ldap/v3"
 )
 
 type Options struct {
-	Host        string `env:"SSH_HOST" envDefault:"0.0.0.0"`
-	Port        int    `env:"SSH_PORT" envDefault:"22"`
-	TokenLength uint   `env:"TOKEN_LENGTH" envDefault:"6"`
-
-	SMTPServer  string `env:"MAIL_SERVER" envDefault:"localhost:25"`
-	FromName    string `env:"MAIL_FROM_NAME" envDefault:"SSH-Auth"`
-	FromAddress string `env:"MAIL_FROM_ADDRESS" envDefault:"ssh-auth@localhost"`
-	ToSuffix    string `env:"MAIL_TO_SUFFIX" envDefault:"@localhost"`
-	Subject     string `env:"MAIL_SUBJECT" envDefault:"Your SSH Auth token"`
-
-	LdapURI          string  `env:"LDAP_URI" envDefault:"ldap://localhost:3890"`
-	LldapURI         url.URL `env:"LLDAP_URI" envDefault:"https://localhost:17170"`
-	LdapBindDN       string  `env:"LDAP_BIND_DN" envDefault:"uid=admin,ou=people,dc=example,dc=com"`
-	LdapBindPassword string  `env:"LDAP_BIND_PASSWORD" envDefault:"admin"`
-	LdapUserScope    string  `env:"LDAP_USER_SCOPE" envDefault:"ou=people,dc=example,dc=com"`
+	ConfigFile string `env:"CONFIG_FILE"`
+	DryRun     bool   `env:"DRY_RUN" envDefault:"false"`
+	// RecordDir, when set, is where the interactive sessions are recorded,
+	// anonymized, in the asciinema format, see record.go
+	RecordDir string `env:"RECORD_DIR"`
+
+	LogLevel string   `env:"LOG_LEVEL" envDefault:"info"`
+	LogDebug []string `env:"LOG_DEBUG" envSeparator:","`
+	// LogOutput is stderr, syslog, sending RFC 5424 messages to
+	// LOG_SYSLOG_ADDRESS (udp://host:port, tcp://host:port or
+	// unix:///path), journald, with its native protocol, or eventlog, the
+	// Windows event log
+	LogOutput         string `env:"LOG_OUTPUT" envDefault:"stderr"`
+	LogSyslogAddress  string `env:"LOG_SYSLOG_ADDRESS" envDefault:"unix:///dev/log"`
+	LogSyslogFacility string `env:"LOG_SYSLOG_FACILITY" envDefault:"auth"`
+	LogSyslogTag      string `env:"LOG_SYSLOG_TAG" envDefault:"sshauth"`
+	// WindowsServiceName names the Windows service and its event log source
+	WindowsServiceName string `env:"WINDOWS_SERVICE_NAME" envDefault:"sshauth"`
+
+	Host string `env:"SSH_HOST" envDefault:"0.0.0.0"`
+	Port int    `env:"SSH_PORT" envDefault:"22"`
+	// SSHPublicAddress is where the users reach the server, such as
+	// register.example.com or register.example.com:2222, for the invites
+	SSHPublicAddress string `env:"SSH_PUBLIC_ADDRESS"`
+	// Listen lists addresses such as 0.0.0.0:22 or tcp6://[::]:2222, where
+	// tcp4:// and tcp6:// restrict the socket to one address family
+	Listen []string `env:"LISTEN" envSeparator:","`
+	// SSHHostKeys lists the files of the private host keys, a new one being
+	// generated at every start without them
+	SSHHostKeys []string `env:"SSH_HOST_KEYS" envSeparator:","`
+	// the algorithms offered during the SSH handshake, empty for the
+	// defaults, and the oldest client versions accepted, such as OpenSSH_8.0
+	SSHKexAlgorithms     []string `env:"SSH_KEX_ALGORITHMS" envSeparator:","`
+	SSHCiphers           []string `env:"SSH_CIPHERS" envSeparator:","`
+	SSHMACs              []string `env:"SSH_MACS" envSeparator:","`
+	SSHMinClientVersions []string `env:"SSH_MIN_CLIENT_VERSIONS" envSeparator:","`
+
+	TokenLength uint          `env:"TOKEN_LENGTH" envDefault:"6"`
+	TokenTTL    time.Duration `env:"TOKEN_TTL" envDefault:"10m"`
+	// TokenDelivery is code, mailing a token to type in, or link, mailing a
+	// link to the web listener which lets the session carry on once opened
+	TokenDelivery string `env:"TOKEN_DELIVERY" envDefault:"code"`
+	// TokenBinding binds the tokens to the client they were issued to: none,
+	// ip for its address, key for its key (or its address, for the clients
+	// without one) or strict for both
+	TokenBinding string `env:"TOKEN_BINDING" envDefault:"none"`
+
+	TokenCaseInsensitive bool   `env:"TOKEN_CASE_INSENSITIVE" envDefault:"true"`
+	TokenFormat          string `env:"TOKEN_FORMAT" envDefault:"alnum"`
+	// TokenSecret signs the tokens of TOKEN_FORMAT=signed, see
+	// signedtoken.go, and must be the same on every instance
+	TokenSecret string `env:"TOKEN_SECRET"`
+	// TokenSeed seeds the tokens and TokenSequence lists the tokens handed
+	// out in turn, for tests and demos, while FrozenClock stops the clock at
+	// an RFC 3339 time, moved on with the clock command of the admin shell,
+	// the retries and the cleanup jobs waiting for it to move
+	TokenSeed     int64    `env:"TOKEN_SEED"`
+	TokenSequence []string `env:"TOKEN_SEQUENCE" envSeparator:","`
+	FrozenClock   string   `env:"FROZEN_CLOCK"`
+
+	TokenRetries     int           `env:"TOKEN_RETRIES" envDefault:"3"`
+	TokenMaxAttempts int           `env:"TOKEN_MAX_ATTEMPTS" envDefault:"10"`
+	PasswordRetries  int           `env:"PASSWORD_RETRIES" envDefault:"3"`
+	LockoutDuration  time.Duration `env:"LOCKOUT_DURATION" envDefault:"15m"`
+
+	MaxSessions      int           `env:"MAX_SESSIONS" envDefault:"0"`
+	MaxSessionsPerIP int           `env:"MAX_SESSIONS_PER_IP" envDefault:"0"`
+	SessionQueueWait time.Duration `env:"SESSION_QUEUE_WAIT" envDefault:"0s"`
+	// the new connections are refused while MAX_GOROUTINES are running, and
+	// the sessions are ended once they send SESSION_MAX_INPUT bytes
+	MaxGoroutines   int   `env:"MAX_GOROUTINES" envDefault:"0"`
+	SessionMaxInput int64 `env:"SESSION_MAX_INPUT" envDefault:"1048576"`
+	// the clients are probed every KEEPALIVE_INTERVAL, and dropped after
+	// KEEPALIVE_MAX probes in a row go unanswered
+	KeepaliveInterval time.Duration `env:"KEEPALIVE_INTERVAL" envDefault:"30s"`
+	KeepaliveMax      int           `env:"KEEPALIVE_MAX" envDefault:"3"`
+	// the sessions left idle at a prompt for PROMPT_TIMEOUT are closed, 0
+	// never closing them, after a warning PROMPT_TIMEOUT_WARNING before
+	PromptTimeout        time.Duration `env:"PROMPT_TIMEOUT" envDefault:"0s"`
+	PromptTimeoutWarning time.Duration `env:"PROMPT_TIMEOUT_WARNING" envDefault:"60s"`
+
+	AllowedCIDRs []string `env:"ALLOWED_CIDRS" envSeparator:","`
+	DeniedCIDRs  []string `env:"DENIED_CIDRS" envSeparator:","`
+	// users connecting from TRUSTED_CIDRS skip the verification of their
+	// address, their identity being vouched for by the network
+	TrustedCIDRs []string `env:"TRUSTED_CIDRS" envSeparator:","`
+
+	Challenge        string `env:"CHALLENGE" envDefault:"none"`
+	ChallengeRetries int    `env:"CHALLENGE_RETRIES" envDefault:"3"`
+
+	RegistrationQuotaHourly int `env:"REGISTRATION_QUOTA_HOURLY" envDefault:"0"`
+	RegistrationQuotaDaily  int `env:"REGISTRATION_QUOTA_DAILY" envDefault:"0"`
+
+	BanThreshold int           `env:"BAN_THRESHOLD" envDefault:"5"`
+	BanWindow    time.Duration `env:"BAN_WINDOW" envDefault:"10m"`
+	BanDuration  time.Duration `env:"BAN_DURATION" envDefault:"1h"`
+
+	BanMode        string        `env:"BAN_MODE" envDefault:"ban"`
+	TarpitDelay    time.Duration `env:"TARPIT_DELAY" envDefault:"1s"`
+	TarpitMaxDelay time.Duration `env:"TARPIT_MAX_DELAY" envDefault:"30s"`
+
+	ProxyProtocol        bool          `env:"PROXY_PROTOCOL" envDefault:"false"`
+	ProxyProtocolTimeout time.Duration `env:"PROXY_PROTOCOL_TIMEOUT" envDefault:"5s"`
+	// the proxies whose PROXY headers are believed, the connections from
+	// anywhere else being closed
+	ProxyProtocolTrustedCIDRs []string `env:"PROXY_PROTOCOL_TRUSTED_CIDRS" envSeparator:","`
+
+	OtelEndpoint    string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OtelHeaders     string `env:"OTEL_EXPORTER_OTLP_HEADERS"`
+	OtelServiceName string `env:"OTEL_SERVICE_NAME" envDefault:"sshauth"`
+
+	SentryDSN         string `env:"SENTRY_DSN"`
+	SentryEnvironment string `env:"SENTRY_ENVIRONMENT"`
+
+	Store           string `env:"STORE" envDefault:"memory"`
+	StoreSQLitePath string `env:"STORE_SQLITE_PATH" envDefault:"sshauth.db"`
+	RedisURL        string `env:"REDIS_URL" envDefault:"redis://localhost:6379/0"`
+
+	VaultAddr       string        `env:"VAULT_ADDR"`
+	VaultToken      string        `env:"VAULT_TOKEN"`
+	VaultRoleID     string        `env:"VAULT_ROLE_ID"`
+	VaultSecretID   string        `env:"VAULT_SECRET_ID"`
+	VaultAuthPath   string        `env:"VAULT_AUTH_PATH" envDefault:"approle"`
+	VaultSecretPath string        `env:"VAULT_SECRET_PATH" envDefault:"secret/data/sshauth"`
+	VaultRefresh    time.Duration `env:"VAULT_REFRESH" envDefault:"1h"`
+
+	AdminListen string `env:"ADMIN_LISTEN"`
+	AdminToken  string `env:"ADMIN_TOKEN"`
+	// NoticeFile holds a line broadcast to the connected sessions on
+	// SIGUSR1, as the admins can through the admin API and shell
+	NoticeFile string `env:"NOTICE_FILE"`
+	// AdminPprof serves the Go profiles under /debug/pprof/ on ADMIN_LISTEN
+	AdminPprof bool `env:"ADMIN_PPROF" envDefault:"false"`
+	// the management gRPC API, authenticated with ADMIN_TOKEN as well, and
+	// served with TLS unless it listens on the loopback interface
+	GRPCListen  string `env:"GRPC_LISTEN"`
+	GRPCTLSCert string `env:"GRPC_TLS_CERT"`
+	GRPCTLSKey  string `env:"GRPC_TLS_KEY"`
+	// the Prometheus metrics, served without authentication
+	MetricsListen string `env:"METRICS_LISTEN"`
+	// the Pushgateway the metrics are pushed to, for the hosts Prometheus
+	// can't scrape
+	MetricsPushURL      string        `env:"METRICS_PUSH_URL"`
+	MetricsPushInterval time.Duration `env:"METRICS_PUSH_INTERVAL" envDefault:"30s"`
+	MetricsPushJob      string        `env:"METRICS_PUSH_JOB" envDefault:"sshauth"`
+
+	// the web form offering the registration over HTTP, served with TLS when
+	// a certificate is given. WEB_REAL_IP_HEADER names the header where a
+	// reverse proxy puts the address of the client, such as X-Forwarded-For.
+	WebListen       string `env:"WEB_LISTEN"`
+	WebTLSCert      string `env:"WEB_TLS_CERT"`
+	WebTLSKey       string `env:"WEB_TLS_KEY"`
+	WebRealIPHeader string `env:"WEB_REAL_IP_HEADER"`
+	// the reverse proxies whose WEB_REAL_IP_HEADER is believed, the header
+	// of anyone else being ignored
+	WebRealIPTrustedCIDRs []string `env:"WEB_REAL_IP_TRUSTED_CIDRS" envSeparator:","`
+	// WebPublicURL is where the users reach WEB_LISTEN, for the links of
+	// TOKEN_DELIVERY=link
+	WebPublicURL string `env:"WEB_PUBLIC_URL"`
+
+	// the buses the registration events are published to, with the events
+	// to publish, all of them by default
+	EventsNATSURL      string   `env:"EVENTS_NATS_URL"`
+	EventsNATSSubject  string   `env:"EVENTS_NATS_SUBJECT" envDefault:"sshauth.events"`
+	EventsKafkaRESTURL string   `env:"EVENTS_KAFKA_REST_URL"`
+	EventsKafkaTopic   string   `env:"EVENTS_KAFKA_TOPIC" envDefault:"sshauth-events"`
+	EventsTypes        []string `env:"EVENTS_TYPES" envSeparator:","`
+
+	AdminSSHUser string `env:"ADMIN_SSH_USER" envDefault:"sshauth-admin"`
+	AdminSSHKeys string `env:"ADMIN_SSH_KEYS"`
+
+	AlertMail       string   `env:"ALERT_MAIL"`
+	AlertWebhookURL string   `env:"ALERT_WEBHOOK_URL"`
+	AlertUsernames  []string `env:"ALERT_USERNAMES" envSeparator:"," envDefault:"admin,administrator,root,postmaster,webmaster,hostmaster,abuse,security"`
+	// AlertTranscript attaches the last ALERT_TRANSCRIPT_SIZE bytes of the
+	// session raising an alert to it, see transcript.go
+	AlertTranscript     bool `env:"ALERT_TRANSCRIPT" envDefault:"false"`
+	AlertTranscriptSize int  `env:"ALERT_TRANSCRIPT_SIZE" envDefault:"16384"`
+	// AlertCountries raises an alert for the sessions from these countries,
+	// given as ISO 3166 codes and looked up in the network,country lines of
+	// GEOIP_CSV, see alert.go
+	AlertCountries []string `env:"ALERT_COUNTRIES" envSeparator:","`
+	GeoIPCSV       string   `env:"GEOIP_CSV"`
+
+	// SMTPServer lists the relays in order of preference, the next one
+	// being tried when a relay can't be reached or answers with a temporary
+	// error, and the failing ones skipped for MAIL_RELAY_COOLDOWN
+	SMTPServer        []string      `env:"MAIL_SERVER" envSeparator:"," envDefault:"localhost:25"`
+	SMTPUsername      string        `env:"MAIL_USERNAME"`
+	SMTPPassword      string        `env:"MAIL_PASSWORD"`
+	MailRelayCooldown time.Duration `env:"MAIL_RELAY_COOLDOWN" envDefault:"1m"`
+	// MailRoutes maps domains to their relays, see mailroute.go
+	MailRoutes []string `env:"MAIL_ROUTES" envSeparator:","`
+
+	// at most MAIL_THROTTLE tokens are mailed to the same address within
+	// MAIL_THROTTLE_WINDOW, 0 disabling the limit
+	MailThrottle       int           `env:"MAIL_THROTTLE" envDefault:"3"`
+	MailThrottleWindow time.Duration `env:"MAIL_THROTTLE_WINDOW" envDefault:"1h"`
+
+	MailIdleTimeout time.Duration `env:"MAIL_IDLE_TIMEOUT" envDefault:"30s"`
+	// MailTimeout bounds the delivery of a single mail
+	MailTimeout time.Duration `env:"MAIL_TIMEOUT" envDefault:"30s"`
+	// MailDSN requests delivery status notifications, sent to the envelope
+	// sender, from the servers supporting them
+	MailDSN bool `env:"MAIL_DSN" envDefault:"true"`
+
+	MailTransport string `env:"MAIL_TRANSPORT" envDefault:"smtp"`
+	// MailProxy is the SOCKS5 proxy, as socks5://[user:password@]host:port,
+	// the mail servers are reached through
+	MailProxy           string `env:"MAIL_PROXY"`
+	MailSendmailCommand string `env:"MAIL_SENDMAIL_COMMAND" envDefault:"/usr/sbin/sendmail -t"`
+	FromName            string `env:"MAIL_FROM_NAME" envDefault:"SSH-Auth"`
+	FromAddress         string `env:"MAIL_FROM_ADDRESS" envDefault:"ssh-auth@localhost"`
+	// MailEnvelopeFrom is the envelope sender, receiving the bounces, when
+	// it differs from MAIL_FROM_ADDRESS
+	MailEnvelopeFrom string `env:"MAIL_ENVELOPE_FROM"`
+	// MailHeaders are added to every mail, as Name: value entries separated
+	// by semicolons, such as List-Unsubscribe, X-Mailer or Reply-To
+	MailHeaders []string `env:"MAIL_HEADERS" envSeparator:";"`
+	ToSuffix    string   `env:"MAIL_TO_SUFFIX" envDefault:"@localhost"`
+	Subject     string   `env:"MAIL_SUBJECT" envDefault:"Your SSH Auth token"`
+
+	// WelcomeMail sends a second mail after the registration, rendered from
+	// WELCOME_MAIL_TEMPLATE, an HTML template seeing .User, .Mail and
+	// .LoginURL
+	WelcomeMail         bool   `env:"WELCOME_MAIL" envDefault:"false"`
+	WelcomeMailSubject  string `env:"WELCOME_MAIL_SUBJECT" envDefault:"Welcome to SSH Auth"`
+	WelcomeMailTemplate string `env:"WELCOME_MAIL_TEMPLATE"`
+
+	MailMode           string   `env:"MAIL_MODE" envDefault:"suffix"`
+	MailAllowedDomains []string `env:"MAIL_ALLOWED_DOMAINS" envSeparator:","`
+	MailNormalize      []string `env:"MAIL_NORMALIZE" envSeparator:","`
+	MailDotsDomains    []string `env:"MAIL_DOTS_DOMAINS" envSeparator:"," envDefault:"gmail.com,googlemail.com"`
+	// MailUnique refuses the addresses already used by another user, also
+	// searched for right before the user is created, when MAIL_TAKEN_ACTION
+	// is refuse, or reset to mail the owner a link to reset their password
+	MailUnique      bool   `env:"MAIL_UNIQUE" envDefault:"false"`
+	MailTakenAction string `env:"MAIL_TAKEN_ACTION" envDefault:"refuse"`
+
+	KeyVerification     bool   `env:"KEY_VERIFICATION" envDefault:"false"`
+	LdapSSHKeyAttribute string `env:"LDAP_SSH_KEY_ATTRIBUTE" envDefault:"sshPublicKey"`
+
+	SelfService bool `env:"SELF_SERVICE" envDefault:"false"`
+	// EnumerationProtection runs the registration flow for the users who
+	// exist already as for the new ones, never telling them apart, at the
+	// cost of SELF_SERVICE and LLDAP_PASSWORD_RESET, which are not offered
+	EnumerationProtection bool `env:"ENUMERATION_PROTECTION" envDefault:"false"`
+	// Color is one of auto, always or never
+	Color string `env:"COLOR" envDefault:"auto"`
+	// Plain makes the output linear, for braille terminals and screen
+	// readers: no colors, spinner or cursor movements. Clients can ask for it
+	// with SSHAUTH_PLAIN=1.
+	Plain bool `env:"PLAIN" envDefault:"false"`
+	// Newlines is one of auto, crlf or lf, the line endings of the output
+	Newlines string `env:"NEWLINES" envDefault:"auto"`
+
+	// LinkIdentity offers the new users to link an external identity,
+	// checked by a verifier: github, gitlab, on LINK_IDENTITY_URL or
+	// gitlab.com, pattern, matching LINK_IDENTITY_PATTERN, or webhook,
+	// asking LINK_IDENTITY_URL. It is stored in LINK_IDENTITY_ATTRIBUTE,
+	// and LINK_IDENTITY_LABEL tells the users what to enter.
+	LinkIdentity          string `env:"LINK_IDENTITY"`
+	LinkIdentityAttribute string `env:"LINK_IDENTITY_ATTRIBUTE"`
+	LinkIdentityLabel     string `env:"LINK_IDENTITY_LABEL" envDefault:"GitHub username"`
+	LinkIdentityPattern   string `env:"LINK_IDENTITY_PATTERN"`
+	LinkIdentityURL       string `env:"LINK_IDENTITY_URL"`
+
+	// VerifyPhone requires a phone number too, verified with a code of
+	// SMS_CODE_LENGTH digits sent by SMS_BACKEND, see phone.go: webhook
+	// posts it to SMS_WEBHOOK_URL, and twilio sends it from SMS_FROM
+	VerifyPhone      bool   `env:"VERIFY_PHONE" envDefault:"false"`
+	SMSBackend       string `env:"SMS_BACKEND" envDefault:"webhook"`
+	SMSWebhookURL    string `env:"SMS_WEBHOOK_URL"`
+	SMSFrom          string `env:"SMS_FROM"`
+	SMSCodeLength    uint   `env:"SMS_CODE_LENGTH" envDefault:"6"`
+	TwilioAccountSID string `env:"TWILIO_ACCOUNT_SID"`
+	TwilioAuthToken  string `env:"TWILIO_AUTH_TOKEN"`
+
+	// LoginQR shows the login URL as a QR code after the registration
+	LoginQR bool `env:"LOGIN_QR" envDefault:"false"`
+	// while MAINTENANCE_FILE exists, or maintenance is turned on by an admin,
+	// users are shown MAINTENANCE_MESSAGE instead of registering
+	MaintenanceFile    string `env:"MAINTENANCE_FILE"`
+	MaintenanceMessage string `env:"MAINTENANCE_MESSAGE" envDefault:"Registration is temporarily unavailable, please try again later."`
+
+	// ScriptedMode enables the request-token and verify commands, which skip
+	// the challenge and the prompts of the flow.
+	ScriptedMode bool `env:"SCRIPTED_MODE" envDefault:"false"`
+
+	// MessagesDir holds *.tmpl files overriding the definitions of
+	// messages.tmpl, the messages shown to the users, and subdirectories
+	// such as it or pt_BR with the translations
+	MessagesDir string `env:"MESSAGES_DIR"`
+	// MessagesLanguage is used when the client doesn't send LANG or LC_ALL
+	// for a language in MESSAGES_DIR
+	MessagesLanguage string `env:"MESSAGES_LANGUAGE" envDefault:"en"`
+
+	FlowFile  string `env:"FLOW_FILE"`
+	HooksFile string `env:"HOOKS_FILE"`
+	// DefaultsFile maps username patterns and address domains to the
+	// groups and attributes given to the new users, see defaults.go
+	DefaultsFile string `env:"DEFAULTS_FILE"`
+	// ProfilesFile lists the profiles, the endpoints with their own listen
+	// addresses and flow settings, see profile.go
+	ProfilesFile string `env:"PROFILES_FILE"`
+	// AccountExpire makes the new accounts expire after that long, with the
+	// LDAP backend, storing the expiry in ACCOUNT_EXPIRE_ATTRIBUTE in the
+	// ACCOUNT_EXPIRE_FORMAT, one of days, filetime, generalized or unix;
+	// shadowExpire in days, or accountExpires with Active Directory, by
+	// default
+	AccountExpire          time.Duration `env:"ACCOUNT_EXPIRE" envDefault:"0s"`
+	AccountExpireAttribute string        `env:"ACCOUNT_EXPIRE_ATTRIBUTE"`
+	AccountExpireFormat    string        `env:"ACCOUNT_EXPIRE_FORMAT"`
+
+	DirectoryBackend string `env:"DIRECTORY_BACKEND" envDefault:"ldap"`
+	DirectoryType    string `env:"DIRECTORY_TYPE" envDefault:"ldap"`
+	ADUPNSuffix      string `env:"AD_UPN_SUFFIX"`
+	// PasswordMethod is how the passwords are handed to the directory: exop
+	// for the LDAP password modify extended operation, hash for a hash in
+	// the LDAP_PASSWORD_HASH scheme, plain for the clear password over TLS,
+	// hashed by the server, or api for the REST backends. Each backend
+	// supports some of them, the first one by default
+	PasswordMethod string `env:"PASSWORD_METHOD"`
+
+	// CleanupAfter, when set, makes the janitor delete or disable, as per
+	// CLEANUP_ACTION, the entries left in the directory by registrations
+	// which failed halfway, once they are that old
+	CleanupAfter    time.Duration `env:"CLEANUP_AFTER" envDefault:"0s"`
+	CleanupAction   string        `env:"CLEANUP_ACTION" envDefault:"delete"`
+	CleanupInterval time.Duration `env:"CLEANUP_INTERVAL" envDefault:"10m"`
+
+	// how long the data about the users is kept, purged every
+	// RETENTION_INTERVAL: the tokens and the locks, once expired, the
+	// registrations listed by the admin API and the recordings, 0 keeping
+	// the last two
+	RetentionTokens        time.Duration `env:"RETENTION_TOKENS" envDefault:"0s"`
+	RetentionRegistrations time.Duration `env:"RETENTION_REGISTRATIONS" envDefault:"0s"`
+	RetentionRecordings    time.Duration `env:"RETENTION_RECORDINGS" envDefault:"0s"`
+	RetentionInterval      time.Duration `env:"RETENTION_INTERVAL" envDefault:"1h"`
+
+	// RegistrationMode is create, adding new users to the directory, or
+	// complete, only letting in the users provisioned beforehand as
+	// disabled stubs, which get enabled with the chosen password
+	RegistrationMode string `env:"REGISTRATION_MODE" envDefault:"create"`
+	// UsernameSuggestions is how many free usernames are suggested to the
+	// users whose username is taken, 0 disabling the suggestions
+	UsernameSuggestions int `env:"USERNAME_SUGGESTIONS" envDefault:"3"`
+
+	// HTTPTimeout bounds each request to the HTTP based backends
+	HTTPTimeout time.Duration `env:"HTTP_TIMEOUT" envDefault:"30s"`
+
+	// PolicyURL is asked, before a registration starts, whether the user
+	// may register, see policy.go; POLICY_FAILURE, deny or allow, applies
+	// when it can't answer
+	PolicyURL     string `env:"POLICY_URL"`
+	PolicyToken   string `env:"POLICY_TOKEN"`
+	PolicyFailure string `env:"POLICY_FAILURE" envDefault:"deny"`
+
+	KeycloakURL          string   `env:"KEYCLOAK_URL" envDefault:"http://localhost:8080"`
+	KeycloakRealm        string   `env:"KEYCLOAK_REALM" envDefault:"master"`
+	KeycloakClientID     string   `env:"KEYCLOAK_CLIENT_ID"`
+	KeycloakClientSecret string   `env:"KEYCLOAK_CLIENT_SECRET"`
+	KeycloakRoles        []string `env:"KEYCLOAK_ROLES" envSeparator:","`
+
+	AuthentikURL      string   `env:"AUTHENTIK_URL" envDefault:"http://localhost:9000"`
+	AuthentikToken    string   `env:"AUTHENTIK_TOKEN"`
+	AuthentikGroups   []string `env:"AUTHENTIK_GROUPS" envSeparator:","`
+	AuthentikUserPath string   `env:"AUTHENTIK_USER_PATH" envDefault:"users"`
+
+	SCIMURL   string `env:"SCIM_URL" envDefault:"http://localhost:8080/scim/v2"`
+	SCIMToken string `env:"SCIM_TOKEN"`
+
+	WebhookURL          string `env:"WEBHOOK_URL"`
+	WebhookExistsURL    string `env:"WEBHOOK_EXISTS_URL"`
+	WebhookSecret       string `env:"WEBHOOK_SECRET"`
+	WebhookPasswordMode string `env:"WEBHOOK_PASSWORD_MODE" envDefault:"hash"`
+	WebhookTemplate     string `env:"WEBHOOK_TEMPLATE"`
+	WebhookContentType  string `env:"WEBHOOK_CONTENT_TYPE" envDefault:"application/json"`
+
+	// LdapURI lists the LDAP servers, the first one being the primary
+	LdapURI          []string      `env:"LDAP_URI" envSeparator:"," envDefault:"ldap://localhost:3890"`
+	LdapTimeout      time.Duration `env:"LDAP_TIMEOUT" envDefault:"10s"`
+	LdapRetryAfter   time.Duration `env:"LDAP_RETRY_AFTER" envDefault:"30s"`
+	LldapURI         url.URL       `env:"LLDAP_URI" envDefault:"https://localhost:17170"`
+	LdapBindDN       string        `env:"LDAP_BIND_DN" envDefault:"uid=admin,ou=people,dc=example,dc=com"`
+	LdapBindPassword string        `env:"LDAP_BIND_PASSWORD" envDefault:"admin"`
+	LdapUserScope    string        `env:"LDAP_USER_SCOPE" envDefault:"ou=people,dc=example,dc=com"`
+	// the groups of DEFAULTS_FILE are cn=<group> under LDAP_GROUP_SCOPE,
+	// listing their members in LDAP_GROUP_MEMBER_ATTRIBUTE, by DN or, for
+	// memberUid, by username
+	LdapGroupScope           string `env:"LDAP_GROUP_SCOPE" envDefault:"ou=groups,dc=example,dc=com"`
+	LdapGroupMemberAttribute string `env:"LDAP_GROUP_MEMBER_ATTRIBUTE" envDefault:"member"`
+
+	// LldapPasswordReset offers the users who are already registered to
+	// reset their password through LLDAP, which mails them a link
+	LldapPasswordReset bool `env:"LLDAP_PASSWORD_RESET" envDefault:"false"`
+	// the TLS settings of the HTTP API of LLDAP: LLDAP_CA_FILE is a PEM
+	// bundle trusted along with the system certificates, and the client
+	// certificate is presented when set. LLDAP_INSECURE_SKIP_VERIFY turns
+	// the verification off, for tests only
+	LldapCAFile             string `env:"LLDAP_CA_FILE"`
+	LldapClientCert         string `env:"LLDAP_CLIENT_CERT"`
+	LldapClientKey          string `env:"LLDAP_CLIENT_KEY"`
+	LldapInsecureSkipVerify bool   `env:"LLDAP_INSECURE_SKIP_VERIFY" envDefault:"false"`
+
+	// how existing users are found: LDAP_USER_FILTER is a template where
+	// {{.User}} is the escaped username, built by default from the object
+	// class and the attribute, and searched under LDAP_SEARCH_BASE, which
+	// defaults to LDAP_USER_SCOPE
+	LdapUserFilter      string `env:"LDAP_USER_FILTER"`
+	LdapUserObjectClass string `env:"LDAP_USER_OBJECT_CLASS"`
+	LdapUserAttribute   string `env:"LDAP_USER_ATTRIBUTE"`
+	LdapSearchBase      string `env:"LDAP_SEARCH_BASE"`
+	// LdapPasswordHash, one of ssha, argon2 or bcrypt, is the scheme of
+	// PASSWORD_METHOD=hash; setting it alone selects that method, for the
+	// directories which don't support the password modify extended operation
+	LdapPasswordHash string `env:"LDAP_PASSWORD_HASH"`
+	// with REGISTRATION_MODE=complete, the filter matching the stub users,
+	// the disabled accounts by default with Active Directory, and the
+	// attribute=value changes enabling them, an empty value deleting the
+	// attribute
+	LdapStubFilter string   `env:"LDAP_STUB_FILTER"`
+	LdapStubEnable []string `env:"LDAP_STUB_ENABLE" envSeparator:","`
+	// the attribute=value locking the disabled accounts with plain LDAP, such
+	// as pwdAccountLockedTime=000001010000Z with the ppolicy overlay of
+	// OpenLDAP or nsAccountLock=TRUE with 389 Directory Server, deleted to
+	// enable them again
+	LdapLockAttribute string `env:"LDAP_LOCK_ATTRIBUTE"`
+
+	DirectoryPreflight bool `env:"DIRECTORY_PREFLIGHT" envDefault:"false"`
+	// the connections to the directory are retried DIRECTORY_RETRIES times,
+	// and the registrations suspended for DIRECTORY_BREAKER_COOLDOWN after
+	// DIRECTORY_BREAKER_THRESHOLD of them failed in a row, 0 disabling it
+	DirectoryRetries          int           `env:"DIRECTORY_RETRIES" envDefault:"2"`
+	DirectoryRetryBackoff     time.Duration `env:"DIRECTORY_RETRY_BACKOFF" envDefault:"500ms"`
+	DirectoryBreakerThreshold int           `env:"DIRECTORY_BREAKER_THRESHOLD" envDefault:"5"`
+	DirectoryBreakerCooldown  time.Duration `env:"DIRECTORY_BREAKER_COOLDOWN" envDefault:"1m"`
+	// the retries of the directory and of the events wait as per
+	// RETRY_BACKOFF, see backoff.go
+	RetryBackoff    string        `env:"RETRY_BACKOFF" envDefault:"exponential"`
+	RetryBackoffMax time.Duration `env:"RETRY_BACKOFF_MAX" envDefault:"30s"`
+	RetryJitter     float64       `env:"RETRY_JITTER" envDefault:"0.5"`
+	// DirectoryVerify reads the new users back after the registration and
+	// binds as them, with the LDAP backend
+	DirectoryVerify bool `env:"DIRECTORY_VERIFY" envDefault:"true"`
 
 	PasswordMin    uint   `env:"PASSWORD_MIN" envDefault:"8"`
 	PasswordMax    uint   `env:"PASSWORD_MAX" envDefault:"32"`
-	PasswordRegexp string `env:"PASSWORD_REGEXP" envDefault:"^(?=.*[A-Za-z])(?=.*\d)[A-Za-z\d]{8,}$"`
+	PasswordRegexp string `env:"PASSWORD_REGEXP"`
+
+	PasswordRequireLetter  bool `env:"PASSWORD_REQUIRE_LETTER" envDefault:"true"`
+	PasswordRequireUpper   bool `env:"PASSWORD_REQUIRE_UPPER" envDefault:"false"`
+	PasswordRequireLower   bool `env:"PASSWORD_REQUIRE_LOWER" envDefault:"false"`
+	PasswordRequireDigit   bool `env:"PASSWORD_REQUIRE_DIGIT" envDefault:"true"`
+	PasswordRequireSymbol  bool `env:"PASSWORD_REQUIRE_SYMBOL" envDefault:"false"`
+	PasswordForbidUsername bool `env:"PASSWORD_FORBID_USERNAME" envDefault:"false"`
+
+	PasswordRulesText string `env:"PASSWORD_RULES_TEXT"`
 }
 
-var (
-	options        Options
-	token          string
-	endsAt         = time.Now()
-	passwordRegexp *regexp.Regexp
-)
+// currentOptions is the configuration in use. A reload swaps it as a whole,
+// for the sessions and the handlers running meanwhile never to see it half
+// written; read it with options.
+var currentOptions atomic.Pointer[Options]
 
-const WELCOME_BODY = "Welcome.\nSending a mail to %s, do you accept? (y/N): "
-const MAIL_BODY = `Your authenticatoin token is: %s`
-const TOKEN_BODY = "Enter the token you received by mail: "
-const TOKEN_FAILED = "Invalid token. Verification failed.\n"
-const TOKEN_RETRY = "Invalid token. Please, try again (you have %d more retries)\n"
-const ALREADY_REGISTERED = "You're already registered.\nYou can manage your profile over at\n\t%s\nBye!\n"
-const PASWORD_RULES = "Please, enter your password twice. It must respect the following rules:\n- The length must be between %d and %d (included)\n- It must contain at least one letter and one digit\n"
-const PASSWORD_FAILED = "Password attempts failed. Logging out."
-const REGISTRATION_SUCCESS = "You are now registered! \nYou can manage your profile over at\n\t%s\nBye!\n"
-
-func contains[T comparable](elems []T, v T) bool {
-	for _, s := range elems {
-		if v == s {
-			return true
-		}
-	}
-	return false
+func init() {
+	currentOptions.Store(&Options{})
 }
 
-func readN(s io.ReadWriter, l uint, onlyIn []byte, write bool) (res []byte, in uint) {
-	res = make([]byte, l)
-	done := false
-	for !done {
-		buf := make([]byte, 1)
-		_, err := s.Read(buf)
-		if err != nil {
-			return
-		}
+// options returns the configuration in use. The values are not to be
+// changed once the server runs: a new configuration goes through
+// swapOptions.
+func options() *Options {
+	return currentOptions.Load()
+}
 
-		switch buf[0] {
-		case 127:
-			if in > 0 {
-				if write {
-					io.WriteString(s, "\b \b")
-				}
-				// defaults
-				in--
-				res[in] = ' '
-			}
-			break
+// optionsMu serializes the changes to the configuration, between a reload
+// and the credentials refreshed from Vault.
+var optionsMu sync.Mutex
 
-		case '\r':
-			s.Write([]byte("\n\r"))
-			done = true
-			break
+// swapOptions replaces the configuration in use with o, returning the
+// previous one.
+func swapOptions(o *Options) *Options {
+	return currentOptions.Swap(o)
+}
 
-		default:
-			if len(onlyIn) > 0 && !contains(onlyIn, buf[0]) {
-				break
-			}
-			if in < l {
-				if write {
-					s.Write(buf)
-				}
-				res[in] = buf[0]
-				in += 1
-			}
-			break
-		}
+var (
+	limiter       *sessionLimiter
+	bans          banStore
+	tokens        pendingStore
+	registrations = newRegistrationLog(100)
+)
+
+// the names of the messages shown to the users, defined in messages.tmpl
+const (
+	INTERNAL_ERROR           = "internal_error"
+	TOO_MANY_SESSIONS        = "too_many_sessions"
+	SERVER_BUSY              = "server_busy"
+	SERVER_QUEUED            = "server_queued"
+	INVALID_USERNAME         = "invalid_username"
+	CLIENT_TOO_OLD           = "client_too_old"
+	EXEC_REFUSED             = "exec_refused"
+	SUBSYSTEM_REFUSED        = "subsystem_refused"
+	FORWARDING_REFUSED       = "forwarding_refused"
+	BYE                      = "bye"
+	PROMPT_IDLE_WARNING      = "prompt_idle_warning"
+	PROMPT_TIMED_OUT         = "prompt_timed_out"
+	INVALID_ANSWER           = "invalid_answer"
+	CHALLENGE_MATH           = "challenge_math"
+	CHALLENGE_FAILED         = "challenge_failed"
+	QUOTA_EXCEEDED           = "quota_exceeded"
+	LOCKED_OUT               = "locked_out"
+	TRUSTED_NETWORK          = "trusted_network"
+	WELCOME_BODY             = "welcome_body"
+	MAIL_PROMPT              = "mail_prompt"
+	MAIL_INVALID             = "mail_invalid"
+	MAIL_DOMAIN_NOT_ALLOWED  = "mail_domain_not_allowed"
+	MAIL_TAKEN               = "mail_taken"
+	MAIL_TAKEN_RESET         = "mail_taken_reset"
+	MAIL_RETRY               = "mail_retry"
+	MAIL_CONFIRM             = "mail_confirm"
+	MAIL_REJECTED            = "mail_rejected"
+	MAIL_FAILED              = "mail_failed"
+	MAIL_THROTTLED           = "mail_throttled"
+	MAIL_BODY                = "mail_body"
+	LINK_BODY                = "link_body"
+	LINK_WAITING             = "link_waiting"
+	LINK_CONFIRMED           = "link_confirmed"
+	INVITE_BODY              = "invite_body"
+	TOKEN_PENDING            = "token_pending"
+	TOKEN_SENT               = "token_sent"
+	TOKEN_BODY               = "token_body"
+	TOKEN_EXPIRED            = "token_expired"
+	TOKEN_REVOKED            = "token_revoked"
+	TOKEN_FAILED             = "token_failed"
+	TOKEN_BOUND              = "token_bound"
+	TOKEN_RETRY              = "token_retry"
+	PASSWORD_RULES           = "password_rules"
+	PASSWORD_PROMPT          = "password_prompt"
+	PASSWORD_REPEAT          = "password_repeat"
+	PASSWORDS_DIFFER         = "passwords_differ"
+	PASSWORD_FAILED          = "password_failed"
+	REGISTRATION_SUCCESS     = "registration_success"
+	REGISTRATION_ROLLED_BACK = "registration_rolled_back"
+	NOT_PROVISIONED          = "not_provisioned"
+	KEY_VERIFIED             = "key_verified"
+	ALREADY_REGISTERED       = "already_registered"
+	POLICY_DENIED            = "policy_denied"
+	POLICY_REVIEW            = "policy_review"
+	ALREADY_REGISTERED_RESET = "already_registered_reset"
+	RESET_PROMPT             = "reset_prompt"
+	RESET_SENT               = "reset_sent"
+	ACCOUNT_MENU             = "account_menu"
+	NO_MAIL_ON_FILE          = "no_mail_on_file"
+	MAIL_CHANGE_PROMPT       = "mail_change_prompt"
+	MAIL_UNCHANGED           = "mail_unchanged"
+	MAIL_CHANGED             = "mail_changed"
+	ACCOUNT_DELETE_CONFIRM   = "account_delete_confirm"
+	ACCOUNT_DELETED          = "account_deleted"
+	ACCOUNT_NOT_DELETED      = "account_not_deleted"
+	ACCOUNT_EXISTS_BODY      = "account_exists_body"
+	PROGRESS_MAIL            = "progress_mail"
+	PROGRESS_REGISTER        = "progress_register"
+	PROGRESS_PASSWORD        = "progress_password"
+	PROGRESS_MAIL_CHANGE     = "progress_mail_change"
+	PROGRESS_DELETE          = "progress_delete"
+	PROGRESS_RESET           = "progress_reset"
+	PROGRESS_DONE            = "progress_done"
+	PROGRESS_FAILED          = "progress_failed"
+	IDENTITY_PROMPT          = "identity_prompt"
+	IDENTITY_UNKNOWN         = "identity_unknown"
+	IDENTITY_LINKED          = "identity_linked"
+	IDENTITY_FAILED          = "identity_failed"
+	PHONE_PROMPT             = "phone_prompt"
+	PHONE_CODE_PROMPT        = "phone_code_prompt"
+	PHONE_CODE_FAILED        = "phone_code_failed"
+	PROGRESS_SMS             = "progress_sms"
+	SMS_BODY                 = "sms_body"
+)
+
+// sendmail mails a token to dest, or with TOKEN_DELIVERY=link, the link
+// confirming the address of user.
+func sendmail(ctx context.Context, user, dest, token string) error {
+	if options().TokenDelivery == "link" {
+		return deliver(ctx, dest, options().Subject, renderText(LINK_BODY, messageData{User: user, Mail: dest, URL: confirmURL(user, token)}))
 	}
-	return
+	return deliver(ctx, dest, options().Subject, renderText(MAIL_BODY, messageData{Mail: dest, Token: token}))
 }
 
-func sendmail(dest, token string) (err error) {
-	toAddress := dest
-	body := fmt.Sprintf(MAIL_BODY, token)
+// deliver sends an HTML mail through the configured transport, failing
+// over to the next relay of the route, see sendFailover.
+func deliver(ctx context.Context, dest, subject, body string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, options().MailTimeout)
+	defer cancel()
+	relays := orderRelays(mailRelays(dest))
+	_, sp := startSpan(ctx, "smtp.send", spanKindClient)
+	sp.setAttr("smtp.server", relays[0].server)
+	start := time.Now()
+	defer func() {
+		sp.finish(err)
+		if !options().DryRun {
+			mailLatency.observe(time.Since(start).Seconds(), sp.TraceID())
+		}
+		if errors.Is(err, errRecipientRejected) {
+			countFailure(failMailRejected)
+		} else if err != nil {
+			countFailure(failMailError)
+		}
+	}()
+
+	from := mail.Address{Name: options().FromName, Address: options().FromAddress}
+	to := mail.Address{Address: dest}
 
-	from := mail.Address{Name: options.FromName, Address: options.FromAddress}
-	to := mail.Address{Address: toAddress}
+	msg := buildMessage(from, to, subject, body)
 
-	header := make(map[string]string)
-	header["To"] = to.String()
-	header["From"] = from.String()
-	header["Subject"] = options.Subject
-	header["Content-Type"] = `text/html; charset="UTF-8"`
-	msg := ""
+	if options().DryRun {
+		logInfo("[dry-run] Would send mail through %s:\n%s", relays[0].server, msg)
+		return nil
+	}
 
-	for k, v := range header {
-		msg += fmt.Sprintf("%s: %s\r\n", k, v)
+	if options().MailTransport == "sendmail" {
+		sp.setAttr("mail.transport", "sendmail")
+		return pipeMail(ctx, msg)
 	}
 
-	c, err := smtp.Dial(options.SMTPServer)
+	return sendFailover(ctx, relays, to.Address, msg)
+}
+
+// sendSMTP sends a message through the relay of route.
+func sendSMTP(ctx context.Context, route smtpRoute, to, msg string) (err error) {
+	c, err := mailPool.get(ctx, route)
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		} else {
+			mailPool.put(route, c)
+		}
+	}()
+	// abort the exchange when ctx is cancelled, as when the user disconnects
+	sent := make(chan struct{})
+	defer close(sent)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-sent:
+		}
+	}()
 
-	defer c.Close()
-	if err = c.Mail(from.String()); err != nil {
+	if err = mailFrom(c.Client, envelopeFrom()); err != nil {
 		return
 	}
 
-	if err = c.Rcpt(to.String()); err != nil {
+	if err = rcptTo(c.Client, to); err != nil {
 		return
 	}
 
@@ -145,16 +688,51 @@ func sendmail(dest, token string) (err error) {
 		return
 	}
 
-	if _, err = w.Write([]byte(msg + "\r\n" + body)); err != nil {
+	if _, err = w.Write([]byte(msg)); err != nil {
 		return
 	}
 
-	if err = w.Close(); err != nil {
-		return
+	err = w.Close()
+	return
+}
+
+// dialSMTP connects to the mail server within the deadline of ctx, logging
+// the SMTP conversation when the smtp debug output is enabled. AUTH commands
+// are redacted.
+func dialSMTP(ctx context.Context, addr string) (*smtpConn, error) {
+	conn, err := dialMail(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &smtpConn{conn: conn}
+	c.setDeadline(ctx)
+	var wire net.Conn = conn
+	if debugEnabled("smtp") {
+		wire = &wireLog{Conn: conn, subsystem: "smtp", redact: func(line string) bool {
+			return strings.HasPrefix(strings.ToUpper(line), "AUTH ")
+		}}
 	}
+	host, _, _ := net.SplitHostPort(addr)
+	if c.Client, err = smtp.NewClient(wire, host); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
 
-	err = c.Quit()
-	return
+// authSMTP authenticates with the credentials of the route, if any,
+// upgrading the connection with STARTTLS first when the server offers it.
+func authSMTP(c *smtp.Client, route smtpRoute) error {
+	if route.username == "" {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(route.server)
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	return c.Auth(smtp.PlainAuth("", route.username, route.password, host))
 }
 
 var (
@@ -165,172 +743,157 @@ var (
 func randomString(n uint) string {
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = runes[rand.Intn(len(runes))]
+		b[i] = runes[tokenRand.get().Intn(len(runes))]
 	}
 	return string(b)
 }
 
-func readPassword(s io.ReadWriter) (ok bool, ans string) {
-	passwd, read := readN(s, options.PasswordMax, []byte(letters), false)
-	if read < options.PasswordMin {
-		return false, "Password is too short"
+func readPassword(s io.ReadWriter, user string) (ok bool, ans string, err error) {
+	if ps, ok := s.(*session); ok {
+		defer ps.recordSecret("password")()
 	}
-	if !passwordRegexp.Match([]byte(passwd)) {
-		return false, "Password does not comply with the rules"
-	}
-	return true, string(passwd)
-}
-
-func bind() (*ldap.Conn, error) {
-	l, err := ldap.DialURL(options.LdapURI)
+	passwd, err := readN(s, options().PasswordMax, passwordChars, false)
 	if err != nil {
-		return nil, fmt.Errorf("Could not connect to the LDAP server: %v", err)
+		return false, "", err
 	}
-
-	if err := l.Bind(options.LdapBindDN, options.LdapBindPassword); err != nil {
-		return nil, fmt.Errorf("Could not bind with the given user: %v", err)
+	if problem := checkPassword(user, string(passwd)); problem != "" {
+		return false, problem, nil
 	}
-	return l, nil
+	return true, string(passwd), nil
 }
 
-func exists(l *ldap.Conn, uid string) (bool, error) {
-	searchRequest := ldap.NewSearchRequest(
-		options.LdapUserScope,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(objectClass=person)(uid=%s))", ldap.EscapeFilter(uid)),
-		[]string{"dn"},
-		nil,
-	)
-
-	sr, err := l.Search(searchRequest)
+// preflight makes sure the backends are reachable, and with
+// DIRECTORY_PREFLIGHT that the directory is set up correctly, before
+// accepting users.
+func preflight() error {
+	ctx := context.Background()
+	d, err := openDirectory(ctx)
 	if err != nil {
-		return false, err
+		return err
 	}
-	return len(sr.Entries) > 0, nil
-}
-
-func register(l *ldap.Conn, uid, email, password string) error {
-	user := fmt.Sprintf("uid=%s,", uid) + options.LdapUserScope
-	addRequest := ldap.AddRequest{
-		DN: user,
-		Attributes: []ldap.Attribute{
-			{Type: "email", Vals: []string{email}},
-		},
-	}
-
-	if err := l.Add(&addRequest); err != nil {
-		return fmt.Errorf("Could not add new user: %v", err)
-	}
-
-	passwordModifyRequest := ldap.NewPasswordModifyRequest(user, "", password)
-	if _, err := l.PasswordModify(passwordModifyRequest); err != nil {
-		return fmt.Errorf("Could not add a password to the new user: %v", err)
+	defer d.Close()
+	if options().DirectoryPreflight {
+		return checkDirectory(ctx, d, true)
 	}
 	return nil
 }
 
 func main() {
-	env.Parse(&options)
-	passwordRegexp = regexp.MustCompile(options.PasswordRegexp)
-
-	ssh.Handle(func(s ssh.Session) {
-		defer s.Close()
-
-		user := s.User()
-		// initalize the ldap connection
-		l, err := bind()
-		if err != nil {
-			log.Fatalf("Could not bind to LDAP: %v", err)
-		}
-		defer func() { l.Unbind(); l.Close() }()
-		exists, err := exists(l, user)
+	if err := loadOptions(options()); err != nil {
+		log.Fatal(err)
+	}
+	if ok, err := runService(); ok || err != nil {
 		if err != nil {
-			log.Fatalf("Error while searching LDAP user: %v", err)
-		}
-		if exists {
-			// already registered
-			io.WriteString(s, fmt.Sprintf(ALREADY_REGISTERED, options.LldapURI.JoinPath("/login").String()))
-			return
+			log.Fatal(err)
 		}
+		return
+	}
+	name, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		name, args = os.Args[1], os.Args[2:]
+	}
+	if err := runCommand(name, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-		mail := user + options.ToSuffix
-		io.WriteString(s, fmt.Sprintf(WELCOME_BODY, mail))
+// serve runs the SSH server until one of the listeners fails.
+func serve(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: sshauth serve")
+	}
+	limiter = newSessionLimiter(options().MaxSessions, options().MaxSessionsPerIP)
+	bans = newBanList(options().BanThreshold, options().BanWindow, options().BanDuration)
+	initTracing()
+	defer stopTracing()
+	if options().DryRun {
+		logInfo("Running in dry-run mode: no mail will be sent and no user will be created")
+	}
+	var err error
+	if tokens, err = newPendingStore(); err != nil {
+		return err
+	}
+	if rs, ok := tokens.(*redisStore); ok {
+		// share the ban list and session counters with the other instances
+		limiter.shared = rs.client
+		quotas.shared = rs.client
+		mailThrottles.shared = rs.client
+		bans = &redisBans{client: rs.client, threshold: options().BanThreshold, window: options().BanWindow, duration: options().BanDuration}
+	}
+	if err := initErrorReporting(); err != nil {
+		return err
+	}
 
-		buf, read := readN(s, 1, []byte{'y', 'n'}, true)
-		if read < 1 || buf[0] != 'y' {
-			io.WriteString(s, "Bye!\n")
-			return
-		}
-		token := randomString(options.TokenLength)
-		if err := sendmail(mail, token); err != nil {
-			log.Printf("Could not send mail: %v", err)
-			io.WriteString(s, "Could not send mail\n")
-			return
-		}
-		log.Printf("token for %s is %s", mail, token)
-		i := 3
-		for true {
-			io.WriteString(s, TOKEN_BODY)
-			buf, read = readN(s, options.TokenLength, []byte{}, true)
-			if read != options.TokenLength || string(buf) != token {
-				i--
-				if i == 0 {
-					io.WriteString(s, TOKEN_FAILED)
-					return
-				} else {
-					io.WriteString(s, fmt.Sprintf(TOKEN_RETRY, i))
-				}
-			} else {
-				break
-			}
+	server := &ssh.Server{
+		Handler:              recoverPanics(handle),
+		ConnCallback:         acceptConn,
+		ServerConfigCallback: serverConfig,
+		ChannelHandlers:      refusingChannelHandlers,
+		RequestHandlers:      refusingRequestHandlers,
+		SubsystemHandlers:    refusingSubsystemHandlers,
+	}
+	keys, err := hostKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		server.AddHostKey(k)
+	}
+	if options().KeyVerification || options().AdminSSHKeys != "" || keyBinding() {
+		server.PublicKeyHandler = publicKeyHandler
+		server.KeyboardInteractiveHandler = keyboardInteractiveHandler
+	}
+	lns, err := listeners()
+	if err != nil {
+		return err
+	}
+	plns, err := profileListeners()
+	if err != nil {
+		for _, ln := range append(lns, plns...) {
+			ln.Close()
 		}
+		return err
+	}
+	lns = append(lns, plns...)
+
+	serveAdmin()
+	serveGRPC()
+	serveWeb()
+	serveMetrics()
+	publishEvents()
+	go janitor()
+	go purger()
+	if err := preflight(); err != nil {
+		return fmt.Errorf("Preflight check failed: %v", err)
+	}
 
-		// not registered, add new user
-		io.WriteString(s, "You're not registered. Proceeding with the registration process\n")
-		io.WriteString(s, fmt.Sprintf(PASWORD_RULES, options.PasswordMin, options.PasswordMax))
-		passwd, i := "", 3
-		for true {
-			io.WriteString(s, "Password: ")
-			ok, firstPasswd := readPassword(s)
-			i--
-			if !ok {
-				io.WriteString(s, firstPasswd+"\n")
-				if i <= 0 {
-					io.WriteString(s, PASSWORD_FAILED)
-					return
-				}
-			} else {
-				passwd = firstPasswd
-				break
-			}
-		}
-		for true {
-			io.WriteString(s, "Repeat your password: ")
-			ok, secondPassword := readPassword(s)
-			i--
-			if ok && secondPassword != passwd {
-				ok = false
-				secondPassword = "Passwords don't match"
-			}
-			if !ok {
-				io.WriteString(s, secondPassword+"\n")
-				if i <= 0 {
-					io.WriteString(s, PASSWORD_FAILED)
-					return
-				}
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		if options().ProxyProtocol {
+			if pl, ok := ln.(profileListener); ok {
+				// the profile tags the connections once the header is read
+				pl.Listener = &proxyListener{Listener: pl.Listener, timeout: options().ProxyProtocolTimeout}
+				ln = pl
 			} else {
-				break
+				ln = &proxyListener{Listener: ln, timeout: options().ProxyProtocolTimeout}
 			}
 		}
-		io.WriteString(s, "Registering user with the given password\n")
-		fmt.Println("Registering with passwd: " + passwd)
-		if err := register(l, user, mail, passwd); err != nil {
-			log.Fatalf("Error while registering a new user with LDAP: %v", err)
-		}
-		io.WriteString(s, fmt.Sprintf(REGISTRATION_SUCCESS, options.LldapURI.JoinPath("/login").String()))
-	})
-
-	listen := fmt.Sprintf("%s:%d", options.Host, options.Port)
-	log.Printf("Listening on %s", listen)
-	log.Fatal(ssh.ListenAndServe(listen, nil))
+		go func(ln net.Listener) { errs <- server.Serve(ln) }(ln)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logError("Could not notify systemd: %v", err)
+	}
+	go watchdog()
+	go reloadOnSIGHUP()
+	go noticeOnSIGUSR1()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		logInfo("Stopping on %s", sig)
+		return nil
+	}
 }
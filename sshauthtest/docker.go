@@ -0,0 +1,221 @@
+package sshauthtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// ErrNoDocker is returned by StartServices when Docker can't be reached, for
+// the tests to skip rather than fail.
+var ErrNoDocker = errors.New("Docker is not available")
+
+// the directories StartServices provisions
+const (
+	OpenLDAP = "openldap"
+	LLDAP    = "lldap"
+)
+
+// the base DN and the password of the admin of the directories
+const (
+	BaseDN        = "dc=example,dc=com"
+	AdminPassword = "adminpassword"
+)
+
+// servicesExpire bounds the life of the containers, should the test be
+// killed before removing them.
+const servicesExpire = 10 * time.Minute
+
+// Services are the containers a test runs sshauth against, provisioned with
+// dockertest: the directory and Mailhog.
+type Services struct {
+	// Env points sshauth at the services, to be passed in Config.Env with
+	// NoDev
+	Env []string
+	// LDAPURL is the address of the directory, as ldap://host:port
+	LDAPURL string
+	// BindDN is the admin of the directory, whose password is AdminPassword
+	BindDN string
+	// UserScope is where the users of the directory are
+	UserScope string
+	// MailhogURL is the API of Mailhog, for MailhogMails
+	MailhogURL string
+
+	pool      *dockertest.Pool
+	resources []*dockertest.Resource
+}
+
+// StartServices starts directory, one of OpenLDAP or LLDAP, and Mailhog in
+// Docker, through DOCKER_HOST or the default socket, returning once they
+// accept connections. It returns ErrNoDocker when Docker can't be reached.
+func StartServices(ctx context.Context, directory string) (*Services, error) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoDocker, err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoDocker, err)
+	}
+	pool.MaxWait = time.Minute
+	s := &Services{pool: pool}
+
+	var run *dockertest.RunOptions
+	var ldapPort string
+	switch directory {
+	case OpenLDAP:
+		run = &dockertest.RunOptions{
+			Repository: "bitnami/openldap",
+			Tag:        "2.6",
+			Env: []string{
+				"LDAP_ROOT=" + BaseDN,
+				"LDAP_ADMIN_USERNAME=admin",
+				"LDAP_ADMIN_PASSWORD=" + AdminPassword,
+				"LDAP_SKIP_DEFAULT_TREE=no",
+			},
+		}
+		ldapPort = "1389/tcp"
+		s.BindDN = "cn=admin," + BaseDN
+		s.UserScope = "ou=users," + BaseDN
+	case LLDAP:
+		run = &dockertest.RunOptions{
+			Repository: "lldap/lldap",
+			Tag:        "stable",
+			Env: []string{
+				"LLDAP_LDAP_BASE_DN=" + BaseDN,
+				"LLDAP_LDAP_USER_PASS=" + AdminPassword,
+				"LLDAP_JWT_SECRET=sshauthtest-jwt-secret",
+				"LLDAP_KEY_SEED=sshauthtest-key-seed",
+			},
+		}
+		ldapPort = "3890/tcp"
+		s.BindDN = "uid=admin,ou=people," + BaseDN
+		s.UserScope = "ou=people," + BaseDN
+	default:
+		return nil, fmt.Errorf("Unknown directory %q, expected one of %s or %s", directory, OpenLDAP, LLDAP)
+	}
+
+	dir, err := s.run(run)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.LDAPURL = "ldap://" + dir.GetHostPort(ldapPort)
+	if err := s.retry(ctx, func() error {
+		l, err := ldap.DialURL(s.LDAPURL)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		return l.Bind(s.BindDN, AdminPassword)
+	}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("The %s container did not start: %v", directory, err)
+	}
+
+	mailhog, err := s.run(&dockertest.RunOptions{Repository: "mailhog/mailhog", Tag: "v1.0.1"})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.MailhogURL = "http://" + mailhog.GetHostPort("8025/tcp")
+	if err := s.retry(ctx, func() error {
+		_, err := MailhogMails(ctx, s.MailhogURL)
+		return err
+	}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("The Mailhog container did not start: %v", err)
+	}
+
+	s.Env = []string{
+		"DIRECTORY_BACKEND=ldap",
+		"LDAP_URI=" + s.LDAPURL,
+		"LDAP_BIND_DN=" + s.BindDN,
+		"LDAP_BIND_PASSWORD=" + AdminPassword,
+		"LDAP_USER_SCOPE=" + s.UserScope,
+		"LDAP_GROUP_SCOPE=ou=groups," + BaseDN,
+		"MAIL_SERVER=" + mailhog.GetHostPort("1025/tcp"),
+		"MAIL_TO_SUFFIX=@example.com",
+	}
+	return s, nil
+}
+
+// run starts a container, removed when it stops.
+func (s *Services) run(opts *dockertest.RunOptions) (*dockertest.Resource, error) {
+	r, err := s.pool.RunWithOptions(opts, func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not start %s:%s: %v", opts.Repository, opts.Tag, err)
+	}
+	s.resources = append(s.resources, r)
+	r.Expire(uint(servicesExpire / time.Second))
+	return r, nil
+}
+
+// retry calls op until it succeeds, for at most the MaxWait of the pool.
+func (s *Services) retry(ctx context.Context, op func() error) error {
+	return s.pool.Retry(func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return op()
+	})
+}
+
+// AddUser adds a user with an address to the directory, as an account
+// registered before the test. The username is not escaped.
+func (s *Services) AddUser(user, mail string) error {
+	l, err := ldap.DialURL(s.LDAPURL)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := l.Bind(s.BindDN, AdminPassword); err != nil {
+		return err
+	}
+	add := ldap.NewAddRequest("uid="+user+","+s.UserScope, nil)
+	add.Attribute("objectClass", []string{"inetOrgPerson"})
+	add.Attribute("uid", []string{user})
+	add.Attribute("cn", []string{user})
+	add.Attribute("sn", []string{user})
+	add.Attribute("mail", []string{mail})
+	return l.Add(add)
+}
+
+// WaitMail waits for Mailhog to catch a mail to the address to.
+func (s *Services) WaitMail(ctx context.Context, to string) (Mail, error) {
+	for {
+		mails, err := MailhogMails(ctx, s.MailhogURL)
+		if err != nil {
+			return Mail{}, err
+		}
+		for _, m := range mails {
+			if strings.Contains(m.To, to) {
+				return m, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return Mail{}, fmt.Errorf("No mail to %s: %v", to, ctx.Err())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// Close removes the containers.
+func (s *Services) Close() error {
+	var errs []error
+	for _, r := range s.resources {
+		if err := s.pool.Purge(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+package sshauthtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucat1/sshauth/sshauthtest"
+)
+
+// the password the users of the tests choose, within the default rules
+const testPassword = "Correct-Horse-Battery-9"
+
+// startServices provisions the directory and Mailhog, skipping the test
+// without Docker.
+func startServices(t *testing.T, ctx context.Context, directory string) *sshauthtest.Services {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("the Docker services are skipped in short mode")
+	}
+	svc, err := sshauthtest.StartServices(ctx, directory)
+	if errors.Is(err, sshauthtest.ErrNoDocker) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.Close() })
+	return svc
+}
+
+func startServer(t *testing.T, ctx context.Context, cfg sshauthtest.Config) *sshauthtest.Server {
+	t.Helper()
+	srv, err := sshauthtest.Start(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("server output:\n%s", srv.Output())
+		}
+		srv.Close()
+	})
+	return srv
+}
+
+func expect(t *testing.T, ctx context.Context, conn *sshauthtest.Conn, text string) {
+	t.Helper()
+	if got, err := conn.Expect(ctx, text); err != nil {
+		t.Fatalf("%v, got:\n%s", err, got)
+	}
+}
+
+func send(t *testing.T, conn *sshauthtest.Conn, line string) {
+	t.Helper()
+	if err := conn.Send(line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRegistration runs the interactive flow to the end: the user accepts
+// the mail, enters the token it carries and chooses a password.
+func TestRegistration(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		directory string
+	}{
+		{name: "dev"},
+		{name: "lldap", directory: sshauthtest.LLDAP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+			defer cancel()
+
+			cfg := sshauthtest.Config{}
+			to := "alice@localhost"
+			var svc *sshauthtest.Services
+			if tc.directory != "" {
+				svc = startServices(t, ctx, tc.directory)
+				cfg = sshauthtest.Config{NoDev: true, Env: svc.Env}
+				to = "alice@example.com"
+			}
+			srv := startServer(t, ctx, cfg)
+
+			conn, err := srv.Dial("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			expect(t, ctx, conn, "Sending a mail to "+to+", do you accept?")
+			send(t, conn, "y")
+
+			var m sshauthtest.Mail
+			if svc != nil {
+				m, err = svc.WaitMail(ctx, to)
+			} else {
+				m, err = srv.NextMail(ctx)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			token := m.Find(`token is: (\S+)`)
+			if token == "" {
+				t.Fatalf("No token in the mail:\n%s", m.Raw)
+			}
+			expect(t, ctx, conn, "Enter the token")
+			send(t, conn, token)
+			expect(t, ctx, conn, "Password: ")
+			send(t, conn, testPassword)
+			expect(t, ctx, conn, "Repeat your password: ")
+			send(t, conn, testPassword)
+			expect(t, ctx, conn, "You are now registered!")
+			if status, err := conn.Wait(); err != nil || status != 0 {
+				t.Fatalf("The session ended with %d: %v", status, err)
+			}
+
+			// the account exists from now on
+			again, err := srv.Dial("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer again.Close()
+			expect(t, ctx, again, "You're already registered.")
+		})
+	}
+}
+
+// TestAlreadyRegistered connects as a user added to OpenLDAP beforehand.
+func TestAlreadyRegistered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+	svc := startServices(t, ctx, sshauthtest.OpenLDAP)
+	if err := svc.AddUser("bob", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	env := append(svc.Env, "LDAP_USER_ATTRIBUTE=uid", "LDAP_USER_OBJECT_CLASS=inetOrgPerson")
+	srv := startServer(t, ctx, sshauthtest.Config{NoDev: true, Env: env})
+
+	conn, err := srv.Dial("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect(t, ctx, conn, "You're already registered.")
+}
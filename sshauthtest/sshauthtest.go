@@ -0,0 +1,381 @@
+// Package sshauthtest boots an sshauth server for end-to-end tests and
+// drives its interactive flow over SSH:
+//
+//	srv, err := sshauthtest.Start(ctx, sshauthtest.Config{})
+//	defer srv.Close()
+//	conn, err := srv.Dial("alice")
+//	conn.Expect(ctx, "do you accept?")
+//	conn.Send("y")
+//	mail, err := srv.NextMail(ctx)
+//	conn.Expect(ctx, "Enter the token")
+//	conn.Send(mail.Find(`token is: (\w+)`))
+//
+// By default the server runs with the dev command, whose in-memory
+// directory and SMTP sink need nothing else. To test against real services,
+// start OpenLDAP or LLDAP and Mailhog in Docker with StartServices, and run
+// the server with NoDev and their Env; the mails are then read from Mailhog
+// with WaitMail:
+//
+//	svc, err := sshauthtest.StartServices(ctx, sshauthtest.LLDAP)
+//	if errors.Is(err, sshauthtest.ErrNoDocker) {
+//		t.Skip(err)
+//	}
+//	defer svc.Close()
+//	srv, err := sshauthtest.Start(ctx, sshauthtest.Config{NoDev: true, Env: svc.Env})
+package sshauthtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucat1/sshauth/client"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config is the server to start.
+type Config struct {
+	// Binary is the sshauth binary, built from the module when empty
+	Binary string
+	// Env is added to the environment of the server, such as
+	// DIRECTORY_BACKEND=ldap or SCRIPTED_MODE=true
+	Env []string
+	// NoDev runs the serve command instead of the dev one, whose
+	// in-memory directory and SMTP sink are the default
+	NoDev bool
+	// StartTimeout bounds the start of the server, 30 seconds by default
+	StartTimeout time.Duration
+}
+
+// Mail is a mail sent by the server.
+type Mail struct {
+	To  string
+	Raw string
+}
+
+// Find returns the first group of the first match of pattern in the mail,
+// or the whole match when pattern has no group, or "".
+func (m Mail) Find(pattern string) string {
+	match := regexp.MustCompile(pattern).FindStringSubmatch(m.Raw)
+	switch {
+	case len(match) > 1:
+		return match[1]
+	case len(match) == 1:
+		return match[0]
+	}
+	return ""
+}
+
+// Server is a running sshauth server.
+type Server struct {
+	// Addr is where the server listens, a 127.0.0.1:port
+	Addr string
+
+	cmd   *exec.Cmd
+	tmp   string
+	mails chan Mail
+	done  chan struct{}
+
+	mu  sync.Mutex
+	out strings.Builder
+}
+
+// Start builds sshauth if needed and starts it on a free port, returning
+// once it accepts connections.
+func Start(ctx context.Context, cfg Config) (*Server, error) {
+	tmp, err := os.MkdirTemp("", "sshauthtest")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{tmp: tmp, mails: make(chan Mail, 64), done: make(chan struct{})}
+	bin := cfg.Binary
+	if bin == "" {
+		bin = filepath.Join(tmp, "sshauth")
+		build := exec.CommandContext(ctx, "go", "build", "-o", bin, "github.com/lucat1/sshauth")
+		if out, err := build.CombinedOutput(); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Could not build sshauth: %v\n%s", err, out)
+		}
+	}
+	port, err := freePort()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.Addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	args := []string{"serve"}
+	if !cfg.NoDev {
+		args = []string{"dev"}
+	}
+	s.cmd = exec.Command(bin, args...)
+	s.cmd.Env = append(os.Environ(), "SSH_HOST=127.0.0.1", "SSH_PORT="+strconv.Itoa(port), "STORE_SQLITE_PATH="+filepath.Join(tmp, "store.db"))
+	s.cmd.Env = append(s.cmd.Env, cfg.Env...)
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.cmd.Stderr = s.cmd.Stdout
+	if err := s.cmd.Start(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	go s.read(stdout)
+	go func() {
+		s.cmd.Wait()
+		close(s.done)
+	}()
+
+	timeout := cfg.StartTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", s.Addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return s, nil
+		}
+		select {
+		case <-s.done:
+			s.Close()
+			return nil, fmt.Errorf("sshauth exited before listening:\n%s", s.Output())
+		case <-ctx.Done():
+			s.Close()
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			s.Close()
+			return nil, fmt.Errorf("sshauth did not listen within %s:\n%s", timeout, s.Output())
+		}
+	}
+}
+
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// read collects the output of the server, picking out the mails printed by
+// the SMTP sink of the dev command.
+func (s *Server) read(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	var mail *Mail
+	for sc.Scan() {
+		line := sc.Text()
+		s.mu.Lock()
+		s.out.WriteString(line + "\n")
+		s.mu.Unlock()
+		switch {
+		case mail == nil && strings.HasPrefix(line, "----- mail ") && strings.HasSuffix(line, " -----"):
+			mail = &Mail{To: strings.TrimSuffix(strings.TrimPrefix(line, "----- mail "), " -----")}
+		case mail != nil && line == "----- end of mail -----":
+			select {
+			case s.mails <- *mail:
+			default:
+			}
+			mail = nil
+		case mail != nil:
+			mail.Raw += line + "\n"
+		}
+	}
+}
+
+// Output returns everything the server wrote so far, logs included.
+func (s *Server) Output() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.String()
+}
+
+// NextMail waits for the next mail printed by the dev command.
+func (s *Server) NextMail(ctx context.Context) (Mail, error) {
+	select {
+	case m := <-s.mails:
+		return m, nil
+	case <-ctx.Done():
+		return Mail{}, ctx.Err()
+	}
+}
+
+// Client returns a client of the scripted mode, which the server must
+// enable with SCRIPTED_MODE=true.
+func (s *Server) Client() *client.Client {
+	return client.New(s.Addr, ssh.InsecureIgnoreHostKey())
+}
+
+// Close stops the server and removes its files.
+func (s *Server) Close() error {
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+	return os.RemoveAll(s.tmp)
+}
+
+// Conn is an interactive session, with a terminal, as a user would open.
+type Conn struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+
+	mu   sync.Mutex
+	out  []byte
+	seen int
+	more chan struct{}
+	err  error
+}
+
+// Dial opens an interactive session as user, offering signers, if any.
+func (s *Server) Dial(user string, signers ...ssh.Signer) (*Conn, error) {
+	auth := []ssh.AuthMethod{ssh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) { return nil, nil })}
+	if len(signers) > 0 {
+		auth = append([]ssh.AuthMethod{ssh.PublicKeys(signers...)}, auth...)
+	}
+	cl, err := ssh.Dial("tcp", s.Addr, &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	sess, err := cl.NewSession()
+	if err != nil {
+		cl.Close()
+		return nil, err
+	}
+	c := &Conn{client: cl, session: sess, more: make(chan struct{}, 1)}
+	if c.stdin, err = sess.StdinPipe(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := sess.RequestPty("xterm", 40, 120, ssh.TerminalModes{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := sess.Shell(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.read(stdout)
+	return c, nil
+}
+
+func (c *Conn) read(r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		c.mu.Lock()
+		c.out = append(c.out, buf[:n]...)
+		if err != nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+		select {
+		case c.more <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Expect waits for text to be written by the server after what the last
+// Expect matched, returning everything written up to it.
+func (c *Conn) Expect(ctx context.Context, text string) (string, error) {
+	for {
+		c.mu.Lock()
+		if i := strings.Index(string(c.out[c.seen:]), text); i >= 0 {
+			got := string(c.out[c.seen : c.seen+i+len(text)])
+			c.seen += i + len(text)
+			c.mu.Unlock()
+			return got, nil
+		}
+		err, rest := c.err, string(c.out[c.seen:])
+		c.mu.Unlock()
+		if err != nil {
+			return rest, fmt.Errorf("The session ended before %q: %v", text, err)
+		}
+		select {
+		case <-c.more:
+		case <-ctx.Done():
+			return rest, fmt.Errorf("Did not get %q: %v", text, ctx.Err())
+		}
+	}
+}
+
+// Send types line followed by the enter key.
+func (c *Conn) Send(line string) error {
+	_, err := io.WriteString(c.stdin, line+"\r")
+	return err
+}
+
+// Wait waits for the session to end, returning its exit status.
+func (c *Conn) Wait() (int, error) {
+	err := c.session.Wait()
+	if exit, ok := err.(*ssh.ExitError); ok {
+		return exit.ExitStatus(), nil
+	}
+	return 0, err
+}
+
+// Close ends the session.
+func (c *Conn) Close() error {
+	c.session.Close()
+	return c.client.Close()
+}
+
+// MailhogMails returns the mails caught by the Mailhog whose API is at
+// apiURL, such as http://localhost:8025, most recent first.
+func MailhogMails(ctx context.Context, apiURL string) ([]Mail, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(apiURL, "/")+"/api/v2/messages", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Mailhog replied %s", res.Status)
+	}
+	var reply struct {
+		Items []struct {
+			Raw struct {
+				To   []string `json:"To"`
+				Data string   `json:"Data"`
+			} `json:"Raw"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("Could not decode the reply of Mailhog: %v", err)
+	}
+	mails := make([]Mail, 0, len(reply.Items))
+	for _, it := range reply.Items {
+		mails = append(mails, Mail{To: strings.Join(it.Raw.To, ", "), Raw: it.Raw.Data})
+	}
+	return mails, nil
+}
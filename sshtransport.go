@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// the algorithms implemented by the SSH server, which SSH_KEX_ALGORITHMS,
+// SSH_CIPHERS and SSH_MACS may choose from
+var (
+	supportedKexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	supportedCiphers = []string{
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// minClientVersion is an entry of SSH_MIN_CLIENT_VERSIONS, such as
+// OpenSSH_8.0: clients identifying as the given software are refused when
+// their version is older.
+type minClientVersion struct {
+	software string
+	version  []int
+}
+
+var minClientVersions reloadable[[]minClientVersion]
+
+// validateTransport checks the SSH_* algorithm lists and parses
+// SSH_MIN_CLIENT_VERSIONS.
+func validateTransport() error {
+	for _, l := range []struct {
+		name      string
+		values    []string
+		supported []string
+	}{
+		{"SSH_KEX_ALGORITHMS", options().SSHKexAlgorithms, supportedKexAlgorithms},
+		{"SSH_CIPHERS", options().SSHCiphers, supportedCiphers},
+		{"SSH_MACS", options().SSHMACs, supportedMACs},
+	} {
+		for _, v := range l.values {
+			if !contains(l.supported, v) {
+				return fmt.Errorf("Unsupported algorithm %q in %s, expected some of %s", v, l.name, strings.Join(l.supported, ", "))
+			}
+		}
+	}
+
+	var mins []minClientVersion
+	for _, entry := range options().SSHMinClientVersions {
+		software, version := splitSoftware(strings.TrimSpace(entry))
+		v := parseClientVersion(version)
+		if software == "" || v == nil {
+			return fmt.Errorf("Invalid SSH_MIN_CLIENT_VERSIONS entry %q, expected software_version such as OpenSSH_8.0", entry)
+		}
+		mins = append(mins, minClientVersion{software: software, version: v})
+	}
+	minClientVersions.set(mins)
+	return nil
+}
+
+// serverConfig restricts the algorithms negotiated by every connection to the
+// configured ones. Empty lists keep the defaults of the SSH library.
+func serverConfig(ssh.Context) *gossh.ServerConfig {
+	cfg := &gossh.ServerConfig{}
+	cfg.KeyExchanges = options().SSHKexAlgorithms
+	cfg.Ciphers = options().SSHCiphers
+	cfg.MACs = options().SSHMACs
+	return cfg
+}
+
+// splitSoftware splits an identification such as PuTTY_Release_0.78 at its
+// last underscore, into the software and its version.
+func splitSoftware(ident string) (string, string) {
+	i := strings.LastIndex(ident, "_")
+	if i < 0 {
+		return ident, ""
+	}
+	return ident[:i], ident[i+1:]
+}
+
+// parseClientVersion parses the leading dotted numbers of a version, such as
+// 8.9 from 8.9p1, returning nil if there are none.
+func parseClientVersion(s string) []int {
+	var v []int
+	for _, part := range strings.Split(s, ".") {
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			break
+		}
+		v = append(v, n)
+		if end < len(part) {
+			break
+		}
+	}
+	return v
+}
+
+func olderVersion(a, b []int) bool {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// clientAllowed tells whether a client, identified by its version string
+// such as SSH-2.0-OpenSSH_8.9p1 Ubuntu-3, passes SSH_MIN_CLIENT_VERSIONS.
+// Clients running software which isn't listed are always allowed.
+func clientAllowed(clientVersion string) bool {
+	ident := strings.TrimPrefix(clientVersion, "SSH-2.0-")
+	ident, _, _ = strings.Cut(ident, " ")
+	software, version := splitSoftware(ident)
+	for _, m := range minClientVersions.get() {
+		if !strings.EqualFold(software, m.software) {
+			continue
+		}
+		v := parseClientVersion(version)
+		if v == nil || olderVersion(v, m.version) {
+			return false
+		}
+	}
+	return true
+}
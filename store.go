@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pendingToken is a token that has been mailed to a user and not yet used.
+type pendingToken struct {
+	User      string    `json:"user"`
+	Mail      string    `json:"mail"`
+	IP        string    `json:"ip"`
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// number of wrong tokens entered so far, across all connections
+	Attempts int `json:"attempts"`
+	// whether the link of TOKEN_DELIVERY=link was followed
+	Confirmed bool `json:"confirmed,omitempty"`
+	// the fingerprint of the key of the client the token was issued to, for
+	// TOKEN_BINDING
+	Key string `json:"key,omitempty"`
+}
+
+// pendingStore remembers the tokens issued to users until they expire, so
+// that a user reconnecting within the token lifetime can resume the flow
+// without receiving another mail. With the redis store, the ban list and the
+// per-IP session counters are shared through the same server, so that several
+// instances can run behind a load balancer.
+type pendingStore interface {
+	// Put stores t, replacing any pending token for the same user.
+	Put(ctx context.Context, t pendingToken) error
+	// Get returns the pending token for user, if it exists and has not expired.
+	Get(ctx context.Context, user string) (pendingToken, bool, error)
+	// Remove drops the pending token for user, reporting whether there was one.
+	Remove(ctx context.Context, user string) (bool, error)
+	// Confirm atomically marks the pending token for user as confirmed,
+	// leaving its counters alone, reporting whether there was one.
+	Confirm(ctx context.Context, user string) (bool, error)
+	// List returns all the pending tokens, sorted by expiry.
+	List(ctx context.Context) ([]pendingToken, error)
+	// Fail atomically records a wrong token entered for user from ip,
+	// returning the number of failures in total and from that address. The
+	// counters are reset when a new token is Put.
+	Fail(ctx context.Context, user, ip string) (total, fromIP int, err error)
+	// Failures returns the counters of Fail without changing them.
+	Failures(ctx context.Context, user, ip string) (total, fromIP int, err error)
+
+	// Lock prevents user from starting a new flow until the given time.
+	Lock(ctx context.Context, user string, until time.Time) error
+	// LockedUntil returns when the lock on user expires, if it is locked.
+	LockedUntil(ctx context.Context, user string) (time.Time, bool, error)
+
+	// MarkIncomplete records that a failed registration left an entry for
+	// user in the directory, for the janitor to clean it up.
+	MarkIncomplete(ctx context.Context, user string, at time.Time) error
+	// ClearIncomplete drops the record of MarkIncomplete.
+	ClearIncomplete(ctx context.Context, user string) error
+	// ListIncomplete returns the users marked as incomplete, along with
+	// when they were marked.
+	ListIncomplete(ctx context.Context) (map[string]time.Time, error)
+
+	// Purge drops the tokens and the locks which expired before the given
+	// time, with their counters, returning how many were dropped.
+	Purge(ctx context.Context, before time.Time) (int, error)
+	// Forget drops everything stored about user: the pending token, the
+	// counters, the lock and the incomplete mark.
+	Forget(ctx context.Context, user string) error
+}
+
+// tokenCheck is the outcome of checking a token with verifyPending.
+type tokenCheck struct {
+	// Found is false when there is no pending token, or it expired
+	Found bool
+	Valid bool
+	// Unbound is true when the token is right, but entered by another
+	// client than the one it is bound to; it is recorded as a failure
+	Unbound bool
+	// the failures recorded so far, in total and from the address, when
+	// the token is wrong
+	Total, FromIP int
+}
+
+// verifyPending checks the token entered by user from c against the pending
+// one, recording the failure from its address when it doesn't match or the
+// token is bound to another client. It is the one place
+// where tokens are checked, so that expiry and the accounting of the attempts
+// behave the same with every store. A valid token is kept until claimPending,
+// so that a user disconnecting before the registration is complete can
+// reconnect and enter it again, instead of waiting for another mail.
+func verifyPending(ctx context.Context, store pendingStore, user string, c tokenClient, input string) (tokenCheck, error) {
+	t, ok, err := pendingFor(ctx, store, user, input)
+	if err != nil || !ok {
+		return tokenCheck{}, err
+	}
+	matches := tokenMatches(input, t.Token)
+	if matches && c.redeems(t) {
+		return tokenCheck{Found: true, Valid: true}, nil
+	}
+	total, fromIP, err := store.Fail(ctx, user, c.IP)
+	if err != nil {
+		return tokenCheck{}, err
+	}
+	return tokenCheck{Found: true, Unbound: matches, Total: total, FromIP: fromIP}, nil
+}
+
+// claimPending removes the verified token of user as the registration
+// starts, so that two sessions entering the same token can't both register.
+// It reports false when the token is gone, claimed by another session or
+// revoked, and returns it for the registrations failing to put it back.
+func claimPending(ctx context.Context, store pendingStore, user string) (pendingToken, bool, error) {
+	t, ok, err := store.Get(ctx, user)
+	if err != nil || !ok {
+		return pendingToken{}, false, err
+	}
+	if ok, err = store.Remove(ctx, user); err != nil || !ok {
+		return pendingToken{}, false, err
+	}
+	return t, true, nil
+}
+
+// confirmPending marks the pending token of user as confirmed through the
+// link it was mailed in, for the session waiting for it to proceed.
+func confirmPending(ctx context.Context, store pendingStore, user string) error {
+	_, err := store.Confirm(ctx, user)
+	return err
+}
+
+func newPendingStore() (pendingStore, error) {
+	switch options().Store {
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return newSQLiteStore(options().StoreSQLitePath)
+	case "redis":
+		return newRedisStore(options().RedisURL)
+	default:
+		return nil, fmt.Errorf("Unknown STORE %q, expected one of memory, sqlite or redis", options().Store)
+	}
+}
+
+func sortByExpiry(res []pendingToken) {
+	sort.Slice(res, func(i, j int) bool { return res[i].ExpiresAt.Before(res[j].ExpiresAt) })
+}
+
+// memoryStore keeps the pending tokens in memory, so they are lost when the
+// process restarts.
+type memoryStore struct {
+	mu       sync.Mutex
+	tokens   map[string]pendingToken
+	attempts map[string]map[string]int
+	locks    map[string]time.Time
+	// the incomplete entries, by user
+	incomplete map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{tokens: map[string]pendingToken{}, attempts: map[string]map[string]int{}, locks: map[string]time.Time{}, incomplete: map[string]time.Time{}}
+}
+
+func (m *memoryStore) Put(_ context.Context, t pendingToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[t.User] = t
+	delete(m.attempts, t.User)
+	return nil
+}
+
+func (m *memoryStore) Fail(_ context.Context, user, ip string) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[user]
+	if !ok {
+		return 0, 0, nil
+	}
+	t.Attempts++
+	m.tokens[user] = t
+	if m.attempts[user] == nil {
+		m.attempts[user] = map[string]int{}
+	}
+	m.attempts[user][ip]++
+	return t.Attempts, m.attempts[user][ip], nil
+}
+
+func (m *memoryStore) Failures(_ context.Context, user, ip string) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tokens[user].Attempts, m.attempts[user][ip], nil
+}
+
+func (m *memoryStore) Get(_ context.Context, user string) (pendingToken, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[user]
+	if ok && clockNow().After(t.ExpiresAt) {
+		delete(m.tokens, user)
+		return pendingToken{}, false, nil
+	}
+	return t, ok, nil
+}
+
+func (m *memoryStore) Remove(_ context.Context, user string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.tokens[user]
+	delete(m.tokens, user)
+	delete(m.attempts, user)
+	return ok, nil
+}
+
+func (m *memoryStore) Confirm(_ context.Context, user string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[user]
+	if !ok || clockNow().After(t.ExpiresAt) {
+		return false, nil
+	}
+	t.Confirmed = true
+	m.tokens[user] = t
+	return true, nil
+}
+
+func (m *memoryStore) List(_ context.Context) ([]pendingToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]pendingToken, 0, len(m.tokens))
+	now := clockNow()
+	for user, t := range m.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(m.tokens, user)
+			delete(m.attempts, user)
+			continue
+		}
+		res = append(res, t)
+	}
+	sortByExpiry(res)
+	return res, nil
+}
+
+func (m *memoryStore) Lock(_ context.Context, user string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks[user] = until
+	return nil
+}
+
+func (m *memoryStore) LockedUntil(_ context.Context, user string) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.locks[user]
+	if ok && clockNow().After(until) {
+		delete(m.locks, user)
+		return time.Time{}, false, nil
+	}
+	return until, ok, nil
+}
+
+func (m *memoryStore) MarkIncomplete(_ context.Context, user string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.incomplete[user] = at
+	return nil
+}
+
+func (m *memoryStore) ClearIncomplete(_ context.Context, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.incomplete, user)
+	return nil
+}
+
+func (m *memoryStore) ListIncomplete(_ context.Context) (map[string]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]time.Time, len(m.incomplete))
+	for user, at := range m.incomplete {
+		res[user] = at
+	}
+	return res, nil
+}
+
+func (m *memoryStore) Purge(_ context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for user, t := range m.tokens {
+		if t.ExpiresAt.Before(before) {
+			delete(m.tokens, user)
+			delete(m.attempts, user)
+			n++
+		}
+	}
+	for user, until := range m.locks {
+		if until.Before(before) {
+			delete(m.locks, user)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) Forget(_ context.Context, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, user)
+	delete(m.attempts, user)
+	delete(m.locks, user)
+	delete(m.incomplete, user)
+	return nil
+}
+
+// registration records a successfully completed registration.
+type registration struct {
+	User string    `json:"user"`
+	Mail string    `json:"mail"`
+	IP   string    `json:"ip"`
+	Time time.Time `json:"time"`
+	// Trusted is set when the address wasn't verified, the user connecting
+	// from TRUSTED_CIDRS
+	Trusted bool `json:"trusted,omitempty"`
+	// the connection the user registered from, or Web when they used the
+	// web form
+	Conn connMeta `json:"connection"`
+	Web  bool     `json:"web,omitempty"`
+	// Disabled is set while an admin has the account disabled, see
+	// softdelete.go
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// registrationLog keeps the most recent registrations in memory.
+type registrationLog struct {
+	mu      sync.Mutex
+	size    int
+	entries []registration
+}
+
+func newRegistrationLog(size int) *registrationLog {
+	return &registrationLog{size: size}
+}
+
+func (l *registrationLog) add(r registration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, r)
+	if len(l.entries) > l.size {
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+}
+
+// purge drops the registrations made before the given time, returning how
+// many were dropped.
+func (l *registrationLog) purge(before time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := 0
+	for i < len(l.entries) && l.entries[i].Time.Before(before) {
+		i++
+	}
+	l.entries = l.entries[i:]
+	return i
+}
+
+// forget drops the registrations of user, returning how many were dropped.
+func (l *registrationLog) forget(user string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.entries[:0]
+	for _, r := range l.entries {
+		if r.User != user {
+			kept = append(kept, r)
+		}
+	}
+	n := len(l.entries) - len(kept)
+	l.entries = kept
+	return n
+}
+
+// setDisabled marks the registrations of user as disabled, or not.
+func (l *registrationLog) setDisabled(user string, disabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.entries {
+		if l.entries[i].User == user {
+			l.entries[i].Disabled = disabled
+		}
+	}
+}
+
+// list returns the recorded registrations, most recent first.
+func (l *registrationLog) list() []registration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	res := make([]registration, len(l.entries))
+	for i, r := range l.entries {
+		res[len(res)-1-i] = r
+	}
+	return res
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisPendingPrefix = "sshauth:pending:"
+	redisLockPrefix    = "sshauth:lock:"
+	// a hash of the incomplete entries, with the time they were marked
+	redisIncompleteKey = "sshauth:incomplete"
+	// hashes holding the failure counters of each pending token, with a
+	// "total" field and an "ip:<address>" field per address
+	redisAttemptsPrefix = "sshauth:attempts:"
+)
+
+// redisStore keeps the pending tokens in Redis, relying on key expiry to
+// drop the stale ones.
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(uri string) (*redisStore, error) {
+	opts, err := redis.ParseURL(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid REDIS_URL: %v", err)
+	}
+	return &redisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (r *redisStore) Put(ctx context.Context, t pendingToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	ttl := clockUntil(t.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, redisPendingPrefix+t.User, data, ttl)
+	pipe.Del(ctx, redisAttemptsPrefix+t.User)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisStore) Fail(ctx context.Context, user, ip string) (int, int, error) {
+	key := redisAttemptsPrefix + user
+	pipe := r.client.TxPipeline()
+	total := pipe.HIncrBy(ctx, key, "total", 1)
+	fromIP := pipe.HIncrBy(ctx, key, "ip:"+ip, 1)
+	pipe.Expire(ctx, key, options().TokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+	return int(total.Val()), int(fromIP.Val()), nil
+}
+
+func (r *redisStore) Failures(ctx context.Context, user, ip string) (int, int, error) {
+	vals, err := r.client.HMGet(ctx, redisAttemptsPrefix+user, "total", "ip:"+ip).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	var n [2]int
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			n[i], _ = strconv.Atoi(s)
+		}
+	}
+	return n[0], n[1], nil
+}
+
+func (r *redisStore) Get(ctx context.Context, user string) (pendingToken, bool, error) {
+	var t pendingToken
+	data, err := r.client.Get(ctx, redisPendingPrefix+user).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return t, false, nil
+	} else if err != nil {
+		return t, false, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, false, err
+	}
+	if n, err := r.client.HGet(ctx, redisAttemptsPrefix+user, "total").Int(); err == nil {
+		t.Attempts = n
+	} else if !errors.Is(err, redis.Nil) {
+		return t, false, err
+	}
+	return t, clockNow().Before(t.ExpiresAt), nil
+}
+
+func (r *redisStore) Remove(ctx context.Context, user string) (bool, error) {
+	n, err := r.client.Del(ctx, redisPendingPrefix+user, redisAttemptsPrefix+user).Result()
+	return n > 0, err
+}
+
+func (r *redisStore) Confirm(ctx context.Context, user string) (bool, error) {
+	key := redisPendingPrefix + user
+	for {
+		confirmed := false
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			var t pendingToken
+			if err := json.Unmarshal(data, &t); err != nil {
+				return err
+			}
+			t.Confirmed = true
+			if data, err = json.Marshal(t); err != nil {
+				return err
+			}
+			// the attempts are kept under their own key, untouched here
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(ctx, key, data, redis.SetArgs{Mode: "XX", KeepTTL: true})
+				return nil
+			})
+			if errors.Is(err, redis.Nil) {
+				// expired in the meantime
+				return nil
+			}
+			confirmed = err == nil
+			return err
+		}, key)
+		// the token changed under the watch: read it again
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return confirmed, err
+	}
+}
+
+func (r *redisStore) List(ctx context.Context) ([]pendingToken, error) {
+	res := []pendingToken{}
+	iter := r.client.Scan(ctx, 0, redisPendingPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		t, ok, err := r.Get(ctx, iter.Val()[len(redisPendingPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, t)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sortByExpiry(res)
+	return res, nil
+}
+
+func (r *redisStore) Lock(ctx context.Context, user string, until time.Time) error {
+	ttl := clockUntil(until)
+	if ttl <= 0 {
+		return nil
+	}
+	return r.client.Set(ctx, redisLockPrefix+user, until.Unix(), ttl).Err()
+}
+
+func (r *redisStore) LockedUntil(ctx context.Context, user string) (time.Time, bool, error) {
+	until, err := r.client.Get(ctx, redisLockPrefix+user).Int64()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(until, 0), true, nil
+}
+
+// Purge has nothing to do, the tokens, the counters and the locks expiring
+// with their keys.
+func (r *redisStore) Purge(context.Context, time.Time) (int, error) {
+	return 0, nil
+}
+
+func (r *redisStore) Forget(ctx context.Context, user string) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, redisPendingPrefix+user, redisAttemptsPrefix+user, redisLockPrefix+user)
+	pipe.HDel(ctx, redisIncompleteKey, user)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisStore) MarkIncomplete(ctx context.Context, user string, at time.Time) error {
+	return r.client.HSet(ctx, redisIncompleteKey, user, at.Unix()).Err()
+}
+
+func (r *redisStore) ClearIncomplete(ctx context.Context, user string) error {
+	return r.client.HDel(ctx, redisIncompleteKey, user).Err()
+}
+
+func (r *redisStore) ListIncomplete(ctx context.Context) (map[string]time.Time, error) {
+	all, err := r.client.HGetAll(ctx, redisIncompleteKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]time.Time, len(all))
+	for user, v := range all {
+		at, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid time %q for the incomplete entry of %s", v, user)
+		}
+		res[user] = time.Unix(at, 0)
+	}
+	return res, nil
+}
@@ -0,0 +1,256 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS pending (
+	user TEXT PRIMARY KEY,
+	mail TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	token TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS token_attempts (
+	user TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (user, ip)
+);
+CREATE TABLE IF NOT EXISTS locks (
+	user TEXT PRIMARY KEY,
+	until INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS incomplete (
+	user TEXT PRIMARY KEY,
+	since INTEGER NOT NULL
+)`
+
+// sqliteStore persists the pending tokens in a local SQLite database, so
+// they survive restarts of a single instance.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (pendingStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the SQLite store at %s: %v", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not create the SQLite schema: %v", err)
+	}
+	// added after the first release, fail when the columns exist already
+	for _, column := range []string{"attempts INTEGER NOT NULL DEFAULT 0", "confirmed INTEGER NOT NULL DEFAULT 0", "client_key TEXT NOT NULL DEFAULT ''"} {
+		if _, err := db.Exec(`ALTER TABLE pending ADD COLUMN ` + column); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("Could not update the SQLite schema: %v", err)
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Put(ctx context.Context, t pendingToken) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT OR REPLACE INTO pending (user, mail, ip, token, expires_at, attempts, confirmed, client_key) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.User, t.Mail, t.IP, t.Token, t.ExpiresAt.Unix(), t.Attempts, t.Confirmed, t.Key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM token_attempts WHERE user = ?`, t.User); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Fail(ctx context.Context, user, ip string) (total, fromIP int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, `UPDATE pending SET attempts = attempts + 1 WHERE user = ?`, user); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx,
+		`INSERT INTO token_attempts (user, ip, count) VALUES (?, ?, 1) ON CONFLICT (user, ip) DO UPDATE SET count = count + 1`,
+		user, ip); err != nil {
+		return
+	}
+	if err = tx.QueryRowContext(ctx,
+		`SELECT p.attempts, a.count FROM pending p JOIN token_attempts a ON a.user = p.user WHERE p.user = ? AND a.ip = ?`,
+		user, ip).Scan(&total, &fromIP); errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	} else if err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+func (s *sqliteStore) Failures(ctx context.Context, user, ip string) (total, fromIP int, err error) {
+	err = s.db.QueryRowContext(ctx,
+		`SELECT COALESCE((SELECT attempts FROM pending WHERE user = ?), 0), COALESCE((SELECT count FROM token_attempts WHERE user = ? AND ip = ?), 0)`,
+		user, user, ip).Scan(&total, &fromIP)
+	return
+}
+
+func (s *sqliteStore) Get(ctx context.Context, user string) (pendingToken, bool, error) {
+	t := pendingToken{User: user}
+	var expires int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT mail, ip, token, expires_at, attempts, confirmed, client_key FROM pending WHERE user = ? AND expires_at > ?`,
+		user, clockNow().Unix()).Scan(&t.Mail, &t.IP, &t.Token, &expires, &t.Attempts, &t.Confirmed, &t.Key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pendingToken{}, false, nil
+	} else if err != nil {
+		return pendingToken{}, false, err
+	}
+	t.ExpiresAt = time.Unix(expires, 0)
+	return t, true, nil
+}
+
+func (s *sqliteStore) Remove(ctx context.Context, user string) (bool, error) {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM token_attempts WHERE user = ?`, user); err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM pending WHERE user = ?`, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) Confirm(ctx context.Context, user string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE pending SET confirmed = 1 WHERE user = ? AND expires_at > ?`, user, clockNow().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) List(ctx context.Context) ([]pendingToken, error) {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM pending WHERE expires_at <= ?`, clockNow().Unix()); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT user, mail, ip, token, expires_at, attempts, confirmed, client_key FROM pending ORDER BY expires_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []pendingToken{}
+	for rows.Next() {
+		var t pendingToken
+		var expires int64
+		if err := rows.Scan(&t.User, &t.Mail, &t.IP, &t.Token, &expires, &t.Attempts, &t.Confirmed, &t.Key); err != nil {
+			return nil, err
+		}
+		t.ExpiresAt = time.Unix(expires, 0)
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteStore) Lock(ctx context.Context, user string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO locks (user, until) VALUES (?, ?)`, user, until.Unix())
+	return err
+}
+
+func (s *sqliteStore) LockedUntil(ctx context.Context, user string) (time.Time, bool, error) {
+	var until int64
+	err := s.db.QueryRowContext(ctx, `SELECT until FROM locks WHERE user = ? AND until > ?`, user, clockNow().Unix()).Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(until, 0), true, nil
+}
+
+func (s *sqliteStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM token_attempts WHERE user IN (SELECT user FROM pending WHERE expires_at < ?)`, before.Unix()); err != nil {
+		return 0, err
+	}
+	n := int64(0)
+	for _, q := range []string{`DELETE FROM pending WHERE expires_at < ?`, `DELETE FROM locks WHERE until < ?`} {
+		res, err := tx.ExecContext(ctx, q, before.Unix())
+		if err != nil {
+			return 0, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		n += rows
+	}
+	// the counters left behind by tokens already gone
+	if _, err := tx.ExecContext(ctx, `DELETE FROM token_attempts WHERE user NOT IN (SELECT user FROM pending)`); err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+func (s *sqliteStore) Forget(ctx context.Context, user string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"pending", "token_attempts", "locks", "incomplete"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user = ?`, user); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) MarkIncomplete(ctx context.Context, user string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO incomplete (user, since) VALUES (?, ?)`, user, at.Unix())
+	return err
+}
+
+func (s *sqliteStore) ClearIncomplete(ctx context.Context, user string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM incomplete WHERE user = ?`, user)
+	return err
+}
+
+func (s *sqliteStore) ListIncomplete(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user, since FROM incomplete`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[string]time.Time{}
+	for rows.Next() {
+		var user string
+		var since int64
+		if err := rows.Scan(&user, &since); err != nil {
+			return nil, err
+		}
+		res[user] = time.Unix(since, 0)
+	}
+	return res, rows.Err()
+}
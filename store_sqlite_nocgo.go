@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+
+func newSQLiteStore(path string) (pendingStore, error) {
+	return nil, errors.New("The SQLite store requires a build with cgo enabled")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// stubDirectory is implemented by the backends able to complete accounts
+// provisioned beforehand, disabled, such as the ones imported from HR.
+type stubDirectory interface {
+	// Stub reports whether user is a stub waiting to be completed, along
+	// with the address on file, if any.
+	Stub(ctx context.Context, user string) (bool, string, error)
+	// Complete sets the address and the password of a stub and enables it.
+	Complete(ctx context.Context, user, mail, password string) error
+}
+
+// adDisabledFilter matches the Active Directory accounts with the
+// ACCOUNTDISABLE flag set in userAccountControl.
+const adDisabledFilter = "(userAccountControl:1.2.840.113556.1.4.803:=2)"
+
+// validateRegistrationMode checks REGISTRATION_MODE and, for the complete
+// mode, the options telling the stubs apart.
+func validateRegistrationMode() error {
+	switch options().RegistrationMode {
+	case "create":
+		return nil
+	case "complete":
+	default:
+		return fmt.Errorf("Unknown REGISTRATION_MODE %q, expected one of create or complete", options().RegistrationMode)
+	}
+	switch options().DirectoryBackend {
+	case "keycloak", "scim":
+		return nil
+	case "ldap":
+	default:
+		return fmt.Errorf("REGISTRATION_MODE=complete is not supported by the %s directory backend", options().DirectoryBackend)
+	}
+	if options().DirectoryType != "ad" && options().LdapStubFilter == "" {
+		return fmt.Errorf("LDAP_STUB_FILTER must be set to tell the stub accounts apart with REGISTRATION_MODE=complete")
+	}
+	if _, err := ldap.CompileFilter(stubFilter()); err != nil {
+		return fmt.Errorf("Invalid LDAP_STUB_FILTER: %v", err)
+	}
+	for _, c := range options().LdapStubEnable {
+		if attr, _, ok := strings.Cut(c, "="); !ok || attr == "" {
+			return fmt.Errorf("Invalid LDAP_STUB_ENABLE change %q, expected attribute=value", c)
+		}
+	}
+	return nil
+}
+
+// stubFilter is LDAP_STUB_FILTER, or the default of the DIRECTORY_TYPE.
+func stubFilter() string {
+	if options().LdapStubFilter == "" && options().DirectoryType == "ad" {
+		return adDisabledFilter
+	}
+	return options().LdapStubFilter
+}
+
+// lookupAccount tells whether user is registered or, with
+// REGISTRATION_MODE=complete, a stub waiting to be completed, in which case
+// the address on file is returned as well. Stubs are not registered.
+func lookupAccount(ctx context.Context, dir directory, user string) (registered, stub bool, mail string, err error) {
+	if options().RegistrationMode == "complete" {
+		sd, ok := dir.(stubDirectory)
+		if !ok {
+			return false, false, "", fmt.Errorf("The directory backend can't complete stub accounts")
+		}
+		if stub, mail, err = sd.Stub(ctx, user); err != nil || stub {
+			if err != nil {
+				countFailure(failDirectoryError)
+			}
+			return false, stub, mail, err
+		}
+	}
+	if registered, err = dir.Exists(ctx, user); err != nil {
+		countFailure(failDirectoryError)
+	}
+	return registered, false, "", err
+}
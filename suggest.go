@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// suggestUsernames returns up to USERNAME_SUGGESTIONS usernames still free
+// for someone whose username is taken, likely by someone else: the one
+// before the @ of their address, user.surname when it reads name.surname,
+// then user2, user3 and so on. There are none with REGISTRATION_MODE=complete,
+// where the usernames are provisioned, nor with ENUMERATION_PROTECTION.
+func suggestUsernames(ctx context.Context, dir directory, user, mail string) []string {
+	if options().UsernameSuggestions <= 0 || options().RegistrationMode != "create" || options().EnumerationProtection {
+		return nil
+	}
+	var candidates []string
+	if local, _, ok := strings.Cut(mail, "@"); ok && local != "" {
+		candidates = append(candidates, local)
+		if _, surname, ok := strings.Cut(local, "."); ok && surname != "" {
+			candidates = append(candidates, user+"."+surname)
+		}
+	}
+	for i := 2; i <= 9; i++ {
+		candidates = append(candidates, fmt.Sprintf("%s%d", user, i))
+	}
+	var free []string
+	for _, c := range candidates {
+		c, err := normalizeUsername(c)
+		if err != nil || c == user || contains(free, c) || c == options().AdminSSHUser || sensitiveUsername(c) {
+			continue
+		}
+		exists, err := dir.Exists(ctx, c)
+		if err != nil {
+			logWarn("Could not look up the username %s to suggest: %v", c, err)
+			return free
+		}
+		if !exists {
+			if free = append(free, c); len(free) == options().UsernameSuggestions {
+				break
+			}
+		}
+	}
+	return free
+}
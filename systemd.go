@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state update to the systemd service manager. It does
+// nothing when the process is not supervised by systemd.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// abstract namespace sockets are advertised with a leading @
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects a keep-alive ping, or
+// zero if the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings systemd at half the requested interval, as recommended by
+// sd_watchdog_enabled(3).
+func watchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval / 2) {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logError("Could not notify the systemd watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tarpit slows down the addresses which would otherwise be banned, when
+// BAN_MODE is tarpit: their connections are accepted, but every write is
+// delayed, and the delay doubles with each new connection made while the
+// ban lasts. Bots spraying credentials waste their time instead of moving on
+// to the next address right away.
+type tarpit struct {
+	mu     sync.Mutex
+	levels map[string]int
+}
+
+var tarpits = &tarpit{levels: map[string]int{}}
+
+// delay returns the delay for a new connection from ip, raising its level.
+func (t *tarpit) delay(ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.levels[ip]++
+	d := options().TarpitDelay
+	for i := 1; i < t.levels[ip] && d < options().TarpitMaxDelay; i++ {
+		d *= 2
+	}
+	if d > options().TarpitMaxDelay {
+		d = options().TarpitMaxDelay
+	}
+	return d
+}
+
+// forget resets the level of an address which is no longer banned.
+func (t *tarpit) forget(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.levels, ip)
+}
+
+// tarpitConn delays every write by a fixed amount.
+type tarpitConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *tarpitConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// validateNewlines checks the NEWLINES option.
+func validateNewlines() error {
+	switch options().Newlines {
+	case "auto", "crlf", "lf":
+		return nil
+	default:
+		return fmt.Errorf("Unknown NEWLINES %q, expected one of auto, crlf or lf", options().Newlines)
+	}
+}
+
+// terminal normalizes the line endings written to a client. The messages
+// end their lines with \n alone: clients with a PTY put their terminal in raw
+// mode and need \r\n, or the lines are stair-stepped, while the others print
+// the output as is, where a \r is at best useless.
+type terminal struct {
+	w    io.Writer
+	crlf bool
+	// whether the last byte written ended a line, so that the \r of a \n\r
+	// split across writes is dropped
+	newline bool
+}
+
+// newTerminal wraps the output of s. With the default NEWLINES=auto, lines
+// end with \r\n for the clients with a PTY and with \n for the others.
+func newTerminal(s ssh.Session) *terminal {
+	crlf := options().Newlines == "crlf"
+	if options().Newlines == "auto" {
+		_, _, crlf = s.Pty()
+	}
+	return &terminal{w: s, crlf: crlf}
+}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+len(p)/16)
+	for i, b := range p {
+		switch {
+		case b == '\r' && (i+1 < len(p) && p[i+1] == '\n' || t.newline):
+			// part of a line ending
+			t.newline = false
+			continue
+		case b == '\n' && t.crlf:
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, b)
+		}
+		t.newline = b == '\n'
+	}
+	if _, err := t.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// bracketedPaste turns the bracketed paste mode of the client terminal on or
+// off, for readN to tell pasted input apart from typed input.
+func (s *session) bracketedPaste(on bool) {
+	if _, _, isPty := s.Pty(); !isPty || s.jsonLines || s.plain {
+		return
+	}
+	if on {
+		io.WriteString(s, "\x1b[?2004h")
+	} else {
+		io.WriteString(s, "\x1b[?2004l")
+	}
+}
+
+// term returns the terminal of the session.
+func (s *session) term() *terminal {
+	if s.out == nil {
+		s.out = newTerminal(s.Session)
+	}
+	return s.out
+}
+
+// Write writes the output of the session through its terminal, or as
+// messages in the JSON mode.
+func (s *session) Write(p []byte) (int, error) {
+	if s.jsonLines {
+		writeJSONEvent(s.Session, jsonEvent{Type: "message", Text: string(p)})
+		return len(p), nil
+	}
+	return s.term().Write(p)
+}
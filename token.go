@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// extra room left in the token prompt for stray whitespace around the token
+const tokenInputSlack = 8
+
+// the size of each group in grouped tokens, such as ABC-DEF
+const tokenGroupSize = 3
+
+var (
+	upperRunes   = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
+	numericRunes = []rune("0123456789")
+
+	//go:embed wordlist.txt
+	wordlist   string
+	tokenWords = strings.Fields(wordlist)
+)
+
+// validateTokenFormat checks the TOKEN_FORMAT option.
+func validateTokenFormat() error {
+	switch options().TokenFormat {
+	case "alnum", "numeric", "grouped", "words":
+		return nil
+	case "signed":
+		return validateSignedTokens()
+	default:
+		return fmt.Errorf("Unknown TOKEN_FORMAT %q, expected one of alnum, numeric, grouped, words or signed", options().TokenFormat)
+	}
+}
+
+func randomRunes(alphabet []rune, n uint) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = alphabet[tokenRand.get().Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// newToken generates a new token in the configured format. TOKEN_LENGTH is
+// the number of characters, or the number of words for word tokens.
+// Case-insensitive tokens only use upper case letters, so that no entropy is
+// lost when comparing them case-folded. TOKEN_SEQUENCE overrides them all.
+func newToken() string {
+	if t, ok := sequenceToken(); ok {
+		return t
+	}
+	switch options().TokenFormat {
+	case "numeric":
+		return randomRunes(numericRunes, options().TokenLength)
+
+	case "grouped":
+		t := randomRunes(upperRunes, options().TokenLength)
+		var groups []string
+		for len(t) > tokenGroupSize {
+			groups = append(groups, t[:tokenGroupSize])
+			t = t[tokenGroupSize:]
+		}
+		return strings.Join(append(groups, t), "-")
+
+	case "words":
+		words := make([]string, options().TokenLength)
+		for i := range words {
+			words[i] = tokenWords[tokenRand.get().Intn(len(tokenWords))]
+		}
+		return strings.Join(words, "-")
+
+	default:
+		if options().TokenCaseInsensitive {
+			return randomRunes(upperRunes, options().TokenLength)
+		}
+		return randomString(options().TokenLength)
+	}
+}
+
+// issueToken generates the token of user, mailed to mail and expiring at
+// expires: a new one from newToken or, with TOKEN_FORMAT=signed, one
+// carrying them all.
+func issueToken(user, mail string, expires time.Time) string {
+	if options().TokenFormat == "signed" {
+		return signToken(user, mail, expires)
+	}
+	return newToken()
+}
+
+// tokenInputLength returns how many characters the token prompt accepts.
+func tokenInputLength() uint {
+	switch options().TokenFormat {
+	case "grouped":
+		return options().TokenLength + options().TokenLength/tokenGroupSize + tokenInputSlack
+	case "words":
+		longest := 0
+		for _, w := range tokenWords {
+			if len(w) > longest {
+				longest = len(w)
+			}
+		}
+		return options().TokenLength*uint(longest+1) + tokenInputSlack
+	case "signed":
+		return uint(maxSignedToken) + tokenInputSlack
+	default:
+		return options().TokenLength + tokenInputSlack
+	}
+}
+
+// tokenMatches compares the token entered by the user with the expected one
+// in constant time.
+func tokenMatches(input, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(normalizeToken(input)), []byte(normalizeToken(token))) == 1
+}
+
+// normalizeToken strips any whitespace and group separators from a token and,
+// for case-insensitive tokens, folds it to upper case.
+func normalizeToken(t string) string {
+	t = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' {
+			return -1
+		}
+		return r
+	}, t)
+	if options().TokenCaseInsensitive {
+		t = strings.ToUpper(t)
+	}
+	return t
+}
@@ -0,0 +1,65 @@
+package main
+
+import "fmt"
+
+// validateTokenBinding checks the TOKEN_BINDING option.
+func validateTokenBinding() error {
+	switch options().TokenBinding {
+	case "none", "ip", "key", "strict":
+		return nil
+	default:
+		return fmt.Errorf("Unknown TOKEN_BINDING %q, expected one of none, ip, key or strict", options().TokenBinding)
+	}
+}
+
+// keyBinding reports whether the tokens are bound to the client keys, which
+// are then asked for on authentication.
+func keyBinding() bool {
+	return options().TokenBinding == "key" || options().TokenBinding == "strict"
+}
+
+// tokenClient is the client entering a token: its address and the SHA256
+// fingerprint of its key, empty for the clients without one, such as the
+// web form.
+type tokenClient struct {
+	IP, Key string
+	// whether the client is following a confirmation link, which may be
+	// opened anywhere: the binding is checked by the session waiting for it
+	link bool
+}
+
+// client returns the tokenClient of the session.
+func (s *session) client() tokenClient {
+	c := tokenClient{IP: s.ip}
+	if s.Session != nil {
+		// the key the client authenticated with, rather than the last one
+		// it offered
+		c.Key = authExtension(s.Context(), extensionKey)
+	}
+	return c
+}
+
+// redeems reports whether c may redeem t under TOKEN_BINDING. With key, the
+// tokens issued to the clients without a key are bound to their address;
+// strict binds to both. The tokens issued by the management API are bound
+// to no one.
+func (c tokenClient) redeems(t pendingToken) bool {
+	if c.link || options().TokenBinding == "none" {
+		return true
+	}
+	checkIP := options().TokenBinding != "key" || t.Key == ""
+	if keyBinding() && t.Key != "" && c.Key != t.Key {
+		return false
+	}
+	return !checkIP || t.IP == "" || c.IP == t.IP
+}
+
+// unboundToken records a valid token entered by another client than the one
+// it was issued to, as when the mail was intercepted.
+func (s *session) unboundToken() {
+	logWarn("The token of %s was entered from %s, which it is not bound to", s.user, s.ip)
+	bans.fail(s.ip, s.user, "token from another client")
+	countFailure(failTokenBound)
+	audits.publish(auditEvent{Type: auditFailed, User: s.user, Mail: s.mail, IP: s.ip, Detail: "token entered from another client"})
+	s.raiseAlert(securityAlert{Event: "token binding", User: s.user, Mail: s.mail, IP: s.ip, Detail: "valid token entered from another client than the one it was issued to"})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+	// the most spans kept waiting for the collector to take them back, the
+	// oldest being dropped beyond
+	traceMaxPending = 8 * traceBatchSize
+)
+
+type spanKey struct{}
+
+// span is a minimal OpenTelemetry span. All methods are safe to call on a nil
+// span, which is what startSpan returns when tracing is disabled.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+
+	mu    sync.Mutex
+	attrs map[string]string
+	err   error
+}
+
+func (sp *span) setAttr(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.attrs[key] = fmt.Sprint(value)
+}
+
+// finish ends the span, marking it as failed when err is not nil, and queues
+// it for export.
+func (sp *span) finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.end = time.Now()
+	sp.err = err
+	sp.mu.Unlock()
+	tracer.enqueue(sp)
+}
+
+// TraceID returns the hex encoded trace identifier, or an empty string when
+// tracing is disabled.
+func (sp *span) TraceID() string {
+	if sp == nil {
+		return ""
+	}
+	return hex.EncodeToString(sp.traceID[:])
+}
+
+// startSpan starts a new span as a child of the one stored in ctx, if any.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if !tracer.enabled() {
+		return ctx, nil
+	}
+	sp := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]string{}}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		sp.traceID = parent.traceID
+		sp.parentID = parent.spanID
+	} else {
+		rand.Read(sp.traceID[:])
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// spanFromContext returns the active span in ctx, if any.
+func spanFromContext(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanKey{}).(*span)
+	return sp
+}
+
+// traceExporter batches finished spans and ships them to an OTLP/HTTP
+// collector using the JSON encoding.
+type traceExporter struct {
+	endpoint string
+	service  string
+	headers  map[string]string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+
+	ticker *time.Ticker
+	// closed to stop the flushing loop, which closes stopped once done
+	done, stopped chan struct{}
+	stopOnce      sync.Once
+}
+
+var tracer = &traceExporter{}
+
+func (t *traceExporter) enabled() bool {
+	return t.endpoint != ""
+}
+
+func (t *traceExporter) enqueue(sp *span) {
+	t.mu.Lock()
+	t.pending = append(t.pending, sp)
+	full := len(t.pending) >= traceBatchSize
+	t.mu.Unlock()
+	if full {
+		go t.flush()
+	}
+}
+
+// parseOTLPHeaders parses the comma separated key=value list used by the
+// OTEL_EXPORTER_OTLP_HEADERS variable.
+func parseOTLPHeaders(raw string) map[string]string {
+	headers := map[string]string{}
+	for _, kv := range strings.Split(raw, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return headers
+}
+
+func initTracing() {
+	if options().OtelEndpoint == "" {
+		return
+	}
+	tracer.endpoint = strings.TrimSuffix(options().OtelEndpoint, "/") + "/v1/traces"
+	tracer.service = options().OtelServiceName
+	tracer.headers = parseOTLPHeaders(options().OtelHeaders)
+	tracer.client = &http.Client{Transport: httpTransport, Timeout: 10 * time.Second}
+	tracer.ticker = time.NewTicker(traceFlushInterval)
+	tracer.done, tracer.stopped = make(chan struct{}), make(chan struct{})
+	go tracer.run()
+	logInfo("Exporting traces to %s", tracer.endpoint)
+}
+
+// run flushes the spans every traceFlushInterval until stop.
+func (t *traceExporter) run() {
+	defer close(t.stopped)
+	for {
+		select {
+		case <-t.ticker.C:
+			t.flush()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// stopTracing stops the flushing loop and ships the spans still queued, for
+// them not to be lost on shutdown. Only the first call does anything.
+func stopTracing() {
+	if !tracer.enabled() {
+		return
+	}
+	tracer.stopOnce.Do(func() {
+		tracer.ticker.Stop()
+		close(tracer.done)
+		<-tracer.stopped
+		tracer.flush()
+	})
+}
+
+// requeue puts back a batch the collector could not take, ahead of the
+// spans queued since, for the next flush to retry it.
+func (t *traceExporter) requeue(batch []*span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(batch, t.pending...)
+	if over := len(t.pending) - traceMaxPending; over > 0 {
+		t.pending = t.pending[over:]
+		logWarn("Dropped %d spans the collector could not take", over)
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func (sp *span) otlp() otlpSpan {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(sp.traceID[:]),
+		SpanID:            hex.EncodeToString(sp.spanID[:]),
+		Name:              sp.name,
+		Kind:              sp.kind,
+		StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+	}
+	if sp.parentID != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+	}
+	for k, v := range sp.attrs {
+		s.Attributes = append(s.Attributes, otlpKeyValue{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	if sp.err != nil {
+		s.Status = otlpStatus{Code: spanStatusError, Message: sp.err.Error()}
+	}
+	return s
+}
+
+func (t *traceExporter) flush() {
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, len(batch))
+	for i, sp := range batch {
+		spans[i] = sp.otlp()
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue{StringValue: t.service}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "sshauth"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logError("Could not encode traces: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		logError("Could not export traces: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		logError("Could not export traces: %v", err)
+		t.requeue(batch)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		logError("Could not export traces: collector replied %s", res.Status)
+		// the collector may take them later, unlike a rejected batch
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode/100 == 5 {
+			t.requeue(batch)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// the escape sequences of the terminal, dropped from the transcripts
+var escapeSequence = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|[@-Z\\-_])`)
+
+// transcript keeps the last ALERT_TRANSCRIPT_SIZE bytes of what a session
+// showed the user, with ALERT_TRANSCRIPT, for the alerts it raises to carry
+// them. Unlike the recordings of RECORD_DIR, the transcripts keep the
+// details of the user, the admins investigating needing them, but they are
+// sanitized: the escape sequences and the control characters are dropped,
+// and the echo of the secret prompts, the token, the address and the
+// password, is masked.
+type transcript struct {
+	mu     sync.Mutex
+	text   []byte
+	secret bool
+	// whether the start of the session was dropped to stay within the size
+	truncated bool
+}
+
+// validateTranscript checks the ALERT_TRANSCRIPT options.
+func validateTranscript() error {
+	if options().AlertTranscript && options().AlertTranscriptSize <= 0 {
+		return fmt.Errorf("ALERT_TRANSCRIPT_SIZE must be positive when ALERT_TRANSCRIPT is set")
+	}
+	return nil
+}
+
+// transcribedSession captures the output of an SSH session.
+type transcribedSession struct {
+	ssh.Session
+	t *transcript
+}
+
+func (t transcribedSession) Write(p []byte) (int, error) {
+	t.t.output(p)
+	return t.Session.Write(p)
+}
+
+// startTranscript captures the output of the session from now on.
+func (s *session) startTranscript() {
+	s.transcript = &transcript{}
+	s.Session = transcribedSession{Session: s.Session, t: s.transcript}
+}
+
+// mask masks the output while a secret prompt is read. A nil transcript
+// ignores it.
+func (t *transcript) mask(secret bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.secret = secret
+	t.mu.Unlock()
+}
+
+func (t *transcript) output(p []byte) {
+	out := escapeSequence.ReplaceAllString(string(p), "")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out = strings.Map(func(c rune) rune {
+		switch {
+		case c == '\n' || c == '\t':
+			return c
+		case !unicode.IsPrint(c):
+			return -1
+		case t.secret && c != ' ':
+			return '*'
+		}
+		return c
+	}, out)
+	t.text = append(t.text, out...)
+	if over := len(t.text) - options().AlertTranscriptSize; over > 0 {
+		t.text = append(t.text[:0], t.text[over:]...)
+		t.truncated = true
+	}
+}
+
+// String returns the transcript so far, empty for a nil one.
+func (t *transcript) String() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.truncated {
+		return "[...]\n" + strings.ToValidUTF8(string(t.text), "")
+	}
+	return string(t.text)
+}
+
+// raiseAlert raises an alert about the session, carrying its transcript
+// with ALERT_TRANSCRIPT.
+func (s *session) raiseAlert(a securityAlert) {
+	a.Transcript = s.transcript.String()
+	raiseAlert(a)
+}
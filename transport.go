@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// validateMailTransport checks the MAIL_TRANSPORT option.
+func validateMailTransport() error {
+	switch options().MailTransport {
+	case "smtp":
+		return nil
+	case "sendmail":
+		if len(strings.Fields(options().MailSendmailCommand)) == 0 {
+			return fmt.Errorf("MAIL_SENDMAIL_COMMAND must not be empty")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown MAIL_TRANSPORT %q, expected one of smtp or sendmail", options().MailTransport)
+	}
+}
+
+// pipeMail hands a complete message over to the local MTA by running
+// MAIL_SENDMAIL_COMMAND with the message on its standard input. The command
+// is expected to take the recipients from the headers, like sendmail -t, and
+// is given MAIL_ENVELOPE_FROM, if set, with -f.
+func pipeMail(ctx context.Context, msg string) error {
+	args := strings.Fields(options().MailSendmailCommand)
+	if options().MailEnvelopeFrom != "" {
+		args = append(args, "-f", envelopeFrom())
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(msg)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not run %s: %v: %s", args[0], err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/secure/precis"
+)
+
+// normalizeUsername applies the PRECIS UsernameCasePreserved profile (RFC
+// 8265) to the name the user logged in with: the result is in NFC, so that
+// the different encodings of the same name are registered only once, and
+// names with spaces, control characters and the like are refused.
+func normalizeUsername(user string) (string, error) {
+	u, err := precis.UsernameCasePreserved.String(user)
+	if err != nil {
+		return "", fmt.Errorf("Invalid username %q: %v", user, err)
+	}
+	return u, nil
+}
+
+// escapeDN escapes a value for use in a DN, as per RFC 4514.
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case r == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.ContainsRune(`"+,;<>\=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(value)-1 && r == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	env "github.com/caarlos0/env/v7"
+)
+
+// vaultMinRefresh bounds how often secrets are fetched again, for leases
+// that are very short or missing altogether.
+const vaultMinRefresh = time.Minute
+
+// vaultClient reads credentials from a HashiCorp Vault KV secret. The keys of
+// the secret are option names, such as LDAP_BIND_PASSWORD or MAIL_PASSWORD,
+// and override the values from the environment.
+type vaultClient struct {
+	addr      string
+	token     string
+	renewable bool
+	lease     time.Duration
+}
+
+type vaultAuth struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+func (v *vaultClient) header() http.Header {
+	return http.Header{"X-Vault-Token": {v.token}}
+}
+
+func (v *vaultClient) setAuth(a *vaultAuth) {
+	v.token = a.Auth.ClientToken
+	v.renewable = a.Auth.Renewable
+	v.lease = time.Duration(a.Auth.LeaseDuration) * time.Second
+}
+
+// login authenticates with VAULT_TOKEN or, when that is empty, through the
+// AppRole auth method.
+func (v *vaultClient) login(ctx context.Context) error {
+	if options().VaultToken != "" {
+		v.token = options().VaultToken
+		var self struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if _, err := doJSON(ctx, http.MethodGet, v.addr+"/v1/auth/token/lookup-self", v.header(), nil, &self); err != nil {
+			return fmt.Errorf("Could not look up the Vault token: %v", err)
+		}
+		v.renewable = self.Data.Renewable
+		v.lease = time.Duration(self.Data.TTL) * time.Second
+		return nil
+	}
+
+	var auth vaultAuth
+	body := map[string]string{"role_id": options().VaultRoleID, "secret_id": options().VaultSecretID}
+	url := v.addr + "/v1/auth/" + strings.Trim(options().VaultAuthPath, "/") + "/login"
+	if _, err := doJSON(ctx, http.MethodPost, url, nil, body, &auth); err != nil {
+		return fmt.Errorf("Could not log into Vault: %v", err)
+	}
+	v.setAuth(&auth)
+	return nil
+}
+
+// renew extends the token lease, logging in again when that isn't possible.
+func (v *vaultClient) renew(ctx context.Context) error {
+	if v.renewable {
+		var auth vaultAuth
+		if _, err := doJSON(ctx, http.MethodPost, v.addr+"/v1/auth/token/renew-self", v.header(), struct{}{}, &auth); err == nil {
+			v.setAuth(&auth)
+			return nil
+		}
+	}
+	return v.login(ctx)
+}
+
+// read fetches VAULT_SECRET_PATH, unwrapping the KV version 2 envelope, and
+// returns the secret along with its lease.
+func (v *vaultClient) read(ctx context.Context) (map[string]string, time.Duration, error) {
+	var secret struct {
+		LeaseDuration int            `json:"lease_duration"`
+		Data          map[string]any `json:"data"`
+	}
+	url := v.addr + "/v1/" + strings.Trim(options().VaultSecretPath, "/")
+	if _, err := doJSON(ctx, http.MethodGet, url, v.header(), nil, &secret); err != nil {
+		return nil, 0, fmt.Errorf("Could not read the Vault secret: %v", err)
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	values := make(map[string]string, len(data))
+	for k, val := range data {
+		if s, ok := val.(string); ok {
+			values[strings.ToUpper(k)] = s
+		}
+	}
+	return values, time.Duration(secret.LeaseDuration) * time.Second, nil
+}
+
+// refreshIn returns how long to wait before renewing the token and reading
+// the secret again: two thirds of the shortest lease, or VAULT_REFRESH.
+func (v *vaultClient) refreshIn(lease time.Duration) time.Duration {
+	d := options().VaultRefresh
+	for _, l := range []time.Duration{v.lease, lease} {
+		if l > 0 && l*2/3 < d {
+			d = l * 2 / 3
+		}
+	}
+	if d < vaultMinRefresh {
+		d = vaultMinRefresh
+	}
+	return d
+}
+
+// initVault reads the credentials from Vault, if VAULT_ADDR is set, and keeps
+// them fresh in the background. It must run after env.Parse, which it runs
+// again with the secret values in the environment.
+func initVault() error {
+	if options().VaultAddr == "" {
+		return nil
+	}
+	ctx := context.Background()
+	v := &vaultClient{addr: strings.TrimSuffix(options().VaultAddr, "/")}
+	if err := v.login(ctx); err != nil {
+		return err
+	}
+	values, lease, err := v.read(ctx)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if optionField(name) >= 0 {
+			os.Setenv(name, value)
+			vaultNames[name] = true
+		}
+	}
+	if err := env.Parse(options()); err != nil {
+		return err
+	}
+	logInfo("Loaded %d credentials from Vault", len(values))
+
+	go func() {
+		for {
+			time.Sleep(v.refreshIn(lease))
+			if err := v.renew(ctx); err != nil {
+				logError("Could not renew the Vault token: %v", err)
+				continue
+			}
+			if values, lease, err = v.read(ctx); err != nil {
+				logError("%v", err)
+				continue
+			}
+			setStringOptions(values)
+		}
+	}()
+	return nil
+}
+
+// optionField returns the index of the Options field read from the given
+// variable, or -1.
+func optionField(name string) int {
+	t := reflect.TypeOf(Options{})
+	for i := 0; i < t.NumField(); i++ {
+		if n, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ","); n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// setStringOptions updates the string options named by the keys of values.
+// Credentials are read when connecting to the backends, so new values are
+// picked up by the next session.
+func setStringOptions(values map[string]string) {
+	optionsMu.Lock()
+	defer optionsMu.Unlock()
+	next := *options()
+	o := reflect.ValueOf(&next).Elem()
+	for name, value := range values {
+		if i := optionField(name); i >= 0 && o.Field(i).Kind() == reflect.String {
+			o.Field(i).SetString(value)
+			// keep the environment in sync for configuration reloads
+			os.Setenv(name, value)
+		}
+	}
+	swapOptions(&next)
+}
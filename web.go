@@ -0,0 +1,191 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webPage is the page of the web form, offering the registration to the users
+// whose network blocks outbound SSH. It drives the steps of the scripted mode,
+// so the two share the token store, the mail and the directory.
+//
+//go:embed web.html
+var webPage string
+
+var webTemplate = template.Must(template.New("web").Parse(webPage))
+
+// webData is the data of webPage. Step is start, verify or done, or confirm
+// and confirmed for the links of TOKEN_DELIVERY=link.
+type webData struct {
+	Step      string
+	User      string
+	Mail      string
+	AskMail   bool
+	Rules     string
+	ExpiresAt time.Time
+	URL       string
+	Error     string
+	// the token of the confirmation link
+	Token string
+}
+
+// the errors sending the user back to the start of the web form, since the
+// token is gone
+var webRestart = []string{scriptNoPendingToken, scriptTokenFailed, scriptTokenBound, scriptLockedOut, scriptPolicyDenied, scriptApprovalRequired, scriptAlreadyRegistered, scriptNotProvisioned, scriptMailTaken}
+
+// validateWeb checks the WEB_* options.
+func validateWeb() error {
+	if (options().WebTLSCert == "") != (options().WebTLSKey == "") {
+		return fmt.Errorf("WEB_TLS_CERT and WEB_TLS_KEY must be set together")
+	}
+	return nil
+}
+
+// webIP returns the address of the client, as told by the reverse proxy
+// when WEB_REAL_IP_HEADER is set and the request comes from one of the
+// WEB_REAL_IP_TRUSTED_CIDRS. The last address of the header is the one
+// added by the proxy.
+func webIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if options().WebRealIPHeader == "" {
+		return host
+	}
+	if ip := net.ParseIP(host); ip == nil || !inNets(webProxyNets.get(), ip) {
+		return host
+	}
+	values := strings.Split(r.Header.Get(options().WebRealIPHeader), ",")
+	if ip := strings.TrimSpace(values[len(values)-1]); ip != "" {
+		return ip
+	}
+	return host
+}
+
+func serveWebPage(w http.ResponseWriter, status int, d webData) {
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := webTemplate.Execute(w, d); err != nil {
+		logError("Could not render the web form: %v", err)
+	}
+}
+
+// webForm serves the web form: the start step asks for the username, and
+// the address with MAIL_MODE=prompt, to mail a token to; the verify step
+// takes the token along with the new password.
+type webForm struct{}
+
+func (webForm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	ip := webIP(r)
+	if !ipAllowed(ip) || bans.banned(ip) {
+		logWarn("Refusing web request from %s: address not allowed or banned", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	start := webData{Step: "start", AskMail: options().MailMode == "prompt"}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if inMaintenance() {
+			start.Error = options().MaintenanceMessage
+		}
+		serveWebPage(w, http.StatusOK, start)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, sp := startSpan(r.Context(), "web", spanKindServer)
+	sp.setAttr("net.peer.ip", ip)
+	defer sp.finish(nil)
+
+	start.User, start.Mail = r.PostFormValue("user"), r.PostFormValue("mail")
+	user, err := normalizeUsername(start.User)
+	if err != nil {
+		logWarn("Rejecting web request from %s: %v", ip, err)
+		start.Error = "This username is not valid."
+		serveWebPage(w, http.StatusBadRequest, start)
+		return
+	}
+	sp.setAttr("ssh.user", user)
+	s := &session{ctx: ctx, ip: ip, user: user, vars: map[string]string{}, web: true}
+
+	var res scriptResult
+	switch r.PostFormValue("step") {
+	case "start":
+		args := []string{"request-token"}
+		if start.Mail != "" {
+			args = append(args, start.Mail)
+		}
+		res = s.scriptStep(args)
+	case "verify":
+		if r.PostFormValue("password") != r.PostFormValue("repeat") {
+			countFailure(failPasswordMismatch)
+			res = scriptError(scriptInvalidPassword, "The passwords don't match")
+			break
+		}
+		res = s.scriptStep([]string{"verify", r.PostFormValue("token"), r.PostFormValue("password")})
+	default:
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	verify := webData{Step: "verify", User: user, Mail: res.Mail}
+	if verify.Mail == "" {
+		verify.Mail = r.PostFormValue("mail")
+	}
+	if res.ExpiresAt != nil {
+		verify.ExpiresAt = *res.ExpiresAt
+	}
+	if verify.Rules, err = passwordRules(); err != nil {
+		logError("Could not describe the password rules: %v", err)
+	}
+	switch {
+	case res.Status == "registered":
+		logInfo("Registered %s <%s> through the web form", user, res.Mail)
+		serveWebPage(w, http.StatusOK, webData{Step: "done", User: user, Mail: res.Mail, URL: options().LldapURI.JoinPath("/login").String()})
+	case res.Status != "error":
+		serveWebPage(w, http.StatusOK, verify)
+	case r.PostFormValue("step") == "start" || contains(webRestart, res.Error):
+		start.Error = res.Message
+		serveWebPage(w, http.StatusOK, start)
+	default:
+		verify.Error = res.Message
+		serveWebPage(w, http.StatusOK, verify)
+	}
+}
+
+// serveWeb starts the web form on WEB_LISTEN, if configured.
+func serveWeb() {
+	if options().WebListen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", webForm{})
+	mux.Handle("/confirm", confirmLink{})
+	server := &http.Server{Addr: options().WebListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	logInfo("Web form listening on %s", options().WebListen)
+	go func() {
+		if options().WebTLSCert != "" {
+			log.Fatal(server.ListenAndServeTLS(options().WebTLSCert, options().WebTLSKey))
+		}
+		log.Fatal(server.ListenAndServe())
+	}()
+}
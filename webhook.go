@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// webhookPayload is the data available to the webhook body template.
+type webhookPayload struct {
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// webhookDirectory hands new users over to a bespoke system by POSTing a
+// JSON (or templated) payload to WEBHOOK_URL. Requests are signed with an
+// HMAC-SHA256 of the timestamp and body, so the receiver can authenticate
+// them. Any 2xx reply counts as success.
+type webhookDirectory struct {
+	tmpl *template.Template
+}
+
+func openWebhook(ctx context.Context) (*webhookDirectory, error) {
+	u, err := url.Parse(options().WebhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WEBHOOK_URL: %v", err)
+	}
+	if options().WebhookPasswordMode != "hash" && options().WebhookPasswordMode != "plaintext" {
+		return nil, fmt.Errorf("Unknown WEBHOOK_PASSWORD_MODE %q, expected one of hash or plaintext", options().WebhookPasswordMode)
+	}
+	if passwordMethod() == passwordPlain && u.Scheme != "https" {
+		return nil, errors.New("Refusing to send plaintext passwords to a webhook without TLS")
+	}
+
+	d := &webhookDirectory{}
+	if options().WebhookTemplate != "" {
+		raw, err := os.ReadFile(options().WebhookTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read WEBHOOK_TEMPLATE: %v", err)
+		}
+		d.tmpl, err = template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v any) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse WEBHOOK_TEMPLATE: %v", err)
+		}
+	}
+	return d, nil
+}
+
+func (d *webhookDirectory) Close() error {
+	return nil
+}
+
+// sign adds the timestamp and signature headers to req.
+func (d *webhookDirectory) sign(req *http.Request, body []byte) {
+	if options().WebhookSecret == "" {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(options().WebhookSecret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	req.Header.Set("X-Sshauth-Timestamp", ts)
+	req.Header.Set("X-Sshauth-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Exists asks WEBHOOK_EXISTS_URL whether the user is known, expecting a 200
+// or a 404 reply. Without it every username is considered available.
+func (d *webhookDirectory) Exists(ctx context.Context, user string) (_ bool, err error) {
+	if options().WebhookExistsURL == "" {
+		return false, nil
+	}
+	_, sp := startSpan(ctx, "webhook.exists", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	u := options().WebhookExistsURL
+	if strings.Contains(u, "?") {
+		u += "&"
+	} else {
+		u += "?"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u+url.Values{"username": {user}}.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	d.sign(req, nil)
+	_, err = send(req, nil)
+	var status *httpStatusError
+	if errors.As(err, &status) && status.Status == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Could not query the webhook: %v", err)
+	}
+	return true, nil
+}
+
+func (d *webhookDirectory) Register(ctx context.Context, user, mail, password string) (err error) {
+	_, sp := startSpan(ctx, "webhook.register", spanKindClient)
+	defer func() { sp.finish(err) }()
+
+	payload := webhookPayload{Username: user, Email: mail}
+	if passwordMethod() == passwordPlain {
+		payload.Password = password
+	} else {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		payload.PasswordHash = string(hash)
+	}
+
+	var body []byte
+	if d.tmpl != nil {
+		var buf bytes.Buffer
+		if err := d.tmpl.Execute(&buf, payload); err != nil {
+			return fmt.Errorf("Could not render the webhook template: %v", err)
+		}
+		body = buf.Bytes()
+	} else if body, err = json.Marshal(payload); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, options().WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", options().WebhookContentType)
+	d.sign(req, body)
+	if _, err := send(req, nil); err != nil {
+		return fmt.Errorf("Could not register the user through the webhook: %v", err)
+	}
+	return nil
+}
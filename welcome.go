@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+)
+
+// welcomeData is the data available to WELCOME_MAIL_TEMPLATE.
+type welcomeData struct {
+	User     string
+	Mail     string
+	LoginURL string
+}
+
+// defaultWelcomeMail is the body of the welcome mail when no
+// WELCOME_MAIL_TEMPLATE is given.
+const defaultWelcomeMail = `<p>Welcome {{.User}}!</p>
+<p>Your account has been created, you can now log in with the password you chose at
+<a href="{{.LoginURL}}">{{.LoginURL}}</a>.</p>
+<p>Next steps:</p>
+<ul>
+<li>log in and complete your profile;</li>
+<li>keep your password safe, nobody will ever ask you for it.</li>
+</ul>
+`
+
+var welcomeTemplate reloadable[*template.Template]
+
+// loadWelcomeMail parses WELCOME_MAIL_TEMPLATE, or the default body, when
+// WELCOME_MAIL is set.
+func loadWelcomeMail() error {
+	welcomeTemplate.set(nil)
+	if !options().WelcomeMail {
+		return nil
+	}
+	text := defaultWelcomeMail
+	if options().WelcomeMailTemplate != "" {
+		data, err := os.ReadFile(options().WelcomeMailTemplate)
+		if err != nil {
+			return fmt.Errorf("Could not read WELCOME_MAIL_TEMPLATE: %v", err)
+		}
+		text = string(data)
+	}
+	t, err := template.New("welcome").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return fmt.Errorf("Could not parse WELCOME_MAIL_TEMPLATE: %v", err)
+	}
+	// a field other than .User, .Mail and .LoginURL fails here, rather than
+	// in the background after the first registration
+	if err := t.Execute(&strings.Builder{}, welcomeData{}); err != nil {
+		return fmt.Errorf("Could not render WELCOME_MAIL_TEMPLATE: %v", err)
+	}
+	welcomeTemplate.set(t)
+	return nil
+}
+
+// sendWelcome mails a newly registered user, in the background so that they
+// don't wait for it. Failures are only logged: the account exists already.
+func sendWelcome(user, mail string) {
+	t := welcomeTemplate.get()
+	if t == nil || mail == "" {
+		return
+	}
+	data := welcomeData{User: user, Mail: mail, LoginURL: options().LldapURI.JoinPath("/login").String()}
+	go func() {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			logError("Could not render the welcome mail for %s: %v", user, err)
+			return
+		}
+		if err := deliver(context.Background(), mail, options().WelcomeMailSubject, b.String()); err != nil {
+			logError("Could not send the welcome mail to %s: %v", mail, err)
+			return
+		}
+		logInfo("Sent the welcome mail to %s <%s>", user, mail)
+	}()
+}
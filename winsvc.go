@@ -0,0 +1,161 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runService runs the server under the Windows service control manager,
+// when started by it. It reports whether it did.
+func runService() (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	return true, svc.Run(options().WindowsServiceName, winService{})
+}
+
+// winService answers the service control manager, stopping the process on
+// stop and shutdown and reloading the configuration on a parameter change,
+// the equivalent of SIGHUP.
+type winService struct{}
+
+func (winService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	errs := make(chan error, 1)
+	go func() { errs <- runCommand("serve", nil) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+	for {
+		select {
+		case err := <-errs:
+			logError("The server stopped: %v", err)
+			return true, 1
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.ParamChange:
+				if err := reload(); err != nil {
+					logError("Could not reload the configuration: %v", err)
+				} else {
+					logInfo("Configuration reloaded")
+				}
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				logInfo("Stopping the Windows service")
+				status <- svc.Status{State: svc.StopPending}
+				stopTracing()
+				return false, 0
+			}
+		}
+	}
+}
+
+// noticeOnSIGUSR1 does nothing, there being no SIGUSR1 on Windows: the
+// notices are broadcast through the admin API or the admin shell.
+func noticeOnSIGUSR1() {}
+
+// eventLogSink writes the log lines to the Windows event log, under the
+// source registered by the service install command.
+type eventLogSink struct {
+	log *eventlog.Log
+}
+
+func openEventLog() (logSink, error) {
+	l, err := eventlog.Open(options().WindowsServiceName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the event log: %v", err)
+	}
+	return &eventLogSink{log: l}, nil
+}
+
+func (s *eventLogSink) write(level int, subsystem, msg string) error {
+	if subsystem != "" {
+		msg = subsystem + ": " + msg
+	}
+	switch level {
+	case levelError:
+		return s.log.Error(1, msg)
+	case levelWarn:
+		return s.log.Warning(1, msg)
+	default:
+		return s.log.Info(1, msg)
+	}
+}
+
+func (s *eventLogSink) Close() error {
+	return s.log.Close()
+}
+
+// serviceCommand installs the binary as the WINDOWS_SERVICE_NAME service,
+// started automatically with the options of --config-file, and registers
+// its event log source, or removes both.
+func serviceCommand(args []string) error {
+	const usage = "Usage: sshauth service install [--config-file <path>] | remove"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	name := options().WindowsServiceName
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Could not connect to the service control manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	switch {
+	case args[0] == "install" && (len(args) == 1 || len(args) == 3 && args[1] == "--config-file"):
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: "sshauth",
+			Description: "Self-service registration of directory accounts over SSH",
+			StartType:   mgr.StartAutomatic,
+		}, "serve")
+		if err != nil {
+			return fmt.Errorf("Could not create the %s service: %v", name, err)
+		}
+		defer s.Close()
+		if len(args) == 3 {
+			// the service control manager passes it to the process
+			k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+name, registry.SET_VALUE)
+			if err != nil {
+				return fmt.Errorf("Could not set the environment of the service: %v", err)
+			}
+			defer k.Close()
+			if err := k.SetStringsValue("Environment", []string{"CONFIG_FILE=" + args[2]}); err != nil {
+				return fmt.Errorf("Could not set the environment of the service: %v", err)
+			}
+		}
+		if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("Could not register the event log source: %v", err)
+		}
+		fmt.Printf("Installed the %s service, start it with: sc start %s\n", name, name)
+		return nil
+	case args[0] == "remove" && len(args) == 1:
+		s, err := m.OpenService(name)
+		if err != nil {
+			return fmt.Errorf("Could not open the %s service: %v", name, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("Could not remove the %s service: %v", name, err)
+		}
+		if err := eventlog.Remove(name); err != nil {
+			return fmt.Errorf("Could not remove the event log source: %v", err)
+		}
+		fmt.Printf("Removed the %s service\n", name)
+		return nil
+	default:
+		return fmt.Errorf(usage)
+	}
+}
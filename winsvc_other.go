@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// runService only runs the server as a service on Windows.
+func runService() (bool, error) {
+	return false, nil
+}
+
+func openEventLog() (logSink, error) {
+	return nil, fmt.Errorf("LOG_OUTPUT=eventlog is only supported on Windows")
+}
+
+func serviceCommand([]string) error {
+	return fmt.Errorf("The service command is only supported on Windows")
+}